@@ -0,0 +1,49 @@
+// Command rotate-keys rotates the keys used to sign JWTs.
+//
+// It generates a new key in the key ring directory specified by the jwt_key_dir configuration and schedules
+// it to become the signing key after a delay. The previous signing keys are kept for verification only and
+// are removed once every token they signed has expired. Running servers reload the key ring every minute, and
+// clients may cache the published keys for five minutes, so the delay must be at least six minutes.
+package main
+
+import (
+	"flag"
+	"github.com/garaekz/priv8/internal/auth"
+	"github.com/garaekz/priv8/internal/config"
+	"github.com/garaekz/priv8/pkg/log"
+	"os"
+	"time"
+)
+
+var (
+	flagConfig = flag.String("config", "./config/local.yml", "path to the config file")
+	flagAlg    = flag.String("alg", "ES256", "signing algorithm of the new key: RS256, ES256, ES384, ES512 or EdDSA")
+	flagDelay  = flag.Duration("delay", 10*time.Minute, "delay before the new key is used for signing")
+)
+
+func main() {
+	flag.Parse()
+	logger := log.New()
+
+	cfg, err := config.Load(*flagConfig, logger)
+	if err != nil {
+		logger.Errorf("failed to load application configuration: %s", err)
+		os.Exit(-1)
+	}
+	if *flagDelay < auth.MinActivationDelay {
+		logger.Errorf("delay must be at least %v", auth.MinActivationDelay)
+		os.Exit(-1)
+	}
+	if cfg.JWTKeyDir == "" {
+		logger.Error("jwt_key_dir is not configured")
+		os.Exit(-1)
+	}
+
+	maxTokenLifetime := auth.MaxTokenLifetime(time.Duration(cfg.AccessTokenExpiration) * time.Minute)
+	key, err := auth.RotateKeys(cfg.JWTKeyDir, *flagAlg, *flagDelay, maxTokenLifetime)
+	if err != nil {
+		logger.Errorf("failed to rotate keys: %s", err)
+		os.Exit(-1)
+	}
+	logger.Infof("generated %v signing key %v", key.Method.Alg(), key.ID)
+}
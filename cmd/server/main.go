@@ -6,13 +6,17 @@ import (
 	"flag"
 	"fmt"
 	"github.com/garaekz/priv8/internal/album"
+	"github.com/garaekz/priv8/internal/audit"
 	"github.com/garaekz/priv8/internal/auth"
 	"github.com/garaekz/priv8/internal/config"
 	"github.com/garaekz/priv8/internal/errors"
 	"github.com/garaekz/priv8/internal/healthcheck"
+	"github.com/garaekz/priv8/internal/oauth"
 	"github.com/garaekz/priv8/pkg/accesslog"
 	"github.com/garaekz/priv8/pkg/dbcontext"
 	"github.com/garaekz/priv8/pkg/log"
+	"github.com/garaekz/priv8/pkg/mail"
+	"github.com/garaekz/priv8/pkg/pagination"
 	"github.com/go-ozzo/ozzo-dbx"
 	"github.com/go-ozzo/ozzo-routing/v2"
 	"github.com/go-ozzo/ozzo-routing/v2/content"
@@ -54,11 +58,44 @@ func main() {
 		}
 	}()
 
+	// load the keys for signing and verifying JWTs
+	keys, err := loadKeyRing(cfg)
+	if err != nil {
+		logger.Errorf("failed to load JWT keys: %s", err)
+		os.Exit(-1)
+	}
+	// pick up the keys rotated by the rotate-keys command
+	go runPeriodically(auth.KeyRingReloadInterval, func(context.Context) error { return keys.Reload() }, logger)
+
+	mailer, err := newMailer(cfg)
+	if err != nil {
+		logger.Errorf("failed to create the mailer: %s", err)
+		os.Exit(-1)
+	}
+
+	dbc := dbcontext.New(db)
+
+	// revoked access tokens are only needed until they expire
+	denylist := auth.NewDBDenylist(dbc, logger)
+	go runPeriodically(time.Hour, denylist.Prune, logger)
+
+	// failed logins are only remembered for a while
+	throttler := auth.NewThrottler(newAttemptStore(cfg, dbc, logger), logger)
+	go runPeriodically(time.Hour, throttler.Prune, logger)
+
+	// authorization codes are only exchanged within minutes
+	go runPeriodically(time.Hour, oauth.NewRepository(dbc, logger).Prune, logger)
+
+	// deleted albums can be restored from the trash until the retention period is over
+	purger := album.NewPurger(album.NewRepository(dbc, logger), audit.NewService(audit.NewRepository(dbc, logger), logger),
+		dbc.Transactional, time.Duration(cfg.TrashRetention)*24*time.Hour)
+	go runPeriodically(time.Hour, purger.Purge, logger)
+
 	// build HTTP server
 	address := fmt.Sprintf(":%v", cfg.ServerPort)
 	hs := &http.Server{
 		Addr:    address,
-		Handler: buildHandler(logger, dbcontext.New(db), cfg),
+		Handler: buildHandler(logger, dbc, keys, denylist, throttler, mailer, cfg),
 	}
 
 	// start the HTTP server with graceful shutdown
@@ -71,7 +108,8 @@ func main() {
 }
 
 // buildHandler sets up the HTTP routing and builds an HTTP handler.
-func buildHandler(logger log.Logger, db *dbcontext.DB, cfg *config.Config) http.Handler {
+func buildHandler(logger log.Logger, db *dbcontext.DB, keys *auth.KeyRing, denylist auth.Denylist,
+	throttler *auth.Throttler, mailer mail.Mailer, cfg *config.Config) http.Handler {
 	router := routing.New()
 
 	router.Use(
@@ -82,24 +120,100 @@ func buildHandler(logger log.Logger, db *dbcontext.DB, cfg *config.Config) http.
 	)
 
 	healthcheck.RegisterHandlers(router, Version)
+	auth.RegisterJWKSHandler(router, keys)
 
 	rg := router.Group("/v1")
 
-	authHandler := auth.Handler(cfg.JWTSigningKey)
-
-	album.RegisterHandlers(rg.Group(""),
-		album.NewService(album.NewRepository(db, logger), logger),
-		authHandler, logger,
+	auditService := audit.NewService(audit.NewRepository(db, logger), logger)
+
+	albumService := album.NewService(album.NewRepository(db, logger), album.NewShareRepository(db, logger),
+		auth.NewKeyRing(auth.NewHMACKey(cfg.ShareLinkSigningKey)), auditService, db.Transactional, logger)
+
+	authService := auth.NewService(
+		auth.NewRepository(db, logger),
+		auth.NewTokenRepository(db, logger),
+		auth.NewSessionRepository(db, logger),
+		auth.NewAPIKeyRepository(db, logger),
+		auth.NewPasswordResetRepository(db, logger),
+		denylist,
+		keys,
+		throttler,
+		mailer,
+		albumService,
+		auditService,
+		db.Transactional,
+		cfg.PasswordResetURL,
+		time.Duration(cfg.AccessTokenExpiration)*time.Minute,
+		time.Duration(cfg.RefreshTokenExpiration)*time.Hour,
+		logger,
 	)
-
-	auth.RegisterHandlers(rg.Group(""),
-		auth.NewService(cfg.JWTSigningKey, cfg.JWTExpiration, logger),
+	authHandler := auth.Handler(keys, denylist, authService, authService)
+
+	oauthService := oauth.NewService(
+		oauth.NewRepository(db, logger),
+		auth.NewRepository(db, logger),
+		keys,
+		denylist,
+		authService,
+		auditService,
+		db.Transactional,
+		time.Duration(cfg.AccessTokenExpiration)*time.Minute,
 		logger,
 	)
+	oauth.RegisterServerHandlers(router, oauthService)
+
+	album.RegisterHandlers(rg.Group(""), albumService, authHandler,
+		pagination.NewCursorCodec([]byte(cfg.CursorSigningKey)), logger)
+
+	auth.RegisterHandlers(rg.Group(""), authService, authHandler, logger)
+
+	oauth.RegisterHandlers(rg.Group(""), oauthService, authHandler, logger)
+
+	audit.RegisterHandlers(rg.Group(""), auditService, authHandler)
 
 	return router
 }
 
+// newAttemptStore creates the store of failed login attempts configured by the application configuration.
+func newAttemptStore(cfg *config.Config, db *dbcontext.DB, logger log.Logger) auth.AttemptStore {
+	if cfg.LoginAttemptStore == "memory" {
+		return auth.NewMemoryAttemptStore()
+	}
+	return auth.NewDBAttemptStore(db, logger)
+}
+
+// newMailer creates the mailer configured by the application configuration.
+func newMailer(cfg *config.Config) (mail.Mailer, error) {
+	if cfg.SMTPAddr != "" {
+		return mail.NewSMTPMailer(cfg.SMTPAddr, cfg.SMTPUsername, cfg.SMTPPassword, cfg.MailFrom)
+	}
+	return mail.NewDirMailer(cfg.MailDir, cfg.MailFrom), nil
+}
+
+// loadKeyRing creates the key ring for signing and verifying JWTs from the application configuration.
+func loadKeyRing(cfg *config.Config) (*auth.KeyRing, error) {
+	switch {
+	case cfg.JWTKeyDir != "":
+		return auth.LoadKeyRing(cfg.JWTKeyDir)
+	case cfg.JWTPrivateKeyFile != "":
+		key, err := auth.LoadSigningKey(cfg.JWTPrivateKeyFile)
+		return auth.NewKeyRing(key), err
+	default:
+		return auth.NewKeyRing(auth.NewHMACKey(cfg.JWTSigningKey)), nil
+	}
+}
+
+// runPeriodically calls f every interval until the process exits. Errors returned by f are logged.
+func runPeriodically(interval time.Duration, f func(ctx context.Context) error, logger log.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := f(context.Background()); err != nil {
+			logger.Errorf("periodic task failed: %v", err)
+		}
+	}
+}
+
 // logDBQuery returns a logging function that can be used to log SQL queries.
 func logDBQuery(logger log.Logger) dbx.QueryLogFunc {
 	return func(ctx context.Context, t time.Duration, sql string, rows *sql.Rows, err error) {
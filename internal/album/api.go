@@ -1,30 +1,71 @@
 package album
 
 import (
+	"github.com/garaekz/priv8/internal/auth"
 	"github.com/garaekz/priv8/internal/errors"
+	"github.com/garaekz/priv8/pkg/conditional"
+	"github.com/garaekz/priv8/pkg/jsonpatch"
 	"github.com/garaekz/priv8/pkg/log"
 	"github.com/garaekz/priv8/pkg/pagination"
 	"github.com/go-ozzo/ozzo-routing/v2"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // RegisterHandlers sets up the routing of the HTTP handlers.
-func RegisterHandlers(r *routing.RouteGroup, service Service, authHandler routing.Handler, logger log.Logger) {
-	res := resource{service, logger}
+// The cursors of the album list are signed with the given codec.
+func RegisterHandlers(r *routing.RouteGroup, service Service, authHandler routing.Handler, cursors pagination.CursorCodec,
+	logger log.Logger) {
+	res := resource{service, cursors, logger}
 
-	r.Get("/albums/<id>", res.get)
-	r.Get("/albums", res.query)
+	// the trash requires a valid JWT; it is registered first so that "trash" is not taken for an album ID
+	r.Get("/albums/trash", authHandler, auth.Require(auth.PermissionAlbumDelete), res.queryTrash)
+
+	// the following endpoints show the private albums of the current user if a valid JWT is given,
+	// and answer 304 Not Modified to the requests with If-None-Match if nothing has changed; single albums
+	// also honor If-Modified-Since, but lists have no Last-Modified time
+	r.Get("/albums/<id>", auth.Optional(authHandler), varyByUser, conditional.Handler, res.get)
+	r.Get("/albums", auth.Optional(authHandler), varyByUser, conditional.Handler, res.query)
+	// the share link token replaces the JWT, and the password of the link is given in the X-Share-Password header
+	r.Get("/shared/<token>", res.getShared)
 
 	r.Use(authHandler)
 
-	// the following endpoints require a valid JWT
-	r.Post("/albums", res.create)
-	r.Put("/albums/<id>", res.update)
-	r.Delete("/albums/<id>", res.delete)
+	// the following endpoints require a valid JWT with the listed permissions;
+	// updates and deletions also require the If-Match header with the ETag of the album
+	r.Post("/albums", auth.Require(auth.PermissionAlbumCreate), res.create)
+	r.Put("/albums/<id>", auth.Require(auth.PermissionAlbumUpdate), res.update)
+	r.Patch("/albums/<id>", auth.Require(auth.PermissionAlbumUpdate), res.patch)
+	r.Delete("/albums/<id>", auth.Require(auth.PermissionAlbumDelete), res.delete)
+	r.Post("/albums/<id>/restore", auth.Require(auth.PermissionAlbumDelete), res.restore)
+
+	r.Get("/albums/<id>/grants", auth.Require(auth.PermissionAlbumShare), res.queryGrants)
+	r.Put("/albums/<id>/grants/<userID>", auth.Require(auth.PermissionAlbumShare), res.saveGrant)
+	r.Delete("/albums/<id>/grants/<userID>", auth.Require(auth.PermissionAlbumShare), res.deleteGrant)
+	r.Get("/albums/<id>/links", auth.Require(auth.PermissionAlbumShare), res.queryShareLinks)
+	r.Post("/albums/<id>/links", auth.Require(auth.PermissionAlbumShare), res.createShareLink)
+	r.Delete("/albums/<id>/links/<linkID>", auth.Require(auth.PermissionAlbumShare), res.deleteShareLink)
+}
+
+// varyByUser marks the response as depending on the credentials of the request, so that shared caches
+// do not serve it to other users. The responses to authenticated requests must not be stored by shared caches at all.
+func varyByUser(c *routing.Context) error {
+	header := c.Response.Header()
+	header.Add("Vary", "Authorization")
+	header.Add("Vary", auth.APIKeyHeader)
+	if auth.CurrentUser(c.Request.Context()) != nil {
+		header.Set("Cache-Control", "private")
+	}
+	return c.Next()
 }
 
 type resource struct {
 	service Service
+	cursors pagination.CursorCodec
 	logger  log.Logger
 }
 
@@ -34,21 +75,82 @@ func (r resource) get(c *routing.Context) error {
 		return err
 	}
 
+	c.Response.Header().Set("ETag", etag(album))
+	conditional.SetLastModified(c.Response, album.UpdatedAt)
 	return c.Write(album)
 }
 
+// query lists the albums selected by the query parameters: name_contains and q filter the albums by name,
+// created_after and created_before, which are RFC 3339 timestamps, by their creation time, and sort lists
+// the fields that the albums are sorted by, such as "-created_at,name". The list is paginated with cursors
+// if the cursor query parameter is given, and with page numbers otherwise.
 func (r resource) query(c *routing.Context) error {
+	input, err := parseQuery(c.Request)
+	if err != nil {
+		return err
+	}
+	return r.list(c, input)
+}
+
+// queryTrash lists the albums in the trash of the current user, with the same query parameters as query.
+func (r resource) queryTrash(c *routing.Context) error {
+	input, err := parseQuery(c.Request)
+	if err != nil {
+		return err
+	}
+	input.Trashed = true
+	return r.list(c, input)
+}
+
+// list writes the page of the albums selected by the given request that the query parameters ask for.
+func (r resource) list(c *routing.Context, input QueryAlbumsRequest) error {
+	if pagination.IsCursorRequest(c.Request) {
+		return r.queryWithCursor(c, input)
+	}
 	ctx := c.Request.Context()
-	count, err := r.service.Count(ctx)
+	count, err := r.service.Count(ctx, input)
 	if err != nil {
 		return err
 	}
 	pages := pagination.NewFromRequest(c.Request, count)
-	albums, err := r.service.Query(ctx, pages.Offset(), pages.Limit())
+	albums, err := r.service.Query(ctx, input, pages.Offset(), pages.Limit())
 	if err != nil {
 		return err
 	}
 	pages.Items = albums
+	pages.SetLinks(c.Response, c.Request)
+	return c.Write(pages)
+}
+
+// queryWithCursor lists the albums after or before the cursor of the request. The total number of albums
+// is only counted if it is requested, and the cursor must have been returned for the same sort order.
+func (r resource) queryWithCursor(c *routing.Context, input QueryAlbumsRequest) error {
+	filter := Filter{Sort: input.Sort}
+	pages, err := pagination.NewCursorPagesFromRequest(c.Request, r.cursors, strings.Join(filter.orderBy(), ","))
+	if err != nil {
+		return errors.BadRequest("The cursor is invalid or was returned for another sort order.")
+	}
+	ctx := c.Request.Context()
+	if pages.WithCount {
+		count, err := r.service.Count(ctx, input)
+		if err != nil {
+			return err
+		}
+		pages.TotalCount = &count
+	}
+	input.Cursor = pages.Cursor
+	albums, err := r.service.Query(ctx, input, 0, pages.FetchLimit())
+	if err == pagination.ErrInvalidCursor {
+		return errors.BadRequest("The cursor is invalid or was returned for another sort order.")
+	} else if err != nil {
+		return err
+	}
+	start, end := pages.SetCursors(len(albums), func(i int) []string {
+		return filter.cursorKey(albums[i].Album)
+	})
+	albums = albums[start:end]
+	pages.Items = albums
+	pages.SetLinks(c.Response, c.Request)
 	return c.Write(pages)
 }
 
@@ -63,29 +165,202 @@ func (r resource) create(c *routing.Context) error {
 		return err
 	}
 
+	c.Response.Header().Set("ETag", etag(album))
 	return c.WriteWithStatus(album, http.StatusCreated)
 }
 
 func (r resource) update(c *routing.Context) error {
+	version, err := ifMatch(c.Request)
+	if err != nil {
+		return err
+	}
 	var input UpdateAlbumRequest
 	if err := c.Read(&input); err != nil {
 		r.logger.With(c.Request.Context()).Info(err)
 		return errors.BadRequest("")
 	}
 
-	album, err := r.service.Update(c.Request.Context(), c.Param("id"), input)
+	album, err := r.service.Update(c.Request.Context(), c.Param("id"), version, input)
+	if err != nil {
+		return err
+	}
+
+	c.Response.Header().Set("ETag", etag(album))
+	return c.Write(album)
+}
+
+// acceptPatch lists the media types of the patch documents accepted by PATCH requests.
+var acceptPatch = jsonpatch.MergePatchType + ", " + jsonpatch.JSONPatchType
+
+func (r resource) patch(c *routing.Context) error {
+	version, err := ifMatch(c.Request)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		r.logger.With(c.Request.Context()).Info(err)
+		return errors.BadRequest("")
+	}
+	patch, err := jsonpatch.New(c.Request.Header.Get("Content-Type"), data)
+	if err == jsonpatch.ErrUnsupportedType {
+		c.Response.Header().Set("Accept-Patch", acceptPatch)
+		return errors.UnsupportedMediaType("The patch must be a JSON Merge Patch or a JSON Patch document.")
+	} else if err != nil {
+		return errors.BadRequest(err.Error())
+	}
+
+	album, err := r.service.Patch(c.Request.Context(), c.Param("id"), version, patch)
 	if err != nil {
 		return err
 	}
 
+	c.Response.Header().Set("ETag", etag(album))
 	return c.Write(album)
 }
 
 func (r resource) delete(c *routing.Context) error {
-	album, err := r.service.Delete(c.Request.Context(), c.Param("id"))
+	version, err := ifMatch(c.Request)
+	if err != nil {
+		return err
+	}
+	album, err := r.service.Delete(c.Request.Context(), c.Param("id"), version)
+	if err != nil {
+		return err
+	}
+
+	return c.Write(album)
+}
+
+func (r resource) restore(c *routing.Context) error {
+	album, err := r.service.Restore(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		return err
+	}
+
+	c.Response.Header().Set("ETag", etag(album))
+	return c.Write(album)
+}
+
+// parseQuery returns the album list request given in the query parameters of a request.
+func parseQuery(req *http.Request) (QueryAlbumsRequest, error) {
+	query := req.URL.Query()
+	input := QueryAlbumsRequest{
+		NameContains: query.Get("name_contains"),
+		Search:       query.Get("q"),
+	}
+	if sort := query.Get("sort"); sort != "" {
+		input.Sort = strings.Split(sort, ",")
+	}
+	errs := validation.Errors{}
+	for name, t := range map[string]*time.Time{"created_after": &input.CreatedAfter, "created_before": &input.CreatedBefore} {
+		if value := query.Get(name); value != "" {
+			var err error
+			if *t, err = time.Parse(time.RFC3339, value); err != nil {
+				errs[name] = validation.NewError("validation_time_invalid", "must be an RFC 3339 timestamp")
+			}
+		}
+	}
+	return input, errs.Filter()
+}
+
+// etag returns the entity tag of the given album, which is its quoted version.
+func etag(album Album) string {
+	return `"` + strconv.Itoa(album.Version) + `"`
+}
+
+// ifMatch returns the album version required by the If-Match header of the given request, or AnyVersion
+// if the header is "*". errors.PreconditionRequired is returned if the header is missing, and
+// errors.PreconditionFailed if it is not an entity tag returned by etag.
+func ifMatch(req *http.Request) (int, error) {
+	value := strings.TrimSpace(req.Header.Get("If-Match"))
+	if value == "" {
+		return 0, errors.PreconditionRequired("The If-Match header with the ETag of the album is required.")
+	}
+	if value == "*" {
+		return AnyVersion, nil
+	}
+	if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+		return 0, errors.PreconditionFailed("")
+	}
+	version, err := strconv.Atoi(value[1 : len(value)-1])
+	if err != nil || version <= 0 {
+		return 0, errors.PreconditionFailed("")
+	}
+	return version, nil
+}
+
+func (r resource) getShared(c *routing.Context) error {
+	album, err := r.service.GetShared(c.Request.Context(), c.Param("token"), c.Request.Header.Get("X-Share-Password"))
 	if err != nil {
 		return err
 	}
 
 	return c.Write(album)
 }
+
+func (r resource) queryGrants(c *routing.Context) error {
+	grants, err := r.service.QueryGrants(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		return err
+	}
+
+	return c.Write(grants)
+}
+
+func (r resource) saveGrant(c *routing.Context) error {
+	var input GrantRequest
+	if err := c.Read(&input); err != nil {
+		r.logger.With(c.Request.Context()).Info(err)
+		return errors.BadRequest("")
+	}
+
+	grant, err := r.service.SaveGrant(c.Request.Context(), c.Param("id"), c.Param("userID"), input)
+	if err != nil {
+		return err
+	}
+
+	return c.Write(grant)
+}
+
+func (r resource) deleteGrant(c *routing.Context) error {
+	if err := r.service.DeleteGrant(c.Request.Context(), c.Param("id"), c.Param("userID")); err != nil {
+		return err
+	}
+
+	c.Response.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (r resource) queryShareLinks(c *routing.Context) error {
+	links, err := r.service.QueryShareLinks(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		return err
+	}
+
+	return c.Write(links)
+}
+
+func (r resource) createShareLink(c *routing.Context) error {
+	var input CreateShareLinkRequest
+	if err := c.Read(&input); err != nil {
+		r.logger.With(c.Request.Context()).Info(err)
+		return errors.BadRequest("")
+	}
+
+	link, err := r.service.CreateShareLink(c.Request.Context(), c.Param("id"), input)
+	if err != nil {
+		return err
+	}
+
+	return c.WriteWithStatus(link, http.StatusCreated)
+}
+
+func (r resource) deleteShareLink(c *routing.Context) error {
+	if err := r.service.DeleteShareLink(c.Request.Context(), c.Param("id"), c.Param("linkID")); err != nil {
+		return err
+	}
+
+	c.Response.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -1,39 +1,352 @@
 package album
 
 import (
+	"context"
+	"encoding/json"
 	"github.com/garaekz/priv8/internal/auth"
 	"github.com/garaekz/priv8/internal/entity"
+	"github.com/garaekz/priv8/internal/errors"
 	"github.com/garaekz/priv8/internal/test"
+	"github.com/garaekz/priv8/pkg/jsonpatch"
 	"github.com/garaekz/priv8/pkg/log"
+	"github.com/garaekz/priv8/pkg/pagination"
+	"github.com/go-ozzo/ozzo-routing/v2"
+	"github.com/stretchr/testify/assert"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
 
+// testCursors signs the cursors of the album list in tests.
+var testCursors = pagination.NewCursorCodec([]byte("test"))
+
 func TestAPI(t *testing.T) {
 	logger, _ := log.NewForTest()
 	router := test.MockRouter(logger)
+	owner, other := "100", "101"
 	repo := &mockRepository{items: []entity.Album{
-		{"123", "album123", time.Now(), time.Now()},
+		{ID: "123", Name: "album123", OwnerID: &owner, Visibility: entity.AlbumPublic, CreatedAt: time.Now(), UpdatedAt: time.Now(), Version: 1},
+		{ID: "456", Name: "album456", OwnerID: &other, Visibility: entity.AlbumPrivate, CreatedAt: time.Now(), UpdatedAt: time.Now(), Version: 1},
 	}}
-	RegisterHandlers(router.Group(""), NewService(repo, logger), auth.MockAuthHandler, logger)
+	shares := &mockShareRepository{}
+	RegisterHandlers(router.Group(""), NewService(repo, shares, testSigner, &mockAuditor{}, withoutTransaction, logger), auth.MockAuthHandler, testCursors, logger)
 	header := auth.MockAuthHeader()
+	// ifMatch returns the authentication header with the If-Match header set to the given value.
+	ifMatch := func(value string) http.Header {
+		h := auth.MockAuthHeader()
+		h.Set("If-Match", value)
+		return h
+	}
+	// patchHeader returns the authentication header with the If-Match header and the type of the patch.
+	patchHeader := func(version, contentType string) http.Header {
+		h := auth.MockAuthHeader()
+		if version != "" {
+			h.Set("If-Match", version)
+		}
+		h.Set("Content-Type", contentType)
+		return h
+	}
 
 	tests := []test.APITestCase{
 		{"get all", "GET", "/albums", "", nil, http.StatusOK, `*"total_count":1*`},
 		{"get 123", "GET", "/albums/123", "", nil, http.StatusOK, `*album123*`},
+		{"get filtered", "GET", "/albums?name_contains=ALBUM&sort=-created_at,name", "", header, http.StatusOK, `*"total_count":1*`},
+		{"get filtered out", "GET", "/albums?name_contains=xyz", "", header, http.StatusOK, `*"total_count":0*`},
+		{"get invalid sort", "GET", "/albums?sort=owner_id", "", nil, http.StatusBadRequest, `*"field":"sort"*`},
+		{"get invalid time", "GET", "/albums?created_after=yesterday", "", nil, http.StatusBadRequest, `*"field":"created_after"*`},
+		{"get 123 not modified", "GET", "/albums/123", "", http.Header{"If-None-Match": []string{`"1"`}}, http.StatusNotModified, ""},
+		{"get 123 modified", "GET", "/albums/123", "", http.Header{"If-None-Match": []string{`"0"`}}, http.StatusOK, `*album123*`},
 		{"get unknown", "GET", "/albums/1234", "", nil, http.StatusNotFound, ""},
-		{"create ok", "POST", "/albums", `{"name":"test"}`, header, http.StatusCreated, "*test*"},
-		{"create ok count", "GET", "/albums", "", nil, http.StatusOK, `*"total_count":2*`},
+		{"get private", "GET", "/albums/456", "", nil, http.StatusNotFound, ""},
+		{"get private of other user", "GET", "/albums/456", "", header, http.StatusNotFound, ""},
+		{"get auth error", "GET", "/albums/123", "", http.Header{"Authorization": []string{"Bearer xyz"}}, http.StatusUnauthorized, ""},
+		{"create ok", "POST", "/albums", `{"name":"test"}`, header, http.StatusCreated, `*"visibility":"private"*`},
+		{"create ok count", "GET", "/albums", "", header, http.StatusOK, `*"total_count":2*`},
+		{"get links", "GET", "/albums?per_page=1&links=true", "", header, http.StatusOK, `*"links":{"next":"/albums?links=true*`},
+		{"create ok anonymous count", "GET", "/albums", "", nil, http.StatusOK, `*"total_count":1*`},
+		{"create input error visibility", "POST", "/albums", `{"name":"test","visibility":"secret"}`, header, http.StatusBadRequest, ""},
 		{"create auth error", "POST", "/albums", `{"name":"test"}`, nil, http.StatusUnauthorized, ""},
 		{"create input error", "POST", "/albums", `"name":"test"}`, header, http.StatusBadRequest, ""},
-		{"update ok", "PUT", "/albums/123", `{"name":"albumxyz"}`, header, http.StatusOK, "*albumxyz*"},
+		{"update ok", "PUT", "/albums/123", `{"name":"albumxyz"}`, ifMatch(`"1"`), http.StatusOK, `*"version":2*`},
 		{"update verify", "GET", "/albums/123", "", nil, http.StatusOK, `*albumxyz*`},
+		{"update outdated version", "PUT", "/albums/123", `{"name":"albumabc"}`, ifMatch(`"1"`), http.StatusPreconditionFailed, ""},
+		{"update invalid version", "PUT", "/albums/123", `{"name":"albumabc"}`, ifMatch(`W/"2"`), http.StatusPreconditionFailed, ""},
+		{"update without version", "PUT", "/albums/123", `{"name":"albumabc"}`, header, http.StatusPreconditionRequired, ""},
+		{"update any version", "PUT", "/albums/123", `{"name":"albumxyz"}`, ifMatch("*"), http.StatusOK, `*"version":3*`},
+		{"patch ok", "PATCH", "/albums/123", `{"visibility":"unlisted"}`, patchHeader(`"3"`, jsonpatch.MergePatchType), http.StatusOK, `*"visibility":"unlisted"*`},
+		{"patch json patch", "PATCH", "/albums/123", `[{"op":"replace","path":"/visibility","value":"public"}]`, patchHeader(`"4"`, jsonpatch.JSONPatchType), http.StatusOK, `*"version":5*`},
+		{"patch outdated version", "PATCH", "/albums/123", `{"visibility":"private"}`, patchHeader(`"4"`, jsonpatch.MergePatchType), http.StatusPreconditionFailed, ""},
+		{"patch without version", "PATCH", "/albums/123", `{"visibility":"private"}`, patchHeader("", jsonpatch.MergePatchType), http.StatusPreconditionRequired, ""},
+		{"patch unsupported type", "PATCH", "/albums/123", `{"visibility":"private"}`, patchHeader(`"5"`, "application/json"), http.StatusUnsupportedMediaType, ""},
+		{"patch malformed", "PATCH", "/albums/123", `{"visibility":`, patchHeader(`"5"`, jsonpatch.MergePatchType), http.StatusBadRequest, ""},
+		{"patch input error", "PATCH", "/albums/123", `{"name":""}`, patchHeader(`"5"`, jsonpatch.MergePatchType), http.StatusBadRequest, ""},
+		{"patch auth error", "PATCH", "/albums/123", `{"visibility":"private"}`, nil, http.StatusUnauthorized, ""},
 		{"update auth error", "PUT", "/albums/123", `{"name":"albumxyz"}`, nil, http.StatusUnauthorized, ""},
-		{"update input error", "PUT", "/albums/123", `"name":"albumxyz"}`, header, http.StatusBadRequest, ""},
-		{"delete ok", "DELETE", "/albums/123", ``, header, http.StatusOK, "*albumxyz*"},
-		{"delete verify", "DELETE", "/albums/123", ``, header, http.StatusNotFound, ""},
+		{"update input error", "PUT", "/albums/123", `"name":"albumxyz"}`, ifMatch(`"3"`), http.StatusBadRequest, ""},
+		{"delete outdated version", "DELETE", "/albums/123", ``, ifMatch(`"3"`), http.StatusPreconditionFailed, ""},
+		{"delete without version", "DELETE", "/albums/123", ``, header, http.StatusPreconditionRequired, ""},
+		{"delete ok", "DELETE", "/albums/123", ``, ifMatch(`"5"`), http.StatusOK, "*albumxyz*"},
+		{"delete verify", "DELETE", "/albums/123", ``, ifMatch("*"), http.StatusNotFound, ""},
 		{"delete auth error", "DELETE", "/albums/123", ``, nil, http.StatusUnauthorized, ""},
+		{"delete private of other user", "DELETE", "/albums/456", ``, ifMatch(`"1"`), http.StatusNotFound, ""},
+		{"trash", "GET", "/albums/trash", "", header, http.StatusOK, `*"total_count":1,"items":[{"id":"123"*`},
+		{"trash auth error", "GET", "/albums/trash", "", nil, http.StatusUnauthorized, ""},
+		{"restore", "POST", "/albums/123/restore", "", header, http.StatusOK, "*albumxyz*"},
+		{"restore verify", "POST", "/albums/123/restore", "", header, http.StatusNotFound, ""},
+		{"restore not deleted", "POST", "/albums/456/restore", "", header, http.StatusNotFound, ""},
+		{"restore auth error", "POST", "/albums/123/restore", "", nil, http.StatusUnauthorized, ""},
+		{"trash after restore", "GET", "/albums/trash", "", header, http.StatusOK, `*"total_count":0*`},
+		{"get restored", "GET", "/albums/123", "", nil, http.StatusOK, "*albumxyz*"},
+		{"create album to share", "POST", "/albums", `{"name":"shared"}`, header, http.StatusCreated, ""},
+	}
+	for _, tc := range tests {
+		test.Endpoint(t, router, tc)
+	}
+
+	// sharing
+	shared := repo.items[len(repo.items)-1].ID
+	link, _ := NewService(repo, shares, testSigner, &mockAuditor{}, withoutTransaction, logger).CreateShareLink(
+		auth.WithUser(context.Background(), "100", "Tester"), shared, CreateShareLinkRequest{Password: "secret"})
+	passwordHeader := http.Header{"X-Share-Password": []string{"secret"}}
+	tests = []test.APITestCase{
+		{"grant ok", "PUT", "/albums/" + shared + "/grants/101", `{"level":"viewer"}`, header, http.StatusOK, `*"level":"viewer"*`},
+		{"grant input error", "PUT", "/albums/" + shared + "/grants/101", `{"level":"owner"}`, header, http.StatusBadRequest, ""},
+		{"grant auth error", "PUT", "/albums/" + shared + "/grants/101", `{"level":"viewer"}`, nil, http.StatusUnauthorized, ""},
+		{"grant unknown album", "PUT", "/albums/1234/grants/101", `{"level":"viewer"}`, header, http.StatusNotFound, ""},
+		{"get grants", "GET", "/albums/" + shared + "/grants", "", header, http.StatusOK, `*"user_id":"101"*`},
+		{"revoke grant", "DELETE", "/albums/" + shared + "/grants/101", "", header, http.StatusNoContent, ""},
+		{"revoke grant verify", "DELETE", "/albums/" + shared + "/grants/101", "", header, http.StatusNotFound, ""},
+		{"create link", "POST", "/albums/" + shared + "/links", `{"expires_in":3600}`, header, http.StatusCreated, `*"protected":false*`},
+		{"create link input error", "POST", "/albums/" + shared + "/links", `{"expires_in":1}`, header, http.StatusBadRequest, ""},
+		{"get links", "GET", "/albums/" + shared + "/links", "", header, http.StatusOK, `*"protected":true*`},
+		{"get shared", "GET", "/shared/" + link.Token, "", passwordHeader, http.StatusOK, `*"name":"shared"*`},
+		{"get shared without password", "GET", "/shared/" + link.Token, "", nil, http.StatusUnauthorized, ""},
+		{"get shared invalid", "GET", "/shared/xyz", "", nil, http.StatusNotFound, ""},
+		{"revoke link", "DELETE", "/albums/" + shared + "/links/" + link.ID, "", header, http.StatusNoContent, ""},
+		{"revoke link verify", "GET", "/shared/" + link.Token, "", passwordHeader, http.StatusNotFound, ""},
+	}
+	for _, tc := range tests {
+		test.Endpoint(t, router, tc)
+	}
+
+	// a user without the album permissions cannot modify albums
+	router = test.MockRouter(logger)
+	RegisterHandlers(router.Group(""), NewService(repo, shares, testSigner, &mockAuditor{}, withoutTransaction, logger), func(c *routing.Context) error {
+		c.Request = c.Request.WithContext(auth.WithUser(c.Request.Context(), "101", "Guest"))
+		return nil
+	}, testCursors, logger)
+	tests = []test.APITestCase{
+		{"create forbidden", "POST", "/albums", `{"name":"test"}`, nil, http.StatusForbidden, ""},
+		{"update forbidden", "PUT", "/albums/123", `{"name":"albumxyz"}`, nil, http.StatusForbidden, ""},
+		{"patch forbidden", "PATCH", "/albums/123", `{"name":"albumxyz"}`, nil, http.StatusForbidden, ""},
+		{"delete forbidden", "DELETE", "/albums/123", ``, nil, http.StatusForbidden, ""},
+		{"trash forbidden", "GET", "/albums/trash", "", nil, http.StatusForbidden, ""},
+		{"restore forbidden", "POST", "/albums/123/restore", "", nil, http.StatusForbidden, ""},
+		{"get grants forbidden", "GET", "/albums/123/grants", "", nil, http.StatusForbidden, ""},
+		{"get links forbidden", "GET", "/albums/123/links", "", nil, http.StatusForbidden, ""},
+	}
+	for _, tc := range tests {
+		test.Endpoint(t, router, tc)
+	}
+}
+
+func TestAPI_editor(t *testing.T) {
+	logger, _ := log.NewForTest()
+	router := test.MockRouter(logger)
+	owner := "101"
+	repo := &mockRepository{items: []entity.Album{
+		{ID: "456", Name: "album456", OwnerID: &owner, Visibility: entity.AlbumPrivate, Version: 1},
+	}}
+	// the mock user is an editor of the album of another user
+	shares := &mockShareRepository{grants: []entity.AlbumGrant{{AlbumID: "456", UserID: "100", Level: entity.AlbumEditor}}}
+	RegisterHandlers(router.Group(""), NewService(repo, shares, testSigner, &mockAuditor{}, withoutTransaction, logger), auth.MockAuthHandler, testCursors, logger)
+	// withType returns the authentication header with the given content type.
+	withType := func(contentType string) http.Header {
+		h := auth.MockAuthHeader()
+		h.Set("If-Match", "*")
+		h.Set("Content-Type", contentType)
+		return h
+	}
+
+	tests := []test.APITestCase{
+		{"update name", "PUT", "/albums/456", `{"name":"renamed"}`, withType("application/json"), http.StatusOK, `*"visibility":"private"*`},
+		{"update visibility", "PUT", "/albums/456", `{"name":"renamed","visibility":"public"}`, withType("application/json"), http.StatusForbidden, ""},
+		{"patch visibility", "PATCH", "/albums/456", `{"visibility":"unlisted"}`, withType(jsonpatch.MergePatchType), http.StatusForbidden, ""},
+		{"json patch visibility", "PATCH", "/albums/456", `[{"op":"replace","path":"/visibility","value":"public"}]`, withType(jsonpatch.JSONPatchType), http.StatusForbidden, ""},
+		{"still private", "GET", "/albums/456", "", auth.MockAuthHeader(), http.StatusOK, `*"visibility":"private"*`},
+	}
+	for _, tc := range tests {
+		test.Endpoint(t, router, tc)
+	}
+}
+
+func TestAPI_conditional(t *testing.T) {
+	logger, _ := log.NewForTest()
+	router := test.MockRouter(logger)
+	modified := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	owner := "100"
+	repo := &mockRepository{items: []entity.Album{
+		{ID: "123", Name: "album123", Visibility: entity.AlbumPublic, UpdatedAt: modified, Version: 3},
+		{ID: "124", Name: "album124", OwnerID: &owner, Visibility: entity.AlbumPublic, UpdatedAt: modified, Version: 1},
+	}}
+	RegisterHandlers(router.Group(""), NewService(repo, &mockShareRepository{}, testSigner, &mockAuditor{}, withoutTransaction, logger), auth.MockAuthHandler, testCursors, logger)
+
+	req, _ := http.NewRequest("GET", "/albums/123", nil)
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, `"3"`, res.Header().Get("ETag"))
+	assert.Equal(t, modified.Format(http.TimeFormat), res.Header().Get("Last-Modified"))
+	assert.Equal(t, []string{"Authorization", auth.APIKeyHeader}, res.Header().Values("Vary"))
+	assert.Empty(t, res.Header().Get("Cache-Control"))
+
+	// the responses to authenticated requests are private, also when they are not modified
+	req, _ = http.NewRequest("GET", "/albums/123", nil)
+	req.Header = auth.MockAuthHeader()
+	req.Header.Set("If-None-Match", `"3"`)
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusNotModified, res.Code)
+	assert.Equal(t, []string{"Authorization", auth.APIKeyHeader}, res.Header().Values("Vary"))
+	assert.Equal(t, "private", res.Header().Get("Cache-Control"))
+
+	req, _ = http.NewRequest("GET", "/albums", nil)
+	req.Header = auth.MockAuthHeader()
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "private", res.Header().Get("Cache-Control"))
+
+	// the list is not modified until an album changes
+	req, _ = http.NewRequest("GET", "/albums", nil)
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+	listETag := res.Header().Get("ETag")
+	assert.NotEmpty(t, listETag)
+	assert.Empty(t, res.Header().Get("Last-Modified"))
+	assert.Equal(t, []string{"Authorization", auth.APIKeyHeader}, res.Header().Values("Vary"))
+	assert.Empty(t, res.Header().Get("Cache-Control"))
+
+	req, _ = http.NewRequest("GET", "/albums", nil)
+	req.Header.Set("If-None-Match", listETag)
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusNotModified, res.Code)
+	assert.Empty(t, res.Body.String())
+
+	// trashing an album changes the list although the remaining albums are unchanged
+	req, _ = http.NewRequest("DELETE", "/albums/124", nil)
+	req.Header = auth.MockAuthHeader()
+	req.Header.Set("If-Match", `"1"`)
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	req, _ = http.NewRequest("GET", "/albums", nil)
+	req.Header.Set("If-None-Match", listETag)
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.NotContains(t, res.Body.String(), "album124")
+	listETag = res.Header().Get("ETag")
+
+	repo.items[0].Name = "renamed"
+	req, _ = http.NewRequest("GET", "/albums", nil)
+	req.Header.Set("If-None-Match", listETag)
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Contains(t, res.Body.String(), "renamed")
+}
+
+func Test_ifMatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		version int
+		status  int
+	}{
+		{"version", `"3"`, 3, 0},
+		{"any", "*", AnyVersion, 0},
+		{"missing", "", 0, http.StatusPreconditionRequired},
+		{"unquoted", "3", 0, http.StatusPreconditionFailed},
+		{"weak", `W/"3"`, 0, http.StatusPreconditionFailed},
+		{"list", `"3", "4"`, 0, http.StatusPreconditionFailed},
+		{"zero", `"0"`, 0, http.StatusPreconditionFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("PUT", "/albums/123", nil)
+			if tt.value != "" {
+				req.Header.Set("If-Match", tt.value)
+			}
+			version, err := ifMatch(req)
+			if tt.status == 0 {
+				assert.Nil(t, err)
+				assert.Equal(t, tt.version, version)
+			} else if assert.NotNil(t, err) {
+				assert.Equal(t, tt.status, err.(errors.ErrorResponse).Status)
+			}
+		})
+	}
+}
+
+func TestAPI_cursor(t *testing.T) {
+	logger, _ := log.NewForTest()
+	router := test.MockRouter(logger)
+	// the mock repository sorts by ID only, so the albums are created in that order
+	repo := &mockRepository{}
+	for _, id := range []string{"a1", "a2", "a3", "a4", "a5"} {
+		repo.items = append(repo.items, entity.Album{ID: id, Name: "album " + id, Visibility: entity.AlbumPublic, Version: 1})
+	}
+	RegisterHandlers(router.Group(""), NewService(repo, &mockShareRepository{}, testSigner, &mockAuditor{}, withoutTransaction, logger), auth.MockAuthHandler, testCursors, logger)
+
+	// list returns the IDs of the albums and the cursors of a page of the album list
+	list := func(query string) (ids []string, next, prev string, count *int) {
+		req, _ := http.NewRequest("GET", "/albums?"+query, nil)
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		assert.Equal(t, http.StatusOK, res.Code, query)
+		if strings.Contains(res.Body.String(), `"next_cursor"`) {
+			assert.Contains(t, res.Header().Get("Link"), `rel="next"`)
+		}
+		var pages struct {
+			TotalCount *int    `json:"total_count"`
+			NextCursor string  `json:"next_cursor"`
+			PrevCursor string  `json:"prev_cursor"`
+			Items      []Album `json:"items"`
+		}
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &pages))
+		for _, album := range pages.Items {
+			ids = append(ids, album.ID)
+		}
+		return ids, pages.NextCursor, pages.PrevCursor, pages.TotalCount
+	}
+
+	ids, next, prev, count := list("cursor=&limit=2&count=true")
+	assert.Equal(t, []string{"a1", "a2"}, ids)
+	assert.Empty(t, prev)
+	if assert.NotNil(t, count) {
+		assert.Equal(t, 5, *count)
+	}
+	second := next
+	ids, next, prev, count = list("cursor=" + second + "&limit=2")
+	assert.Equal(t, []string{"a3", "a4"}, ids)
+	assert.Nil(t, count)
+	ids, next, _, _ = list("cursor=" + next + "&limit=2")
+	assert.Equal(t, []string{"a5"}, ids)
+	assert.Empty(t, next)
+	ids, _, prev, _ = list("cursor=" + prev + "&limit=2")
+	assert.Equal(t, []string{"a1", "a2"}, ids)
+	assert.Empty(t, prev)
+
+	tests := []test.APITestCase{
+		{"invalid cursor", "GET", "/albums?cursor=xyz", "", nil, http.StatusBadRequest, ""},
+		{"cursor of another order", "GET", "/albums?sort=-name&cursor=" + second, "", nil, http.StatusBadRequest, ""},
+		{"invalid sort", "GET", "/albums?sort=owner_id&cursor=", "", nil, http.StatusBadRequest, ""},
 	}
 	for _, tc := range tests {
 		test.Endpoint(t, router, tc)
@@ -0,0 +1,40 @@
+package album
+
+import (
+	"context"
+	"github.com/garaekz/priv8/internal/audit"
+	"github.com/garaekz/priv8/internal/entity"
+	"github.com/garaekz/priv8/pkg/dbcontext"
+	"time"
+)
+
+// Purger permanently deletes the albums that have been in the trash for longer than a retention period.
+type Purger struct {
+	repo          Repository
+	auditor       audit.Recorder
+	transactional dbcontext.TransactionFunc
+	retention     time.Duration
+}
+
+// NewPurger creates a purger that keeps deleted albums in the trash for the given retention period.
+func NewPurger(repo Repository, auditor audit.Recorder, transactional dbcontext.TransactionFunc,
+	retention time.Duration) Purger {
+	return Purger{repo, auditor, transactional, retention}
+}
+
+// Purge permanently deletes the albums that were moved to the trash before the retention period.
+// Each purged album is recorded in the audit log as deleted without an actor. It is meant to be called periodically.
+func (p Purger) Purge(ctx context.Context) error {
+	return p.transactional(ctx, func(ctx context.Context) error {
+		albums, err := p.repo.Purge(ctx, time.Now().Add(-p.retention))
+		if err != nil {
+			return err
+		}
+		for _, album := range albums {
+			if err := p.auditor.Record(ctx, entity.AuditDelete, auditResource, album.ID, Album{album}, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
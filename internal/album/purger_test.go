@@ -0,0 +1,35 @@
+package album
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/garaekz/priv8/internal/entity"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPurger_Purge(t *testing.T) {
+	recent, old := time.Now().Add(-time.Hour), time.Now().Add(-48*time.Hour)
+	repo := &mockRepository{items: []entity.Album{
+		{ID: "album1", Name: "album1"},
+		{ID: "album2", Name: "album2", DeletedAt: &recent},
+		{ID: "album3", Name: "album3", DeletedAt: &old},
+	}}
+	auditor := &mockAuditor{}
+	purger := NewPurger(repo, auditor, withoutTransaction, 24*time.Hour)
+
+	assert.Nil(t, purger.Purge(context.Background()))
+	var ids []string
+	for _, item := range repo.items {
+		ids = append(ids, item.ID)
+	}
+	assert.Equal(t, []string{"album1", "album2"}, ids)
+	// the purges are not done by any user
+	if assert.Equal(t, 1, len(auditor.records)) {
+		assert.Equal(t, entity.AuditRecord{Action: entity.AuditDelete, ResourceType: "album", ResourceID: "album3"},
+			auditor.records[0].AuditRecord)
+		assert.Equal(t, "album3", auditor.records[0].before.(Album).Name)
+		assert.Nil(t, auditor.records[0].after)
+	}
+}
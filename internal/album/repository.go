@@ -2,25 +2,219 @@ package album
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"github.com/garaekz/priv8/internal/entity"
 	"github.com/garaekz/priv8/pkg/dbcontext"
 	"github.com/garaekz/priv8/pkg/log"
+	"github.com/garaekz/priv8/pkg/pagination"
+	dbx "github.com/go-ozzo/ozzo-dbx"
+	"strings"
+	"time"
 )
 
 // Repository encapsulates the logic to access albums from the data source.
 type Repository interface {
-	// Get returns the album with the specified album ID.
+	// Get returns the album with the specified album ID. Albums in the trash are not returned.
 	Get(ctx context.Context, id string) (entity.Album, error)
-	// Count returns the number of albums.
-	Count(ctx context.Context) (int, error)
-	// Query returns the list of albums with the given offset and limit.
-	Query(ctx context.Context, offset, limit int) ([]entity.Album, error)
+	// GetTrashed returns the album with the specified album ID if it is in the trash.
+	GetTrashed(ctx context.Context, id string) (entity.Album, error)
+	// Count returns the number of albums that satisfy the given filter.
+	Count(ctx context.Context, filter Filter) (int, error)
+	// Query returns the list of albums that satisfy the given filter with the given offset and limit,
+	// in the order specified by the filter.
+	Query(ctx context.Context, filter Filter, offset, limit int) ([]entity.Album, error)
 	// Create saves a new album in the storage.
 	Create(ctx context.Context, album entity.Album) error
-	// Update updates the album with given ID in the storage.
+	// Update updates the album with given ID in the storage if its stored version is still the version of the
+	// given album, and increments the stored version. ErrVersionConflict is returned otherwise.
 	Update(ctx context.Context, album entity.Album) error
-	// Delete removes the album with given ID from the storage.
-	Delete(ctx context.Context, id string) error
+	// Delete moves the album with given ID to the trash at the given time if its stored version is the given
+	// version, unless it is AnyVersion. ErrVersionConflict is returned otherwise.
+	Delete(ctx context.Context, id string, version int, deletedAt time.Time) error
+	// DeleteOwnedBy moves the albums owned by the user with the specified ID to the trash at the given time
+	// and increments their versions. It returns the albums as they were before.
+	DeleteOwnedBy(ctx context.Context, ownerID string, deletedAt time.Time) ([]entity.Album, error)
+	// Restore moves the album with given ID out of the trash.
+	Restore(ctx context.Context, id string) error
+	// Purge permanently removes the albums that were moved to the trash before the given time and returns them.
+	Purge(ctx context.Context, before time.Time) ([]entity.Album, error)
+}
+
+// ErrVersionConflict is returned by Repository.Update and Repository.Delete if the album was changed or deleted
+// since it was read.
+var ErrVersionConflict = errors.New("the album has been changed by another request")
+
+// sortFields lists the fields that albums can be sorted by. They are also the names of the columns.
+var sortFields = []string{"id", "name", "created_at", "updated_at"}
+
+// Filter specifies the albums returned by Repository.Count and Repository.Query.
+// Empty fields do not filter the albums.
+type Filter struct {
+	// ViewerID is the ID of the user who lists the albums. The albums owned by the viewer, the albums shared with
+	// the viewer and the public albums are returned. Only the public albums are returned if the viewer is anonymous.
+	ViewerID string
+	// All disables the visibility check so that every album is returned.
+	All bool
+	// Trashed selects the albums in the trash instead of the other albums. Only the albums owned by the viewer
+	// are in the trash of the viewer, as only the owners can restore them, unless All is set.
+	Trashed bool
+	// NameContains selects the albums whose names contain the given text, ignoring case.
+	NameContains string
+	// Search selects the albums whose names contain every word of the given text, ignoring case.
+	Search string
+	// CreatedAfter and CreatedBefore select the albums created after CreatedAfter and before CreatedBefore.
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	// Sort lists the fields of sortFields that the albums are sorted by, each prefixed with "-" for
+	// a descending order. The albums are finally sorted by ID, so that the order is stable.
+	Sort []string
+	// Cursor, if set, makes Query return the albums after the cursor in the sort order, or before it
+	// if the cursor is backward. The cursor must have been created for the same sort order. Count ignores it.
+	Cursor *pagination.Cursor
+}
+
+// expression returns the WHERE condition that implements the filter.
+func (f Filter) expression() dbx.Expression {
+	var conditions []dbx.Expression
+	if f.Trashed {
+		conditions = append(conditions, dbx.NewExp("deleted_at IS NOT NULL"))
+	} else {
+		conditions = append(conditions, dbx.NewExp("deleted_at IS NULL"))
+	}
+	if !f.All && f.Trashed {
+		// an anonymous viewer owns no albums
+		conditions = append(conditions, dbx.HashExp{"owner_id": f.ViewerID})
+	} else if !f.All {
+		public := dbx.HashExp{"visibility": entity.AlbumPublic}
+		if f.ViewerID == "" {
+			conditions = append(conditions, public)
+		} else {
+			conditions = append(conditions, dbx.Or(
+				dbx.HashExp{"owner_id": f.ViewerID},
+				public,
+				dbx.NewExp("id IN (SELECT album_id FROM album_grant WHERE user_id={:viewer})", dbx.Params{"viewer": f.ViewerID}),
+			))
+		}
+	}
+	// the LIKE expressions escape the wildcards in the values
+	if f.NameContains != "" {
+		like := dbx.Like("name", f.NameContains)
+		like.Like = "ILIKE"
+		conditions = append(conditions, like)
+	}
+	if words := strings.Fields(f.Search); len(words) > 0 {
+		like := dbx.Like("name", words...)
+		like.Like = "ILIKE"
+		conditions = append(conditions, like)
+	}
+	if !f.CreatedAfter.IsZero() {
+		conditions = append(conditions, dbx.NewExp("created_at > {:after}", dbx.Params{"after": f.CreatedAfter}))
+	}
+	if !f.CreatedBefore.IsZero() {
+		conditions = append(conditions, dbx.NewExp("created_at < {:before}", dbx.Params{"before": f.CreatedBefore}))
+	}
+	return dbx.And(conditions...)
+}
+
+// orderBy returns the ORDER BY columns that implement the sort order of the filter.
+func (f Filter) orderBy() []string {
+	var columns []string
+	for _, column := range f.sortColumns() {
+		if column.name == "id" && !column.desc {
+			columns = append(columns, "id")
+		} else if column.desc {
+			columns = append(columns, column.name+" DESC")
+		} else {
+			columns = append(columns, column.name+" ASC")
+		}
+	}
+	return columns
+}
+
+// sortColumn is a column of the sort order of albums.
+type sortColumn struct {
+	name string
+	desc bool
+}
+
+// sortColumns returns the columns of the sort order of the filter, which always end with the ID.
+// Fields that are not in sortFields are ignored, so that only known columns end up in the query.
+func (f Filter) sortColumns() []sortColumn {
+	var columns []sortColumn
+	for _, field := range f.Sort {
+		desc := strings.HasPrefix(field, "-")
+		field = strings.TrimPrefix(field, "-")
+		for _, name := range sortFields {
+			if field == name {
+				columns = append(columns, sortColumn{name, desc})
+				if name == "id" {
+					return columns
+				}
+			}
+		}
+	}
+	return append(columns, sortColumn{name: "id"})
+}
+
+// keyset returns the WHERE condition that selects the albums after the key of the cursor in the sort order
+// of the filter, or before it if the cursor is backward.
+func (f Filter) keyset() (dbx.Expression, error) {
+	columns := f.sortColumns()
+	if len(f.Cursor.Key) != len(columns) {
+		return nil, pagination.ErrInvalidCursor
+	}
+	// (a, b) after (x, y) is "a > x OR a = x AND b > y", with < for the descending columns
+	var terms []string
+	params := dbx.Params{}
+	for i, column := range columns {
+		value, err := keyValue(column.name, f.Cursor.Key[i])
+		if err != nil {
+			return nil, err
+		}
+		params[fmt.Sprintf("key%d", i)] = value
+		op := ">"
+		if column.desc != f.Cursor.Backward {
+			op = "<"
+		}
+		term := fmt.Sprintf("%s %s {:key%d}", column.name, op, i)
+		for j := i - 1; j >= 0; j-- {
+			term = fmt.Sprintf("%s = {:key%d} AND %s", columns[j].name, j, term)
+		}
+		terms = append(terms, "("+term+")")
+	}
+	return dbx.NewExp(strings.Join(terms, " OR "), params), nil
+}
+
+// cursorKey returns the sort key of the given album in the sort order of the filter.
+func (f Filter) cursorKey(album entity.Album) []string {
+	var key []string
+	for _, column := range f.sortColumns() {
+		switch column.name {
+		case "id":
+			key = append(key, album.ID)
+		case "name":
+			key = append(key, album.Name)
+		case "created_at":
+			key = append(key, album.CreatedAt.Format(time.RFC3339Nano))
+		case "updated_at":
+			key = append(key, album.UpdatedAt.Format(time.RFC3339Nano))
+		}
+	}
+	return key
+}
+
+// keyValue parses a value of a cursor key for the given column.
+func keyValue(column, value string) (interface{}, error) {
+	if column != "created_at" && column != "updated_at" {
+		return value, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return nil, pagination.ErrInvalidCursor
+	}
+	return t, nil
 }
 
 // repository persists albums in database
@@ -34,10 +228,17 @@ func NewRepository(db *dbcontext.DB, logger log.Logger) Repository {
 	return repository{db, logger}
 }
 
-// Get reads the album with the specified ID from the database.
+// Get reads the album with the specified ID from the database, unless it is in the trash.
 func (r repository) Get(ctx context.Context, id string) (entity.Album, error) {
 	var album entity.Album
-	err := r.db.With(ctx).Select().Model(id, &album)
+	err := r.db.With(ctx).Select().Where(dbx.NewExp("deleted_at IS NULL")).Model(id, &album)
+	return album, err
+}
+
+// GetTrashed reads the album with the specified ID from the database if it is in the trash.
+func (r repository) GetTrashed(ctx context.Context, id string) (entity.Album, error) {
+	var album entity.Album
+	err := r.db.With(ctx).Select().Where(dbx.NewExp("deleted_at IS NOT NULL")).Model(id, &album)
 	return album, err
 }
 
@@ -47,35 +248,150 @@ func (r repository) Create(ctx context.Context, album entity.Album) error {
 	return r.db.With(ctx).Model(&album).Insert()
 }
 
-// Update saves the changes to an album in the database.
+// Update saves the changes to an album in the database. The version is checked and incremented in the same
+// statement, so that only one of several concurrent updates of the same version succeeds.
 func (r repository) Update(ctx context.Context, album entity.Album) error {
-	return r.db.With(ctx).Model(&album).Update()
+	result, err := r.db.With(ctx).Update("album", dbx.Params{
+		"name":       album.Name,
+		"owner_id":   album.OwnerID,
+		"visibility": album.Visibility,
+		"updated_at": album.UpdatedAt,
+		"version":    dbx.NewExp("version+1"),
+	}, dbx.HashExp{"id": album.ID, "version": album.Version, "deleted_at": nil}).Execute()
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrVersionConflict
+	}
+	return nil
+}
+
+// Delete moves an album with the specified ID to the trash by setting the time when it was deleted.
+// ErrVersionConflict is returned if the album is not at the given version or is already in the trash.
+// If the version is AnyVersion, sql.ErrNoRows is returned if there is no such album outside the trash.
+func (r repository) Delete(ctx context.Context, id string, version int, deletedAt time.Time) error {
+	where := dbx.HashExp{"id": id, "deleted_at": nil}
+	if version != AnyVersion {
+		where["version"] = version
+	}
+	result, err := r.db.With(ctx).Update("album", dbx.Params{"deleted_at": deletedAt}, where).Execute()
+	if err = requireRow(result, err); err == sql.ErrNoRows && version != AnyVersion {
+		return ErrVersionConflict
+	}
+	return err
+}
+
+// DeleteOwnedBy moves the albums owned by the specified user to the trash by setting the time when they were
+// deleted. Their versions are incremented, so that updates based on an earlier read are rejected.
+// Only the albums that were read are changed, so that every album returned is the one moved to the trash.
+func (r repository) DeleteOwnedBy(ctx context.Context, ownerID string, deletedAt time.Time) ([]entity.Album, error) {
+	var albums []entity.Album
+	err := r.db.With(ctx).Select().Where(dbx.HashExp{"owner_id": ownerID, "deleted_at": nil}).OrderBy("id").All(&albums)
+	if err != nil || len(albums) == 0 {
+		return nil, err
+	}
+	ids := make([]interface{}, len(albums))
+	for i, album := range albums {
+		ids[i] = album.ID
+	}
+	_, err = r.db.With(ctx).Update("album",
+		dbx.Params{"deleted_at": deletedAt, "version": dbx.NewExp("version+1")},
+		dbx.And(dbx.In("id", ids...), dbx.HashExp{"deleted_at": nil}),
+	).Execute()
+	return albums, err
 }
 
-// Delete deletes an album with the specified ID from the database.
-func (r repository) Delete(ctx context.Context, id string) error {
-	album, err := r.Get(ctx, id)
+// Restore moves an album with the specified ID out of the trash.
+// sql.ErrNoRows is returned if there is no such album in the trash.
+func (r repository) Restore(ctx context.Context, id string) error {
+	result, err := r.db.With(ctx).Update("album", dbx.Params{"deleted_at": nil},
+		dbx.And(dbx.HashExp{"id": id}, dbx.NewExp("deleted_at IS NOT NULL"))).Execute()
+	return requireRow(result, err)
+}
+
+// Purge deletes the albums that were moved to the trash before the given time from the database,
+// together with their grants and share links. The albums are returned as they were before they were deleted.
+func (r repository) Purge(ctx context.Context, before time.Time) ([]entity.Album, error) {
+	var albums []entity.Album
+	expired := dbx.NewExp("deleted_at < {:before}", dbx.Params{"before": before})
+	err := r.db.With(ctx).Select().Where(expired).OrderBy("id").All(&albums)
+	if err != nil || len(albums) == 0 {
+		return nil, err
+	}
+	ids := make([]interface{}, len(albums))
+	for i, album := range albums {
+		ids[i] = album.ID
+	}
+	if _, err := r.db.With(ctx).Delete("album", dbx.In("id", ids...)).Execute(); err != nil {
+		return nil, err
+	}
+	r.logger.With(ctx).Infof("purged %d albums from the trash", len(albums))
+	return albums, nil
+}
+
+// requireRow returns sql.ErrNoRows if the statement with the given result changed no rows.
+func requireRow(result sql.Result, err error) error {
 	if err != nil {
 		return err
 	}
-	return r.db.With(ctx).Model(&album).Delete()
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
 }
 
-// Count returns the number of the album records in the database.
-func (r repository) Count(ctx context.Context) (int, error) {
+// Count returns the number of the album records that satisfy the given filter in the database.
+func (r repository) Count(ctx context.Context, filter Filter) (int, error) {
 	var count int
-	err := r.db.With(ctx).Select("COUNT(*)").From("album").Row(&count)
+	err := r.db.With(ctx).Select("COUNT(*)").From("album").Where(filter.expression()).Row(&count)
 	return count, err
 }
 
-// Query retrieves the album records with the specified offset and limit from the database.
-func (r repository) Query(ctx context.Context, offset, limit int) ([]entity.Album, error) {
+// Query retrieves the album records that satisfy the given filter with the specified offset and limit from the database.
+// If the filter has a cursor, the albums are selected by their sort keys, which does not require an offset.
+func (r repository) Query(ctx context.Context, filter Filter, offset, limit int) ([]entity.Album, error) {
 	var albums []entity.Album
-	err := r.db.With(ctx).
-		Select().
-		OrderBy("id").
+	q := r.db.With(ctx).Select().Where(filter.expression())
+	backward := false
+	if filter.Cursor != nil {
+		keyset, err := filter.keyset()
+		if err != nil {
+			return nil, err
+		}
+		q.AndWhere(keyset)
+		backward = filter.Cursor.Backward
+	}
+	orderBy := filter.orderBy()
+	if backward {
+		// the albums right before the cursor are the first ones in the reverse order
+		orderBy = Filter{Sort: reverse(filter.sortColumns())}.orderBy()
+	}
+	err := q.OrderBy(orderBy...).
 		Offset(int64(offset)).
 		Limit(int64(limit)).
 		All(&albums)
+	if backward {
+		for i, j := 0, len(albums)-1; i < j; i, j = i+1, j-1 {
+			albums[i], albums[j] = albums[j], albums[i]
+		}
+	}
 	return albums, err
 }
+
+// reverse returns the sort fields of the reverse order of the given columns.
+func reverse(columns []sortColumn) []string {
+	var fields []string
+	for _, column := range columns {
+		if column.desc {
+			fields = append(fields, column.name)
+		} else {
+			fields = append(fields, "-"+column.name)
+		}
+	}
+	return fields
+}
@@ -3,9 +3,12 @@ package album
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"github.com/garaekz/priv8/internal/entity"
 	"github.com/garaekz/priv8/internal/test"
 	"github.com/garaekz/priv8/pkg/log"
+	"github.com/garaekz/priv8/pkg/pagination"
+	dbx "github.com/go-ozzo/ozzo-dbx"
 	"github.com/stretchr/testify/assert"
 	"testing"
 	"time"
@@ -14,26 +17,40 @@ import (
 func TestRepository(t *testing.T) {
 	logger, _ := log.NewForTest()
 	db := test.DB(t)
-	test.ResetTables(t, db, "album")
+	test.ResetTables(t, db, "album", "user")
+	test.CreateUser(t, db, "user1", "user1")
+	test.CreateUser(t, db, "user2", "user2")
 	repo := NewRepository(db, logger)
 
 	ctx := context.Background()
 
 	// initial count
-	count, err := repo.Count(ctx)
+	count, err := repo.Count(ctx, Filter{All: true})
 	assert.Nil(t, err)
 
 	// create
+	owner := "user1"
 	err = repo.Create(ctx, entity.Album{
-		ID:        "test1",
-		Name:      "album1",
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
+		ID:         "test1",
+		Name:       "album1",
+		OwnerID:    &owner,
+		Visibility: entity.AlbumPrivate,
+		CreatedAt:  time.Now(),
+		UpdatedAt:  time.Now(),
+		Version:    1,
 	})
 	assert.Nil(t, err)
-	count2, _ := repo.Count(ctx)
+	count2, _ := repo.Count(ctx, Filter{All: true})
 	assert.Equal(t, 1, count2-count)
 
+	// filter by visibility
+	count, _ = repo.Count(ctx, Filter{ViewerID: "user1"})
+	assert.Equal(t, 1, count)
+	count, _ = repo.Count(ctx, Filter{ViewerID: "user2"})
+	assert.Equal(t, 0, count)
+	count, _ = repo.Count(ctx, Filter{})
+	assert.Equal(t, 0, count)
+
 	// get
 	album, err := repo.Get(ctx, "test1")
 	assert.Nil(t, err)
@@ -43,25 +60,207 @@ func TestRepository(t *testing.T) {
 
 	// update
 	err = repo.Update(ctx, entity.Album{
-		ID:        "test1",
-		Name:      "album1 updated",
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
+		ID:         "test1",
+		Name:       "album1 updated",
+		OwnerID:    &owner,
+		Visibility: entity.AlbumPublic,
+		CreatedAt:  time.Now(),
+		UpdatedAt:  time.Now(),
+		Version:    1,
 	})
 	assert.Nil(t, err)
 	album, _ = repo.Get(ctx, "test1")
 	assert.Equal(t, "album1 updated", album.Name)
+	assert.True(t, album.IsOwnedBy("user1"))
+	assert.Equal(t, 2, album.Version)
+
+	// update of an outdated version
+	album.Name = "album1 conflict"
+	album.Version = 1
+	assert.Equal(t, ErrVersionConflict, repo.Update(ctx, album))
+	album, _ = repo.Get(ctx, "test1")
+	assert.Equal(t, "album1 updated", album.Name)
+	assert.Equal(t, 2, album.Version)
 
 	// query
-	albums, err := repo.Query(ctx, 0, count2)
+	albums, err := repo.Query(ctx, Filter{All: true}, 0, count2)
 	assert.Nil(t, err)
 	assert.Equal(t, count2, len(albums))
+	albums, _ = repo.Query(ctx, Filter{ViewerID: "user2"}, 0, count2)
+	assert.Equal(t, 1, len(albums))
+
+	// filter and sort
+	for i, name := range []string{"Summer trip", "Winter trip", "100%_done"} {
+		assert.Nil(t, repo.Create(ctx, entity.Album{
+			ID:         fmt.Sprintf("test%d", i+2),
+			Name:       name,
+			OwnerID:    &owner,
+			Visibility: entity.AlbumPrivate,
+			CreatedAt:  time.Date(2026, 1, i+1, 0, 0, 0, 0, time.UTC),
+			UpdatedAt:  time.Now(),
+			Version:    1,
+		}))
+	}
+	count, _ = repo.Count(ctx, Filter{ViewerID: "user1", NameContains: "TRIP"})
+	assert.Equal(t, 2, count)
+	count, _ = repo.Count(ctx, Filter{ViewerID: "user2", NameContains: "trip"})
+	assert.Equal(t, 0, count)
+	count, _ = repo.Count(ctx, Filter{All: true, NameContains: "%_"})
+	assert.Equal(t, 1, count)
+	count, _ = repo.Count(ctx, Filter{All: true, Search: "trip summer"})
+	assert.Equal(t, 1, count)
+	count, _ = repo.Count(ctx, Filter{All: true, CreatedAfter: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+		CreatedBefore: time.Date(2026, 1, 3, 0, 0, 0, 0, time.UTC)})
+	assert.Equal(t, 1, count)
+	albums, _ = repo.Query(ctx, Filter{All: true, NameContains: "trip", Sort: []string{"-created_at"}}, 0, 10)
+	if assert.Equal(t, 2, len(albums)) {
+		assert.Equal(t, "Winter trip", albums[0].Name)
+		assert.Equal(t, "Summer trip", albums[1].Name)
+	}
+
+	// cursors
+	filter := Filter{All: true, Sort: []string{"-created_at"}}
+	albums, _ = repo.Query(ctx, filter, 0, 2)
+	if assert.Equal(t, 2, len(albums)) {
+		assert.Equal(t, "test1", albums[0].ID)
+		assert.Equal(t, "test4", albums[1].ID)
+	}
+	filter.Cursor = &pagination.Cursor{Key: filter.cursorKey(albums[1])}
+	albums, _ = repo.Query(ctx, filter, 0, 2)
+	if assert.Equal(t, 2, len(albums)) {
+		assert.Equal(t, "test3", albums[0].ID)
+		assert.Equal(t, "test2", albums[1].ID)
+	}
+	filter.Cursor = &pagination.Cursor{Key: filter.cursorKey(albums[1]), Backward: true}
+	albums, _ = repo.Query(ctx, filter, 0, 2)
+	if assert.Equal(t, 2, len(albums)) {
+		assert.Equal(t, "test4", albums[0].ID)
+		assert.Equal(t, "test3", albums[1].ID)
+	}
+	filter.Cursor = &pagination.Cursor{Key: []string{"yesterday", "test1"}}
+	_, err = repo.Query(ctx, filter, 0, 2)
+	assert.Equal(t, pagination.ErrInvalidCursor, err)
 
 	// delete
-	err = repo.Delete(ctx, "test1")
+	deleted := time.Now()
+	err = repo.Delete(ctx, "test1", 1, deleted)
+	assert.Equal(t, ErrVersionConflict, err)
+	err = repo.Delete(ctx, "test1", 2, deleted)
 	assert.Nil(t, err)
 	_, err = repo.Get(ctx, "test1")
 	assert.Equal(t, sql.ErrNoRows, err)
-	err = repo.Delete(ctx, "test1")
+	err = repo.Delete(ctx, "test1", 2, deleted)
+	assert.Equal(t, ErrVersionConflict, err)
+	err = repo.Delete(ctx, "test1", AnyVersion, deleted)
+	assert.Equal(t, sql.ErrNoRows, err)
+	album.Version = 2
+	assert.Equal(t, ErrVersionConflict, repo.Update(ctx, album))
+
+	// trash
+	album, err = repo.GetTrashed(ctx, "test1")
+	assert.Nil(t, err)
+	assert.NotNil(t, album.DeletedAt)
+	_, err = repo.GetTrashed(ctx, "test2")
+	assert.Equal(t, sql.ErrNoRows, err)
+	count, _ = repo.Count(ctx, Filter{All: true})
+	assert.Equal(t, 3, count)
+	count, _ = repo.Count(ctx, Filter{ViewerID: "user1", Trashed: true})
+	assert.Equal(t, 1, count)
+	count, _ = repo.Count(ctx, Filter{ViewerID: "user2", Trashed: true})
+	assert.Equal(t, 0, count)
+	count, _ = repo.Count(ctx, Filter{Trashed: true})
+	assert.Equal(t, 0, count)
+
+	// restore
+	assert.Nil(t, repo.Restore(ctx, "test1"))
+	_, err = repo.Get(ctx, "test1")
+	assert.Nil(t, err)
+	assert.Equal(t, sql.ErrNoRows, repo.Restore(ctx, "test1"))
+
+	// delete owned by
+	album, _ = repo.Get(ctx, "test1")
+	albums, err = repo.DeleteOwnedBy(ctx, "user1", deleted)
+	assert.Nil(t, err)
+	if assert.Equal(t, 4, len(albums)) {
+		assert.Equal(t, album, albums[0])
+	}
+	trashed, err := repo.GetTrashed(ctx, "test1")
+	assert.Nil(t, err)
+	assert.Equal(t, album.Version+1, trashed.Version)
+	albums, err = repo.DeleteOwnedBy(ctx, "user1", deleted)
+	assert.Nil(t, err)
+	assert.Empty(t, albums)
+	for i := 1; i <= 4; i++ {
+		assert.Nil(t, repo.Restore(ctx, fmt.Sprintf("test%d", i)))
+	}
+
+	// purge
+	assert.Nil(t, repo.Delete(ctx, "test1", AnyVersion, deleted))
+	albums, err = repo.Purge(ctx, deleted)
+	assert.Nil(t, err)
+	assert.Empty(t, albums)
+	_, err = repo.GetTrashed(ctx, "test1")
+	assert.Nil(t, err)
+	albums, err = repo.Purge(ctx, deleted.Add(time.Second))
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(albums)) {
+		assert.Equal(t, "test1", albums[0].ID)
+	}
+	_, err = repo.GetTrashed(ctx, "test1")
 	assert.Equal(t, sql.ErrNoRows, err)
 }
+
+func TestFilter_orderBy(t *testing.T) {
+	tests := []struct {
+		name string
+		sort []string
+		want []string
+	}{
+		{"default", nil, []string{"id"}},
+		{"fields", []string{"-created_at", "name"}, []string{"created_at DESC", "name ASC", "id"}},
+		{"id", []string{"name", "-id", "created_at"}, []string{"name ASC", "id DESC"}},
+		{"unknown", []string{"name; DROP TABLE album", "-owner_id"}, []string{"id"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, Filter{Sort: tt.sort}.orderBy())
+		})
+	}
+}
+
+func TestFilter_expression(t *testing.T) {
+	db := dbx.NewFromDB(nil, "postgres")
+	assert.Equal(t, `deleted_at IS NULL`, Filter{All: true}.expression().Build(db, dbx.Params{}))
+	assert.Equal(t, `(deleted_at IS NULL) AND ("visibility"={:p0})`, Filter{}.expression().Build(db, dbx.Params{}))
+	params := dbx.Params{}
+	assert.Equal(t, `(deleted_at IS NOT NULL) AND ("owner_id"={:p0})`,
+		Filter{ViewerID: "100", Trashed: true}.expression().Build(db, params))
+	assert.Equal(t, dbx.Params{"p0": "100"}, params)
+	assert.Equal(t, `deleted_at IS NOT NULL`, Filter{All: true, Trashed: true}.expression().Build(db, dbx.Params{}))
+}
+
+func TestFilter_keyset(t *testing.T) {
+	db := dbx.NewFromDB(nil, "postgres")
+	created := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	filter := Filter{Sort: []string{"-created_at", "name"}}
+	key := filter.cursorKey(entity.Album{ID: "123", Name: "album", CreatedAt: created})
+	assert.Equal(t, []string{"2026-10-16T12:00:00Z", "album", "123"}, key)
+
+	filter.Cursor = &pagination.Cursor{Key: key}
+	exp, err := filter.keyset()
+	assert.Nil(t, err)
+	params := dbx.Params{}
+	assert.Equal(t, "(created_at < {:key0}) OR (created_at = {:key0} AND name > {:key1}) OR "+
+		"(created_at = {:key0} AND name = {:key1} AND id > {:key2})", exp.Build(db, params))
+	assert.Equal(t, dbx.Params{"key0": created, "key1": "album", "key2": "123"}, params)
+
+	filter.Cursor.Backward = true
+	exp, _ = filter.keyset()
+	assert.Equal(t, "(created_at > {:key0}) OR (created_at = {:key0} AND name < {:key1}) OR "+
+		"(created_at = {:key0} AND name = {:key1} AND id < {:key2})", exp.Build(db, dbx.Params{}))
+
+	// the key must match the sort order
+	filter.Cursor = &pagination.Cursor{Key: []string{"123"}}
+	_, err = filter.keyset()
+	assert.Equal(t, pagination.ErrInvalidCursor, err)
+}
@@ -1,21 +1,75 @@
 package album
 
 import (
+	"bytes"
 	"context"
+	"database/sql"
+	"encoding/json"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/garaekz/priv8/internal/audit"
+	"github.com/garaekz/priv8/internal/auth"
 	"github.com/garaekz/priv8/internal/entity"
+	"github.com/garaekz/priv8/internal/errors"
+	"github.com/garaekz/priv8/pkg/dbcontext"
+	"github.com/garaekz/priv8/pkg/jsonpatch"
 	"github.com/garaekz/priv8/pkg/log"
+	"github.com/garaekz/priv8/pkg/pagination"
 	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"strings"
 	"time"
 )
 
 // Service encapsulates usecase logic for albums.
+//
+// Private albums are only visible to their owners and the users they are shared with. Albums can be updated by
+// their owners and the users granted entity.AlbumEditor access, while only the owners can delete and share them.
+// Users with auth.PermissionAlbumManage have the same access as the owners to every album.
 type Service interface {
 	Get(ctx context.Context, id string) (Album, error)
-	Query(ctx context.Context, offset, limit int) ([]Album, error)
-	Count(ctx context.Context) (int, error)
+	// Query returns the albums listed for the current user that satisfy the given request,
+	// with the specified offset and limit.
+	Query(ctx context.Context, input QueryAlbumsRequest, offset, limit int) ([]Album, error)
+	// Count returns the number of albums listed for the current user that satisfy the given request.
+	Count(ctx context.Context, input QueryAlbumsRequest) (int, error)
 	Create(ctx context.Context, input CreateAlbumRequest) (Album, error)
-	Update(ctx context.Context, id string, input UpdateAlbumRequest) (Album, error)
-	Delete(ctx context.Context, id string) (Album, error)
+	// Update updates the album with the specified ID if its current version is the given version.
+	// errors.PreconditionFailed is returned if the album has been changed since. AnyVersion skips the check.
+	Update(ctx context.Context, id string, version int, input UpdateAlbumRequest) (Album, error)
+	// Patch applies a patch to the editable fields of the album with the specified ID, which are those
+	// of UpdateAlbumRequest, and updates the album like Update.
+	Patch(ctx context.Context, id string, version int, patch jsonpatch.Patch) (Album, error)
+	// Delete moves the album with the specified ID to the trash if its current version is the given version.
+	// Albums in the trash are only listed with a QueryAlbumsRequest for the trash, and can be restored
+	// until they are purged.
+	Delete(ctx context.Context, id string, version int) (Album, error)
+	// Restore moves the album with the specified ID out of the trash.
+	Restore(ctx context.Context, id string) (Album, error)
+	// DeleteOwnedBy moves the albums owned by the user with the specified ID to the trash.
+	DeleteOwnedBy(ctx context.Context, ownerID string) error
+
+	// QueryGrants returns the users that the album with the specified ID is shared with.
+	QueryGrants(ctx context.Context, id string) ([]entity.AlbumGrant, error)
+	// SaveGrant shares the album with the specified ID with a user, or changes the access level of the user.
+	SaveGrant(ctx context.Context, id, userID string, input GrantRequest) (entity.AlbumGrant, error)
+	// DeleteGrant stops sharing the album with the specified ID with a user.
+	DeleteGrant(ctx context.Context, id, userID string) error
+	// QueryShareLinks returns the share links of the album with the specified ID.
+	QueryShareLinks(ctx context.Context, id string) ([]ShareLink, error)
+	// CreateShareLink creates a share link for the album with the specified ID.
+	CreateShareLink(ctx context.Context, id string, input CreateShareLinkRequest) (ShareLink, error)
+	// DeleteShareLink revokes a share link of the album with the specified ID.
+	DeleteShareLink(ctx context.Context, id, linkID string) error
+	// GetShared returns the album that the given share link token gives access to.
+	GetShared(ctx context.Context, token, password string) (Album, error)
+}
+
+// TokenSigner signs and verifies the tokens of share links. It is implemented by auth.KeyRing.
+// Its key must not be rotated like the JWT keys, or the share links would stop working long before they expire.
+type TokenSigner interface {
+	// Sign signs the given claims and returns the encoded token.
+	Sign(claims jwt.Claims) (string, error)
+	// Parse verifies the given token and returns its claims.
+	Parse(token string) (jwt.MapClaims, error)
 }
 
 // Album represents the data about an album.
@@ -23,107 +77,313 @@ type Album struct {
 	entity.Album
 }
 
+// AnyVersion can be given to Service.Update and Service.Delete to change an album regardless of its version.
+const AnyVersion = 0
+
+// Types of the resources whose changes are recorded in the audit log.
+const (
+	auditResource      = "album"
+	auditGrantResource = "album_grant"
+	auditLinkResource  = "share_link"
+)
+
+// visibilityRule validates the visibility of an album.
+var visibilityRule = validation.In(entity.AlbumPrivate, entity.AlbumUnlisted, entity.AlbumPublic)
+
 // CreateAlbumRequest represents an album creation request.
 type CreateAlbumRequest struct {
 	Name string `json:"name"`
+	// Visibility defaults to entity.AlbumPrivate.
+	Visibility string `json:"visibility"`
 }
 
 // Validate validates the CreateAlbumRequest fields.
 func (m CreateAlbumRequest) Validate() error {
 	return validation.ValidateStruct(&m,
 		validation.Field(&m.Name, validation.Required, validation.Length(0, 128)),
+		validation.Field(&m.Visibility, visibilityRule),
+	)
+}
+
+// QueryAlbumsRequest represents the filters and the sort order of an album list request.
+// Empty fields do not filter the albums.
+type QueryAlbumsRequest struct {
+	// Sort lists the fields that the albums are sorted by, each prefixed with "-" for a descending order.
+	Sort []string `json:"sort"`
+	// NameContains selects the albums whose names contain the given text, ignoring case.
+	NameContains string `json:"name_contains"`
+	// Search selects the albums whose names contain every word of the given text, ignoring case.
+	Search string `json:"q"`
+	// CreatedAfter and CreatedBefore select the albums created after CreatedAfter and before CreatedBefore.
+	CreatedAfter  time.Time `json:"created_after"`
+	CreatedBefore time.Time `json:"created_before"`
+	// Cursor, if set, selects the albums after or before a position in the sort order instead of an offset.
+	Cursor *pagination.Cursor `json:"-"`
+	// Trashed lists the albums in the trash of the current user instead, which are the deleted albums
+	// that the user owns.
+	Trashed bool `json:"-"`
+}
+
+// Validate validates the QueryAlbumsRequest fields.
+func (m QueryAlbumsRequest) Validate() error {
+	return validation.ValidateStruct(&m,
+		validation.Field(&m.Sort, validation.Each(validation.By(validateSortField))),
+		validation.Field(&m.NameContains, validation.Length(0, 128)),
+		validation.Field(&m.Search, validation.Length(0, 128)),
 	)
 }
 
+// validateSortField checks that a sort field is one of sortFields, optionally prefixed with "-".
+func validateSortField(value interface{}) error {
+	field, _ := value.(string)
+	field = strings.TrimPrefix(field, "-")
+	for _, f := range sortFields {
+		if field == f {
+			return nil
+		}
+	}
+	return validation.NewError("validation_sort_invalid", "must be one of "+strings.Join(sortFields, ", ")+
+		", optionally prefixed with -")
+}
+
 // UpdateAlbumRequest represents an album update request.
 type UpdateAlbumRequest struct {
 	Name string `json:"name"`
+	// Visibility is left unchanged if it is empty.
+	Visibility string `json:"visibility"`
 }
 
 // Validate validates the CreateAlbumRequest fields.
 func (m UpdateAlbumRequest) Validate() error {
 	return validation.ValidateStruct(&m,
 		validation.Field(&m.Name, validation.Required, validation.Length(0, 128)),
+		validation.Field(&m.Visibility, visibilityRule),
 	)
 }
 
 type service struct {
-	repo   Repository
-	logger log.Logger
+	repo          Repository
+	shareRepo     ShareRepository
+	signer        TokenSigner
+	auditor       audit.Recorder
+	transactional dbcontext.TransactionFunc
+	logger        log.Logger
 }
 
 // NewService creates a new album service.
-func NewService(repo Repository, logger log.Logger) Service {
-	return service{repo, logger}
+// Every change is recorded with the auditor in the transaction that makes the change.
+func NewService(repo Repository, shareRepo ShareRepository, signer TokenSigner, auditor audit.Recorder,
+	transactional dbcontext.TransactionFunc, logger log.Logger) Service {
+	return service{repo, shareRepo, signer, auditor, transactional, logger}
 }
 
 // Get returns the album with the specified the album ID.
+// sql.ErrNoRows is returned if the album is not visible to the current user.
 func (s service) Get(ctx context.Context, id string) (Album, error) {
-	album, err := s.repo.Get(ctx, id)
-	if err != nil {
-		return Album{}, err
-	}
-	return Album{album}, nil
+	return s.getWithAccess(ctx, id, accessView)
 }
 
-// Create creates a new album.
+// Create creates a new album owned by the current user.
 func (s service) Create(ctx context.Context, req CreateAlbumRequest) (Album, error) {
 	if err := req.Validate(); err != nil {
 		return Album{}, err
 	}
+	user := auth.CurrentUser(ctx)
+	if user == nil {
+		return Album{}, errors.Unauthorized("")
+	}
+	ownerID := user.GetID()
+	if req.Visibility == "" {
+		req.Visibility = entity.AlbumPrivate
+	}
 	id := entity.GenerateID()
 	now := time.Now()
-	err := s.repo.Create(ctx, entity.Album{
-		ID:        id,
-		Name:      req.Name,
-		CreatedAt: now,
-		UpdatedAt: now,
+	var album Album
+	err := s.transactional(ctx, func(ctx context.Context) error {
+		err := s.repo.Create(ctx, entity.Album{
+			ID:         id,
+			Name:       req.Name,
+			OwnerID:    &ownerID,
+			Visibility: req.Visibility,
+			CreatedAt:  now,
+			UpdatedAt:  now,
+			Version:    1,
+		})
+		if err != nil {
+			return err
+		}
+		if album, err = s.Get(ctx, id); err != nil {
+			return err
+		}
+		return s.auditor.Record(ctx, entity.AuditCreate, auditResource, id, nil, album)
 	})
-	if err != nil {
-		return Album{}, err
-	}
-	return s.Get(ctx, id)
+	return album, err
 }
 
 // Update updates the album with the specified ID.
-func (s service) Update(ctx context.Context, id string, req UpdateAlbumRequest) (Album, error) {
+func (s service) Update(ctx context.Context, id string, version int, req UpdateAlbumRequest) (Album, error) {
 	if err := req.Validate(); err != nil {
 		return Album{}, err
 	}
 
-	album, err := s.Get(ctx, id)
+	album, err := s.getWithAccess(ctx, id, accessEdit)
 	if err != nil {
 		return album, err
 	}
+	return s.update(ctx, album, version, req)
+}
+
+// Patch applies a patch to the album with the specified ID.
+func (s service) Patch(ctx context.Context, id string, version int, patch jsonpatch.Patch) (Album, error) {
+	album, err := s.getWithAccess(ctx, id, accessEdit)
+	if err != nil {
+		return album, err
+	}
+
+	doc, err := json.Marshal(UpdateAlbumRequest{Name: album.Name, Visibility: album.Visibility})
+	if err != nil {
+		return Album{}, err
+	}
+	if doc, err = patch.Apply(doc); err != nil {
+		return Album{}, errors.BadRequest("The patch cannot be applied: " + err.Error())
+	}
+	var req UpdateAlbumRequest
+	decoder := json.NewDecoder(bytes.NewReader(doc))
+	// the fields that cannot be updated, such as the ID, cannot be patched either
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		return Album{}, errors.BadRequest("The patched album is invalid: " + err.Error())
+	}
+	if err := req.Validate(); err != nil {
+		return Album{}, err
+	}
+	return s.update(ctx, album, version, req)
+}
+
+// update saves the changes of a validated request to the given album if the album is at the given version.
+// Only the owners can change the visibility, as publishing an album is a way of sharing it.
+func (s service) update(ctx context.Context, album Album, version int, req UpdateAlbumRequest) (Album, error) {
+	if !matchesVersion(album, version) {
+		return Album{}, errors.PreconditionFailed("")
+	}
+	if req.Visibility != "" && req.Visibility != album.Visibility {
+		if access, err := s.access(ctx, album.Album); err != nil {
+			return Album{}, err
+		} else if access < accessOwn {
+			return Album{}, errors.Forbidden("Only the owner can change the visibility of the album.")
+		}
+	}
+	before := album
 	album.Name = req.Name
+	if req.Visibility != "" {
+		album.Visibility = req.Visibility
+	}
 	album.UpdatedAt = time.Now()
 
-	if err := s.repo.Update(ctx, album.Album); err != nil {
-		return album, err
+	err := s.transactional(ctx, func(ctx context.Context) error {
+		// the album may have been changed by another request since it was read
+		if err := s.repo.Update(ctx, album.Album); err == ErrVersionConflict {
+			return errors.PreconditionFailed("")
+		} else if err != nil {
+			return err
+		}
+		album.Version++
+		return s.auditor.Record(ctx, entity.AuditUpdate, auditResource, album.ID, before, album)
+	})
+	if err != nil {
+		return Album{}, err
 	}
 	return album, nil
 }
 
-// Delete deletes the album with the specified ID.
-func (s service) Delete(ctx context.Context, id string) (Album, error) {
-	album, err := s.Get(ctx, id)
+// Delete moves the album with the specified ID to the trash.
+func (s service) Delete(ctx context.Context, id string, version int) (Album, error) {
+	album, err := s.getWithAccess(ctx, id, accessOwn)
 	if err != nil {
 		return Album{}, err
 	}
-	if err = s.repo.Delete(ctx, id); err != nil {
+	if !matchesVersion(album, version) {
+		return Album{}, errors.PreconditionFailed("")
+	}
+	now := time.Now()
+	err = s.transactional(ctx, func(ctx context.Context) error {
+		// the album may have been changed by another request since it was read
+		if err := s.repo.Delete(ctx, id, version, now); err == ErrVersionConflict {
+			return errors.PreconditionFailed("")
+		} else if err != nil {
+			return err
+		}
+		return s.auditor.Record(ctx, entity.AuditDelete, auditResource, id, album, nil)
+	})
+	if err != nil {
 		return Album{}, err
 	}
+	album.DeletedAt = &now
 	return album, nil
 }
 
-// Count returns the number of albums.
-func (s service) Count(ctx context.Context) (int, error) {
-	return s.repo.Count(ctx)
+// DeleteOwnedBy moves the albums owned by the user with the specified ID to the trash, as when the user deletes
+// their account. Each album is recorded in the audit log as deleted by the current user.
+func (s service) DeleteOwnedBy(ctx context.Context, ownerID string) error {
+	return s.transactional(ctx, func(ctx context.Context) error {
+		albums, err := s.repo.DeleteOwnedBy(ctx, ownerID, time.Now())
+		if err != nil {
+			return err
+		}
+		for _, album := range albums {
+			if err := s.auditor.Record(ctx, entity.AuditDelete, auditResource, album.ID, Album{album}, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
-// Query returns the albums with the specified offset and limit.
-func (s service) Query(ctx context.Context, offset, limit int) ([]Album, error) {
-	items, err := s.repo.Query(ctx, offset, limit)
+// Restore moves the album with the specified ID out of the trash. Only the owners can restore albums.
+// sql.ErrNoRows is returned if the album is not in the trash of the current user.
+func (s service) Restore(ctx context.Context, id string) (Album, error) {
+	trashed, err := s.repo.GetTrashed(ctx, id)
+	if err != nil {
+		return Album{}, err
+	}
+	if access, err := s.access(ctx, trashed); err != nil {
+		return Album{}, err
+	} else if access < accessOwn {
+		return Album{}, sql.ErrNoRows
+	}
+	album := Album{trashed}
+	album.DeletedAt = nil
+	err = s.transactional(ctx, func(ctx context.Context) error {
+		if err := s.repo.Restore(ctx, id); err != nil {
+			return err
+		}
+		return s.auditor.Record(ctx, entity.AuditRestore, auditResource, id, Album{trashed}, album)
+	})
+	if err != nil {
+		return Album{}, err
+	}
+	return album, nil
+}
+
+// matchesVersion reports whether the album is at the given version. Every version matches AnyVersion.
+func matchesVersion(album Album, version int) bool {
+	return version == AnyVersion || album.Version == version
+}
+
+// Count returns the number of albums listed for the current user that satisfy the request.
+func (s service) Count(ctx context.Context, req QueryAlbumsRequest) (int, error) {
+	if err := req.Validate(); err != nil {
+		return 0, err
+	}
+	return s.repo.Count(ctx, listFilter(ctx, req))
+}
+
+// Query returns the albums listed for the current user that satisfy the request with the specified offset and limit.
+func (s service) Query(ctx context.Context, req QueryAlbumsRequest, offset, limit int) ([]Album, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	items, err := s.repo.Query(ctx, listFilter(ctx, req), offset, limit)
 	if err != nil {
 		return nil, err
 	}
@@ -133,3 +393,81 @@ func (s service) Query(ctx context.Context, offset, limit int) ([]Album, error)
 	}
 	return result, nil
 }
+
+// listFilter returns the filter that selects the albums listed for the current user that satisfy the request.
+// The albums listed for a user are the albums owned by or shared with the user and the public albums.
+func listFilter(ctx context.Context, req QueryAlbumsRequest) Filter {
+	filter := Filter{
+		NameContains:  req.NameContains,
+		Search:        req.Search,
+		CreatedAfter:  req.CreatedAfter,
+		CreatedBefore: req.CreatedBefore,
+		Sort:          req.Sort,
+		Cursor:        req.Cursor,
+		Trashed:       req.Trashed,
+	}
+	if auth.HasPermission(ctx, auth.PermissionAlbumManage) {
+		filter.All = true
+	} else if user := auth.CurrentUser(ctx); user != nil {
+		filter.ViewerID = user.GetID()
+	}
+	return filter
+}
+
+// Access levels of the current user to an album. A higher level includes the lower ones.
+const (
+	accessNone = iota
+	accessView
+	accessEdit
+	accessOwn
+)
+
+// access returns the access level of the current user to the given album.
+// Unlisted albums can be viewed by anyone who knows their IDs.
+func (s service) access(ctx context.Context, album entity.Album) (int, error) {
+	if auth.HasPermission(ctx, auth.PermissionAlbumManage) {
+		return accessOwn, nil
+	}
+	access := accessNone
+	if album.Visibility != entity.AlbumPrivate {
+		access = accessView
+	}
+	user := auth.CurrentUser(ctx)
+	if user == nil {
+		return access, nil
+	}
+	if album.IsOwnedBy(user.GetID()) {
+		return accessOwn, nil
+	}
+	grant, err := s.shareRepo.GetGrant(ctx, album.ID, user.GetID())
+	if err == sql.ErrNoRows {
+		return access, nil
+	} else if err != nil {
+		return accessNone, err
+	}
+	if grant.Level == entity.AlbumEditor {
+		return accessEdit, nil
+	}
+	return accessView, nil
+}
+
+// getWithAccess returns the album with the specified ID if the current user has at least the given access level.
+// sql.ErrNoRows is returned if the album is not visible to the current user, and errors.Forbidden
+// if the album is visible but the access level is too low.
+func (s service) getWithAccess(ctx context.Context, id string, required int) (Album, error) {
+	album, err := s.repo.Get(ctx, id)
+	if err != nil {
+		return Album{}, err
+	}
+	access, err := s.access(ctx, album)
+	if err != nil {
+		return Album{}, err
+	}
+	if access < accessView {
+		return Album{}, sql.ErrNoRows
+	}
+	if access < required {
+		return Album{}, errors.Forbidden("")
+	}
+	return Album{album}, nil
+}
@@ -3,15 +3,25 @@ package album
 import (
 	"context"
 	"database/sql"
-	"errors"
+	"fmt"
+	"net/http"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/garaekz/priv8/internal/auth"
 	"github.com/garaekz/priv8/internal/entity"
+	"github.com/garaekz/priv8/internal/errors"
+	"github.com/garaekz/priv8/pkg/jsonpatch"
 	"github.com/garaekz/priv8/pkg/log"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
 	"github.com/stretchr/testify/assert"
 )
 
-var errCRUD = errors.New("error crud")
+var errCRUD = fmt.Errorf("error crud")
+
+// testSigner signs the tokens of share links in tests.
+var testSigner = auth.NewKeyRing(auth.NewHMACKey("test"))
 
 func TestCreateAlbumRequest_Validate(t *testing.T) {
 	tests := []struct {
@@ -20,6 +30,8 @@ func TestCreateAlbumRequest_Validate(t *testing.T) {
 		wantError bool
 	}{
 		{"success", CreateAlbumRequest{Name: "test"}, false},
+		{"visibility", CreateAlbumRequest{Name: "test", Visibility: entity.AlbumPublic}, false},
+		{"invalid visibility", CreateAlbumRequest{Name: "test", Visibility: "secret"}, true},
 		{"required", CreateAlbumRequest{Name: ""}, true},
 		{"too long", CreateAlbumRequest{Name: "1234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890"}, true},
 	}
@@ -31,6 +43,27 @@ func TestCreateAlbumRequest_Validate(t *testing.T) {
 	}
 }
 
+func TestQueryAlbumsRequest_Validate(t *testing.T) {
+	tests := []struct {
+		name      string
+		model     QueryAlbumsRequest
+		wantError bool
+	}{
+		{"empty", QueryAlbumsRequest{}, false},
+		{"success", QueryAlbumsRequest{Sort: []string{"-created_at", "name"}, NameContains: "trip", Search: "summer trip"}, false},
+		{"unknown sort field", QueryAlbumsRequest{Sort: []string{"owner_id"}}, true},
+		{"empty sort field", QueryAlbumsRequest{Sort: []string{"name", ""}}, true},
+		{"name too long", QueryAlbumsRequest{NameContains: strings.Repeat("a", 129)}, true},
+		{"search too long", QueryAlbumsRequest{Search: strings.Repeat("a", 129)}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.model.Validate()
+			assert.Equal(t, tt.wantError, err != nil)
+		})
+	}
+}
+
 func TestUpdateAlbumRequest_Validate(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -38,6 +71,8 @@ func TestUpdateAlbumRequest_Validate(t *testing.T) {
 		wantError bool
 	}{
 		{"success", UpdateAlbumRequest{Name: "test"}, false},
+		{"visibility", UpdateAlbumRequest{Name: "test", Visibility: entity.AlbumUnlisted}, false},
+		{"invalid visibility", UpdateAlbumRequest{Name: "test", Visibility: "secret"}, true},
 		{"required", UpdateAlbumRequest{Name: ""}, true},
 		{"too long", UpdateAlbumRequest{Name: "1234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890"}, true},
 	}
@@ -51,12 +86,13 @@ func TestUpdateAlbumRequest_Validate(t *testing.T) {
 
 func Test_service_CRUD(t *testing.T) {
 	logger, _ := log.NewForTest()
-	s := NewService(&mockRepository{}, logger)
+	auditor := &mockAuditor{}
+	s := NewService(&mockRepository{}, &mockShareRepository{}, testSigner, auditor, withoutTransaction, logger)
 
-	ctx := context.Background()
+	ctx := auth.WithUser(context.Background(), "100", "test", auth.RoleUser)
 
 	// initial count
-	count, _ := s.Count(ctx)
+	count, _ := s.Count(ctx, QueryAlbumsRequest{})
 	assert.Equal(t, 0, count)
 
 	// successful creation
@@ -65,42 +101,54 @@ func Test_service_CRUD(t *testing.T) {
 	assert.NotEmpty(t, album.ID)
 	id := album.ID
 	assert.Equal(t, "test", album.Name)
+	assert.True(t, album.IsOwnedBy("100"))
+	assert.Equal(t, entity.AlbumPrivate, album.Visibility)
 	assert.NotEmpty(t, album.CreatedAt)
 	assert.NotEmpty(t, album.UpdatedAt)
-	count, _ = s.Count(ctx)
+	assert.Equal(t, 1, album.Version)
+	count, _ = s.Count(ctx, QueryAlbumsRequest{})
 	assert.Equal(t, 1, count)
 
 	// validation error in creation
 	_, err = s.Create(ctx, CreateAlbumRequest{Name: ""})
 	assert.NotNil(t, err)
-	count, _ = s.Count(ctx)
+	count, _ = s.Count(ctx, QueryAlbumsRequest{})
 	assert.Equal(t, 1, count)
 
 	// unexpected error in creation
 	_, err = s.Create(ctx, CreateAlbumRequest{Name: "error"})
 	assert.Equal(t, errCRUD, err)
-	count, _ = s.Count(ctx)
+	count, _ = s.Count(ctx, QueryAlbumsRequest{})
 	assert.Equal(t, 1, count)
 
 	_, _ = s.Create(ctx, CreateAlbumRequest{Name: "test2"})
 
 	// update
-	album, err = s.Update(ctx, id, UpdateAlbumRequest{Name: "test updated"})
+	album, err = s.Update(ctx, id, 1, UpdateAlbumRequest{Name: "test updated"})
 	assert.Nil(t, err)
 	assert.Equal(t, "test updated", album.Name)
-	_, err = s.Update(ctx, "none", UpdateAlbumRequest{Name: "test updated"})
+	assert.Equal(t, 2, album.Version)
+	_, err = s.Update(ctx, "none", AnyVersion, UpdateAlbumRequest{Name: "test updated"})
 	assert.NotNil(t, err)
 
 	// validation error in update
-	_, err = s.Update(ctx, id, UpdateAlbumRequest{Name: ""})
+	_, err = s.Update(ctx, id, AnyVersion, UpdateAlbumRequest{Name: ""})
 	assert.NotNil(t, err)
-	count, _ = s.Count(ctx)
+	count, _ = s.Count(ctx, QueryAlbumsRequest{})
 	assert.Equal(t, 2, count)
 
+	// update of an outdated version
+	_, err = s.Update(ctx, id, 1, UpdateAlbumRequest{Name: "test outdated"})
+	assert.Equal(t, errors.PreconditionFailed(""), err)
+
+	// concurrent update between the read and the write
+	_, err = s.Update(ctx, id, AnyVersion, UpdateAlbumRequest{Name: "conflict"})
+	assert.Equal(t, errors.PreconditionFailed(""), err)
+
 	// unexpected error in update
-	_, err = s.Update(ctx, id, UpdateAlbumRequest{Name: "error"})
+	_, err = s.Update(ctx, id, AnyVersion, UpdateAlbumRequest{Name: "error"})
 	assert.Equal(t, errCRUD, err)
-	count, _ = s.Count(ctx)
+	count, _ = s.Count(ctx, QueryAlbumsRequest{})
 	assert.Equal(t, 2, count)
 
 	// get
@@ -110,40 +158,356 @@ func Test_service_CRUD(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, "test updated", album.Name)
 	assert.Equal(t, id, album.ID)
+	assert.Equal(t, 2, album.Version)
 
 	// query
-	albums, _ := s.Query(ctx, 0, 0)
+	albums, _ := s.Query(ctx, QueryAlbumsRequest{}, 0, 0)
 	assert.Equal(t, 2, len(albums))
+	albums, _ = s.Query(ctx, QueryAlbumsRequest{NameContains: "UPDATED", Sort: []string{"-created_at"}}, 0, 0)
+	assert.Equal(t, 1, len(albums))
+	count, _ = s.Count(ctx, QueryAlbumsRequest{NameContains: "UPDATED"})
+	assert.Equal(t, 1, count)
+	_, err = s.Query(ctx, QueryAlbumsRequest{Sort: []string{"owner_id"}}, 0, 0)
+	assert.IsType(t, validation.Errors{}, err)
+	_, err = s.Count(ctx, QueryAlbumsRequest{Sort: []string{"--name"}})
+	assert.IsType(t, validation.Errors{}, err)
 
 	// delete
-	_, err = s.Delete(ctx, "none")
+	_, err = s.Delete(ctx, "none", AnyVersion)
 	assert.NotNil(t, err)
-	album, err = s.Delete(ctx, id)
+	_, err = s.Delete(ctx, id, 1)
+	assert.Equal(t, errors.PreconditionFailed(""), err)
+	album, err = s.Delete(ctx, id, 2)
 	assert.Nil(t, err)
 	assert.Equal(t, id, album.ID)
-	count, _ = s.Count(ctx)
+	assert.NotNil(t, album.DeletedAt)
+	count, _ = s.Count(ctx, QueryAlbumsRequest{})
 	assert.Equal(t, 1, count)
+	_, err = s.Get(ctx, id)
+	assert.Equal(t, sql.ErrNoRows, err)
+	_, err = s.Delete(ctx, id, AnyVersion)
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	// trash and restore
+	trash, err := s.Query(ctx, QueryAlbumsRequest{Trashed: true}, 0, 0)
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(trash)) {
+		assert.Equal(t, id, trash[0].ID)
+	}
+	album, err = s.Restore(ctx, id)
+	assert.Nil(t, err)
+	assert.Nil(t, album.DeletedAt)
+	_, err = s.Restore(ctx, id)
+	assert.Equal(t, sql.ErrNoRows, err)
+	count, _ = s.Count(ctx, QueryAlbumsRequest{Trashed: true})
+	assert.Equal(t, 0, count)
+	count, _ = s.Count(ctx, QueryAlbumsRequest{})
+	assert.Equal(t, 2, count)
+
+	// every change is audited, but failed ones
+	if assert.Equal(t, 5, len(auditor.records)) {
+		assert.Equal(t, entity.AuditRecord{Action: entity.AuditCreate, ResourceType: "album", ResourceID: id, ActorID: "100"},
+			auditor.records[0].AuditRecord)
+		assert.Nil(t, auditor.records[0].before)
+		assert.Equal(t, entity.AuditUpdate, auditor.records[2].Action)
+		assert.Equal(t, "test", auditor.records[2].before.(Album).Name)
+		assert.Equal(t, "test updated", auditor.records[2].after.(Album).Name)
+		assert.Equal(t, entity.AuditDelete, auditor.records[3].Action)
+		assert.Nil(t, auditor.records[3].after)
+		assert.Equal(t, entity.AuditRestore, auditor.records[4].Action)
+		assert.NotNil(t, auditor.records[4].before.(Album).DeletedAt)
+		assert.Nil(t, auditor.records[4].after.(Album).DeletedAt)
+	}
+
+	// anonymous creation
+	_, err = s.Create(context.Background(), CreateAlbumRequest{Name: "test"})
+	assert.NotNil(t, err)
+}
+
+func Test_service_DeleteConflict(t *testing.T) {
+	logger, _ := log.NewForTest()
+	owner := "100"
+	repo := &mockRepository{items: []entity.Album{{ID: "123", Name: "album123", OwnerID: &owner, Version: 2}}}
+	auditor := &mockAuditor{}
+	s := NewService(staleRepository{repo}, &mockShareRepository{}, testSigner, auditor, withoutTransaction, logger)
+	ctx := auth.WithUser(context.Background(), "100", "test", auth.RoleUser)
+
+	// the album was updated after it was read, so the version that was read is no longer current
+	_, err := s.Delete(ctx, "123", 1)
+	assert.Equal(t, errors.PreconditionFailed(""), err)
+	assert.Nil(t, repo.items[0].DeletedAt)
+	assert.Empty(t, auditor.records)
+
+	_, err = s.Delete(ctx, "123", AnyVersion)
+	assert.Nil(t, err)
+	assert.NotNil(t, repo.items[0].DeletedAt)
+}
+
+func Test_service_DeleteOwnedBy(t *testing.T) {
+	logger, _ := log.NewForTest()
+	owner, other := "100", "101"
+	repo := &mockRepository{items: []entity.Album{
+		{ID: "123", Name: "album123", OwnerID: &owner, Version: 1},
+		{ID: "124", Name: "album124", OwnerID: &other, Version: 1},
+		{ID: "125", Name: "album125", OwnerID: &owner, Version: 2},
+	}}
+	auditor := &mockAuditor{}
+	s := NewService(repo, &mockShareRepository{}, testSigner, auditor, withoutTransaction, logger)
+	ctx := auth.WithUser(context.Background(), owner, "owner", auth.RoleUser)
+
+	assert.Nil(t, s.DeleteOwnedBy(ctx, owner))
+	assert.NotNil(t, repo.items[0].DeletedAt)
+	assert.Nil(t, repo.items[1].DeletedAt)
+	assert.NotNil(t, repo.items[2].DeletedAt)
+	// the versions change so that earlier ETags no longer match once the albums are restored
+	assert.Equal(t, 2, repo.items[0].Version)
+	assert.Equal(t, 3, repo.items[2].Version)
+	if assert.Equal(t, 2, len(auditor.records)) {
+		assert.Equal(t, entity.AuditRecord{ActorID: owner, Action: entity.AuditDelete, ResourceType: "album", ResourceID: "123"},
+			auditor.records[0].AuditRecord)
+		assert.Equal(t, "album123", auditor.records[0].before.(Album).Name)
+		assert.Nil(t, auditor.records[0].after)
+		assert.Equal(t, "125", auditor.records[1].ResourceID)
+	}
+
+	// nothing is left to delete
+	assert.Nil(t, s.DeleteOwnedBy(ctx, owner))
+	assert.Equal(t, 2, len(auditor.records))
+}
+
+func Test_service_Patch(t *testing.T) {
+	logger, _ := log.NewForTest()
+	owner := "100"
+	repo := &mockRepository{items: []entity.Album{
+		{ID: "123", Name: "album123", OwnerID: &owner, Visibility: entity.AlbumPrivate, Version: 1},
+	}}
+	auditor := &mockAuditor{}
+	s := NewService(repo, &mockShareRepository{}, testSigner, auditor, withoutTransaction, logger)
+	ctx := auth.WithUser(context.Background(), owner, "owner", auth.RoleUser)
+
+	mergePatch := func(patch string) jsonpatch.Patch {
+		p, err := jsonpatch.NewMergePatch([]byte(patch))
+		assert.Nil(t, err)
+		return p
+	}
+	jsonPatch := func(patch string) jsonpatch.Patch {
+		p, err := jsonpatch.NewJSONPatch([]byte(patch))
+		assert.Nil(t, err)
+		return p
+	}
+
+	// merge patch of a single field
+	album, err := s.Patch(ctx, "123", 1, mergePatch(`{"visibility":"public"}`))
+	assert.Nil(t, err)
+	assert.Equal(t, "album123", album.Name)
+	assert.Equal(t, entity.AlbumPublic, album.Visibility)
+	assert.Equal(t, 2, album.Version)
+	if assert.Equal(t, 1, len(auditor.records)) {
+		assert.Equal(t, entity.AuditUpdate, auditor.records[0].Action)
+		assert.Equal(t, entity.AlbumPrivate, auditor.records[0].before.(Album).Visibility)
+	}
+
+	// JSON patch with a test
+	album, err = s.Patch(ctx, "123", 2, jsonPatch(`[{"op":"test","path":"/name","value":"album123"},{"op":"replace","path":"/name","value":"renamed"}]`))
+	assert.Nil(t, err)
+	assert.Equal(t, "renamed", album.Name)
+	assert.Equal(t, entity.AlbumPublic, album.Visibility)
+	assert.Equal(t, 3, album.Version)
+
+	// failures
+	_, err = s.Patch(ctx, "123", 2, mergePatch(`{"name":"outdated"}`))
+	assert.Equal(t, errors.PreconditionFailed(""), err)
+	_, err = s.Patch(ctx, "none", AnyVersion, mergePatch(`{"name":"unknown"}`))
+	assert.Equal(t, sql.ErrNoRows, err)
+	_, err = s.Patch(ctx, "123", 3, jsonPatch(`[{"op":"test","path":"/name","value":"album123"}]`))
+	assert.Equal(t, http.StatusBadRequest, err.(errors.ErrorResponse).Status)
+	_, err = s.Patch(ctx, "123", 3, mergePatch(`{"id":"456"}`))
+	assert.Equal(t, http.StatusBadRequest, err.(errors.ErrorResponse).Status)
+	_, err = s.Patch(ctx, "123", 3, mergePatch(`{"name":5}`))
+	assert.Equal(t, http.StatusBadRequest, err.(errors.ErrorResponse).Status)
+	_, err = s.Patch(ctx, "123", 3, mergePatch(`{"name":null}`))
+	assert.IsType(t, validation.Errors{}, err)
+	_, err = s.Patch(ctx, "123", 3, mergePatch(`{"visibility":"secret"}`))
+	assert.IsType(t, validation.Errors{}, err)
+	album, _ = s.Get(ctx, "123")
+	assert.Equal(t, "renamed", album.Name)
+	assert.Equal(t, 3, album.Version)
+	assert.Equal(t, 2, len(auditor.records))
+
+	// only editors can patch an album
+	_, err = s.Patch(auth.WithUser(context.Background(), "101", "other", auth.RoleUser), "123", AnyVersion,
+		mergePatch(`{"name":"hacked"}`))
+	assert.Equal(t, errors.Forbidden(""), err)
+}
+
+func Test_service_Visibility(t *testing.T) {
+	logger, _ := log.NewForTest()
+	owner, other := "100", "101"
+	repo := &mockRepository{items: []entity.Album{
+		{ID: "private", Name: "private", OwnerID: &owner, Visibility: entity.AlbumPrivate},
+		{ID: "unlisted", Name: "unlisted", OwnerID: &owner, Visibility: entity.AlbumUnlisted},
+		{ID: "public", Name: "public", OwnerID: &owner, Visibility: entity.AlbumPublic},
+		{ID: "other", Name: "other", OwnerID: &other, Visibility: entity.AlbumPrivate},
+	}}
+	s := NewService(repo, &mockShareRepository{}, testSigner, &mockAuditor{}, withoutTransaction, logger)
+
+	anonymous := context.Background()
+	ownerCtx := auth.WithUser(context.Background(), owner, "owner", auth.RoleUser)
+	otherCtx := auth.WithUser(context.Background(), other, "other", auth.RoleUser)
+	adminCtx := auth.WithPermissions(auth.WithUser(context.Background(), "102", "admin", auth.RoleAdmin),
+		auth.Permissions(auth.RoleAdmin)...)
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		visible []string
+		listed  []string
+	}{
+		{"anonymous", anonymous, []string{"unlisted", "public"}, []string{"public"}},
+		{"owner", ownerCtx, []string{"private", "unlisted", "public"}, []string{"private", "unlisted", "public"}},
+		{"other", otherCtx, []string{"unlisted", "public", "other"}, []string{"public", "other"}},
+		{"admin", adminCtx, []string{"private", "unlisted", "public", "other"}, []string{"private", "unlisted", "public", "other"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var visible []string
+			for _, item := range repo.items {
+				if _, err := s.Get(tt.ctx, item.ID); err == nil {
+					visible = append(visible, item.ID)
+				} else {
+					assert.Equal(t, sql.ErrNoRows, err)
+				}
+			}
+			assert.Equal(t, tt.visible, visible)
+
+			var listed []string
+			albums, _ := s.Query(tt.ctx, QueryAlbumsRequest{}, 0, 100)
+			for _, album := range albums {
+				listed = append(listed, album.ID)
+			}
+			assert.Equal(t, tt.listed, listed)
+			count, _ := s.Count(tt.ctx, QueryAlbumsRequest{})
+			assert.Equal(t, len(tt.listed), count)
+		})
+	}
+
+	// only the owner and the admin can modify an album
+	_, err := s.Update(otherCtx, "public", AnyVersion, UpdateAlbumRequest{Name: "hacked"})
+	assert.Equal(t, errors.Forbidden(""), err)
+	_, err = s.Delete(otherCtx, "unlisted", AnyVersion)
+	assert.Equal(t, errors.Forbidden(""), err)
+	_, err = s.Delete(otherCtx, "private", AnyVersion)
+	assert.Equal(t, sql.ErrNoRows, err)
+	album, err := s.Update(ownerCtx, "private", AnyVersion, UpdateAlbumRequest{Name: "renamed", Visibility: entity.AlbumPublic})
+	assert.Nil(t, err)
+	assert.Equal(t, entity.AlbumPublic, album.Visibility)
+	album, err = s.Update(adminCtx, "other", AnyVersion, UpdateAlbumRequest{Name: "renamed"})
+	assert.Nil(t, err)
+	assert.Equal(t, entity.AlbumPrivate, album.Visibility)
+	_, err = s.Delete(adminCtx, "other", AnyVersion)
+	assert.Nil(t, err)
+
+	// the trash of a user holds the deleted albums owned by the user, which only the owner and the admin can restore
+	trash, _ := s.Query(ownerCtx, QueryAlbumsRequest{Trashed: true}, 0, 100)
+	assert.Empty(t, trash)
+	trash, _ = s.Query(otherCtx, QueryAlbumsRequest{Trashed: true}, 0, 100)
+	assert.Equal(t, 1, len(trash))
+	trash, _ = s.Query(anonymous, QueryAlbumsRequest{Trashed: true}, 0, 100)
+	assert.Empty(t, trash)
+	_, err = s.Restore(ownerCtx, "other")
+	assert.Equal(t, sql.ErrNoRows, err)
+	_, err = s.Restore(otherCtx, "other")
+	assert.Nil(t, err)
+}
+
+// withoutTransaction runs f as if it was in a transaction.
+func withoutTransaction(ctx context.Context, f func(ctx context.Context) error) error {
+	return f(ctx)
+}
+
+// auditedChange is an audit record together with the resource before and after the change.
+type auditedChange struct {
+	entity.AuditRecord
+	before, after interface{}
+}
+
+type mockAuditor struct {
+	records []auditedChange
+}
+
+func (m *mockAuditor) Record(ctx context.Context, action, resourceType, resourceID string, before, after interface{}) error {
+	record := entity.AuditRecord{
+		Action:       action,
+		ResourceType: resourceType,
+		ResourceID:   resourceID,
+	}
+	if user := auth.CurrentUser(ctx); user != nil {
+		record.ActorID = user.GetID()
+	}
+	m.records = append(m.records, auditedChange{record, before, after})
+	return nil
 }
 
 type mockRepository struct {
 	items []entity.Album
+	// shares provides the grants used to filter the albums in Query, if set.
+	shares *mockShareRepository
 }
 
 func (m mockRepository) Get(_ context.Context, id string) (entity.Album, error) {
 	for _, item := range m.items {
-		if item.ID == id {
+		if item.ID == id && item.DeletedAt == nil {
+			return item, nil
+		}
+	}
+	return entity.Album{}, sql.ErrNoRows
+}
+
+func (m mockRepository) GetTrashed(_ context.Context, id string) (entity.Album, error) {
+	for _, item := range m.items {
+		if item.ID == id && item.DeletedAt != nil {
 			return item, nil
 		}
 	}
 	return entity.Album{}, sql.ErrNoRows
 }
 
-func (m mockRepository) Count(_ context.Context) (int, error) {
-	return len(m.items), nil
+func (m mockRepository) Count(ctx context.Context, filter Filter) (int, error) {
+	items, err := m.Query(ctx, filter, 0, 0)
+	return len(items), err
 }
 
-func (m mockRepository) Query(_ context.Context, _, _ int) ([]entity.Album, error) {
-	return m.items, nil
+// Query returns the albums that satisfy the filter in the order of the items. A cursor is assumed to be created
+// for the default order, which is the order of the items if they are sorted by ID.
+func (m mockRepository) Query(_ context.Context, filter Filter, _, limit int) ([]entity.Album, error) {
+	var items []entity.Album
+	for _, item := range m.items {
+		if cursor := filter.Cursor; cursor != nil && (cursor.Backward && item.ID >= cursor.Key[0] ||
+			!cursor.Backward && item.ID <= cursor.Key[0]) {
+			continue
+		}
+		if !strings.Contains(strings.ToLower(item.Name), strings.ToLower(filter.NameContains)) {
+			continue
+		}
+		if filter.Trashed != (item.DeletedAt != nil) {
+			continue
+		}
+		if filter.Trashed {
+			if filter.All || filter.ViewerID != "" && item.IsOwnedBy(filter.ViewerID) {
+				items = append(items, item)
+			}
+		} else if filter.All || item.Visibility == entity.AlbumPublic || filter.ViewerID != "" && item.IsOwnedBy(filter.ViewerID) ||
+			m.shares != nil && m.shares.hasGrant(item.ID, filter.ViewerID) {
+			items = append(items, item)
+		}
+	}
+	if limit > 0 && len(items) > limit {
+		if filter.Cursor != nil && filter.Cursor.Backward {
+			return items[len(items)-limit:], nil
+		}
+		return items[:limit], nil
+	}
+	return items, nil
 }
 
 func (m *mockRepository) Create(_ context.Context, album entity.Album) error {
@@ -160,20 +524,163 @@ func (m *mockRepository) Update(_ context.Context, album entity.Album) error {
 	}
 	for i, item := range m.items {
 		if item.ID == album.ID {
+			if item.Version != album.Version || album.Name == "conflict" {
+				return ErrVersionConflict
+			}
+			album.Version++
 			m.items[i] = album
-			break
+			return nil
 		}
 	}
-	return nil
+	return ErrVersionConflict
+}
+
+func (m *mockRepository) Delete(_ context.Context, id string, version int, deletedAt time.Time) error {
+	for i, item := range m.items {
+		if item.ID == id && item.DeletedAt == nil {
+			if version != AnyVersion && item.Version != version {
+				return ErrVersionConflict
+			}
+			m.items[i].DeletedAt = &deletedAt
+			return nil
+		}
+	}
+	if version != AnyVersion {
+		return ErrVersionConflict
+	}
+	return sql.ErrNoRows
 }
 
-func (m *mockRepository) Delete(_ context.Context, id string) error {
+func (m *mockRepository) DeleteOwnedBy(_ context.Context, ownerID string, deletedAt time.Time) ([]entity.Album, error) {
+	var albums []entity.Album
 	for i, item := range m.items {
-		if item.ID == id {
-			m.items[i] = m.items[len(m.items)-1]
-			m.items = m.items[:len(m.items)-1]
-			break
+		if item.IsOwnedBy(ownerID) && item.DeletedAt == nil {
+			albums = append(albums, item)
+			m.items[i].DeletedAt = &deletedAt
+			m.items[i].Version++
 		}
 	}
+	return albums, nil
+}
+
+// staleRepository returns the albums as they were before their last update, as if they were read
+// right before a concurrent update.
+type staleRepository struct {
+	*mockRepository
+}
+
+func (m staleRepository) Get(ctx context.Context, id string) (entity.Album, error) {
+	album, err := m.mockRepository.Get(ctx, id)
+	album.Version--
+	return album, err
+}
+
+func (m *mockRepository) Restore(_ context.Context, id string) error {
+	for i, item := range m.items {
+		if item.ID == id && item.DeletedAt != nil {
+			m.items[i].DeletedAt = nil
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (m *mockRepository) Purge(_ context.Context, before time.Time) ([]entity.Album, error) {
+	var items, purged []entity.Album
+	for _, item := range m.items {
+		if item.DeletedAt == nil || !item.DeletedAt.Before(before) {
+			items = append(items, item)
+		} else {
+			purged = append(purged, item)
+		}
+	}
+	m.items = items
+	return purged, nil
+}
+
+type mockShareRepository struct {
+	grants []entity.AlbumGrant
+	links  []entity.ShareLink
+}
+
+func (m *mockShareRepository) hasGrant(albumID, userID string) bool {
+	_, err := m.GetGrant(context.Background(), albumID, userID)
+	return err == nil
+}
+
+func (m *mockShareRepository) GetGrant(_ context.Context, albumID, userID string) (entity.AlbumGrant, error) {
+	for _, grant := range m.grants {
+		if grant.AlbumID == albumID && grant.UserID == userID {
+			return grant, nil
+		}
+	}
+	return entity.AlbumGrant{}, sql.ErrNoRows
+}
+
+func (m *mockShareRepository) QueryGrants(_ context.Context, albumID string) ([]entity.AlbumGrant, error) {
+	var grants []entity.AlbumGrant
+	for _, grant := range m.grants {
+		if grant.AlbumID == albumID {
+			grants = append(grants, grant)
+		}
+	}
+	return grants, nil
+}
+
+func (m *mockShareRepository) SaveGrant(_ context.Context, grant entity.AlbumGrant) error {
+	if grant.UserID == "unknown" {
+		return sql.ErrNoRows
+	}
+	for i, item := range m.grants {
+		if item.AlbumID == grant.AlbumID && item.UserID == grant.UserID {
+			m.grants[i] = grant
+			return nil
+		}
+	}
+	m.grants = append(m.grants, grant)
 	return nil
 }
+
+func (m *mockShareRepository) DeleteGrant(_ context.Context, albumID, userID string) error {
+	for i, grant := range m.grants {
+		if grant.AlbumID == albumID && grant.UserID == userID {
+			m.grants = append(m.grants[:i], m.grants[i+1:]...)
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (m *mockShareRepository) GetLink(_ context.Context, id string) (entity.ShareLink, error) {
+	for _, link := range m.links {
+		if link.ID == id {
+			return link, nil
+		}
+	}
+	return entity.ShareLink{}, sql.ErrNoRows
+}
+
+func (m *mockShareRepository) QueryLinks(_ context.Context, albumID string) ([]entity.ShareLink, error) {
+	var links []entity.ShareLink
+	for _, link := range m.links {
+		if link.AlbumID == albumID {
+			links = append(links, link)
+		}
+	}
+	return links, nil
+}
+
+func (m *mockShareRepository) CreateLink(_ context.Context, link entity.ShareLink) error {
+	m.links = append(m.links, link)
+	return nil
+}
+
+func (m *mockShareRepository) DeleteLink(_ context.Context, id string) error {
+	for i, link := range m.links {
+		if link.ID == id {
+			m.links = append(m.links[:i], m.links[i+1:]...)
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
@@ -0,0 +1,111 @@
+package album
+
+import (
+	"context"
+	"database/sql"
+	"github.com/garaekz/priv8/internal/entity"
+	"github.com/garaekz/priv8/pkg/dbcontext"
+	"github.com/garaekz/priv8/pkg/log"
+	dbx "github.com/go-ozzo/ozzo-dbx"
+)
+
+// ShareRepository encapsulates the logic to access album grants and share links from the data source.
+type ShareRepository interface {
+	// GetGrant returns the grant of the specified album to the specified user.
+	GetGrant(ctx context.Context, albumID, userID string) (entity.AlbumGrant, error)
+	// QueryGrants returns the grants of the specified album.
+	QueryGrants(ctx context.Context, albumID string) ([]entity.AlbumGrant, error)
+	// SaveGrant creates or updates a grant. sql.ErrNoRows is returned if the granted user does not exist.
+	SaveGrant(ctx context.Context, grant entity.AlbumGrant) error
+	// DeleteGrant removes the grant of the specified album to the specified user.
+	DeleteGrant(ctx context.Context, albumID, userID string) error
+	// GetLink returns the share link with the specified ID.
+	GetLink(ctx context.Context, id string) (entity.ShareLink, error)
+	// QueryLinks returns the share links of the specified album.
+	QueryLinks(ctx context.Context, albumID string) ([]entity.ShareLink, error)
+	// CreateLink saves a new share link in the storage.
+	CreateLink(ctx context.Context, link entity.ShareLink) error
+	// DeleteLink removes the share link with the specified ID.
+	DeleteLink(ctx context.Context, id string) error
+}
+
+// shareRepository persists album grants and share links in database
+type shareRepository struct {
+	db     *dbcontext.DB
+	logger log.Logger
+}
+
+// NewShareRepository creates a new album share repository
+func NewShareRepository(db *dbcontext.DB, logger log.Logger) ShareRepository {
+	return shareRepository{db, logger}
+}
+
+// GetGrant reads the grant of the specified album to the specified user from the database.
+func (r shareRepository) GetGrant(ctx context.Context, albumID, userID string) (entity.AlbumGrant, error) {
+	var grant entity.AlbumGrant
+	err := r.db.With(ctx).Select().Where(dbx.HashExp{"album_id": albumID, "user_id": userID}).One(&grant)
+	return grant, err
+}
+
+// QueryGrants reads the grants of the specified album from the database.
+func (r shareRepository) QueryGrants(ctx context.Context, albumID string) ([]entity.AlbumGrant, error) {
+	var grants []entity.AlbumGrant
+	err := r.db.With(ctx).Select().Where(dbx.HashExp{"album_id": albumID}).OrderBy("created_at").All(&grants)
+	return grants, err
+}
+
+// SaveGrant inserts a grant record or updates the level of an existing one in the database.
+func (r shareRepository) SaveGrant(ctx context.Context, grant entity.AlbumGrant) error {
+	var count int
+	err := r.db.With(ctx).Select("COUNT(*)").From("user").Where(dbx.HashExp{"id": grant.UserID}).Row(&count)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return sql.ErrNoRows
+	}
+	_, err = r.db.With(ctx).Upsert("album_grant", dbx.Params{
+		"album_id":   grant.AlbumID,
+		"user_id":    grant.UserID,
+		"level":      grant.Level,
+		"created_at": grant.CreatedAt,
+	}, "album_id", "user_id").Execute()
+	return err
+}
+
+// DeleteGrant deletes the grant of the specified album to the specified user from the database.
+func (r shareRepository) DeleteGrant(ctx context.Context, albumID, userID string) error {
+	grant, err := r.GetGrant(ctx, albumID, userID)
+	if err != nil {
+		return err
+	}
+	return r.db.With(ctx).Model(&grant).Delete()
+}
+
+// GetLink reads the share link with the specified ID from the database.
+func (r shareRepository) GetLink(ctx context.Context, id string) (entity.ShareLink, error) {
+	var link entity.ShareLink
+	err := r.db.With(ctx).Select().Model(id, &link)
+	return link, err
+}
+
+// QueryLinks reads the share links of the specified album from the database.
+func (r shareRepository) QueryLinks(ctx context.Context, albumID string) ([]entity.ShareLink, error) {
+	var links []entity.ShareLink
+	err := r.db.With(ctx).Select().Where(dbx.HashExp{"album_id": albumID}).OrderBy("created_at").All(&links)
+	return links, err
+}
+
+// CreateLink saves a new share link record in the database.
+func (r shareRepository) CreateLink(ctx context.Context, link entity.ShareLink) error {
+	return r.db.With(ctx).Model(&link).Insert()
+}
+
+// DeleteLink deletes the share link with the specified ID from the database.
+func (r shareRepository) DeleteLink(ctx context.Context, id string) error {
+	link, err := r.GetLink(ctx, id)
+	if err != nil {
+		return err
+	}
+	return r.db.With(ctx).Model(&link).Delete()
+}
@@ -0,0 +1,78 @@
+package album
+
+import (
+	"context"
+	"database/sql"
+	"github.com/garaekz/priv8/internal/entity"
+	"github.com/garaekz/priv8/internal/test"
+	"github.com/garaekz/priv8/pkg/log"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestShareRepository(t *testing.T) {
+	logger, _ := log.NewForTest()
+	db := test.DB(t)
+	test.ResetTables(t, db, "album", "user")
+	test.CreateUser(t, db, "user1", "user1")
+	test.CreateUser(t, db, "user2", "user2")
+	owner := "user1"
+	err := NewRepository(db, logger).Create(context.Background(), entity.Album{
+		ID:         "album1",
+		Name:       "album1",
+		OwnerID:    &owner,
+		Visibility: entity.AlbumPrivate,
+		CreatedAt:  time.Now(),
+		UpdatedAt:  time.Now(),
+	})
+	assert.Nil(t, err)
+	repo := NewShareRepository(db, logger)
+
+	ctx := context.Background()
+
+	// grants
+	err = repo.SaveGrant(ctx, entity.AlbumGrant{AlbumID: "album1", UserID: "user2", Level: entity.AlbumViewer, CreatedAt: time.Now()})
+	assert.Nil(t, err)
+	err = repo.SaveGrant(ctx, entity.AlbumGrant{AlbumID: "album1", UserID: "user0", Level: entity.AlbumViewer, CreatedAt: time.Now()})
+	assert.Equal(t, sql.ErrNoRows, err)
+	grant, err := repo.GetGrant(ctx, "album1", "user2")
+	assert.Nil(t, err)
+	assert.Equal(t, entity.AlbumViewer, grant.Level)
+	grant.Level = entity.AlbumEditor
+	assert.Nil(t, repo.SaveGrant(ctx, grant))
+	grants, err := repo.QueryGrants(ctx, "album1")
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(grants)) {
+		assert.Equal(t, entity.AlbumEditor, grants[0].Level)
+	}
+
+	// shared albums are listed for the grantee
+	count, _ := NewRepository(db, logger).Count(ctx, Filter{ViewerID: "user2"})
+	assert.Equal(t, 1, count)
+
+	assert.Nil(t, repo.DeleteGrant(ctx, "album1", "user2"))
+	_, err = repo.GetGrant(ctx, "album1", "user2")
+	assert.Equal(t, sql.ErrNoRows, err)
+	assert.Equal(t, sql.ErrNoRows, repo.DeleteGrant(ctx, "album1", "user2"))
+
+	// links
+	err = repo.CreateLink(ctx, entity.ShareLink{
+		ID:        "link1",
+		AlbumID:   "album1",
+		CreatedBy: "user1",
+		ExpiresAt: time.Now().Add(time.Hour),
+		CreatedAt: time.Now(),
+	})
+	assert.Nil(t, err)
+	link, err := repo.GetLink(ctx, "link1")
+	assert.Nil(t, err)
+	assert.Equal(t, "album1", link.AlbumID)
+	links, err := repo.QueryLinks(ctx, "album1")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(links))
+	assert.Nil(t, repo.DeleteLink(ctx, "link1"))
+	_, err = repo.GetLink(ctx, "link1")
+	assert.Equal(t, sql.ErrNoRows, err)
+	assert.Equal(t, sql.ErrNoRows, repo.DeleteLink(ctx, "link1"))
+}
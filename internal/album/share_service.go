@@ -0,0 +1,272 @@
+package album
+
+import (
+	"context"
+	"database/sql"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/garaekz/priv8/internal/auth"
+	"github.com/garaekz/priv8/internal/entity"
+	"github.com/garaekz/priv8/internal/errors"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"golang.org/x/crypto/bcrypt"
+	"time"
+)
+
+const (
+	// defaultShareLinkLifetime is the lifetime of a share link if none is specified.
+	defaultShareLinkLifetime = 7 * 24 * time.Hour
+	// maxShareLinkLifetime is the maximum lifetime of a share link.
+	maxShareLinkLifetime = 365 * 24 * time.Hour
+)
+
+// ShareLink represents the data about a share link.
+type ShareLink struct {
+	entity.ShareLink
+	// Protected indicates whether the link requires a password.
+	Protected bool `json:"protected"`
+	// Token is the signed token that gives access to the album.
+	Token string `json:"token"`
+}
+
+// GrantRequest represents a request to share an album with a user.
+type GrantRequest struct {
+	Level string `json:"level"`
+}
+
+// Validate validates the GrantRequest fields.
+func (m GrantRequest) Validate() error {
+	return validation.ValidateStruct(&m,
+		validation.Field(&m.Level, validation.Required, validation.In(entity.AlbumViewer, entity.AlbumEditor)),
+	)
+}
+
+// CreateShareLinkRequest represents a share link creation request.
+type CreateShareLinkRequest struct {
+	// ExpiresIn is the lifetime of the link in seconds. It defaults to 7 days.
+	ExpiresIn int `json:"expires_in"`
+	// Password is required to use the link if it is not empty.
+	Password string `json:"password"`
+}
+
+// Validate validates the CreateShareLinkRequest fields.
+func (m CreateShareLinkRequest) Validate() error {
+	return validation.ValidateStruct(&m,
+		validation.Field(&m.ExpiresIn, validation.Min(60), validation.Max(int(maxShareLinkLifetime.Seconds()))),
+		validation.Field(&m.Password, validation.Length(0, 72)),
+	)
+}
+
+// QueryGrants returns the grants of the album with the specified ID.
+func (s service) QueryGrants(ctx context.Context, id string) ([]entity.AlbumGrant, error) {
+	if _, err := s.getWithAccess(ctx, id, accessOwn); err != nil {
+		return nil, err
+	}
+	grants, err := s.shareRepo.QueryGrants(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if grants == nil {
+		grants = []entity.AlbumGrant{}
+	}
+	return grants, nil
+}
+
+// SaveGrant grants the specified user access to the album with the specified ID.
+func (s service) SaveGrant(ctx context.Context, id, userID string, req GrantRequest) (entity.AlbumGrant, error) {
+	if err := req.Validate(); err != nil {
+		return entity.AlbumGrant{}, err
+	}
+	album, err := s.getWithAccess(ctx, id, accessOwn)
+	if err != nil {
+		return entity.AlbumGrant{}, err
+	}
+	if album.IsOwnedBy(userID) {
+		return entity.AlbumGrant{}, errors.BadRequest("The album cannot be shared with its owner.")
+	}
+
+	grant, err := s.shareRepo.GetGrant(ctx, id, userID)
+	var before interface{}
+	action := entity.AuditUpdate
+	if err == sql.ErrNoRows {
+		grant = entity.AlbumGrant{AlbumID: id, UserID: userID, CreatedAt: time.Now()}
+		action = entity.AuditCreate
+	} else if err != nil {
+		return entity.AlbumGrant{}, err
+	} else {
+		before = grant
+	}
+	grant.Level = req.Level
+	err = s.transactional(ctx, func(ctx context.Context) error {
+		if err := s.shareRepo.SaveGrant(ctx, grant); err == sql.ErrNoRows {
+			return errors.NotFound("The user was not found.")
+		} else if err != nil {
+			return err
+		}
+		return s.auditor.Record(ctx, action, auditGrantResource, grantResourceID(grant), before, grant)
+	})
+	if err != nil {
+		return entity.AlbumGrant{}, err
+	}
+	s.logger.With(ctx, "album", id).Infof("album shared with user %v as %v", userID, grant.Level)
+	return grant, nil
+}
+
+// DeleteGrant revokes the access of the specified user to the album with the specified ID.
+func (s service) DeleteGrant(ctx context.Context, id, userID string) error {
+	if _, err := s.getWithAccess(ctx, id, accessOwn); err != nil {
+		return err
+	}
+	grant, err := s.shareRepo.GetGrant(ctx, id, userID)
+	if err != nil {
+		return err
+	}
+	err = s.transactional(ctx, func(ctx context.Context) error {
+		if err := s.shareRepo.DeleteGrant(ctx, id, userID); err != nil {
+			return err
+		}
+		return s.auditor.Record(ctx, entity.AuditDelete, auditGrantResource, grantResourceID(grant), grant, nil)
+	})
+	if err != nil {
+		return err
+	}
+	s.logger.With(ctx, "album", id).Infof("album no longer shared with user %v", userID)
+	return nil
+}
+
+// QueryShareLinks returns the share links of the album with the specified ID, including the expired ones.
+func (s service) QueryShareLinks(ctx context.Context, id string) ([]ShareLink, error) {
+	if _, err := s.getWithAccess(ctx, id, accessOwn); err != nil {
+		return nil, err
+	}
+	items, err := s.shareRepo.QueryLinks(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	result := []ShareLink{}
+	for _, item := range items {
+		link, err := s.newShareLink(item)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, link)
+	}
+	return result, nil
+}
+
+// CreateShareLink creates a share link that gives read access to the album with the specified ID until it expires.
+func (s service) CreateShareLink(ctx context.Context, id string, req CreateShareLinkRequest) (ShareLink, error) {
+	if err := req.Validate(); err != nil {
+		return ShareLink{}, err
+	}
+	if _, err := s.getWithAccess(ctx, id, accessOwn); err != nil {
+		return ShareLink{}, err
+	}
+	user := auth.CurrentUser(ctx)
+	if user == nil {
+		return ShareLink{}, errors.Unauthorized("")
+	}
+
+	lifetime := defaultShareLinkLifetime
+	if req.ExpiresIn > 0 {
+		lifetime = time.Duration(req.ExpiresIn) * time.Second
+	}
+	now := time.Now()
+	link := entity.ShareLink{
+		ID:        entity.GenerateID(),
+		AlbumID:   id,
+		CreatedBy: user.GetID(),
+		ExpiresAt: now.Add(lifetime),
+		CreatedAt: now,
+	}
+	if req.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return ShareLink{}, err
+		}
+		link.PasswordHash = string(hash)
+	}
+	err := s.transactional(ctx, func(ctx context.Context) error {
+		if err := s.shareRepo.CreateLink(ctx, link); err != nil {
+			return err
+		}
+		return s.auditor.Record(ctx, entity.AuditCreate, auditLinkResource, link.ID, nil, link)
+	})
+	if err != nil {
+		return ShareLink{}, err
+	}
+	s.logger.With(ctx, "album", id).Infof("share link %v created", link.ID)
+	return s.newShareLink(link)
+}
+
+// DeleteShareLink revokes the specified share link of the album with the specified ID.
+func (s service) DeleteShareLink(ctx context.Context, id, linkID string) error {
+	if _, err := s.getWithAccess(ctx, id, accessOwn); err != nil {
+		return err
+	}
+	link, err := s.shareRepo.GetLink(ctx, linkID)
+	if err != nil {
+		return err
+	}
+	if link.AlbumID != id {
+		return sql.ErrNoRows
+	}
+	err = s.transactional(ctx, func(ctx context.Context) error {
+		if err := s.shareRepo.DeleteLink(ctx, linkID); err != nil {
+			return err
+		}
+		return s.auditor.Record(ctx, entity.AuditDelete, auditLinkResource, linkID, link, nil)
+	})
+	if err != nil {
+		return err
+	}
+	s.logger.With(ctx, "album", id).Infof("share link %v revoked", linkID)
+	return nil
+}
+
+// GetShared returns the album that the given share link token gives access to.
+// The password is only checked if the link has one.
+func (s service) GetShared(ctx context.Context, token, password string) (Album, error) {
+	invalid := errors.NotFound("The share link is invalid or has expired.")
+	claims, err := s.signer.Parse(token)
+	if err != nil {
+		return Album{}, invalid
+	}
+	linkID, _ := claims["share"].(string)
+	link, err := s.shareRepo.GetLink(ctx, linkID)
+	if err == sql.ErrNoRows {
+		return Album{}, invalid
+	} else if err != nil {
+		return Album{}, err
+	}
+	if !time.Now().Before(link.ExpiresAt) {
+		return Album{}, invalid
+	}
+	if link.PasswordHash != "" &&
+		bcrypt.CompareHashAndPassword([]byte(link.PasswordHash), []byte(password)) != nil {
+		return Album{}, errors.Unauthorized("The share link requires a valid password.")
+	}
+
+	album, err := s.repo.Get(ctx, link.AlbumID)
+	if err != nil {
+		return Album{}, err
+	}
+	return Album{album}, nil
+}
+
+// grantResourceID returns the ID of a grant in the audit log, which combines the IDs of the album and the user.
+func grantResourceID(grant entity.AlbumGrant) string {
+	return grant.AlbumID + "/" + grant.UserID
+}
+
+// newShareLink returns the data about a share link including its signed token.
+// The token only contains the link ID and the expiration time, so that the link can be revoked.
+func (s service) newShareLink(link entity.ShareLink) (ShareLink, error) {
+	token, err := s.signer.Sign(jwt.MapClaims{
+		"share": link.ID,
+		"exp":   link.ExpiresAt.Unix(),
+	})
+	if err != nil {
+		return ShareLink{}, err
+	}
+	return ShareLink{ShareLink: link, Protected: link.PasswordHash != "", Token: token}, nil
+}
@@ -0,0 +1,179 @@
+package album
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/garaekz/priv8/internal/auth"
+	"github.com/garaekz/priv8/internal/entity"
+	"github.com/garaekz/priv8/internal/errors"
+	"github.com/garaekz/priv8/pkg/jsonpatch"
+	"github.com/garaekz/priv8/pkg/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGrantRequest_Validate(t *testing.T) {
+	assert.Nil(t, GrantRequest{Level: entity.AlbumViewer}.Validate())
+	assert.Nil(t, GrantRequest{Level: entity.AlbumEditor}.Validate())
+	assert.NotNil(t, GrantRequest{Level: ""}.Validate())
+	assert.NotNil(t, GrantRequest{Level: "owner"}.Validate())
+}
+
+func TestCreateShareLinkRequest_Validate(t *testing.T) {
+	assert.Nil(t, CreateShareLinkRequest{}.Validate())
+	assert.Nil(t, CreateShareLinkRequest{ExpiresIn: 3600, Password: "secret"}.Validate())
+	assert.NotNil(t, CreateShareLinkRequest{ExpiresIn: 10}.Validate())
+	assert.NotNil(t, CreateShareLinkRequest{ExpiresIn: 400 * 24 * 3600}.Validate())
+}
+
+func Test_service_Grants(t *testing.T) {
+	logger, _ := log.NewForTest()
+	owner := "100"
+	shares := &mockShareRepository{}
+	repo := &mockRepository{items: []entity.Album{
+		{ID: "private", Name: "private", OwnerID: &owner, Visibility: entity.AlbumPrivate},
+	}, shares: shares}
+	auditor := &mockAuditor{}
+	s := NewService(repo, shares, testSigner, auditor, withoutTransaction, logger)
+
+	ownerCtx := auth.WithUser(context.Background(), owner, "owner", auth.RoleUser)
+	userCtx := auth.WithUser(context.Background(), "101", "user", auth.RoleUser)
+
+	// the album is not visible before it is shared
+	_, err := s.Get(userCtx, "private")
+	assert.Equal(t, sql.ErrNoRows, err)
+	_, err = s.SaveGrant(userCtx, "private", "101", GrantRequest{Level: entity.AlbumEditor})
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	// validation errors
+	_, err = s.SaveGrant(ownerCtx, "private", "101", GrantRequest{Level: "owner"})
+	assert.NotNil(t, err)
+	_, err = s.SaveGrant(ownerCtx, "private", owner, GrantRequest{Level: entity.AlbumViewer})
+	assert.NotNil(t, err)
+	_, err = s.SaveGrant(ownerCtx, "private", "unknown", GrantRequest{Level: entity.AlbumViewer})
+	assert.Equal(t, errors.NotFound("The user was not found."), err)
+
+	// viewer
+	grant, err := s.SaveGrant(ownerCtx, "private", "101", GrantRequest{Level: entity.AlbumViewer})
+	assert.Nil(t, err)
+	assert.Equal(t, entity.AlbumViewer, grant.Level)
+	_, err = s.Get(userCtx, "private")
+	assert.Nil(t, err)
+	albums, _ := s.Query(userCtx, QueryAlbumsRequest{}, 0, 100)
+	assert.Equal(t, 1, len(albums))
+	_, err = s.Update(userCtx, "private", AnyVersion, UpdateAlbumRequest{Name: "renamed"})
+	assert.Equal(t, errors.Forbidden(""), err)
+
+	// editor
+	_, err = s.SaveGrant(ownerCtx, "private", "101", GrantRequest{Level: entity.AlbumEditor})
+	assert.Nil(t, err)
+	grants, _ := s.QueryGrants(ownerCtx, "private")
+	assert.Equal(t, 1, len(grants))
+	album, err := s.Update(userCtx, "private", AnyVersion, UpdateAlbumRequest{Name: "renamed"})
+	assert.Nil(t, err)
+	assert.Equal(t, "renamed", album.Name)
+	// editors cannot publish the album
+	forbidden := errors.Forbidden("Only the owner can change the visibility of the album.")
+	_, err = s.Update(userCtx, "private", AnyVersion, UpdateAlbumRequest{Name: "renamed", Visibility: entity.AlbumPublic})
+	assert.Equal(t, forbidden, err)
+	patch, _ := jsonpatch.New(jsonpatch.MergePatchType, []byte(`{"visibility":"unlisted"}`))
+	_, err = s.Patch(userCtx, "private", AnyVersion, patch)
+	assert.Equal(t, forbidden, err)
+	album, err = s.Update(userCtx, "private", AnyVersion, UpdateAlbumRequest{Name: "renamed again", Visibility: entity.AlbumPrivate})
+	assert.Nil(t, err)
+	assert.Equal(t, entity.AlbumPrivate, album.Visibility)
+	_, err = s.Delete(userCtx, "private", AnyVersion)
+	assert.Equal(t, errors.Forbidden(""), err)
+	_, err = s.QueryGrants(userCtx, "private")
+	assert.Equal(t, errors.Forbidden(""), err)
+
+	// revoke
+	assert.Nil(t, s.DeleteGrant(ownerCtx, "private", "101"))
+	assert.Equal(t, sql.ErrNoRows, s.DeleteGrant(ownerCtx, "private", "101"))
+	_, err = s.Get(userCtx, "private")
+	assert.Equal(t, sql.ErrNoRows, err)
+	grants, _ = s.QueryGrants(ownerCtx, "private")
+	assert.Equal(t, 0, len(grants))
+
+	// the grants are audited as changes of resources that are identified by the album and the user
+	var actions []string
+	for _, record := range auditor.records {
+		if record.ResourceType == "album_grant" {
+			assert.Equal(t, "private/101", record.ResourceID)
+			actions = append(actions, record.Action)
+		}
+	}
+	assert.Equal(t, []string{entity.AuditCreate, entity.AuditUpdate, entity.AuditDelete}, actions)
+}
+
+func Test_service_ShareLinks(t *testing.T) {
+	logger, _ := log.NewForTest()
+	owner := "100"
+	shares := &mockShareRepository{}
+	repo := &mockRepository{items: []entity.Album{
+		{ID: "private", Name: "private", OwnerID: &owner, Visibility: entity.AlbumPrivate},
+		{ID: "other", Name: "other", OwnerID: &owner, Visibility: entity.AlbumPrivate},
+	}}
+	s := NewService(repo, shares, testSigner, &mockAuditor{}, withoutTransaction, logger)
+
+	ownerCtx := auth.WithUser(context.Background(), owner, "owner", auth.RoleUser)
+	userCtx := auth.WithUser(context.Background(), "101", "user", auth.RoleUser)
+	anonymous := context.Background()
+
+	// only the owner can create links
+	_, err := s.CreateShareLink(userCtx, "private", CreateShareLinkRequest{})
+	assert.Equal(t, sql.ErrNoRows, err)
+	_, err = s.CreateShareLink(ownerCtx, "private", CreateShareLinkRequest{ExpiresIn: 1})
+	assert.NotNil(t, err)
+
+	// link without password
+	link, err := s.CreateShareLink(ownerCtx, "private", CreateShareLinkRequest{})
+	assert.Nil(t, err)
+	assert.False(t, link.Protected)
+	assert.NotEmpty(t, link.Token)
+	assert.Equal(t, owner, link.CreatedBy)
+	assert.WithinDuration(t, time.Now().Add(defaultShareLinkLifetime), link.ExpiresAt, time.Minute)
+	album, err := s.GetShared(anonymous, link.Token, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "private", album.ID)
+
+	// link with password
+	protected, err := s.CreateShareLink(ownerCtx, "private", CreateShareLinkRequest{ExpiresIn: 3600, Password: "secret"})
+	assert.Nil(t, err)
+	assert.True(t, protected.Protected)
+	_, err = s.GetShared(anonymous, protected.Token, "")
+	assert.Equal(t, errors.Unauthorized("The share link requires a valid password."), err)
+	_, err = s.GetShared(anonymous, protected.Token, "wrong")
+	assert.NotNil(t, err)
+	_, err = s.GetShared(anonymous, protected.Token, "secret")
+	assert.Nil(t, err)
+
+	// list
+	links, err := s.QueryShareLinks(ownerCtx, "private")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(links))
+	_, err = s.QueryShareLinks(userCtx, "private")
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	// invalid tokens
+	invalid := errors.NotFound("The share link is invalid or has expired.")
+	_, err = s.GetShared(anonymous, "xyz", "")
+	assert.Equal(t, invalid, err)
+	token, _ := testSigner.Sign(jwt.MapClaims{"id": "100", "name": "owner"})
+	_, err = s.GetShared(anonymous, token, "")
+	assert.Equal(t, invalid, err)
+	token, _ = testSigner.Sign(jwt.MapClaims{"share": link.ID, "exp": time.Now().Add(-time.Minute).Unix()})
+	_, err = s.GetShared(anonymous, token, "")
+	assert.Equal(t, invalid, err)
+
+	// revoke
+	assert.Equal(t, sql.ErrNoRows, s.DeleteShareLink(ownerCtx, "other", link.ID))
+	assert.Nil(t, s.DeleteShareLink(ownerCtx, "private", link.ID))
+	_, err = s.GetShared(anonymous, link.Token, "")
+	assert.Equal(t, invalid, err)
+	links, _ = s.QueryShareLinks(ownerCtx, "private")
+	assert.Equal(t, 1, len(links))
+}
@@ -0,0 +1,63 @@
+package audit
+
+import (
+	"github.com/garaekz/priv8/internal/auth"
+	"github.com/garaekz/priv8/pkg/pagination"
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"net/http"
+	"time"
+)
+
+// RegisterHandlers sets up the routing of the HTTP handlers.
+func RegisterHandlers(r *routing.RouteGroup, service Service, authHandler routing.Handler) {
+	r.Use(authHandler)
+
+	r.Get("/audit", auth.Require(auth.PermissionAuditRead), query(service))
+}
+
+// query returns a handler that lists the audit records selected by the query parameters, newest first.
+// The records can be filtered by actor_id, action, resource_type and resource_id,
+// and by their creation time with since and until, which are RFC 3339 timestamps.
+func query(service Service) routing.Handler {
+	return func(c *routing.Context) error {
+		filter, err := parseFilter(c.Request)
+		if err != nil {
+			return err
+		}
+		ctx := c.Request.Context()
+		count, err := service.Count(ctx, filter)
+		if err != nil {
+			return err
+		}
+		pages := pagination.NewFromRequest(c.Request, count)
+		records, err := service.Query(ctx, filter, pages.Offset(), pages.Limit())
+		if err != nil {
+			return err
+		}
+		pages.Items = records
+		pages.SetLinks(c.Response, c.Request)
+		return c.Write(pages)
+	}
+}
+
+// parseFilter returns the filter given in the query parameters of a request.
+func parseFilter(req *http.Request) (Filter, error) {
+	query := req.URL.Query()
+	filter := Filter{
+		ActorID:      query.Get("actor_id"),
+		Action:       query.Get("action"),
+		ResourceType: query.Get("resource_type"),
+		ResourceID:   query.Get("resource_id"),
+	}
+	errs := validation.Errors{}
+	for name, t := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if value := query.Get(name); value != "" {
+			var err error
+			if *t, err = time.Parse(time.RFC3339, value); err != nil {
+				errs[name] = validation.NewError("validation_time_invalid", "must be an RFC 3339 timestamp")
+			}
+		}
+	}
+	return filter, errs.Filter()
+}
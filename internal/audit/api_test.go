@@ -0,0 +1,58 @@
+package audit
+
+import (
+	"github.com/garaekz/priv8/internal/auth"
+	"github.com/garaekz/priv8/internal/entity"
+	"github.com/garaekz/priv8/internal/test"
+	"github.com/garaekz/priv8/pkg/log"
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAPI(t *testing.T) {
+	logger, _ := log.NewForTest()
+	router := test.MockRouter(logger)
+	repo := &mockRepository{items: []entity.AuditRecord{
+		{ID: "1", ActorID: "100", Action: entity.AuditLogin, ResourceType: "session", ResourceID: "session1"},
+		{ID: "2", ActorID: "100", Action: entity.AuditCreate, ResourceType: "album", ResourceID: "album1",
+			After: entity.Snapshot(`{"id":"album1"}`)},
+	}}
+	RegisterHandlers(router.Group(""), NewService(repo, logger), func(c *routing.Context) error {
+		if c.Request.Header.Get("Authorization") != "admin" {
+			return auth.MockAuthHandler(c)
+		}
+		ctx := auth.WithUser(c.Request.Context(), "102", "admin", auth.RoleAdmin)
+		c.Request = c.Request.WithContext(auth.WithPermissions(ctx, auth.Permissions(auth.RoleAdmin)...))
+		return nil
+	})
+	admin := http.Header{"Authorization": {"admin"}}
+
+	tests := []test.APITestCase{
+		{"query", "GET", "/audit", "", admin, http.StatusOK, `*"total_count":2*`},
+		{"query links", "GET", "/audit?per_page=1&links=true", "", admin, http.StatusOK, `*"links":{"next":"/audit?links=true*`},
+		{"query snapshots", "GET", "/audit", "", admin, http.StatusOK, `*"before":null,"after":{"id":"album1"}*`},
+		{"query filter", "GET", "/audit?action=login&actor_id=100", "", admin, http.StatusOK, `*"total_count":1*`},
+		{"query filter by resource", "GET", "/audit?resource_type=album&resource_id=album2", "", admin, http.StatusOK, `*"total_count":0*`},
+		{"query time filter", "GET", "/audit?since=2026-01-01T00:00:00Z&until=2027-01-01T00:00:00Z", "", admin, http.StatusOK, ""},
+		{"query invalid time", "GET", "/audit?since=yesterday", "", admin, http.StatusBadRequest, `*"field":"since"*`},
+		{"query forbidden", "GET", "/audit", "", auth.MockAuthHeader(), http.StatusForbidden, ""},
+		{"query auth error", "GET", "/audit", "", nil, http.StatusUnauthorized, ""},
+	}
+	for _, tc := range tests {
+		test.Endpoint(t, router, tc)
+	}
+}
+
+func Test_parseFilter(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/audit?actor_id=100&action=update&resource_type=album&resource_id=1&since=2026-10-16T09:00:00Z", nil)
+	filter, err := parseFilter(req)
+	assert.Nil(t, err)
+	assert.Equal(t, Filter{ActorID: "100", Action: "update", ResourceType: "album", ResourceID: "1",
+		Since: time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)}, filter)
+	req, _ = http.NewRequest("GET", "/audit?until=tomorrow", nil)
+	_, err = parseFilter(req)
+	assert.NotNil(t, err)
+}
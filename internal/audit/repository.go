@@ -0,0 +1,91 @@
+package audit
+
+import (
+	"context"
+	"github.com/garaekz/priv8/internal/entity"
+	"github.com/garaekz/priv8/pkg/dbcontext"
+	"github.com/garaekz/priv8/pkg/log"
+	dbx "github.com/go-ozzo/ozzo-dbx"
+	"time"
+)
+
+// Repository encapsulates the logic to access audit records from the data source.
+type Repository interface {
+	// Create saves a new audit record in the storage.
+	Create(ctx context.Context, record entity.AuditRecord) error
+	// Count returns the number of audit records that satisfy the given filter.
+	Count(ctx context.Context, filter Filter) (int, error)
+	// Query returns the audit records that satisfy the given filter with the given offset and limit, newest first.
+	Query(ctx context.Context, filter Filter, offset, limit int) ([]entity.AuditRecord, error)
+}
+
+// Filter specifies the audit records returned by Repository.Count and Repository.Query.
+// Empty fields do not filter the records.
+type Filter struct {
+	ActorID      string
+	Action       string
+	ResourceType string
+	ResourceID   string
+	// Since and Until select the records created at or after Since and before Until.
+	Since time.Time
+	Until time.Time
+}
+
+// expression returns the WHERE condition that implements the filter.
+func (f Filter) expression() dbx.Expression {
+	hash := dbx.HashExp{}
+	for column, value := range map[string]string{
+		"actor_id":      f.ActorID,
+		"action":        f.Action,
+		"resource_type": f.ResourceType,
+		"resource_id":   f.ResourceID,
+	} {
+		if value != "" {
+			hash[column] = value
+		}
+	}
+	conditions := []dbx.Expression{hash}
+	if !f.Since.IsZero() {
+		conditions = append(conditions, dbx.NewExp("created_at >= {:since}", dbx.Params{"since": f.Since}))
+	}
+	if !f.Until.IsZero() {
+		conditions = append(conditions, dbx.NewExp("created_at < {:until}", dbx.Params{"until": f.Until}))
+	}
+	return dbx.And(conditions...)
+}
+
+// repository persists audit records in database
+type repository struct {
+	db     *dbcontext.DB
+	logger log.Logger
+}
+
+// NewRepository creates a new audit repository
+func NewRepository(db *dbcontext.DB, logger log.Logger) Repository {
+	return repository{db, logger}
+}
+
+// Create saves a new audit record in the database, in the transaction of the context if there is one.
+func (r repository) Create(ctx context.Context, record entity.AuditRecord) error {
+	return r.db.With(ctx).Model(&record).Insert()
+}
+
+// Count returns the number of the audit records that satisfy the given filter in the database.
+func (r repository) Count(ctx context.Context, filter Filter) (int, error) {
+	var count int
+	err := r.db.With(ctx).Select("COUNT(*)").From("audit_record").Where(filter.expression()).Row(&count)
+	return count, err
+}
+
+// Query retrieves the audit records that satisfy the given filter with the specified offset and limit from the database.
+func (r repository) Query(ctx context.Context, filter Filter, offset, limit int) ([]entity.AuditRecord, error) {
+	var records []entity.AuditRecord
+	err := r.db.With(ctx).
+		Select().
+		Where(filter.expression()).
+		OrderBy("created_at DESC", "id DESC").
+		Offset(int64(offset)).
+		Limit(int64(limit)).
+		All(&records)
+	return records, err
+}
@@ -0,0 +1,67 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"github.com/garaekz/priv8/internal/entity"
+	"github.com/garaekz/priv8/internal/test"
+	"github.com/garaekz/priv8/pkg/log"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+var errRollback = errors.New("rollback")
+
+func TestRepository(t *testing.T) {
+	logger, _ := log.NewForTest()
+	db := test.DB(t)
+	test.ResetTables(t, db, "audit_record")
+	repo := NewRepository(db, logger)
+	ctx := context.Background()
+	now := time.Now()
+
+	// create
+	records := []entity.AuditRecord{
+		{ID: "record1", ActorID: "100", ActorName: "demo", Action: entity.AuditLogin, ResourceType: "session",
+			ResourceID: "session1", CreatedAt: now.Add(-time.Hour)},
+		{ID: "record2", ActorID: "100", ActorName: "demo", Action: entity.AuditCreate, ResourceType: "album",
+			ResourceID: "album1", After: entity.Snapshot(`{"id":"album1"}`), CreatedAt: now},
+		{ID: "record3", ActorID: "101", ActorName: "other", ImpersonatorID: "102", ImpersonatorName: "admin",
+			Action: entity.AuditDelete, ResourceType: "album", ResourceID: "album1", Before: entity.Snapshot(`{"id":"album1"}`),
+			CreatedAt: now.Add(time.Minute)},
+	}
+	for _, record := range records {
+		assert.Nil(t, repo.Create(ctx, record))
+	}
+
+	// query, newest first
+	result, err := repo.Query(ctx, Filter{}, 0, 100)
+	assert.Nil(t, err)
+	if assert.Equal(t, 3, len(result)) {
+		assert.Equal(t, "record3", result[0].ID)
+		assert.Equal(t, "admin", result[0].ImpersonatorName)
+		assert.JSONEq(t, `{"id":"album1"}`, string(result[0].Before))
+		assert.Nil(t, result[0].After)
+	}
+
+	// filters
+	count, err := repo.Count(ctx, Filter{ActorID: "100"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+	count, _ = repo.Count(ctx, Filter{ResourceType: "album", ResourceID: "album1"})
+	assert.Equal(t, 2, count)
+	count, _ = repo.Count(ctx, Filter{Action: entity.AuditLogin})
+	assert.Equal(t, 1, count)
+	count, _ = repo.Count(ctx, Filter{Since: now.Add(-time.Minute), Until: now.Add(time.Second)})
+	assert.Equal(t, 1, count)
+
+	// records are kept with the transaction that makes the change
+	err = db.Transactional(ctx, func(ctx context.Context) error {
+		_ = repo.Create(ctx, entity.AuditRecord{ID: "record4", Action: entity.AuditCreate, CreatedAt: now})
+		return errRollback
+	})
+	assert.Equal(t, errRollback, err)
+	count, _ = repo.Count(ctx, Filter{})
+	assert.Equal(t, 3, count)
+}
@@ -0,0 +1,92 @@
+// Package audit keeps a durable record of the actions that change the data of the service.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/garaekz/priv8/internal/auth"
+	"github.com/garaekz/priv8/internal/entity"
+	"github.com/garaekz/priv8/pkg/log"
+	"time"
+)
+
+// Recorder records actions in the audit log.
+type Recorder interface {
+	// Record records an action of the current user on a resource with the resource before and after the action.
+	// Before is nil for created resources, and after is nil for deleted ones. The record is saved in the transaction
+	// of the context, if there is one, so that it is only kept if the change is committed.
+	Record(ctx context.Context, action, resourceType, resourceID string, before, after interface{}) error
+}
+
+// Service encapsulates the logic of the audit log.
+type Service interface {
+	Recorder
+	// Query returns the audit records that satisfy the given filter with the specified offset and limit, newest first.
+	Query(ctx context.Context, filter Filter, offset, limit int) ([]entity.AuditRecord, error)
+	// Count returns the number of audit records that satisfy the given filter.
+	Count(ctx context.Context, filter Filter) (int, error)
+}
+
+type service struct {
+	repo   Repository
+	logger log.Logger
+}
+
+// NewService creates a new audit service.
+func NewService(repo Repository, logger log.Logger) Service {
+	return service{repo, logger}
+}
+
+// Record records an action of the current user in the context. When the user is impersonated,
+// the record is tagged with the administrator who impersonates the user.
+func (s service) Record(ctx context.Context, action, resourceType, resourceID string, before, after interface{}) error {
+	record := entity.AuditRecord{
+		ID:           entity.GenerateID(),
+		Action:       action,
+		ResourceType: resourceType,
+		ResourceID:   resourceID,
+		RequestID:    log.RequestID(ctx),
+		CreatedAt:    time.Now(),
+	}
+	if user := auth.CurrentUser(ctx); user != nil {
+		record.ActorID, record.ActorName = user.GetID(), user.GetName()
+	}
+	if auth.IsImpersonated(ctx) {
+		actor := auth.CurrentActor(ctx)
+		record.ImpersonatorID, record.ImpersonatorName = actor.GetID(), actor.GetName()
+	}
+	var err error
+	if record.Before, err = snapshot(before); err != nil {
+		return err
+	}
+	if record.After, err = snapshot(after); err != nil {
+		return err
+	}
+	return s.repo.Create(ctx, record)
+}
+
+// Query returns the audit records that satisfy the given filter with the specified offset and limit.
+func (s service) Query(ctx context.Context, filter Filter, offset, limit int) ([]entity.AuditRecord, error) {
+	records, err := s.repo.Query(ctx, filter, offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	if records == nil {
+		records = []entity.AuditRecord{}
+	}
+	return records, nil
+}
+
+// Count returns the number of audit records that satisfy the given filter.
+func (s service) Count(ctx context.Context, filter Filter) (int, error) {
+	return s.repo.Count(ctx, filter)
+}
+
+// snapshot returns the JSON representation of a resource. It returns nil if the resource is nil.
+func snapshot(resource interface{}) (entity.Snapshot, error) {
+	if resource == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(resource)
+	return entity.Snapshot(data), err
+}
@@ -0,0 +1,102 @@
+package audit
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/garaekz/priv8/internal/auth"
+	"github.com/garaekz/priv8/internal/entity"
+	"github.com/garaekz/priv8/pkg/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_service_Record(t *testing.T) {
+	logger, _ := log.NewForTest()
+	repo := &mockRepository{}
+	s := NewService(repo, logger)
+	req, _ := http.NewRequest("POST", "http://example.com/albums", nil)
+	req.Header.Set("X-Request-ID", "request1")
+	ctx := auth.WithUser(log.WithRequest(context.Background(), req), "100", "demo", auth.RoleUser)
+
+	// create
+	album := entity.Album{ID: "album1", Name: "test"}
+	assert.Nil(t, s.Record(ctx, entity.AuditCreate, "album", "album1", nil, album))
+	if assert.Equal(t, 1, len(repo.items)) {
+		record := repo.items[0]
+		assert.NotEmpty(t, record.ID)
+		assert.Equal(t, "100", record.ActorID)
+		assert.Equal(t, "demo", record.ActorName)
+		assert.Empty(t, record.ImpersonatorID)
+		assert.Equal(t, entity.AuditCreate, record.Action)
+		assert.Equal(t, "album", record.ResourceType)
+		assert.Equal(t, "album1", record.ResourceID)
+		assert.Nil(t, record.Before)
+		assert.JSONEq(t, `{"id":"album1","name":"test","owner_id":null,"visibility":"","version":0,"created_at":"0001-01-01T00:00:00Z","updated_at":"0001-01-01T00:00:00Z"}`,
+			string(record.After))
+		assert.Equal(t, "request1", record.RequestID)
+		assert.WithinDuration(t, time.Now(), record.CreatedAt, time.Minute)
+	}
+
+	// impersonation
+	ctx = auth.WithActor(ctx, "102", "admin")
+	assert.Nil(t, s.Record(ctx, entity.AuditDelete, "album", "album1", album, nil))
+	if assert.Equal(t, 2, len(repo.items)) {
+		record := repo.items[1]
+		assert.Equal(t, "100", record.ActorID)
+		assert.Equal(t, "102", record.ImpersonatorID)
+		assert.Equal(t, "admin", record.ImpersonatorName)
+		assert.NotNil(t, record.Before)
+		assert.Nil(t, record.After)
+	}
+
+	// snapshots must be encodable
+	assert.NotNil(t, s.Record(ctx, entity.AuditUpdate, "album", "album1", nil, func() {}))
+}
+
+func Test_service_Query(t *testing.T) {
+	logger, _ := log.NewForTest()
+	repo := &mockRepository{items: []entity.AuditRecord{
+		{ID: "1", ActorID: "100", Action: entity.AuditLogin},
+		{ID: "2", ActorID: "101", Action: entity.AuditLogin},
+		{ID: "3", ActorID: "100", Action: entity.AuditCreate},
+	}}
+	s := NewService(repo, logger)
+	ctx := context.Background()
+
+	count, err := s.Count(ctx, Filter{ActorID: "100"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+	records, err := s.Query(ctx, Filter{ActorID: "100"}, 0, 100)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(records))
+	records, _ = s.Query(ctx, Filter{ActorID: "100", Action: entity.AuditDelete}, 0, 100)
+	assert.Equal(t, []entity.AuditRecord{}, records)
+}
+
+type mockRepository struct {
+	items []entity.AuditRecord
+}
+
+func (m *mockRepository) Create(_ context.Context, record entity.AuditRecord) error {
+	m.items = append(m.items, record)
+	return nil
+}
+
+func (m mockRepository) Count(ctx context.Context, filter Filter) (int, error) {
+	records, err := m.Query(ctx, filter, 0, len(m.items))
+	return len(records), err
+}
+
+func (m mockRepository) Query(_ context.Context, filter Filter, offset, limit int) ([]entity.AuditRecord, error) {
+	var records []entity.AuditRecord
+	for _, item := range m.items {
+		if (filter.ActorID == "" || item.ActorID == filter.ActorID) && (filter.Action == "" || item.Action == filter.Action) &&
+			(filter.ResourceType == "" || item.ResourceType == filter.ResourceType) &&
+			(filter.ResourceID == "" || item.ResourceID == filter.ResourceID) {
+			records = append(records, item)
+		}
+	}
+	return records, nil
+}
@@ -1,14 +1,154 @@
 package auth
 
 import (
+	"fmt"
 	"github.com/garaekz/priv8/internal/errors"
 	"github.com/garaekz/priv8/pkg/log"
 	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"net/http"
+	"time"
 )
 
 // RegisterHandlers registers handlers for different HTTP requests.
-func RegisterHandlers(rg *routing.RouteGroup, service Service, logger log.Logger) {
+func RegisterHandlers(rg *routing.RouteGroup, service Service, authHandler routing.Handler, logger log.Logger) {
 	rg.Post("/login", login(service, logger))
+	rg.Post("/login/mfa", loginMFA(service, logger))
+	rg.Post("/register", register(service, logger))
+	rg.Post("/token/refresh", refresh(service, logger))
+	rg.Post("/password/forgot", forgotPassword(service, logger))
+	rg.Post("/password/reset", resetPassword(service, logger))
+
+	rg.Use(authHandler)
+
+	// the following endpoints require a valid JWT; API keys and OAuth clients cannot manage the account
+	rg.Post("/logout", logout(service, logger))
+	rg.Get("/me", whoAmI)
+	rg.Put("/me/password", RequireToken, changePassword(service, logger))
+	rg.Delete("/me", RequireToken, deleteAccount(service))
+
+	rg.Get("/me/sessions", RequireToken, querySessions(service))
+	rg.Delete("/me/sessions/<id>", RequireToken, revokeSession(service))
+
+	rg.Get("/me/api-keys", RequireToken, queryAPIKeys(service))
+	rg.Post("/me/api-keys", RequireToken, createAPIKey(service, logger))
+	rg.Delete("/me/api-keys/<id>", RequireToken, deleteAPIKey(service))
+
+	rg.Post("/me/mfa/totp", RequireToken, enrollTOTP(service))
+	rg.Post("/me/mfa/totp/confirm", RequireToken, confirmTOTP(service, logger))
+	rg.Delete("/me/mfa/totp", RequireToken, disableTOTP(service, logger))
+	rg.Post("/me/mfa/recovery-codes", RequireToken, regenerateRecoveryCodes(service, logger))
+
+	rg.Post("/users/<id>/impersonate", RequireToken, Require(PermissionUserImpersonate), impersonate(service))
+}
+
+// Ways in which a request can be authenticated.
+const (
+	// AuthMethodToken is an access token issued at login.
+	AuthMethodToken = "token"
+	// AuthMethodOAuth is an access token issued to an OAuth client.
+	AuthMethodOAuth = "oauth"
+	// AuthMethodAPIKey is an API key.
+	AuthMethodAPIKey = "api_key"
+)
+
+// Me describes the identity that authenticated the current request.
+type Me struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	Roles       []string `json:"roles"`
+	Permissions []string `json:"permissions"`
+	AuthMethod  string   `json:"auth_method"`
+	// ClientID is the ID of the OAuth client that the access token was issued to.
+	ClientID string `json:"client_id,omitempty"`
+	// Actor is the administrator who impersonates the user, if any.
+	Actor *Actor `json:"act,omitempty"`
+	// ExpiresAt is the time when the access token expires. It is nil for API keys.
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// Actor identifies the administrator behind an impersonated request.
+type Actor struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// codeRequest represents a request that carries a second factor code.
+type codeRequest struct {
+	Code string `json:"code"`
+}
+
+// RequireToken is a middleware that rejects requests that were not authenticated with an access token
+// issued at login, such as requests authenticated with an API key or with a token issued to an OAuth client.
+// Impersonation tokens are rejected as well, so that administrators cannot manage the accounts of the users
+// they impersonate.
+func RequireToken(c *routing.Context) error {
+	ctx := c.Request.Context()
+	token, ok := currentToken(ctx)
+	if !ok {
+		return errors.Forbidden("this endpoint requires an access token")
+	}
+	if token.ClientID != "" {
+		return errors.Forbidden("this endpoint cannot be used by OAuth clients")
+	}
+	if IsImpersonated(ctx) {
+		return errors.Forbidden("this endpoint cannot be used while impersonating a user")
+	}
+	return nil
+}
+
+// RegisterJWKSHandler registers the handler that publishes the public keys used to verify JWTs.
+func RegisterJWKSHandler(r *routing.Router, keys *KeyRing) {
+	r.Get("/.well-known/jwks.json", jwks(keys))
+}
+
+// jwks returns a handler that responds with the JSON Web Key Set (RFC 7517) of the given key ring.
+// Keys that are not active yet are included so that clients can verify tokens as soon as they are signed.
+// HMAC keys are secret and therefore never included.
+func jwks(keys *KeyRing) routing.Handler {
+	return func(c *routing.Context) error {
+		set := struct {
+			Keys []JWK `json:"keys"`
+		}{[]JWK{}}
+		for _, key := range keys.Keys() {
+			if jwk, ok := key.JWK(); ok {
+				set.Keys = append(set.Keys, jwk)
+			}
+		}
+		c.Response.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%v", int(jwksMaxAge.Seconds())))
+		return c.Write(set)
+	}
+}
+
+// whoAmI is a handler that describes the identity that authenticated the current request.
+func whoAmI(c *routing.Context) error {
+	ctx := c.Request.Context()
+	identity := CurrentUser(ctx)
+	me := Me{
+		ID:          identity.GetID(),
+		Name:        identity.GetName(),
+		Roles:       identity.GetRoles(),
+		Permissions: CurrentPermissions(ctx),
+		AuthMethod:  AuthMethodAPIKey,
+	}
+	if me.Roles == nil {
+		me.Roles = []string{}
+	}
+	if me.Permissions == nil {
+		me.Permissions = []string{}
+	}
+	if token, ok := currentToken(ctx); ok {
+		me.AuthMethod = AuthMethodToken
+		if token.ClientID != "" {
+			me.AuthMethod = AuthMethodOAuth
+			me.ClientID = token.ClientID
+		}
+		me.ExpiresAt = &token.ExpiresAt
+	}
+	if IsImpersonated(ctx) {
+		actor := CurrentActor(ctx)
+		me.Actor = &Actor{ID: actor.GetID(), Name: actor.GetName()}
+	}
+	return c.Write(me)
 }
 
 // login returns a handler that handles user login request.
@@ -24,12 +164,314 @@ func login(service Service, logger log.Logger) routing.Handler {
 			return errors.BadRequest("")
 		}
 
-		token, err := service.Login(c.Request.Context(), req.Username, req.Password)
+		ctx := withClient(c.Request.Context(), c.Request)
+		tokens, err := service.Login(ctx, req.Username, req.Password)
+		if err != nil {
+			return err
+		}
+		return c.Write(tokens)
+	}
+}
+
+// loginMFA returns a handler that completes a login that requires a second factor.
+func loginMFA(service Service, logger log.Logger) routing.Handler {
+	return func(c *routing.Context) error {
+		var req struct {
+			MFAToken string `json:"mfa_token"`
+			Code     string `json:"code"`
+		}
+
+		if err := c.Read(&req); err != nil {
+			logger.With(c.Request.Context()).Errorf("invalid request: %v", err)
+			return errors.BadRequest("")
+		}
+
+		ctx := withClient(c.Request.Context(), c.Request)
+		tokens, err := service.LoginMFA(ctx, req.MFAToken, req.Code)
+		if err != nil {
+			return err
+		}
+		return c.Write(tokens)
+	}
+}
+
+// refresh returns a handler that exchanges a refresh token for a new pair of tokens.
+func refresh(service Service, logger log.Logger) routing.Handler {
+	return func(c *routing.Context) error {
+		var req struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+
+		if err := c.Read(&req); err != nil {
+			logger.With(c.Request.Context()).Errorf("invalid request: %v", err)
+			return errors.BadRequest("")
+		}
+
+		ctx := withClient(c.Request.Context(), c.Request)
+		tokens, err := service.Refresh(ctx, req.RefreshToken)
+		if err != nil {
+			return err
+		}
+		return c.Write(tokens)
+	}
+}
+
+// logout returns a handler that revokes the access token of the current request.
+// The client may also send its refresh token so that it can no longer be used.
+func logout(service Service, logger log.Logger) routing.Handler {
+	return func(c *routing.Context) error {
+		var req struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+
+		if c.Request.ContentLength != 0 {
+			if err := c.Read(&req); err != nil {
+				logger.With(c.Request.Context()).Errorf("invalid request: %v", err)
+				return errors.BadRequest("")
+			}
+		}
+
+		ctx := c.Request.Context()
+		token, ok := currentToken(ctx)
+		if !ok {
+			return errors.BadRequest("the request was not authenticated with an access token")
+		}
+		err := service.Logout(ctx, CurrentUser(ctx).GetID(), token.SessionID, token.ID, token.ExpiresAt, req.RefreshToken)
+		if err != nil {
+			return err
+		}
+		c.Response.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+}
+
+// register returns a handler that handles user registration request.
+func register(service Service, logger log.Logger) routing.Handler {
+	return func(c *routing.Context) error {
+		var input RegisterRequest
+		if err := c.Read(&input); err != nil {
+			logger.With(c.Request.Context()).Errorf("invalid request: %v", err)
+			return errors.BadRequest("")
+		}
+
+		user, err := service.Register(c.Request.Context(), input)
+		if err != nil {
+			return err
+		}
+		return c.WriteWithStatus(user, http.StatusCreated)
+	}
+}
+
+// forgotPassword returns a handler that sends a password reset email.
+// It responds the same way whether or not the email address is registered.
+func forgotPassword(service Service, logger log.Logger) routing.Handler {
+	return func(c *routing.Context) error {
+		var input ForgotPasswordRequest
+		if err := c.Read(&input); err != nil {
+			logger.With(c.Request.Context()).Errorf("invalid request: %v", err)
+			return errors.BadRequest("")
+		}
+
+		if err := service.ForgotPassword(c.Request.Context(), input); err != nil {
+			return err
+		}
+		c.Response.WriteHeader(http.StatusAccepted)
+		return nil
+	}
+}
+
+// resetPassword returns a handler that sets a new password with a password reset token.
+func resetPassword(service Service, logger log.Logger) routing.Handler {
+	return func(c *routing.Context) error {
+		var input ResetPasswordRequest
+		if err := c.Read(&input); err != nil {
+			logger.With(c.Request.Context()).Errorf("invalid request: %v", err)
+			return errors.BadRequest("")
+		}
+
+		if err := service.ResetPassword(c.Request.Context(), input); err != nil {
+			return err
+		}
+		c.Response.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+}
+
+// changePassword returns a handler that changes the password of the current user.
+func changePassword(service Service, logger log.Logger) routing.Handler {
+	return func(c *routing.Context) error {
+		var input ChangePasswordRequest
+		if err := c.Read(&input); err != nil {
+			logger.With(c.Request.Context()).Errorf("invalid request: %v", err)
+			return errors.BadRequest("")
+		}
+
+		ctx := c.Request.Context()
+		if err := service.ChangePassword(ctx, CurrentUser(ctx).GetID(), input); err != nil {
+			return err
+		}
+		c.Response.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+}
+
+// deleteAccount returns a handler that deletes the account of the current user.
+func deleteAccount(service Service) routing.Handler {
+	return func(c *routing.Context) error {
+		ctx := c.Request.Context()
+		user, err := service.DeleteAccount(ctx, CurrentUser(ctx).GetID())
+		if err != nil {
+			return err
+		}
+		return c.Write(user)
+	}
+}
+
+// querySessions returns a handler that lists the active sessions of the current user.
+// The session of the current request is marked as current.
+func querySessions(service Service) routing.Handler {
+	return func(c *routing.Context) error {
+		ctx := c.Request.Context()
+		sessions, err := service.QuerySessions(ctx, CurrentUser(ctx).GetID())
+		if err != nil {
+			return err
+		}
+		token, _ := currentToken(ctx)
+		for i := range sessions {
+			sessions[i].Current = token.SessionID != "" && sessions[i].ID == token.SessionID
+		}
+		return c.Write(sessions)
+	}
+}
+
+// revokeSession returns a handler that revokes a session of the current user.
+func revokeSession(service Service) routing.Handler {
+	return func(c *routing.Context) error {
+		ctx := c.Request.Context()
+		if err := service.RevokeSession(ctx, CurrentUser(ctx).GetID(), c.Param("id")); err != nil {
+			return err
+		}
+		c.Response.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+}
+
+// impersonate returns a handler that issues a token with which the current administrator acts as another user.
+func impersonate(service Service) routing.Handler {
+	return func(c *routing.Context) error {
+		ctx := c.Request.Context()
+		tokens, err := service.Impersonate(ctx, CurrentUser(ctx), c.Param("id"))
+		if err != nil {
+			return err
+		}
+		return c.Write(tokens)
+	}
+}
+
+// queryAPIKeys returns a handler that lists the API keys of the current user.
+func queryAPIKeys(service Service) routing.Handler {
+	return func(c *routing.Context) error {
+		ctx := c.Request.Context()
+		keys, err := service.QueryAPIKeys(ctx, CurrentUser(ctx).GetID())
+		if err != nil {
+			return err
+		}
+		return c.Write(keys)
+	}
+}
+
+// createAPIKey returns a handler that creates an API key for the current user.
+func createAPIKey(service Service, logger log.Logger) routing.Handler {
+	return func(c *routing.Context) error {
+		var input CreateAPIKeyRequest
+		if err := c.Read(&input); err != nil {
+			logger.With(c.Request.Context()).Errorf("invalid request: %v", err)
+			return errors.BadRequest("")
+		}
+
+		ctx := c.Request.Context()
+		key, err := service.CreateAPIKey(ctx, CurrentUser(ctx).GetID(), input)
+		if err != nil {
+			return err
+		}
+		return c.WriteWithStatus(key, http.StatusCreated)
+	}
+}
+
+// deleteAPIKey returns a handler that revokes an API key of the current user.
+func deleteAPIKey(service Service) routing.Handler {
+	return func(c *routing.Context) error {
+		ctx := c.Request.Context()
+		if err := service.DeleteAPIKey(ctx, CurrentUser(ctx).GetID(), c.Param("id")); err != nil {
+			return err
+		}
+		c.Response.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+}
+
+// enrollTOTP returns a handler that generates a new TOTP secret for the current user.
+func enrollTOTP(service Service) routing.Handler {
+	return func(c *routing.Context) error {
+		ctx := c.Request.Context()
+		enrollment, err := service.EnrollTOTP(ctx, CurrentUser(ctx).GetID())
+		if err != nil {
+			return err
+		}
+		return c.Write(enrollment)
+	}
+}
+
+// confirmTOTP returns a handler that enables two-factor authentication for the current user.
+func confirmTOTP(service Service, logger log.Logger) routing.Handler {
+	return func(c *routing.Context) error {
+		var req codeRequest
+		if err := c.Read(&req); err != nil {
+			logger.With(c.Request.Context()).Errorf("invalid request: %v", err)
+			return errors.BadRequest("")
+		}
+
+		ctx := c.Request.Context()
+		codes, err := service.ConfirmTOTP(ctx, CurrentUser(ctx).GetID(), req.Code)
+		if err != nil {
+			return err
+		}
+		return c.Write(codes)
+	}
+}
+
+// disableTOTP returns a handler that disables two-factor authentication for the current user.
+func disableTOTP(service Service, logger log.Logger) routing.Handler {
+	return func(c *routing.Context) error {
+		var req codeRequest
+		if err := c.Read(&req); err != nil {
+			logger.With(c.Request.Context()).Errorf("invalid request: %v", err)
+			return errors.BadRequest("")
+		}
+
+		ctx := c.Request.Context()
+		if err := service.DisableTOTP(ctx, CurrentUser(ctx).GetID(), req.Code); err != nil {
+			return err
+		}
+		c.Response.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+}
+
+// regenerateRecoveryCodes returns a handler that replaces the recovery codes of the current user.
+func regenerateRecoveryCodes(service Service, logger log.Logger) routing.Handler {
+	return func(c *routing.Context) error {
+		var req codeRequest
+		if err := c.Read(&req); err != nil {
+			logger.With(c.Request.Context()).Errorf("invalid request: %v", err)
+			return errors.BadRequest("")
+		}
+
+		ctx := c.Request.Context()
+		codes, err := service.RegenerateRecoveryCodes(ctx, CurrentUser(ctx).GetID(), req.Code)
 		if err != nil {
 			return err
 		}
-		return c.Write(struct {
-			Token string `json:"token"`
-		}{token})
+		return c.Write(codes)
 	}
 }
@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"context"
+	"github.com/garaekz/priv8/internal/entity"
+	"github.com/garaekz/priv8/pkg/dbcontext"
+	"github.com/garaekz/priv8/pkg/log"
+	dbx "github.com/go-ozzo/ozzo-dbx"
+	"time"
+)
+
+// APIKeyRepository encapsulates the logic to access API keys from the data source.
+type APIKeyRepository interface {
+	// GetByHash returns the API key with the specified key hash.
+	GetByHash(ctx context.Context, hash string) (entity.APIKey, error)
+	// Query returns the API keys of the user with the specified ID.
+	Query(ctx context.Context, userID string) ([]entity.APIKey, error)
+	// Create saves a new API key in the storage.
+	Create(ctx context.Context, key entity.APIKey) error
+	// Delete removes the API key with the specified ID of the user with the specified ID.
+	Delete(ctx context.Context, userID, id string) error
+	// MarkUsed records the time when the API key with the specified ID was last used.
+	MarkUsed(ctx context.Context, id string, at time.Time) error
+}
+
+// apiKeyRepository persists API keys in database
+type apiKeyRepository struct {
+	db     *dbcontext.DB
+	logger log.Logger
+}
+
+// NewAPIKeyRepository creates a new API key repository
+func NewAPIKeyRepository(db *dbcontext.DB, logger log.Logger) APIKeyRepository {
+	return apiKeyRepository{db, logger}
+}
+
+// GetByHash reads the API key with the specified hash from the database.
+func (r apiKeyRepository) GetByHash(ctx context.Context, hash string) (entity.APIKey, error) {
+	var key entity.APIKey
+	err := r.db.With(ctx).Select().Where(dbx.HashExp{"key_hash": hash}).One(&key)
+	return key, err
+}
+
+// Query reads the API keys of the specified user from the database.
+func (r apiKeyRepository) Query(ctx context.Context, userID string) ([]entity.APIKey, error) {
+	var keys []entity.APIKey
+	err := r.db.With(ctx).Select().Where(dbx.HashExp{"user_id": userID}).OrderBy("created_at").All(&keys)
+	return keys, err
+}
+
+// Create saves a new API key record in the database.
+func (r apiKeyRepository) Create(ctx context.Context, key entity.APIKey) error {
+	return r.db.With(ctx).Model(&key).Insert()
+}
+
+// Delete deletes the API key with the specified ID and user ID from the database.
+func (r apiKeyRepository) Delete(ctx context.Context, userID, id string) error {
+	var key entity.APIKey
+	if err := r.db.With(ctx).Select().Where(dbx.HashExp{"id": id, "user_id": userID}).One(&key); err != nil {
+		return err
+	}
+	return r.db.With(ctx).Model(&key).Delete()
+}
+
+// MarkUsed updates the last used time of the API key with the specified ID in the database.
+func (r apiKeyRepository) MarkUsed(ctx context.Context, id string, at time.Time) error {
+	_, err := r.db.With(ctx).Update("api_key", dbx.Params{"last_used_at": at}, dbx.HashExp{"id": id}).Execute()
+	return err
+}
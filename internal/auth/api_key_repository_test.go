@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"github.com/garaekz/priv8/internal/entity"
+	"github.com/garaekz/priv8/internal/test"
+	"github.com/garaekz/priv8/pkg/log"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestAPIKeyRepository(t *testing.T) {
+	logger, _ := log.NewForTest()
+	db := test.DB(t)
+	test.ResetTables(t, db, "api_key", "user")
+	test.CreateUser(t, db, "100", "demo")
+	test.CreateUser(t, db, "101", "other")
+	repo := NewAPIKeyRepository(db, logger)
+	ctx := context.Background()
+
+	// create
+	for _, id := range []string{"key1", "key2"} {
+		err := repo.Create(ctx, entity.APIKey{
+			ID:        id,
+			UserID:    "100",
+			Name:      id,
+			Prefix:    "priv8_" + id,
+			KeyHash:   "hash-" + id,
+			Scopes:    entity.Scopes{PermissionAlbumCreate, PermissionAlbumUpdate},
+			CreatedAt: time.Now(),
+		})
+		assert.Nil(t, err)
+	}
+
+	// get by hash
+	key, err := repo.GetByHash(ctx, "hash-key1")
+	assert.Nil(t, err)
+	assert.Equal(t, "key1", key.ID)
+	assert.Equal(t, entity.Scopes{PermissionAlbumCreate, PermissionAlbumUpdate}, key.Scopes)
+	assert.Nil(t, key.ExpiresAt)
+	assert.Nil(t, key.LastUsedAt)
+	_, err = repo.GetByHash(ctx, "hash-key0")
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	// query
+	keys, err := repo.Query(ctx, "100")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(keys))
+	keys, err = repo.Query(ctx, "101")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(keys))
+
+	// mark used
+	assert.Nil(t, repo.MarkUsed(ctx, "key1", time.Now()))
+	key, _ = repo.GetByHash(ctx, "hash-key1")
+	assert.NotNil(t, key.LastUsedAt)
+
+	// delete
+	assert.Equal(t, sql.ErrNoRows, repo.Delete(ctx, "101", "key1"))
+	assert.Nil(t, repo.Delete(ctx, "100", "key1"))
+	_, err = repo.GetByHash(ctx, "hash-key1")
+	assert.Equal(t, sql.ErrNoRows, err)
+}
@@ -0,0 +1,185 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"github.com/garaekz/priv8/internal/entity"
+	"github.com/garaekz/priv8/internal/errors"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"time"
+)
+
+const (
+	// apiKeyPrefix starts every API key so that leaked keys are easy to recognize.
+	apiKeyPrefix = "priv8_"
+	// apiKeyUsageInterval is how often the last used time of an API key is updated at most.
+	apiKeyUsageInterval = time.Minute
+)
+
+// NewAPIKey represents a newly created API key. The key itself is only returned once, on creation.
+type NewAPIKey struct {
+	entity.APIKey
+	Key string `json:"key"`
+}
+
+// CreateAPIKeyRequest represents an API key creation request.
+type CreateAPIKeyRequest struct {
+	Name string `json:"name"`
+	// Scopes are the permissions of the key. They must be granted to the user as well.
+	Scopes []string `json:"scopes"`
+	// ExpiresIn is the lifetime of the key in seconds. The key never expires if it is zero.
+	ExpiresIn int `json:"expires_in"`
+}
+
+// Validate validates the CreateAPIKeyRequest fields.
+func (m CreateAPIKeyRequest) Validate() error {
+	return validation.ValidateStruct(&m,
+		validation.Field(&m.Name, validation.Required, validation.Length(0, 64)),
+		validation.Field(&m.Scopes, validation.Required),
+		validation.Field(&m.ExpiresIn, validation.Min(60)),
+	)
+}
+
+// QueryAPIKeys returns the API keys of the user with the specified ID.
+func (s service) QueryAPIKeys(ctx context.Context, userID string) ([]entity.APIKey, error) {
+	keys, err := s.apiKeyRepo.Query(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if keys == nil {
+		keys = []entity.APIKey{}
+	}
+	return keys, nil
+}
+
+// CreateAPIKey creates a new API key for the user with the specified ID.
+func (s service) CreateAPIKey(ctx context.Context, userID string, req CreateAPIKeyRequest) (NewAPIKey, error) {
+	if err := req.Validate(); err != nil {
+		return NewAPIKey{}, err
+	}
+	user, err := s.repo.Get(ctx, userID)
+	if err != nil {
+		return NewAPIKey{}, err
+	}
+	var allowed []interface{}
+	for _, permission := range Permissions(user.Roles...) {
+		allowed = append(allowed, permission)
+	}
+	if err := validation.Validate(req.Scopes, validation.Each(validation.In(allowed...))); err != nil {
+		return NewAPIKey{}, validation.Errors{"scopes": err}
+	}
+
+	key, prefix, err := generateAPIKey()
+	if err != nil {
+		return NewAPIKey{}, err
+	}
+	now := time.Now()
+	apiKey := entity.APIKey{
+		ID:        entity.GenerateID(),
+		UserID:    userID,
+		Name:      req.Name,
+		Prefix:    prefix,
+		KeyHash:   HashToken(key),
+		Scopes:    req.Scopes,
+		CreatedAt: now,
+	}
+	if req.ExpiresIn > 0 {
+		expiresAt := now.Add(time.Duration(req.ExpiresIn) * time.Second)
+		apiKey.ExpiresAt = &expiresAt
+	}
+	err = s.transactional(ctx, func(ctx context.Context) error {
+		if err := s.apiKeyRepo.Create(ctx, apiKey); err != nil {
+			return err
+		}
+		return s.auditor.Record(ctx, entity.AuditCreate, auditAPIKeyResource, apiKey.ID, nil, apiKey)
+	})
+	if err != nil {
+		return NewAPIKey{}, err
+	}
+	s.logger.With(ctx, "user", user.Name).Infof("API key %v created", apiKey.Prefix)
+	return NewAPIKey{APIKey: apiKey, Key: key}, nil
+}
+
+// DeleteAPIKey revokes the API key with the specified ID of the user with the specified ID.
+// sql.ErrNoRows is returned if the user has no such key.
+func (s service) DeleteAPIKey(ctx context.Context, userID, id string) error {
+	keys, err := s.apiKeyRepo.Query(ctx, userID)
+	if err != nil {
+		return err
+	}
+	var apiKey *entity.APIKey
+	for i := range keys {
+		if keys[i].ID == id {
+			apiKey = &keys[i]
+		}
+	}
+	if apiKey == nil {
+		return sql.ErrNoRows
+	}
+	err = s.transactional(ctx, func(ctx context.Context) error {
+		if err := s.apiKeyRepo.Delete(ctx, userID, id); err != nil {
+			return err
+		}
+		return s.auditor.Record(ctx, entity.AuditDelete, auditAPIKeyResource, id, *apiKey, nil)
+	})
+	if err != nil {
+		return err
+	}
+	s.logger.With(ctx, "user", userID).Infof("API key %v revoked", id)
+	return nil
+}
+
+// AuthenticateAPIKey returns the identity of the owner of the given API key and the permissions of the key.
+// The permissions are the scopes of the key that are still granted to the owner.
+func (s service) AuthenticateAPIKey(ctx context.Context, key string) (Identity, []string, error) {
+	apiKey, err := s.apiKeyRepo.GetByHash(ctx, HashToken(key))
+	if err == sql.ErrNoRows {
+		return nil, nil, errors.Unauthorized("")
+	} else if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	if apiKey.ExpiresAt != nil && !now.Before(*apiKey.ExpiresAt) {
+		return nil, nil, errors.Unauthorized("API key has expired")
+	}
+	user, err := s.repo.Get(ctx, apiKey.UserID)
+	if err == sql.ErrNoRows {
+		return nil, nil, errors.Unauthorized("")
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) >= apiKeyUsageInterval {
+		if err := s.apiKeyRepo.MarkUsed(ctx, apiKey.ID, now); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	granted := map[string]bool{}
+	for _, permission := range Permissions(user.Roles...) {
+		granted[permission] = true
+	}
+	permissions := []string{}
+	for _, scope := range apiKey.Scopes {
+		if granted[scope] {
+			permissions = append(permissions, scope)
+		}
+	}
+	return user, permissions, nil
+}
+
+// generateAPIKey returns a new random API key and its visible prefix.
+func generateAPIKey() (key, prefix string, err error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	secret, err := GenerateToken()
+	if err != nil {
+		return "", "", err
+	}
+	prefix = apiKeyPrefix + hex.EncodeToString(b)
+	return prefix + "_" + secret, prefix, nil
+}
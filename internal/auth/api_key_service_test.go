@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garaekz/priv8/internal/entity"
+	"github.com/garaekz/priv8/internal/errors"
+	"github.com/garaekz/priv8/pkg/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateAPIKeyRequest_Validate(t *testing.T) {
+	scopes := []string{PermissionAlbumCreate}
+	assert.Nil(t, CreateAPIKeyRequest{Name: "ci", Scopes: scopes}.Validate())
+	assert.Nil(t, CreateAPIKeyRequest{Name: "ci", Scopes: scopes, ExpiresIn: 3600}.Validate())
+	assert.NotNil(t, CreateAPIKeyRequest{Scopes: scopes}.Validate())
+	assert.NotNil(t, CreateAPIKeyRequest{Name: strings.Repeat("x", 65), Scopes: scopes}.Validate())
+	assert.NotNil(t, CreateAPIKeyRequest{Name: "ci"}.Validate())
+	assert.NotNil(t, CreateAPIKeyRequest{Name: "ci", Scopes: scopes, ExpiresIn: 10}.Validate())
+}
+
+func Test_service_APIKeys(t *testing.T) {
+	logger, _ := log.NewForTest()
+	repo := newMockRepository()
+	apiKeyRepo := &mockAPIKeyRepository{}
+	auditor := &mockAuditor{}
+	s := NewService(repo, &mockTokenRepository{}, &mockSessionRepository{}, apiKeyRepo, &mockPasswordResetRepository{}, NewMemoryDenylist(), NewKeyRing(NewHMACKey("test")), NewThrottler(NewMemoryAttemptStore(), logger), &mockMailer{}, &mockAlbumDeleter{}, auditor, withoutTransaction, "", 15*time.Minute, time.Hour, logger)
+	ctx := WithUser(context.Background(), "100", "demo", RoleUser)
+
+	// scopes must be granted to the user
+	_, err := s.CreateAPIKey(ctx, "100", CreateAPIKeyRequest{Name: "ci", Scopes: []string{PermissionAlbumManage}})
+	assert.NotNil(t, err)
+	_, err = s.CreateAPIKey(ctx, "unknown", CreateAPIKeyRequest{Name: "ci", Scopes: []string{PermissionAlbumCreate}})
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	// create
+	key, err := s.CreateAPIKey(ctx, "100", CreateAPIKeyRequest{Name: "ci", Scopes: []string{PermissionAlbumCreate}})
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(key.Key, key.Prefix+"_"))
+	assert.True(t, strings.HasPrefix(key.Prefix, apiKeyPrefix))
+	assert.Equal(t, HashToken(key.Key), key.KeyHash)
+	assert.Nil(t, key.ExpiresAt)
+	keys, err := s.QueryAPIKeys(ctx, "100")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(keys))
+
+	// authenticate
+	identity, permissions, err := s.AuthenticateAPIKey(ctx, key.Key)
+	assert.Nil(t, err)
+	assert.Equal(t, "100", identity.GetID())
+	assert.Equal(t, []string{PermissionAlbumCreate}, permissions)
+	assert.NotNil(t, apiKeyRepo.items[0].LastUsedAt)
+	_, _, err = s.AuthenticateAPIKey(ctx, "priv8_xyz")
+	assert.Equal(t, errors.Unauthorized(""), err)
+
+	// scopes that are no longer granted to the user are dropped
+	apiKeyRepo.items[0].Scopes = entity.Scopes{PermissionAlbumCreate, PermissionAlbumManage}
+	_, permissions, _ = s.AuthenticateAPIKey(ctx, key.Key)
+	assert.Equal(t, []string{PermissionAlbumCreate}, permissions)
+
+	// expired
+	expired, err := s.CreateAPIKey(ctx, "100", CreateAPIKeyRequest{Name: "old", Scopes: []string{PermissionAlbumCreate}, ExpiresIn: 60})
+	assert.Nil(t, err)
+	past := time.Now().Add(-time.Minute)
+	apiKeyRepo.items[1].ExpiresAt = &past
+	_, _, err = s.AuthenticateAPIKey(ctx, expired.Key)
+	assert.Equal(t, errors.Unauthorized("API key has expired"), err)
+
+	// delete
+	assert.Equal(t, sql.ErrNoRows, s.DeleteAPIKey(ctx, "101", key.ID))
+	assert.Nil(t, s.DeleteAPIKey(ctx, "100", key.ID))
+	_, _, err = s.AuthenticateAPIKey(ctx, key.Key)
+	assert.NotNil(t, err)
+	keys, _ = s.QueryAPIKeys(ctx, "100")
+	assert.Equal(t, 1, len(keys))
+
+	// creations and deletions are audited
+	assert.Equal(t, []entity.AuditRecord{
+		{ActorID: "100", Action: entity.AuditCreate, ResourceType: "api_key", ResourceID: key.ID},
+		{ActorID: "100", Action: entity.AuditCreate, ResourceType: "api_key", ResourceID: expired.ID},
+		{ActorID: "100", Action: entity.AuditDelete, ResourceType: "api_key", ResourceID: key.ID},
+	}, auditor.records)
+}
+
+type mockAPIKeyRepository struct {
+	items []entity.APIKey
+}
+
+func (m mockAPIKeyRepository) GetByHash(_ context.Context, hash string) (entity.APIKey, error) {
+	for _, item := range m.items {
+		if item.KeyHash == hash {
+			return item, nil
+		}
+	}
+	return entity.APIKey{}, sql.ErrNoRows
+}
+
+func (m mockAPIKeyRepository) Query(_ context.Context, userID string) ([]entity.APIKey, error) {
+	var keys []entity.APIKey
+	for _, item := range m.items {
+		if item.UserID == userID {
+			keys = append(keys, item)
+		}
+	}
+	return keys, nil
+}
+
+func (m *mockAPIKeyRepository) Create(_ context.Context, key entity.APIKey) error {
+	m.items = append(m.items, key)
+	return nil
+}
+
+func (m *mockAPIKeyRepository) Delete(_ context.Context, userID, id string) error {
+	for i, item := range m.items {
+		if item.ID == id && item.UserID == userID {
+			m.items = append(m.items[:i], m.items[i+1:]...)
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (m *mockAPIKeyRepository) MarkUsed(_ context.Context, id string, at time.Time) error {
+	for i, item := range m.items {
+		if item.ID == id {
+			m.items[i].LastUsedAt = &at
+		}
+	}
+	return nil
+}
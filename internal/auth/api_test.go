@@ -2,34 +2,318 @@ package auth
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"database/sql"
 	"net/http"
 	"testing"
+	"time"
 
+	"github.com/garaekz/priv8/internal/entity"
 	"github.com/garaekz/priv8/internal/errors"
 	"github.com/garaekz/priv8/internal/test"
 	"github.com/garaekz/priv8/pkg/log"
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
 )
 
 type mockService struct{}
 
-func (mockService) Login(_ context.Context, username, password string) (string, error) {
+func (mockService) Login(_ context.Context, username, password string) (Tokens, error) {
 	if username == "test" && password == "pass" {
-		return "token-100", nil
+		return Tokens{AccessToken: "token-100", RefreshToken: "refresh-100", ExpiresIn: 900}, nil
 	}
-	return "", errors.Unauthorized("")
+	return Tokens{}, errors.Unauthorized("")
+}
+
+func (mockService) Refresh(_ context.Context, refreshToken string) (Tokens, error) {
+	if refreshToken == "refresh-100" {
+		return Tokens{AccessToken: "token-101", RefreshToken: "refresh-101", ExpiresIn: 900}, nil
+	}
+	return Tokens{}, errors.Unauthorized("")
+}
+
+func (mockService) Logout(_ context.Context, userID, _, tokenID string, _ time.Time, refreshToken string) error {
+	if userID != "100" || tokenID != "TEST" || refreshToken == "error" {
+		return errors.InternalServerError("")
+	}
+	return nil
+}
+
+func (mockService) Register(_ context.Context, input RegisterRequest) (entity.User, error) {
+	if err := input.Validate(); err != nil {
+		return entity.User{}, err
+	}
+	if input.Username == "taken" {
+		return entity.User{}, validation.Errors{"username": validation.NewError("validation_username_taken", "is already taken")}
+	}
+	return entity.User{ID: "101", Name: input.Username}, nil
+}
+
+func (mockService) ChangePassword(_ context.Context, id string, input ChangePasswordRequest) error {
+	if err := input.Validate(); err != nil {
+		return err
+	}
+	if id != "100" {
+		return errors.NotFound("")
+	}
+	return nil
+}
+
+func (mockService) DeleteAccount(_ context.Context, id string) (entity.User, error) {
+	return entity.User{ID: id, Name: "Tester"}, nil
+}
+
+func (mockService) QueryAPIKeys(_ context.Context, userID string) ([]entity.APIKey, error) {
+	return []entity.APIKey{{ID: "key1", UserID: userID, Name: "ci", Prefix: "priv8_abc"}}, nil
+}
+
+func (mockService) CreateAPIKey(_ context.Context, userID string, input CreateAPIKeyRequest) (NewAPIKey, error) {
+	if err := input.Validate(); err != nil {
+		return NewAPIKey{}, err
+	}
+	return NewAPIKey{APIKey: entity.APIKey{ID: "key2", UserID: userID, Name: input.Name, Prefix: "priv8_def"}, Key: "priv8_def_secret"}, nil
+}
+
+func (mockService) DeleteAPIKey(_ context.Context, userID, id string) error {
+	if id != "key1" {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (mockService) AuthenticateAPIKey(_ context.Context, key string) (Identity, []string, error) {
+	return nil, nil, errors.Unauthorized("")
+}
+
+func (mockService) LoginMFA(_ context.Context, mfaToken, code string) (Tokens, error) {
+	if mfaToken == "mfa-100" && code == "123456" {
+		return Tokens{AccessToken: "token-100", RefreshToken: "refresh-100", ExpiresIn: 900}, nil
+	}
+	return Tokens{}, errors.Unauthorized("")
+}
+
+func (mockService) EnrollTOTP(_ context.Context, userID string) (TOTPEnrollment, error) {
+	return TOTPEnrollment{Secret: "JBSWY3DPEHPK3PXP", URI: totpURI("JBSWY3DPEHPK3PXP", "Tester")}, nil
+}
+
+func (mockService) ConfirmTOTP(_ context.Context, userID, code string) (RecoveryCodes, error) {
+	if code != "123456" {
+		return RecoveryCodes{}, invalidCode()
+	}
+	return RecoveryCodes{Codes: []string{"0123-4567-89ab-cdef"}}, nil
+}
+
+func (mockService) DisableTOTP(_ context.Context, userID, code string) error {
+	if code != "123456" {
+		return invalidCode()
+	}
+	return nil
+}
+
+func (mockService) RegenerateRecoveryCodes(_ context.Context, userID, code string) (RecoveryCodes, error) {
+	return mockService{}.ConfirmTOTP(context.Background(), userID, code)
+}
+
+func (mockService) ForgotPassword(_ context.Context, input ForgotPasswordRequest) error {
+	return input.Validate()
+}
+
+func (mockService) ResetPassword(_ context.Context, input ResetPasswordRequest) error {
+	if err := input.Validate(); err != nil {
+		return err
+	}
+	if input.Token != "reset-100" {
+		return errors.BadRequest("The password reset token is invalid or has expired.")
+	}
+	return nil
+}
+
+func (mockService) QuerySessions(_ context.Context, userID string) ([]entity.Session, error) {
+	return []entity.Session{{ID: "session-" + userID}, {ID: "TEST"}}, nil
+}
+
+func (mockService) RevokeSession(_ context.Context, userID, id string) error {
+	if id != "session-"+userID {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (mockService) ValidateSession(_ context.Context, id string) (bool, error) {
+	return true, nil
+}
+
+func (mockService) Impersonate(_ context.Context, actor Identity, userID string) (Tokens, error) {
+	if userID != "101" {
+		return Tokens{}, sql.ErrNoRows
+	}
+	return Tokens{AccessToken: "token-" + userID, ExpiresIn: 600}, nil
 }
 
 func TestAPI(t *testing.T) {
 	logger, _ := log.NewForTest()
 	router := test.MockRouter(logger)
-	RegisterHandlers(router.Group(""), mockService{}, logger)
+	RegisterHandlers(router.Group(""), mockService{}, MockAuthHandler, logger)
+	header := MockAuthHeader()
 
 	tests := []test.APITestCase{
-		{"success", "POST", "/login", `{"username":"test","password":"pass"}`, nil, http.StatusOK, `{"token":"token-100"}`},
+		{"success", "POST", "/login", `{"username":"test","password":"pass"}`, nil, http.StatusOK, `{"token":"token-100","refresh_token":"refresh-100","expires_in":900}`},
 		{"bad credential", "POST", "/login", `{"username":"test","password":"wrong pass"}`, nil, http.StatusUnauthorized, ""},
 		{"bad json", "POST", "/login", `"username":"test","password":"wrong pass"}`, nil, http.StatusBadRequest, ""},
+		{"mfa ok", "POST", "/login/mfa", `{"mfa_token":"mfa-100","code":"123456"}`, nil, http.StatusOK, `{"token":"token-100","refresh_token":"refresh-100","expires_in":900}`},
+		{"mfa bad code", "POST", "/login/mfa", `{"mfa_token":"mfa-100","code":"000000"}`, nil, http.StatusUnauthorized, ""},
+		{"mfa bad json", "POST", "/login/mfa", `"mfa_token":"mfa-100"}`, nil, http.StatusBadRequest, ""},
+		{"refresh ok", "POST", "/token/refresh", `{"refresh_token":"refresh-100"}`, nil, http.StatusOK, `{"token":"token-101","refresh_token":"refresh-101","expires_in":900}`},
+		{"refresh bad token", "POST", "/token/refresh", `{"refresh_token":"refresh-xyz"}`, nil, http.StatusUnauthorized, ""},
+		{"refresh bad json", "POST", "/token/refresh", `"refresh_token":"refresh-100"}`, nil, http.StatusBadRequest, ""},
+		{"me", "GET", "/me", "", header, http.StatusOK, `*"id":"100","name":"Tester","roles":["user"],"permissions":["album:create",*`},
+		{"me auth method", "GET", "/me", "", header, http.StatusOK, `*"auth_method":"token"*`},
+		{"me auth error", "GET", "/me", "", nil, http.StatusUnauthorized, ""},
+		{"sessions", "GET", "/me/sessions", "", header, http.StatusOK, `*"id":"session-100"*`},
+		{"sessions current", "GET", "/me/sessions", "", header, http.StatusOK, `*"current":true}]`},
+		{"sessions auth error", "GET", "/me/sessions", "", nil, http.StatusUnauthorized, ""},
+		{"revoke session", "DELETE", "/me/sessions/session-100", "", header, http.StatusNoContent, ""},
+		{"revoke session unknown", "DELETE", "/me/sessions/session-101", "", header, http.StatusNotFound, ""},
+		{"logout ok", "POST", "/logout", "", header, http.StatusNoContent, ""},
+		{"logout with refresh token", "POST", "/logout", `{"refresh_token":"refresh-100"}`, header, http.StatusNoContent, ""},
+		{"logout bad json", "POST", "/logout", `"refresh_token":"refresh-100"}`, header, http.StatusBadRequest, ""},
+		{"logout auth error", "POST", "/logout", "", nil, http.StatusUnauthorized, ""},
+		{"forgot password", "POST", "/password/forgot", `{"email":"demo@example.com"}`, nil, http.StatusAccepted, ""},
+		{"forgot password input error", "POST", "/password/forgot", `{"email":"demo"}`, nil, http.StatusBadRequest, `*"field":"email"*`},
+		{"forgot password bad json", "POST", "/password/forgot", `"email"}`, nil, http.StatusBadRequest, ""},
+		{"reset password", "POST", "/password/reset", `{"token":"reset-100","new_password":"n3w-pass-word"}`, nil, http.StatusNoContent, ""},
+		{"reset password bad token", "POST", "/password/reset", `{"token":"xyz","new_password":"n3w-pass-word"}`, nil, http.StatusBadRequest, ""},
+		{"reset password input error", "POST", "/password/reset", `{"token":"reset-100","new_password":"short"}`, nil, http.StatusBadRequest, `*"field":"new_password"*`},
+		{"register ok", "POST", "/register", `{"username":"newbie","password":"s3cret-pass"}`, nil, http.StatusCreated, `*"name":"newbie"*`},
+		{"register weak password", "POST", "/register", `{"username":"newbie","password":"password"}`, nil, http.StatusBadRequest, `*"field":"password"*`},
+		{"register taken", "POST", "/register", `{"username":"taken","password":"s3cret-pass"}`, nil, http.StatusBadRequest, `*"field":"username"*`},
+		{"register bad json", "POST", "/register", `"username":"newbie"}`, nil, http.StatusBadRequest, ""},
+		{"change password ok", "PUT", "/me/password", `{"current_password":"pass","new_password":"n3w-pass-word"}`, header, http.StatusNoContent, ""},
+		{"change password input error", "PUT", "/me/password", `{"current_password":"pass","new_password":"short"}`, header, http.StatusBadRequest, `*"field":"new_password"*`},
+		{"change password auth error", "PUT", "/me/password", `{"current_password":"pass","new_password":"n3w-pass-word"}`, nil, http.StatusUnauthorized, ""},
+		{"delete account ok", "DELETE", "/me", "", header, http.StatusOK, `*"id":"100"*`},
+		{"delete account auth error", "DELETE", "/me", "", nil, http.StatusUnauthorized, ""},
+		{"list api keys", "GET", "/me/api-keys", "", header, http.StatusOK, `*"prefix":"priv8_abc"*`},
+		{"create api key", "POST", "/me/api-keys", `{"name":"ci","scopes":["album:create"]}`, header, http.StatusCreated, `*"key":"priv8_def_secret"*`},
+		{"create api key input error", "POST", "/me/api-keys", `{"scopes":["album:create"]}`, header, http.StatusBadRequest, `*"field":"name"*`},
+		{"create api key auth error", "POST", "/me/api-keys", `{"name":"ci","scopes":["album:create"]}`, nil, http.StatusUnauthorized, ""},
+		{"delete api key", "DELETE", "/me/api-keys/key1", "", header, http.StatusNoContent, ""},
+		{"delete api key not found", "DELETE", "/me/api-keys/key0", "", header, http.StatusNotFound, ""},
+		{"enroll totp", "POST", "/me/mfa/totp", "", header, http.StatusOK, `*"secret":"JBSWY3DPEHPK3PXP"*`},
+		{"enroll totp auth error", "POST", "/me/mfa/totp", "", nil, http.StatusUnauthorized, ""},
+		{"confirm totp", "POST", "/me/mfa/totp/confirm", `{"code":"123456"}`, header, http.StatusOK, `{"recovery_codes":["0123-4567-89ab-cdef"]}`},
+		{"confirm totp bad code", "POST", "/me/mfa/totp/confirm", `{"code":"000000"}`, header, http.StatusBadRequest, `*"field":"code"*`},
+		{"disable totp", "DELETE", "/me/mfa/totp", `{"code":"123456"}`, header, http.StatusNoContent, ""},
+		{"disable totp bad json", "DELETE", "/me/mfa/totp", `"code"}`, header, http.StatusBadRequest, ""},
+		{"regenerate recovery codes", "POST", "/me/mfa/recovery-codes", `{"code":"123456"}`, header, http.StatusOK, `*"recovery_codes"*`},
+		{"impersonate forbidden", "POST", "/users/101/impersonate", "", header, http.StatusForbidden, ""},
+		{"impersonate auth error", "POST", "/users/101/impersonate", "", nil, http.StatusUnauthorized, ""},
 	}
 	for _, tc := range tests {
 		test.Endpoint(t, router, tc)
 	}
 }
+
+func TestAPI_requireToken(t *testing.T) {
+	logger, _ := log.NewForTest()
+	router := test.MockRouter(logger)
+	apiKeyAuth := func(c *routing.Context) error {
+		c.Request = c.Request.WithContext(WithUser(c.Request.Context(), "100", "Tester", RoleUser))
+		return nil
+	}
+	RegisterHandlers(router.Group(""), mockService{}, apiKeyAuth, logger)
+
+	test.Endpoint(t, router, test.APITestCase{
+		Name: "api keys cannot create api keys", Method: "POST", URL: "/me/api-keys",
+		Body: `{"name":"ci","scopes":["album:create"]}`, WantStatus: http.StatusForbidden,
+	})
+	test.Endpoint(t, router, test.APITestCase{
+		Name: "api keys cannot delete the account", Method: "DELETE", URL: "/me", WantStatus: http.StatusForbidden,
+	})
+	test.Endpoint(t, router, test.APITestCase{
+		Name: "me with api key", Method: "GET", URL: "/me",
+		WantStatus: http.StatusOK, WantResponse: `*"auth_method":"api_key","expires_at":null*`,
+	})
+}
+
+func TestAPI_requireTokenWithClient(t *testing.T) {
+	logger, _ := log.NewForTest()
+	router := test.MockRouter(logger)
+	RegisterHandlers(router.Group(""), mockService{}, MockAuthHandler, logger)
+	header := MockClientAuthHeader()
+
+	tests := []test.APITestCase{
+		{Name: "clients cannot delete the account", Method: "DELETE", URL: "/me", Header: header, WantStatus: http.StatusForbidden},
+		{Name: "clients cannot change the password", Method: "PUT", URL: "/me/password", Header: header,
+			Body: `{"current_password":"pass","new_password":"n3w-pass-word"}`, WantStatus: http.StatusForbidden},
+		{Name: "clients cannot list api keys", Method: "GET", URL: "/me/api-keys", Header: header, WantStatus: http.StatusForbidden},
+		{Name: "clients cannot create api keys", Method: "POST", URL: "/me/api-keys", Header: header,
+			Body: `{"name":"ci","scopes":["album:create"]}`, WantStatus: http.StatusForbidden},
+		{Name: "clients cannot revoke sessions", Method: "DELETE", URL: "/me/sessions/session-100", Header: header, WantStatus: http.StatusForbidden},
+		{Name: "me with client token", Method: "GET", URL: "/me", Header: header,
+			WantStatus: http.StatusOK, WantResponse: `*"auth_method":"oauth","client_id":"TEST"*`},
+	}
+	for _, tc := range tests {
+		test.Endpoint(t, router, tc)
+	}
+}
+
+func TestAPI_impersonate(t *testing.T) {
+	logger, _ := log.NewForTest()
+	router := test.MockRouter(logger)
+	adminAuth := func(c *routing.Context) error {
+		ctx := WithUser(c.Request.Context(), "102", "admin", RoleUser, RoleAdmin)
+		ctx = WithPermissions(ctx, Permissions(RoleUser, RoleAdmin)...)
+		ctx = withToken(ctx, tokenInfo{ID: "TEST", ExpiresAt: time.Now().Add(time.Hour)})
+		if c.Request.Header.Get("Authorization") == "impersonated" {
+			ctx = WithUser(ctx, "101", "other", RoleUser)
+			ctx = WithPermissions(ctx, Permissions(RoleUser)...)
+			ctx = WithActor(ctx, "102", "admin")
+		}
+		c.Request = c.Request.WithContext(ctx)
+		return nil
+	}
+	RegisterHandlers(router.Group(""), mockService{}, adminAuth, logger)
+	impersonated := http.Header{"Authorization": {"impersonated"}}
+
+	test.Endpoint(t, router, test.APITestCase{
+		Name: "impersonate", Method: "POST", URL: "/users/101/impersonate",
+		WantStatus: http.StatusOK, WantResponse: `{"token":"token-101","expires_in":600}`,
+	})
+	test.Endpoint(t, router, test.APITestCase{
+		Name: "impersonate unknown user", Method: "POST", URL: "/users/999/impersonate", WantStatus: http.StatusNotFound,
+	})
+	test.Endpoint(t, router, test.APITestCase{
+		Name: "impersonation cannot be nested", Method: "POST", URL: "/users/101/impersonate", Header: impersonated,
+		WantStatus: http.StatusForbidden,
+	})
+	test.Endpoint(t, router, test.APITestCase{
+		Name: "impersonation cannot change the password", Method: "PUT", URL: "/me/password", Header: impersonated,
+		Body: `{"current_password":"pass","new_password":"n3w-pass-word"}`, WantStatus: http.StatusForbidden,
+	})
+	test.Endpoint(t, router, test.APITestCase{
+		Name: "me when impersonated", Method: "GET", URL: "/me", Header: impersonated,
+		WantStatus: http.StatusOK, WantResponse: `*"act":{"id":"102","name":"admin"}*`,
+	})
+}
+
+func TestJWKS(t *testing.T) {
+	logger, _ := log.NewForTest()
+	router := test.MockRouter(logger)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	key, _ := ParseSigningKey(encodePKCS8(t, edKey))
+	RegisterJWKSHandler(router, NewKeyRing(key, NewHMACKey("test")))
+
+	test.Endpoint(t, router, test.APITestCase{
+		Name: "jwks", Method: "GET", URL: "/.well-known/jwks.json",
+		WantStatus: http.StatusOK, WantResponse: `*"keys":[{"kty":"OKP","kid":"` + key.ID + `","use":"sig","alg":"EdDSA","crv":"Ed25519"*`,
+	})
+
+	router = test.MockRouter(logger)
+	RegisterJWKSHandler(router, NewKeyRing(NewHMACKey("test")))
+	test.Endpoint(t, router, test.APITestCase{
+		Name: "jwks without public keys", Method: "GET", URL: "/.well-known/jwks.json",
+		WantStatus: http.StatusOK, WantResponse: `{"keys":[]}`,
+	})
+}
@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"context"
+	"github.com/garaekz/priv8/pkg/dbcontext"
+	"github.com/garaekz/priv8/pkg/log"
+	dbx "github.com/go-ozzo/ozzo-dbx"
+	"sync"
+	"time"
+)
+
+// Denylist keeps track of access tokens that are revoked before they expire.
+// Tokens are identified by their "jti" claim. An entry is only needed until the token expires,
+// after which the token is rejected anyway and the entry can be pruned.
+type Denylist interface {
+	// Revoke revokes the token with the specified ID until the given expiration time.
+	Revoke(ctx context.Context, id string, expiresAt time.Time) error
+	// IsRevoked reports whether the token with the specified ID has been revoked.
+	IsRevoked(ctx context.Context, id string) (bool, error)
+	// Prune removes the entries of the tokens that have expired.
+	Prune(ctx context.Context) error
+}
+
+// memoryDenylist keeps revoked tokens in memory. It is only suitable for a single server instance.
+type memoryDenylist struct {
+	mu    sync.RWMutex
+	items map[string]time.Time
+}
+
+// NewMemoryDenylist creates a new denylist that keeps revoked tokens in memory.
+func NewMemoryDenylist() Denylist {
+	return &memoryDenylist{items: map[string]time.Time{}}
+}
+
+// Revoke adds the token to the denylist.
+func (m *memoryDenylist) Revoke(_ context.Context, id string, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.items[id] = expiresAt
+	return nil
+}
+
+// IsRevoked reports whether the token is in the denylist and has not expired yet.
+func (m *memoryDenylist) IsRevoked(_ context.Context, id string) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	expiresAt, ok := m.items[id]
+	return ok && time.Now().Before(expiresAt), nil
+}
+
+// Prune removes the expired tokens from the denylist.
+func (m *memoryDenylist) Prune(_ context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for id, expiresAt := range m.items {
+		if !now.Before(expiresAt) {
+			delete(m.items, id)
+		}
+	}
+	return nil
+}
+
+// dbDenylist keeps revoked tokens in the database so that they are shared by all server instances.
+type dbDenylist struct {
+	db     *dbcontext.DB
+	logger log.Logger
+}
+
+// NewDBDenylist creates a new denylist that keeps revoked tokens in the database.
+func NewDBDenylist(db *dbcontext.DB, logger log.Logger) Denylist {
+	return dbDenylist{db, logger}
+}
+
+// Revoke saves a revoked token record in the database.
+func (r dbDenylist) Revoke(ctx context.Context, id string, expiresAt time.Time) error {
+	_, err := r.db.With(ctx).Upsert("revoked_token", dbx.Params{
+		"id":         id,
+		"expires_at": expiresAt,
+	}, "id").Execute()
+	return err
+}
+
+// IsRevoked checks if an unexpired revoked token record exists in the database.
+func (r dbDenylist) IsRevoked(ctx context.Context, id string) (bool, error) {
+	var count int
+	err := r.db.With(ctx).Select("COUNT(*)").From("revoked_token").
+		Where(dbx.HashExp{"id": id}).
+		AndWhere(dbx.NewExp("expires_at > {:now}", dbx.Params{"now": time.Now()})).
+		Row(&count)
+	return count > 0, err
+}
+
+// Prune deletes the expired token records from the database.
+func (r dbDenylist) Prune(ctx context.Context) error {
+	result, err := r.db.With(ctx).Delete("revoked_token",
+		dbx.NewExp("expires_at <= {:now}", dbx.Params{"now": time.Now()}),
+	).Execute()
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n > 0 {
+		r.logger.With(ctx).Infof("pruned %d expired revoked tokens", n)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"context"
+	"github.com/garaekz/priv8/internal/test"
+	"github.com/garaekz/priv8/pkg/log"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestMemoryDenylist(t *testing.T) {
+	testDenylist(t, NewMemoryDenylist())
+}
+
+func TestDBDenylist(t *testing.T) {
+	logger, _ := log.NewForTest()
+	db := test.DB(t)
+	test.ResetTables(t, db, "revoked_token")
+	testDenylist(t, NewDBDenylist(db, logger))
+}
+
+func testDenylist(t *testing.T, denylist Denylist) {
+	ctx := context.Background()
+
+	revoked, err := denylist.IsRevoked(ctx, "token1")
+	assert.Nil(t, err)
+	assert.False(t, revoked)
+
+	// revoke
+	assert.Nil(t, denylist.Revoke(ctx, "token1", time.Now().Add(time.Hour)))
+	assert.Nil(t, denylist.Revoke(ctx, "token1", time.Now().Add(time.Hour)))
+	assert.Nil(t, denylist.Revoke(ctx, "token2", time.Now().Add(-time.Hour)))
+	revoked, err = denylist.IsRevoked(ctx, "token1")
+	assert.Nil(t, err)
+	assert.True(t, revoked)
+
+	// expired tokens are not reported as revoked
+	revoked, err = denylist.IsRevoked(ctx, "token2")
+	assert.Nil(t, err)
+	assert.False(t, revoked)
+
+	// prune
+	assert.Nil(t, denylist.Prune(ctx))
+	revoked, _ = denylist.IsRevoked(ctx, "token1")
+	assert.True(t, revoked)
+}
@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/garaekz/priv8/internal/entity"
+	"github.com/garaekz/priv8/internal/errors"
+	"github.com/garaekz/priv8/pkg/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_service_Impersonate(t *testing.T) {
+	logger, entries := log.NewForTest()
+	repo := newMockRepository()
+	repo.items = append(repo.items, entity.User{ID: "102", Name: "admin", Roles: []string{RoleUser, RoleAdmin}})
+	s := newTestService(repo, logger).(service)
+	ctx := context.Background()
+	admin := entity.User{ID: "102", Name: "admin", Roles: []string{RoleUser, RoleAdmin}}
+
+	_, err := s.Impersonate(ctx, admin, "102")
+	assert.Equal(t, errors.BadRequest("You cannot impersonate yourself."), err)
+	_, err = s.Impersonate(ctx, admin, "999")
+	assert.Equal(t, sql.ErrNoRows, err)
+	_, err = s.Impersonate(ctx, entity.User{ID: "103", Name: "other admin"}, "102")
+	assert.Equal(t, errors.Forbidden("Administrators cannot be impersonated."), err)
+
+	tokens, err := s.Impersonate(ctx, admin, "100")
+	assert.Nil(t, err)
+	assert.Empty(t, tokens.RefreshToken)
+	assert.Equal(t, 600, tokens.ExpiresIn)
+	mapClaims, err := s.keys.Parse(tokens.AccessToken)
+	if assert.Nil(t, err) {
+		claims, err := ParseAccessClaims(mapClaims)
+		assert.Nil(t, err)
+		assert.Equal(t, "100", claims.UserID)
+		assert.Equal(t, "demo", claims.UserName)
+		assert.Equal(t, Permissions(RoleUser), claims.Permissions)
+		assert.Equal(t, "102", claims.ActorID)
+		assert.Equal(t, "admin", claims.ActorName)
+		assert.Empty(t, claims.SessionID)
+	}
+	if assert.Equal(t, 1, entries.Len()) {
+		assert.Equal(t, "admin", entries.All()[0].ContextMap()["impersonator"])
+	}
+	assert.Equal(t, []entity.AuditRecord{{ActorID: "102", Action: entity.AuditImpersonate, ResourceType: "user", ResourceID: "100"}},
+		s.auditor.(*mockAuditor).records)
+}
@@ -0,0 +1,324 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// KeyRingManifest is the name of the file that lists the keys in a key ring directory.
+const KeyRingManifest = "keyring.yml"
+
+const (
+	// KeyRingReloadInterval is how often the servers reload the key ring from its directory.
+	KeyRingReloadInterval = time.Minute
+	// jwksMaxAge is how long clients may cache the JSON Web Key Set.
+	jwksMaxAge = 5 * time.Minute
+	// MinActivationDelay is the shortest delay before a new key may be used for signing.
+	// By then every server has reloaded the key ring and every client has fetched the new key set.
+	MinActivationDelay = KeyRingReloadInterval + jwksMaxAge
+)
+
+// MaxTokenLifetime returns the longest lifetime of the JWTs signed by the key ring, given the lifetime of access tokens.
+// Refresh tokens and API keys are not JWTs and are not affected by key rotation.
+func MaxTokenLifetime(accessTokenExpiration time.Duration) time.Duration {
+	lifetime := accessTokenExpiration
+	for _, d := range []time.Duration{mfaChallengeLifetime, impersonationLifetime} {
+		if d > lifetime {
+			lifetime = d
+		}
+	}
+	return lifetime
+}
+
+// KeyRing holds the keys used to sign and verify JWTs.
+//
+// One key is used for signing at a time. Keys that were used for signing before remain available
+// for verification until they are retired, so that the tokens they signed stay valid while the
+// signing key is being rotated. The verification key of a token is selected by its "kid" header.
+type KeyRing struct {
+	mu      sync.RWMutex
+	dir     string
+	entries []keyEntry
+}
+
+// keyEntry represents a key in a key ring.
+type keyEntry struct {
+	key SigningKey
+	// activeFrom is the time from which the key may be used for signing.
+	activeFrom time.Time
+	// retireAt is the time from which the key is no longer accepted. Zero means never.
+	retireAt time.Time
+	// verifyOnly indicates that the key is never used for signing.
+	verifyOnly bool
+}
+
+// manifest describes the keys stored in a key ring directory.
+type manifest struct {
+	Keys []manifestEntry `yaml:"keys"`
+}
+
+// manifestEntry describes a PEM-encoded private key stored in a key ring directory.
+// A key is used for signing from its activation time until a newer key is activated,
+// and it is accepted for verification until its retirement time.
+type manifestEntry struct {
+	File       string    `yaml:"file"`
+	ActiveFrom time.Time `yaml:"active_from"`
+	RetireAt   time.Time `yaml:"retire_at,omitempty"`
+}
+
+// NewKeyRing creates a key ring that signs with the given key and accepts tokens signed by any of the given keys.
+func NewKeyRing(signingKey SigningKey, verificationKeys ...SigningKey) *KeyRing {
+	entries := []keyEntry{{key: signingKey}}
+	for _, key := range verificationKeys {
+		entries = append(entries, keyEntry{key: key, verifyOnly: true})
+	}
+	return &KeyRing{entries: entries}
+}
+
+// LoadKeyRing loads a key ring from the manifest and the PEM files in the given directory.
+func LoadKeyRing(dir string) (*KeyRing, error) {
+	r := &KeyRing{dir: dir}
+	return r, r.Reload()
+}
+
+// Reload reloads the key ring from its directory so that keys rotated by another process are picked up.
+// It does nothing if the key ring was not loaded from a directory.
+func (r *KeyRing) Reload() error {
+	if r.dir == "" {
+		return nil
+	}
+	m, err := readManifest(r.dir)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	var entries []keyEntry
+	for _, item := range m.Keys {
+		if !item.RetireAt.IsZero() && !now.Before(item.RetireAt) {
+			continue
+		}
+		key, err := LoadSigningKey(filepath.Join(r.dir, item.File))
+		if err != nil {
+			return fmt.Errorf("failed to load key %v: %w", item.File, err)
+		}
+		entries = append(entries, keyEntry{
+			key:        key,
+			activeFrom: item.ActiveFrom,
+			retireAt:   item.RetireAt,
+		})
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("no keys found in %v", filepath.Join(r.dir, KeyRingManifest))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = entries
+	return nil
+}
+
+// SigningKey returns the key that is currently used for signing.
+// If several keys are active, the most recently activated one is returned.
+func (r *KeyRing) SigningKey() (SigningKey, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	now := time.Now()
+	var result *keyEntry
+	for i, entry := range r.entries {
+		if entry.verifyOnly || entry.activeFrom.After(now) || !entry.retireAt.IsZero() && !now.Before(entry.retireAt) {
+			continue
+		}
+		if result == nil || entry.activeFrom.After(result.activeFrom) {
+			result = &r.entries[i]
+		}
+	}
+	if result == nil {
+		return SigningKey{}, false
+	}
+	return result.key, true
+}
+
+// VerificationKey returns the unretired key with the given key ID.
+func (r *KeyRing) VerificationKey(id string) (SigningKey, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	now := time.Now()
+	for _, entry := range r.entries {
+		if entry.key.ID == id && (entry.retireAt.IsZero() || now.Before(entry.retireAt)) {
+			return entry.key, true
+		}
+	}
+	return SigningKey{}, false
+}
+
+// Keys returns all unretired keys, including the ones that are not active yet.
+func (r *KeyRing) Keys() []SigningKey {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	now := time.Now()
+	var keys []SigningKey
+	for _, entry := range r.entries {
+		if entry.retireAt.IsZero() || now.Before(entry.retireAt) {
+			keys = append(keys, entry.key)
+		}
+	}
+	return keys
+}
+
+// Sign signs the given claims with the current signing key and returns the encoded JWT.
+func (r *KeyRing) Sign(claims jwt.Claims) (string, error) {
+	key, ok := r.SigningKey()
+	if !ok {
+		return "", fmt.Errorf("no active signing key")
+	}
+	return key.Sign(claims)
+}
+
+// Parse verifies the given JWT with the key named in its "kid" header and returns its claims.
+// An error is returned if the token is invalid or has expired.
+func (r *KeyRing) Parse(token string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, r.keyFunc)
+	return claims, err
+}
+
+// keyFunc returns the key for verifying the given token. The token must be signed
+// with the algorithm of the key so that a public key cannot be abused as an HMAC secret.
+func (r *KeyRing) keyFunc(token *jwt.Token) (interface{}, error) {
+	id, _ := token.Header["kid"].(string)
+	key, ok := r.VerificationKey(id)
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", id)
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %v", token.Method.Alg())
+	}
+	return key.public, nil
+}
+
+// GenerateSigningKey generates a new private key for the given JWT signing algorithm and returns it PEM-encoded.
+// The supported algorithms are RS256, ES256, ES384, ES512 and EdDSA.
+func GenerateSigningKey(alg string) ([]byte, error) {
+	var key interface{}
+	var err error
+	switch alg {
+	case "RS256":
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "ES256":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ES384":
+		key, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case "ES512":
+		key, err = ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	case "EdDSA":
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// RotateKeys adds a newly generated key to the key ring in the given directory and returns it.
+//
+// The new key becomes the signing key after activationDelay, which should be long enough for every
+// server to reload the key ring, so that all of them can verify the new tokens before any are issued.
+// The keys that were used for signing before become verification-only and are retired once the
+// tokens they signed have expired, i.e. maxTokenLifetime after the new key is activated.
+// Retired keys are removed from the directory.
+func RotateKeys(dir, alg string, activationDelay, maxTokenLifetime time.Duration) (SigningKey, error) {
+	m, err := readManifest(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return SigningKey{}, err
+	}
+
+	data, err := GenerateSigningKey(alg)
+	if err != nil {
+		return SigningKey{}, err
+	}
+	key, err := ParseSigningKey(data)
+	if err != nil {
+		return SigningKey{}, err
+	}
+	file := key.ID + ".pem"
+	if err := ioutil.WriteFile(filepath.Join(dir, file), data, 0600); err != nil {
+		return SigningKey{}, err
+	}
+
+	// the first key of a key ring is activated immediately as there are no servers that do not know it
+	now := time.Now().UTC()
+	activeFrom := now.Add(activationDelay)
+	if len(m.Keys) == 0 {
+		activeFrom = now
+	}
+	var keys []manifestEntry
+	var retired []string
+	for _, item := range m.Keys {
+		if item.RetireAt.IsZero() {
+			item.RetireAt = activeFrom.Add(maxTokenLifetime)
+		}
+		if now.Before(item.RetireAt) {
+			keys = append(keys, item)
+		} else {
+			retired = append(retired, item.File)
+		}
+	}
+	keys = append(keys, manifestEntry{File: file, ActiveFrom: activeFrom})
+	sort.SliceStable(keys, func(i, j int) bool { return keys[i].ActiveFrom.Before(keys[j].ActiveFrom) })
+	if err := writeManifest(dir, manifest{Keys: keys}); err != nil {
+		return SigningKey{}, err
+	}
+
+	// the files are removed only after the manifest no longer refers to them
+	for _, file := range retired {
+		if err := os.Remove(filepath.Join(dir, file)); err != nil && !os.IsNotExist(err) {
+			return SigningKey{}, err
+		}
+	}
+	return key, nil
+}
+
+// readManifest reads the key ring manifest in the given directory.
+func readManifest(dir string) (manifest, error) {
+	var m manifest
+	data, err := ioutil.ReadFile(filepath.Join(dir, KeyRingManifest))
+	if err != nil {
+		return m, err
+	}
+	err = yaml.Unmarshal(data, &m)
+	return m, err
+}
+
+// writeManifest replaces the key ring manifest in the given directory.
+// The manifest is written to a temporary file first so that readers never see a partial file.
+func writeManifest(dir string, m manifest) error {
+	data, err := yaml.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, KeyRingManifest+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, KeyRingManifest))
+}
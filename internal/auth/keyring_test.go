@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKeyRing(t *testing.T) {
+	hmacKey := NewHMACKey("test")
+	data, _ := GenerateSigningKey("EdDSA")
+	edKey, _ := ParseSigningKey(data)
+	ring := NewKeyRing(edKey, hmacKey)
+
+	key, ok := ring.SigningKey()
+	assert.True(t, ok)
+	assert.Equal(t, edKey.ID, key.ID)
+	assert.Len(t, ring.Keys(), 2)
+	_, ok = ring.VerificationKey("")
+	assert.True(t, ok)
+	_, ok = ring.VerificationKey("unknown")
+	assert.False(t, ok)
+	assert.Nil(t, ring.Reload())
+
+	// tokens are verified by the key named in their kid header
+	for _, k := range []SigningKey{edKey, hmacKey} {
+		signed, _ := k.Sign(jwt.MapClaims{"id": "100"})
+		_, err := jwt.Parse(signed, ring.keyFunc)
+		assert.Nil(t, err)
+	}
+	signed, _ := ring.Sign(jwt.MapClaims{"id": "100"})
+	token, err := jwt.Parse(signed, ring.keyFunc)
+	if assert.Nil(t, err) {
+		assert.Equal(t, edKey.ID, token.Header["kid"])
+	}
+
+	// parse
+	claims, err := ring.Parse(signed)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "100", claims["id"])
+	}
+	expired, _ := ring.Sign(jwt.MapClaims{"id": "100", "exp": time.Now().Add(-time.Minute).Unix()})
+	_, err = ring.Parse(expired)
+	assert.NotNil(t, err)
+	_, err = ring.Parse("xyz")
+	assert.NotNil(t, err)
+
+	// a token must use the algorithm of its key
+	forged, _ := NewHMACKey("test").Sign(jwt.MapClaims{"id": "100"})
+	_, err = jwt.Parse(forged, NewKeyRing(edKey).keyFunc)
+	assert.NotNil(t, err)
+	forged, _ = SigningKey{ID: edKey.ID, Method: jwt.SigningMethodHS256, private: []byte("test")}.Sign(jwt.MapClaims{"id": "100"})
+	_, err = jwt.Parse(forged, ring.keyFunc)
+	assert.NotNil(t, err)
+}
+
+func TestMaxTokenLifetime(t *testing.T) {
+	assert.Equal(t, time.Hour, MaxTokenLifetime(time.Hour))
+	// impersonation tokens outlive short access tokens
+	assert.Equal(t, impersonationLifetime, MaxTokenLifetime(time.Minute))
+	assert.Equal(t, 6*time.Minute, MinActivationDelay)
+}
+
+func TestRotateKeys(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "keyring")
+	defer os.RemoveAll(dir)
+
+	// no key ring yet
+	_, err := LoadKeyRing(dir)
+	assert.NotNil(t, err)
+
+	// the first key is activated immediately
+	key1, err := RotateKeys(dir, "ES256", time.Hour, time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, "ES256", key1.Method.Alg())
+	ring, err := LoadKeyRing(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+	key, _ := ring.SigningKey()
+	assert.Equal(t, key1.ID, key.ID)
+	signed1, _ := ring.Sign(jwt.MapClaims{"id": "100"})
+
+	// the second key is published but not used for signing until it is activated
+	key2, err := RotateKeys(dir, "EdDSA", time.Hour, time.Hour)
+	assert.Nil(t, err)
+	assert.Nil(t, ring.Reload())
+	key, _ = ring.SigningKey()
+	assert.Equal(t, key1.ID, key.ID)
+	assert.Len(t, ring.Keys(), 2)
+	_, ok := ring.VerificationKey(key2.ID)
+	assert.True(t, ok)
+	_, err = jwt.Parse(signed1, ring.keyFunc)
+	assert.Nil(t, err)
+
+	// the third key is activated right away, which retires the second key that never signed a token,
+	// while the first key keeps the retirement time it was given by the previous rotation
+	key3, err := RotateKeys(dir, "RS256", 0, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, ring.Reload())
+	key, _ = ring.SigningKey()
+	assert.Equal(t, key3.ID, key.ID)
+	_, ok = ring.VerificationKey(key2.ID)
+	assert.False(t, ok)
+	_, err = jwt.Parse(signed1, ring.keyFunc)
+	assert.Nil(t, err)
+
+	// retired keys are removed from the directory
+	_, err = os.Stat(filepath.Join(dir, key2.ID+".pem"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, key1.ID+".pem"))
+	assert.Nil(t, err)
+
+	// unsupported algorithm
+	_, err = RotateKeys(dir, "HS256", time.Hour, time.Hour)
+	assert.NotNil(t, err)
+}
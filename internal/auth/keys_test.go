@@ -0,0 +1,136 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseSigningKey(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ec384Key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	ecDER, _ := x509.MarshalECPrivateKey(ecKey)
+
+	tests := []struct {
+		name    string
+		pem     []byte
+		alg     string
+		kty     string
+		wantErr bool
+	}{
+		{"RSA PKCS#1", pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}), "RS256", "RSA", false},
+		{"RSA PKCS#8", encodePKCS8(t, rsaKey), "RS256", "RSA", false},
+		{"EC SEC1", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER}), "ES256", "EC", false},
+		{"EC P-384", encodePKCS8(t, ec384Key), "ES384", "EC", false},
+		{"Ed25519", encodePKCS8(t, edKey), "EdDSA", "OKP", false},
+		{"not PEM", []byte("xyz"), "", "", true},
+		{"public key", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte("xyz")}), "", "", true},
+		{"bad DER", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("xyz")}), "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := ParseSigningKey(tt.pem)
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+			if !assert.Nil(t, err) {
+				return
+			}
+			assert.Equal(t, tt.alg, key.Method.Alg())
+			assert.NotEmpty(t, key.ID)
+			jwk, ok := key.JWK()
+			if assert.True(t, ok) {
+				assert.Equal(t, tt.kty, jwk.Kty)
+				assert.Equal(t, key.ID, jwk.Kid)
+				assert.Equal(t, tt.alg, jwk.Alg)
+			}
+
+			// sign and verify
+			signed, err := key.Sign(jwt.MapClaims{"id": "100"})
+			assert.Nil(t, err)
+			token, err := jwt.Parse(signed, func(*jwt.Token) (interface{}, error) { return key.public, nil })
+			if assert.Nil(t, err) {
+				assert.Equal(t, key.ID, token.Header["kid"])
+				assert.Equal(t, tt.alg, token.Header["alg"])
+			}
+		})
+	}
+}
+
+func TestLoadSigningKey(t *testing.T) {
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	dir, _ := ioutil.TempDir("", "keys")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "key.pem")
+	assert.Nil(t, ioutil.WriteFile(file, encodePKCS8(t, edKey), 0600))
+
+	key, err := LoadSigningKey(file)
+	assert.Nil(t, err)
+	assert.Equal(t, "EdDSA", key.Method.Alg())
+
+	_, err = LoadSigningKey(filepath.Join(dir, "none.pem"))
+	assert.NotNil(t, err)
+}
+
+func TestNewHMACKey(t *testing.T) {
+	key := NewHMACKey("test")
+	assert.Equal(t, "HS256", key.Method.Alg())
+	assert.Empty(t, key.ID)
+	_, ok := key.JWK()
+	assert.False(t, ok)
+
+	signed, err := key.Sign(jwt.MapClaims{"id": "100"})
+	assert.Nil(t, err)
+	token, err := jwt.Parse(signed, func(*jwt.Token) (interface{}, error) { return []byte("test"), nil })
+	if assert.Nil(t, err) {
+		assert.NotContains(t, token.Header, "kid")
+	}
+}
+
+func Test_thumbprint(t *testing.T) {
+	// the example in RFC 7638 section 3.1
+	n, _ := base64.RawURLEncoding.DecodeString("0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw")
+	key := SigningKey{Method: jwt.SigningMethodRS256, public: &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: 65537}}
+	jwk, _ := key.JWK()
+	assert.Equal(t, "AQAB", jwk.E)
+	tp, err := thumbprint(jwk)
+	assert.Nil(t, err)
+	assert.Equal(t, "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs", tp)
+
+	_, err = thumbprint(JWK{Kty: "oct"})
+	assert.NotNil(t, err)
+}
+
+func TestSigningMethodEdDSA(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	sig, err := SigningMethodEdDSA.Sign("payload", priv)
+	assert.Nil(t, err)
+	assert.Nil(t, SigningMethodEdDSA.Verify("payload", sig, pub))
+	assert.Equal(t, jwt.ErrSignatureInvalid, SigningMethodEdDSA.Verify("tampered", sig, pub))
+	assert.Equal(t, jwt.ErrInvalidKeyType, SigningMethodEdDSA.Verify("payload", sig, []byte("test")))
+	_, err = SigningMethodEdDSA.Sign("payload", []byte("test"))
+	assert.Equal(t, jwt.ErrInvalidKeyType, err)
+}
+
+func encodePKCS8(t *testing.T, key interface{}) []byte {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
@@ -0,0 +1,274 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/garaekz/priv8/internal/entity"
+	"github.com/garaekz/priv8/internal/errors"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"strings"
+	"time"
+)
+
+const (
+	// mfaChallengeLifetime is how long a user has to complete the second login step.
+	mfaChallengeLifetime = 5 * time.Minute
+	// recoveryCodeCount is the number of recovery codes generated for a user.
+	recoveryCodeCount = 10
+)
+
+// TOTPEnrollment represents the data needed to add the TOTP secret of a user to an authenticator app.
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	// URI is the otpauth URI of the secret, usually shown as a QR code.
+	URI string `json:"uri"`
+}
+
+// RecoveryCodes represents the recovery codes of a user. They are only returned once, when they are generated.
+type RecoveryCodes struct {
+	Codes []string `json:"recovery_codes"`
+}
+
+// LoginMFA completes a login that requires two-factor authentication.
+// The code is either a TOTP code or an unused recovery code of the user. Failed codes count as failed logins.
+func (s service) LoginMFA(ctx context.Context, mfaToken, code string) (Tokens, error) {
+	claims, err := s.keys.Parse(mfaToken)
+	if err != nil {
+		return Tokens{}, errors.Unauthorized("")
+	}
+	userID, _ := claims["mfa"].(string)
+	user, err := s.repo.Get(ctx, userID)
+	if err == sql.ErrNoRows {
+		return Tokens{}, errors.Unauthorized("")
+	} else if err != nil {
+		return Tokens{}, err
+	}
+	if !user.TOTPEnabled {
+		return Tokens{}, errors.Unauthorized("")
+	}
+	ip := clientIP(ctx)
+	if err := s.throttler.Check(ctx, user.Name, ip); err != nil {
+		return Tokens{}, err
+	}
+
+	ok, err := s.verifySecondFactor(ctx, &user, code)
+	if err != nil {
+		return Tokens{}, err
+	}
+	if !ok {
+		s.logger.With(ctx, "user", user.Name).Infof("two-factor authentication failed")
+		if err := s.throttler.Fail(ctx, user.Name, ip); err != nil {
+			return Tokens{}, err
+		}
+		return Tokens{}, errors.Unauthorized("")
+	}
+	s.logger.With(ctx, "user", user.Name).Infof("two-factor authentication successful")
+	if err := s.throttler.Succeed(ctx, user.Name); err != nil {
+		return Tokens{}, err
+	}
+	return s.issueTokens(ctx, user, "")
+}
+
+// EnrollTOTP generates a new TOTP secret for the user with the specified ID.
+// Two-factor authentication is enabled only after the enrolment is confirmed with a code of the secret.
+func (s service) EnrollTOTP(ctx context.Context, userID string) (TOTPEnrollment, error) {
+	user, err := s.repo.Get(ctx, userID)
+	if err != nil {
+		return TOTPEnrollment{}, err
+	}
+	if user.TOTPEnabled {
+		return TOTPEnrollment{}, errors.BadRequest("Two-factor authentication is already enabled.")
+	}
+
+	if user.TOTPSecret, err = generateTOTPSecret(); err != nil {
+		return TOTPEnrollment{}, err
+	}
+	user.TOTPLastStep = 0
+	user.UpdatedAt = time.Now()
+	if err := s.repo.Update(ctx, user); err != nil {
+		return TOTPEnrollment{}, err
+	}
+	return TOTPEnrollment{Secret: user.TOTPSecret, URI: totpURI(user.TOTPSecret, user.Name)}, nil
+}
+
+// ConfirmTOTP enables two-factor authentication for the user with the specified ID
+// if the code matches the enrolled TOTP secret. It returns a new set of recovery codes.
+func (s service) ConfirmTOTP(ctx context.Context, userID, code string) (RecoveryCodes, error) {
+	user, err := s.repo.Get(ctx, userID)
+	if err != nil {
+		return RecoveryCodes{}, err
+	}
+	if user.TOTPEnabled {
+		return RecoveryCodes{}, errors.BadRequest("Two-factor authentication is already enabled.")
+	}
+	if user.TOTPSecret == "" {
+		return RecoveryCodes{}, errors.BadRequest("Two-factor authentication has not been enrolled.")
+	}
+	step, ok := validateTOTP(user.TOTPSecret, code, time.Now(), user.TOTPLastStep)
+	if !ok {
+		return RecoveryCodes{}, invalidCode()
+	}
+
+	before := user
+	user.TOTPEnabled = true
+	user.TOTPLastStep = step
+	user.UpdatedAt = time.Now()
+	var codes RecoveryCodes
+	err = s.transactional(ctx, func(ctx context.Context) error {
+		if ok, err := s.repo.UseTOTPStep(ctx, user.ID, step); err != nil {
+			return err
+		} else if !ok {
+			return invalidCode()
+		}
+		if err := s.repo.Update(ctx, user); err != nil {
+			return err
+		}
+		if codes, err = s.generateRecoveryCodes(ctx, user); err != nil {
+			return err
+		}
+		return s.auditor.Record(ctx, entity.AuditUpdate, auditUserResource, user.ID, before, user)
+	})
+	if err != nil {
+		return RecoveryCodes{}, err
+	}
+	s.logger.With(ctx, "user", user.Name).Infof("two-factor authentication enabled")
+	return codes, nil
+}
+
+// DisableTOTP disables two-factor authentication for the user with the specified ID
+// if the code is a valid TOTP code or recovery code of the user.
+func (s service) DisableTOTP(ctx context.Context, userID, code string) error {
+	user, err := s.repo.Get(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if !user.TOTPEnabled {
+		return errors.BadRequest("Two-factor authentication is not enabled.")
+	}
+	if ok, err := s.verifySecondFactor(ctx, &user, code); err != nil {
+		return err
+	} else if !ok {
+		return invalidCode()
+	}
+
+	before := user
+	user.TOTPEnabled = false
+	user.TOTPSecret = ""
+	user.TOTPLastStep = 0
+	user.UpdatedAt = time.Now()
+	err = s.transactional(ctx, func(ctx context.Context) error {
+		if err := s.repo.Update(ctx, user); err != nil {
+			return err
+		}
+		if err := s.repo.ReplaceRecoveryCodes(ctx, user.ID, nil); err != nil {
+			return err
+		}
+		return s.auditor.Record(ctx, entity.AuditUpdate, auditUserResource, user.ID, before, user)
+	})
+	if err != nil {
+		return err
+	}
+	s.logger.With(ctx, "user", user.Name).Infof("two-factor authentication disabled")
+	return nil
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the user with the specified ID
+// if the code is a valid TOTP code of the user.
+func (s service) RegenerateRecoveryCodes(ctx context.Context, userID, code string) (RecoveryCodes, error) {
+	user, err := s.repo.Get(ctx, userID)
+	if err != nil {
+		return RecoveryCodes{}, err
+	}
+	if !user.TOTPEnabled {
+		return RecoveryCodes{}, errors.BadRequest("Two-factor authentication is not enabled.")
+	}
+	step, ok := validateTOTP(user.TOTPSecret, code, time.Now(), user.TOTPLastStep)
+	if !ok {
+		return RecoveryCodes{}, invalidCode()
+	}
+	user.TOTPLastStep = step
+	user.UpdatedAt = time.Now()
+	var codes RecoveryCodes
+	err = s.transactional(ctx, func(ctx context.Context) error {
+		if ok, err := s.repo.UseTOTPStep(ctx, user.ID, step); err != nil {
+			return err
+		} else if !ok {
+			return invalidCode()
+		}
+		if err := s.repo.Update(ctx, user); err != nil {
+			return err
+		}
+		if codes, err = s.generateRecoveryCodes(ctx, user); err != nil {
+			return err
+		}
+		// the codes themselves are secret, so only the fact that they were replaced is recorded
+		return s.auditor.Record(ctx, entity.AuditUpdate, auditRecoveryCodesResource, user.ID, nil, nil)
+	})
+	if err != nil {
+		return RecoveryCodes{}, err
+	}
+	return codes, nil
+}
+
+// issueMFAChallenge returns the challenge token that the user must present together with a second factor
+// to complete the login. The token only identifies the user, so it cannot be used as an access token.
+func (s service) issueMFAChallenge(user entity.User) (Tokens, error) {
+	token, err := s.keys.Sign(jwt.MapClaims{
+		"mfa": user.ID,
+		"exp": time.Now().Add(mfaChallengeLifetime).Unix(),
+	})
+	if err != nil {
+		return Tokens{}, err
+	}
+	return Tokens{MFAToken: token, ExpiresIn: int(mfaChallengeLifetime.Seconds())}, nil
+}
+
+// verifySecondFactor checks whether the code is a valid TOTP code or an unused recovery code of the user.
+// The code is consumed if it is valid. A TOTP code is rejected if a concurrent request has used it already.
+func (s service) verifySecondFactor(ctx context.Context, user *entity.User, code string) (bool, error) {
+	if step, ok := validateTOTP(user.TOTPSecret, code, time.Now(), user.TOTPLastStep); ok {
+		ok, err := s.repo.UseTOTPStep(ctx, user.ID, step)
+		if ok {
+			user.TOTPLastStep = step
+		}
+		return ok, err
+	}
+	ok, err := s.repo.UseRecoveryCode(ctx, user.ID, HashToken(normalizeRecoveryCode(code)))
+	if ok {
+		s.logger.With(ctx, "user", user.Name).Infof("recovery code used")
+	}
+	return ok, err
+}
+
+// generateRecoveryCodes replaces the recovery codes of the user with new ones.
+func (s service) generateRecoveryCodes(ctx context.Context, user entity.User) (RecoveryCodes, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err != nil {
+			return RecoveryCodes{}, err
+		}
+		code := hex.EncodeToString(b)
+		codes[i] = code[:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:]
+		hashes[i] = HashToken(code)
+	}
+	if err := s.repo.ReplaceRecoveryCodes(ctx, user.ID, hashes); err != nil {
+		return RecoveryCodes{}, err
+	}
+	s.logger.With(ctx, "user", user.Name).Infof("recovery codes generated")
+	return RecoveryCodes{Codes: codes}, nil
+}
+
+// normalizeRecoveryCode removes the separators from a recovery code so that it can be typed in any grouping.
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// invalidCode returns the validation error of an invalid second factor code.
+func invalidCode() error {
+	return validation.Errors{"code": validation.NewError("validation_code_invalid", "is invalid")}
+}
@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/garaekz/priv8/internal/entity"
+	"github.com/garaekz/priv8/internal/errors"
+	"github.com/garaekz/priv8/pkg/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_service_TOTP(t *testing.T) {
+	logger, _ := log.NewForTest()
+	repo := newMockRepository()
+	s := newTestService(repo, logger)
+	auditor := s.(service).auditor.(*mockAuditor)
+	ctx := context.Background()
+	stepCode := func(step int64) string {
+		key, _ := totpEncoding.DecodeString(repo.items[0].TOTPSecret)
+		return totpCode(key, step)
+	}
+	code := func(offset int64) string {
+		return stepCode(time.Now().Unix()/totpPeriod + offset)
+	}
+
+	// confirmation requires an enrolment
+	_, err := s.ConfirmTOTP(ctx, "100", "123456")
+	assert.NotNil(t, err)
+
+	// enrol
+	enrollment, err := s.EnrollTOTP(ctx, "100")
+	assert.Nil(t, err)
+	assert.NotEmpty(t, enrollment.Secret)
+	assert.Contains(t, enrollment.URI, "secret="+enrollment.Secret)
+	assert.False(t, repo.items[0].TOTPEnabled)
+
+	// login is not affected until the enrolment is confirmed
+	tokens, err := s.Login(ctx, "demo", "pass")
+	assert.Nil(t, err)
+	assert.NotEmpty(t, tokens.AccessToken)
+
+	// confirm
+	_, err = s.ConfirmTOTP(ctx, "100", "000000")
+	assert.Equal(t, invalidCode(), err)
+	codes, err := s.ConfirmTOTP(ctx, "100", code(0))
+	assert.Nil(t, err)
+	assert.Len(t, codes.Codes, recoveryCodeCount)
+	assert.True(t, repo.items[0].TOTPEnabled)
+	assert.Equal(t, entity.AuditRecord{Action: entity.AuditUpdate, ResourceType: "user", ResourceID: "100"},
+		auditor.records[len(auditor.records)-1])
+	_, err = s.EnrollTOTP(ctx, "100")
+	assert.NotNil(t, err)
+
+	// login with a TOTP code, which cannot be used twice
+	tokens, err = s.Login(ctx, "demo", "pass")
+	assert.Nil(t, err)
+	assert.Empty(t, tokens.AccessToken)
+	assert.NotEmpty(t, tokens.MFAToken)
+	confirmed := repo.items[0].TOTPLastStep
+	stale := repo.items[0]
+	_, err = s.LoginMFA(ctx, tokens.MFAToken, stepCode(confirmed))
+	assert.Equal(t, errors.Unauthorized(""), err)
+	mfaTokens, err := s.LoginMFA(ctx, tokens.MFAToken, stepCode(confirmed+1))
+	assert.Nil(t, err)
+	assert.NotEmpty(t, mfaTokens.AccessToken)
+	assert.NotEmpty(t, mfaTokens.RefreshToken)
+
+	// a concurrent request that read the user before the code was used cannot use it again
+	ok, err := s.(service).verifySecondFactor(ctx, &stale, stepCode(confirmed+1))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// login with a recovery code, which cannot be used twice
+	mfaTokens, err = s.LoginMFA(ctx, tokens.MFAToken, codes.Codes[0])
+	assert.Nil(t, err)
+	assert.NotEmpty(t, mfaTokens.AccessToken)
+	_, err = s.LoginMFA(ctx, tokens.MFAToken, codes.Codes[0])
+	assert.Equal(t, errors.Unauthorized(""), err)
+
+	// access tokens and invalid tokens are not challenge tokens
+	_, err = s.LoginMFA(ctx, mfaTokens.AccessToken, codes.Codes[1])
+	assert.Equal(t, errors.Unauthorized(""), err)
+	_, err = s.LoginMFA(ctx, "xyz", codes.Codes[1])
+	assert.Equal(t, errors.Unauthorized(""), err)
+
+	// regenerate recovery codes
+	_, err = s.RegenerateRecoveryCodes(ctx, "100", codes.Codes[1])
+	assert.Equal(t, invalidCode(), err)
+	_, err = s.RegenerateRecoveryCodes(ctx, "100", code(-1))
+	assert.Equal(t, invalidCode(), err)
+	repo.items[0].TOTPLastStep = 0
+	repo.items[0].UpdatedAt = time.Time{}
+	newCodes, err := s.RegenerateRecoveryCodes(ctx, "100", code(-1))
+	assert.Nil(t, err)
+	assert.False(t, repo.items[0].UpdatedAt.IsZero())
+	assert.Equal(t, entity.AuditRecord{Action: entity.AuditUpdate, ResourceType: "recovery_codes", ResourceID: "100"},
+		auditor.records[len(auditor.records)-1])
+	_, err = s.LoginMFA(ctx, tokens.MFAToken, codes.Codes[1])
+	assert.Equal(t, errors.Unauthorized(""), err)
+
+	// disable
+	assert.Equal(t, invalidCode(), s.DisableTOTP(ctx, "100", "000000"))
+	count := len(auditor.records)
+	assert.Nil(t, s.DisableTOTP(ctx, "100", newCodes.Codes[0]))
+	assert.False(t, repo.items[0].TOTPEnabled)
+	if assert.Equal(t, count+1, len(auditor.records)) {
+		assert.Equal(t, entity.AuditRecord{Action: entity.AuditUpdate, ResourceType: "user", ResourceID: "100"}, auditor.records[count])
+	}
+	assert.Empty(t, repo.items[0].TOTPSecret)
+	assert.NotNil(t, s.DisableTOTP(ctx, "100", newCodes.Codes[1]))
+	tokens, err = s.Login(ctx, "demo", "pass")
+	assert.Nil(t, err)
+	assert.NotEmpty(t, tokens.AccessToken)
+}
+
+func Test_normalizeRecoveryCode(t *testing.T) {
+	assert.Equal(t, "0123456789abcdef", normalizeRecoveryCode("0123-4567-89AB-CDEF"))
+	assert.Equal(t, "0123456789abcdef", normalizeRecoveryCode("0123 4567 89ab cdef"))
+}
@@ -5,36 +5,213 @@ import (
 	"github.com/dgrijalva/jwt-go"
 	"github.com/garaekz/priv8/internal/entity"
 	"github.com/garaekz/priv8/internal/errors"
+	"github.com/garaekz/priv8/pkg/log"
 	routing "github.com/go-ozzo/ozzo-routing/v2"
-	"github.com/go-ozzo/ozzo-routing/v2/auth"
+	"net"
 	"net/http"
+	"strings"
+	"time"
 )
 
-// Handler returns a JWT-based authentication middleware.
-func Handler(verificationKey string) routing.Handler {
-	return auth.JWT(verificationKey, auth.JWTOptions{TokenHandler: handleToken})
+// APIKeyHeader is the HTTP header that carries an API key.
+const APIKeyHeader = "X-API-Key"
+
+// Handler returns an authentication middleware that accepts either a JWT bearer token or an API key.
+// The bearer token must be signed with a key in the given key ring, and tokens found in the given denylist
+// or bound to a session that the given validator rejects are rejected.
+// API keys given in the X-API-Key header are resolved by the given authenticator.
+func Handler(keys *KeyRing, denylist Denylist, apiKeys APIKeyAuthenticator, sessions SessionValidator) routing.Handler {
+	parser := &jwt.Parser{}
+	handle := tokenHandler(denylist, sessions)
+	return func(c *routing.Context) error {
+		if key := c.Request.Header.Get(APIKeyHeader); key != "" {
+			return handleAPIKey(c, apiKeys, key)
+		}
+		header := c.Request.Header.Get("Authorization")
+		if !strings.HasPrefix(header, "Bearer ") {
+			return unauthorized(c, "")
+		}
+		token, err := parser.Parse(header[7:], keys.keyFunc)
+		if err != nil {
+			return unauthorized(c, err.Error())
+		}
+		return handle(c, token)
+	}
+}
+
+// Optional returns a middleware that authenticates a request with the given authentication middleware
+// only if the request carries credentials. Requests without credentials are handled anonymously.
+func Optional(authHandler routing.Handler) routing.Handler {
+	return func(c *routing.Context) error {
+		if c.Request.Header.Get("Authorization") == "" && c.Request.Header.Get(APIKeyHeader) == "" {
+			return nil
+		}
+		return authHandler(c)
+	}
+}
+
+// unauthorized sets the WWW-Authenticate header and returns an authentication error.
+func unauthorized(c *routing.Context, message string) error {
+	c.Response.Header().Set("WWW-Authenticate", `Bearer realm="API"`)
+	return errors.Unauthorized(message)
+}
+
+// tokenHandler returns a function that rejects revoked tokens and the tokens of revoked sessions
+// before passing them to handleToken.
+func tokenHandler(denylist Denylist, sessions SessionValidator) func(c *routing.Context, token *jwt.Token) error {
+	return func(c *routing.Context, token *jwt.Token) error {
+		claims, err := ParseAccessClaims(token.Claims.(jwt.MapClaims))
+		if err != nil {
+			return err
+		}
+		revoked, err := denylist.IsRevoked(c.Request.Context(), claims.ID)
+		if err != nil {
+			return err
+		}
+		if revoked {
+			return unauthorized(c, "token has been revoked")
+		}
+		if claims.SessionID != "" {
+			active, err := sessions.ValidateSession(c.Request.Context(), claims.SessionID)
+			if err != nil {
+				return err
+			}
+			if !active {
+				return unauthorized(c, "session has been revoked")
+			}
+		}
+		return handleToken(c, claims)
+	}
+}
+
+// handleAPIKey stores the identity of the owner of the given API key and the permissions of the key
+// in the request context.
+func handleAPIKey(c *routing.Context, apiKeys APIKeyAuthenticator, key string) error {
+	identity, permissions, err := apiKeys.AuthenticateAPIKey(c.Request.Context(), key)
+	if err != nil {
+		return err
+	}
+	ctx := WithUser(c.Request.Context(), identity.GetID(), identity.GetName(), identity.GetRoles()...)
+	ctx = WithPermissions(ctx, permissions...)
+	c.Request = c.Request.WithContext(ctx)
+	return nil
 }
 
 // handleToken stores the user identity in the request context so that it can be accessed elsewhere.
-func handleToken(c *routing.Context, token *jwt.Token) error {
-	ctx := WithUser(
-		c.Request.Context(),
-		token.Claims.(jwt.MapClaims)["id"].(string),
-		token.Claims.(jwt.MapClaims)["name"].(string),
-	)
+// When the token impersonates the user, the administrator is stored as the actor, and every log message
+// about the request is tagged with the administrator.
+func handleToken(c *routing.Context, claims AccessClaims) error {
+	ctx := WithUser(c.Request.Context(), claims.UserID, claims.UserName, claims.Roles...)
+	ctx = WithPermissions(ctx, claims.Permissions...)
+	ctx = withToken(ctx, tokenInfo{
+		ID:        claims.ID,
+		SessionID: claims.SessionID,
+		ClientID:  claims.ClientID,
+		ExpiresAt: claims.ExpiresAt,
+	})
+	if claims.ActorID != "" {
+		ctx = WithActor(ctx, claims.ActorID, claims.ActorName)
+		ctx = log.WithFields(ctx, "impersonator_id", claims.ActorID, "impersonator", claims.ActorName)
+	}
 	c.Request = c.Request.WithContext(ctx)
 	return nil
 }
 
+// AccessClaims represents the claims of an access token.
+type AccessClaims struct {
+	// ID is the value of the "jti" claim.
+	ID string
+	// SessionID is the ID of the session that the token is bound to. It is empty for tokens issued to OAuth clients.
+	SessionID   string
+	UserID      string
+	UserName    string
+	Roles       []string
+	Permissions []string
+	// ClientID is the ID of the OAuth client that the token was issued to. It is empty for tokens issued at login.
+	ClientID string
+	// ActorID and ActorName come from the "act" claim of an impersonation token. They identify the administrator
+	// who acts as the user, and they are empty for other tokens.
+	ActorID   string
+	ActorName string
+	ExpiresAt time.Time
+}
+
+// ParseAccessClaims extracts the claims of an access token from the claims of a verified JWT.
+// An error is returned if the JWT is not an access token, such as a share link token or a challenge token.
+func ParseAccessClaims(claims jwt.MapClaims) (AccessClaims, error) {
+	id, _ := claims["jti"].(string)
+	if id == "" {
+		return AccessClaims{}, errors.Unauthorized("token has no ID")
+	}
+	userID, _ := claims["id"].(string)
+	name, _ := claims["name"].(string)
+	if userID == "" || name == "" {
+		return AccessClaims{}, errors.Unauthorized("token has no user")
+	}
+	sessionID, _ := claims["sid"].(string)
+	clientID, _ := claims["client_id"].(string)
+	var actorID, actorName string
+	if value, ok := claims["act"]; ok {
+		act, _ := value.(map[string]interface{})
+		actorID, _ = act["id"].(string)
+		actorName, _ = act["name"].(string)
+		if actorID == "" || actorName == "" {
+			return AccessClaims{}, errors.Unauthorized("token has an invalid actor")
+		}
+	}
+	exp, _ := claims["exp"].(float64)
+	return AccessClaims{
+		ID:          id,
+		SessionID:   sessionID,
+		UserID:      userID,
+		UserName:    name,
+		Roles:       stringsClaim(claims, "roles"),
+		Permissions: stringsClaim(claims, "permissions"),
+		ClientID:    clientID,
+		ActorID:     actorID,
+		ActorName:   actorName,
+		ExpiresAt:   time.Unix(int64(exp), 0),
+	}, nil
+}
+
+// stringsClaim returns the strings in the claim with the given name. Values that are not strings are skipped.
+func stringsClaim(claims jwt.MapClaims, name string) []string {
+	values, _ := claims[name].([]interface{})
+	var result []string
+	for _, value := range values {
+		if s, ok := value.(string); ok {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
 type contextKey int
 
 const (
 	userKey contextKey = iota
+	actorKey
+	tokenKey
+	permissionsKey
+	clientIPKey
+	userAgentKey
 )
 
+// tokenInfo describes the access token that authenticated the current request.
+type tokenInfo struct {
+	// ID is the value of the "jti" claim.
+	ID string
+	// SessionID is the ID of the session that the token is bound to, if any.
+	SessionID string
+	// ClientID is the ID of the OAuth client that the token was issued to, if any.
+	ClientID string
+	// ExpiresAt is the time when the token expires.
+	ExpiresAt time.Time
+}
+
 // WithUser returns a context that contains the user identity from the given JWT.
-func WithUser(ctx context.Context, id, name string) context.Context {
-	return context.WithValue(ctx, userKey, entity.User{ID: id, Name: name})
+func WithUser(ctx context.Context, id, name string, roles ...string) context.Context {
+	return context.WithValue(ctx, userKey, entity.User{ID: id, Name: name, Roles: roles})
 }
 
 // CurrentUser returns the user identity from the given context.
@@ -46,15 +223,82 @@ func CurrentUser(ctx context.Context) Identity {
 	return nil
 }
 
+// WithActor returns a context that contains the identity of the administrator who impersonates the current user.
+func WithActor(ctx context.Context, id, name string) context.Context {
+	return context.WithValue(ctx, actorKey, entity.User{ID: id, Name: name})
+}
+
+// CurrentActor returns the identity of the real actor behind the current user in the given context:
+// the administrator when the user is impersonated, and the user otherwise.
+// Nil is returned if no user identity is found in the context.
+func CurrentActor(ctx context.Context) Identity {
+	if actor, ok := ctx.Value(actorKey).(entity.User); ok {
+		return actor
+	}
+	return CurrentUser(ctx)
+}
+
+// IsImpersonated reports whether the current user in the given context is impersonated by an administrator.
+func IsImpersonated(ctx context.Context) bool {
+	_, ok := ctx.Value(actorKey).(entity.User)
+	return ok
+}
+
+// withToken returns a context that contains the information about the access token of the request.
+func withToken(ctx context.Context, token tokenInfo) context.Context {
+	return context.WithValue(ctx, tokenKey, token)
+}
+
+// currentToken returns the information about the access token from the given context.
+// False is returned if the request was not authenticated with an access token.
+func currentToken(ctx context.Context) (tokenInfo, bool) {
+	token, ok := ctx.Value(tokenKey).(tokenInfo)
+	return token, ok
+}
+
+// withClient returns a context that contains the IP address and the user agent of the client that sent the request.
+func withClient(ctx context.Context, req *http.Request) context.Context {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+	ctx = context.WithValue(ctx, clientIPKey, ip)
+	return context.WithValue(ctx, userAgentKey, req.UserAgent())
+}
+
+// clientIP returns the IP address of the client from the given context.
+// An empty string is returned if the context contains no client IP.
+func clientIP(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIPKey).(string)
+	return ip
+}
+
+// userAgent returns the user agent of the client from the given context.
+// An empty string is returned if the context contains no user agent.
+func userAgent(ctx context.Context) string {
+	agent, _ := ctx.Value(userAgentKey).(string)
+	return agent
+}
+
 // MockAuthHandler creates a mock authentication middleware for testing purpose.
 // If the request contains an Authorization header whose value is "TEST", then
-// it considers the user is authenticated as "Tester" whose ID is "100".
-// It fails the authentication otherwise.
+// it considers the user is authenticated as "Tester" whose ID is "100" and whose role is RoleUser.
+// If the value is "TEST-CLIENT", the same user is authenticated with a token issued to the OAuth client "TEST"
+// whose only scope is PermissionAlbumCreate. It fails the authentication otherwise.
 func MockAuthHandler(c *routing.Context) error {
-	if c.Request.Header.Get("Authorization") != "TEST" {
+	var ctx context.Context
+	switch c.Request.Header.Get("Authorization") {
+	case "TEST":
+		ctx = WithUser(c.Request.Context(), "100", "Tester", RoleUser)
+		ctx = WithPermissions(ctx, Permissions(RoleUser)...)
+		ctx = withToken(ctx, tokenInfo{ID: "TEST", SessionID: "TEST", ExpiresAt: time.Now().Add(time.Hour)})
+	case "TEST-CLIENT":
+		ctx = WithUser(c.Request.Context(), "100", "Tester", RoleUser)
+		ctx = WithPermissions(ctx, PermissionAlbumCreate)
+		ctx = withToken(ctx, tokenInfo{ID: "TEST-CLIENT", ClientID: "TEST", ExpiresAt: time.Now().Add(time.Hour)})
+	default:
 		return errors.Unauthorized("")
 	}
-	ctx := WithUser(c.Request.Context(), "100", "Tester")
 	c.Request = c.Request.WithContext(ctx)
 	return nil
 }
@@ -65,3 +309,11 @@ func MockAuthHeader() http.Header {
 	header.Add("Authorization", "TEST")
 	return header
 }
+
+// MockClientAuthHeader returns an HTTP header that MockAuthHandler authenticates with a token
+// issued to an OAuth client.
+func MockClientAuthHeader() http.Header {
+	header := http.Header{}
+	header.Add("Authorization", "TEST-CLIENT")
+	return header
+}
@@ -3,25 +3,177 @@ package auth
 import (
 	"context"
 	"github.com/dgrijalva/jwt-go"
+	"github.com/garaekz/priv8/internal/entity"
+	"github.com/garaekz/priv8/internal/errors"
 	"github.com/garaekz/priv8/internal/test"
 	"github.com/stretchr/testify/assert"
 	"net/http"
 	"testing"
+	"time"
 )
 
 func TestCurrentUser(t *testing.T) {
 	ctx := context.Background()
 	assert.Nil(t, CurrentUser(ctx))
-	ctx = WithUser(ctx, "100", "test")
+	ctx = WithUser(ctx, "100", "test", RoleAdmin)
 	identity := CurrentUser(ctx)
 	if assert.NotNil(t, identity) {
 		assert.Equal(t, "100", identity.GetID())
 		assert.Equal(t, "test", identity.GetName())
+		assert.Equal(t, []string{RoleAdmin}, identity.GetRoles())
 	}
 }
 
+func TestCurrentActor(t *testing.T) {
+	ctx := context.Background()
+	assert.Nil(t, CurrentActor(ctx))
+	ctx = WithUser(ctx, "100", "test", RoleUser)
+	assert.Equal(t, "100", CurrentActor(ctx).GetID())
+	assert.False(t, IsImpersonated(ctx))
+	ctx = WithActor(ctx, "102", "admin")
+	assert.Equal(t, "100", CurrentUser(ctx).GetID())
+	assert.Equal(t, "102", CurrentActor(ctx).GetID())
+	assert.Equal(t, "admin", CurrentActor(ctx).GetName())
+	assert.True(t, IsImpersonated(ctx))
+}
+
 func TestHandler(t *testing.T) {
-	assert.NotNil(t, Handler("test"))
+	key := NewHMACKey("test")
+	handler := Handler(NewKeyRing(key), NewMemoryDenylist(), mockAPIKeyAuthenticator{}, mockSessionValidator{})
+	valid, _ := key.Sign(jwt.MapClaims{"jti": "abc", "id": "100", "name": "test", "exp": time.Now().Add(time.Hour).Unix()})
+	session, _ := key.Sign(jwt.MapClaims{"jti": "abc", "sid": "active", "id": "100", "name": "test", "exp": time.Now().Add(time.Hour).Unix()})
+	revoked, _ := key.Sign(jwt.MapClaims{"jti": "abc", "sid": "revoked", "id": "100", "name": "test", "exp": time.Now().Add(time.Hour).Unix()})
+	expired, _ := key.Sign(jwt.MapClaims{"jti": "abc", "id": "100", "name": "test", "exp": time.Now().Add(-time.Hour).Unix()})
+	otherKey, _ := NewHMACKey("other").Sign(jwt.MapClaims{"jti": "abc", "id": "100", "name": "test"})
+	none, _ := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.MapClaims{"jti": "abc", "id": "100", "name": "test"}).
+		SignedString(jwt.UnsafeAllowNoneSignatureType)
+
+	tests := []struct {
+		name   string
+		header string
+		ok     bool
+	}{
+		{"valid", "Bearer " + valid, true},
+		{"active session", "Bearer " + session, true},
+		{"revoked session", "Bearer " + revoked, false},
+		{"no header", "", false},
+		{"not bearer", "Basic " + valid, false},
+		{"malformed", "Bearer xyz", false},
+		{"expired", "Bearer " + expired, false},
+		{"wrong key", "Bearer " + otherKey, false},
+		{"unsigned", "Bearer " + none, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "http://example.com", nil)
+			req.Header.Set("Authorization", tt.header)
+			ctx, res := test.MockRoutingContext(req)
+			err := handler(ctx)
+			if tt.ok {
+				assert.Nil(t, err)
+				assert.NotNil(t, CurrentUser(ctx.Request.Context()))
+			} else {
+				assert.NotNil(t, err)
+				assert.Nil(t, CurrentUser(ctx.Request.Context()))
+				assert.NotEmpty(t, res.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+
+	// API key
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+	req.Header.Set(APIKeyHeader, "priv8_valid")
+	ctx, _ := test.MockRoutingContext(req)
+	if assert.Nil(t, handler(ctx)) {
+		identity := CurrentUser(ctx.Request.Context())
+		if assert.NotNil(t, identity) {
+			assert.Equal(t, "100", identity.GetID())
+		}
+		assert.True(t, HasPermission(ctx.Request.Context(), PermissionAlbumCreate))
+		assert.False(t, HasPermission(ctx.Request.Context(), PermissionAlbumDelete))
+		_, ok := currentToken(ctx.Request.Context())
+		assert.False(t, ok)
+	}
+	req.Header.Set(APIKeyHeader, "priv8_invalid")
+	ctx, _ = test.MockRoutingContext(req)
+	assert.NotNil(t, handler(ctx))
+	assert.Nil(t, CurrentUser(ctx.Request.Context()))
+}
+
+type mockAPIKeyAuthenticator struct{}
+
+func (mockAPIKeyAuthenticator) AuthenticateAPIKey(_ context.Context, key string) (Identity, []string, error) {
+	if key == "priv8_valid" {
+		return entity.User{ID: "100", Name: "test", Roles: []string{RoleUser}}, []string{PermissionAlbumCreate}, nil
+	}
+	return nil, nil, errors.Unauthorized("")
+}
+
+type mockSessionValidator struct{}
+
+func (mockSessionValidator) ValidateSession(_ context.Context, id string) (bool, error) {
+	return id != "revoked", nil
+}
+
+func TestOptional(t *testing.T) {
+	handler := Optional(MockAuthHandler)
+
+	// anonymous
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+	ctx, _ := test.MockRoutingContext(req)
+	assert.Nil(t, handler(ctx))
+	assert.Nil(t, CurrentUser(ctx.Request.Context()))
+
+	// authenticated
+	req.Header = MockAuthHeader()
+	ctx, _ = test.MockRoutingContext(req)
+	assert.Nil(t, handler(ctx))
+	assert.NotNil(t, CurrentUser(ctx.Request.Context()))
+
+	// invalid credentials
+	req.Header.Set("Authorization", "Bearer xyz")
+	ctx, _ = test.MockRoutingContext(req)
+	assert.NotNil(t, handler(ctx))
+}
+
+func Test_tokenHandler(t *testing.T) {
+	denylist := NewMemoryDenylist()
+	handler := tokenHandler(denylist, mockSessionValidator{})
+	newToken := func(claims jwt.MapClaims) *jwt.Token {
+		return &jwt.Token{Claims: claims}
+	}
+
+	// token without ID
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+	ctx, _ := test.MockRoutingContext(req)
+	err := handler(ctx, newToken(jwt.MapClaims{"id": "100", "name": "test"}))
+	assert.NotNil(t, err)
+	assert.Nil(t, CurrentUser(ctx.Request.Context()))
+
+	// token without user
+	ctx, _ = test.MockRoutingContext(req)
+	err = handler(ctx, newToken(jwt.MapClaims{"jti": "abc", "mfa": "100"}))
+	assert.NotNil(t, err)
+	assert.Nil(t, CurrentUser(ctx.Request.Context()))
+
+	// valid token
+	ctx, _ = test.MockRoutingContext(req)
+	err = handler(ctx, newToken(jwt.MapClaims{"jti": "abc", "id": "100", "name": "test"}))
+	assert.Nil(t, err)
+	assert.NotNil(t, CurrentUser(ctx.Request.Context()))
+
+	// revoked session
+	ctx, _ = test.MockRoutingContext(req)
+	err = handler(ctx, newToken(jwt.MapClaims{"jti": "abc", "sid": "revoked", "id": "100", "name": "test"}))
+	assert.NotNil(t, err)
+	assert.Nil(t, CurrentUser(ctx.Request.Context()))
+
+	// revoked token
+	_ = denylist.Revoke(context.Background(), "abc", time.Now().Add(time.Hour))
+	ctx, _ = test.MockRoutingContext(req)
+	err = handler(ctx, newToken(jwt.MapClaims{"jti": "abc", "id": "100", "name": "test"}))
+	assert.NotNil(t, err)
+	assert.Nil(t, CurrentUser(ctx.Request.Context()))
 }
 
 func Test_handleToken(t *testing.T) {
@@ -29,18 +181,69 @@ func Test_handleToken(t *testing.T) {
 	ctx, _ := test.MockRoutingContext(req)
 	assert.Nil(t, CurrentUser(ctx.Request.Context()))
 
-	err := handleToken(ctx, &jwt.Token{
-		Claims: jwt.MapClaims{
-			"id":   "100",
-			"name": "test",
-		},
+	claims, err := ParseAccessClaims(jwt.MapClaims{
+		"jti":         "abc",
+		"sid":         "session",
+		"id":          "100",
+		"name":        "test",
+		"roles":       []interface{}{RoleUser},
+		"permissions": []interface{}{PermissionAlbumCreate, 1},
+		"client_id":   "app",
+		"exp":         float64(1600000000),
 	})
 	assert.Nil(t, err)
+	err = handleToken(ctx, claims)
+	assert.Nil(t, err)
 	identity := CurrentUser(ctx.Request.Context())
 	if assert.NotNil(t, identity) {
 		assert.Equal(t, "100", identity.GetID())
 		assert.Equal(t, "test", identity.GetName())
+		assert.Equal(t, []string{RoleUser}, identity.GetRoles())
 	}
+	assert.True(t, HasPermission(ctx.Request.Context(), PermissionAlbumCreate))
+	assert.False(t, HasPermission(ctx.Request.Context(), PermissionAlbumDelete))
+	token, ok := currentToken(ctx.Request.Context())
+	if assert.True(t, ok) {
+		assert.Equal(t, "abc", token.ID)
+		assert.Equal(t, "session", token.SessionID)
+		assert.Equal(t, "app", token.ClientID)
+		assert.Equal(t, int64(1600000000), token.ExpiresAt.Unix())
+	}
+	assert.False(t, IsImpersonated(ctx.Request.Context()))
+
+	// impersonation
+	ctx, _ = test.MockRoutingContext(req)
+	err = handleToken(ctx, AccessClaims{ID: "abc", UserID: "100", UserName: "test", ActorID: "102", ActorName: "admin"})
+	assert.Nil(t, err)
+	assert.Equal(t, "100", CurrentUser(ctx.Request.Context()).GetID())
+	assert.Equal(t, "102", CurrentActor(ctx.Request.Context()).GetID())
+}
+
+func TestParseAccessClaims(t *testing.T) {
+	claims, err := ParseAccessClaims(jwt.MapClaims{"jti": "abc", "id": "100", "name": "test"})
+	assert.Nil(t, err)
+	assert.Equal(t, AccessClaims{ID: "abc", UserID: "100", UserName: "test", ExpiresAt: time.Unix(0, 0)}, claims)
+
+	// claims of other tokens
+	_, err = ParseAccessClaims(jwt.MapClaims{"id": "100", "name": "test"})
+	assert.NotNil(t, err)
+	_, err = ParseAccessClaims(jwt.MapClaims{"jti": "abc", "share": "123"})
+	assert.NotNil(t, err)
+	_, err = ParseAccessClaims(jwt.MapClaims{"jti": "abc", "id": "100"})
+	assert.NotNil(t, err)
+	_, err = ParseAccessClaims(jwt.MapClaims{"jti": "abc", "id": 100, "name": "test"})
+	assert.NotNil(t, err)
+
+	// impersonation
+	claims, err = ParseAccessClaims(jwt.MapClaims{"jti": "abc", "id": "100", "name": "test",
+		"act": map[string]interface{}{"id": "102", "name": "admin"}})
+	assert.Nil(t, err)
+	assert.Equal(t, "102", claims.ActorID)
+	assert.Equal(t, "admin", claims.ActorName)
+	_, err = ParseAccessClaims(jwt.MapClaims{"jti": "abc", "id": "100", "name": "test", "act": "102"})
+	assert.NotNil(t, err)
+	_, err = ParseAccessClaims(jwt.MapClaims{"jti": "abc", "id": "100", "name": "test", "act": map[string]interface{}{"id": "102"}})
+	assert.NotNil(t, err)
 }
 
 func TestMocks(t *testing.T) {
@@ -51,4 +254,15 @@ func TestMocks(t *testing.T) {
 	ctx, _ = test.MockRoutingContext(req)
 	assert.Nil(t, MockAuthHandler(ctx))
 	assert.NotNil(t, CurrentUser(ctx.Request.Context()))
+	assert.True(t, HasPermission(ctx.Request.Context(), PermissionAlbumCreate))
+}
+
+func Test_withClient(t *testing.T) {
+	assert.Empty(t, clientIP(context.Background()))
+	assert.Empty(t, userAgent(context.Background()))
+	ctx := withClient(context.Background(), &http.Request{RemoteAddr: "192.168.0.1:4321", Header: http.Header{"User-Agent": {"test/1.0"}}})
+	assert.Equal(t, "192.168.0.1", clientIP(ctx))
+	assert.Equal(t, "test/1.0", userAgent(ctx))
+	ctx = withClient(context.Background(), &http.Request{RemoteAddr: "192.168.0.1"})
+	assert.Equal(t, "192.168.0.1", clientIP(ctx))
 }
@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"context"
+	"github.com/garaekz/priv8/internal/entity"
+	"github.com/garaekz/priv8/pkg/dbcontext"
+	"github.com/garaekz/priv8/pkg/log"
+	dbx "github.com/go-ozzo/ozzo-dbx"
+	"time"
+)
+
+// PasswordResetRepository encapsulates the logic to access password reset tokens from the data source.
+type PasswordResetRepository interface {
+	// GetByHash returns the password reset token with the specified token hash.
+	GetByHash(ctx context.Context, hash string) (entity.PasswordReset, error)
+	// Create saves a new password reset token in the storage.
+	Create(ctx context.Context, reset entity.PasswordReset) error
+	// MarkUsed marks the password reset token with the specified ID as used.
+	// It returns false if the token has already been used.
+	MarkUsed(ctx context.Context, id string, at time.Time) (bool, error)
+	// MarkUserUsed marks every unused password reset token of the specified user as used.
+	MarkUserUsed(ctx context.Context, userID string, at time.Time) error
+}
+
+// passwordResetRepository persists password reset tokens in database
+type passwordResetRepository struct {
+	db     *dbcontext.DB
+	logger log.Logger
+}
+
+// NewPasswordResetRepository creates a new password reset token repository
+func NewPasswordResetRepository(db *dbcontext.DB, logger log.Logger) PasswordResetRepository {
+	return passwordResetRepository{db, logger}
+}
+
+// GetByHash reads the password reset token with the specified hash from the database.
+func (r passwordResetRepository) GetByHash(ctx context.Context, hash string) (entity.PasswordReset, error) {
+	var reset entity.PasswordReset
+	err := r.db.With(ctx).Select().Where(dbx.HashExp{"token_hash": hash}).One(&reset)
+	return reset, err
+}
+
+// Create saves a new password reset token record in the database.
+func (r passwordResetRepository) Create(ctx context.Context, reset entity.PasswordReset) error {
+	return r.db.With(ctx).Model(&reset).Insert()
+}
+
+// MarkUsed sets the used time of an unused password reset token.
+// The check and the update happen in one statement so that a token cannot be used twice concurrently.
+func (r passwordResetRepository) MarkUsed(ctx context.Context, id string, at time.Time) (bool, error) {
+	result, err := r.db.With(ctx).Update("password_reset",
+		dbx.Params{"used_at": at},
+		dbx.HashExp{"id": id, "used_at": nil},
+	).Execute()
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// MarkUserUsed sets the used time of every unused password reset token of a user.
+func (r passwordResetRepository) MarkUserUsed(ctx context.Context, userID string, at time.Time) error {
+	_, err := r.db.With(ctx).Update("password_reset",
+		dbx.Params{"used_at": at},
+		dbx.HashExp{"user_id": userID, "used_at": nil},
+	).Execute()
+	return err
+}
@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"github.com/garaekz/priv8/internal/entity"
+	"github.com/garaekz/priv8/internal/test"
+	"github.com/garaekz/priv8/pkg/log"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestPasswordResetRepository(t *testing.T) {
+	logger, _ := log.NewForTest()
+	db := test.DB(t)
+	test.ResetTables(t, db, "password_reset", "user")
+	test.CreateUser(t, db, "100", "demo")
+	repo := NewPasswordResetRepository(db, logger)
+	ctx := context.Background()
+
+	// create
+	for _, id := range []string{"reset1", "reset2"} {
+		err := repo.Create(ctx, entity.PasswordReset{
+			ID:        id,
+			UserID:    "100",
+			TokenHash: "hash-" + id,
+			ExpiresAt: time.Now().Add(time.Hour),
+			CreatedAt: time.Now(),
+		})
+		assert.Nil(t, err)
+	}
+
+	// get by hash
+	reset, err := repo.GetByHash(ctx, "hash-reset1")
+	assert.Nil(t, err)
+	assert.Equal(t, "reset1", reset.ID)
+	assert.Nil(t, reset.UsedAt)
+	_, err = repo.GetByHash(ctx, "hash-reset0")
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	// mark used
+	ok, err := repo.MarkUsed(ctx, "reset1", time.Now())
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = repo.MarkUsed(ctx, "reset1", time.Now())
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// mark the tokens of a user used
+	assert.Nil(t, repo.MarkUserUsed(ctx, "100", time.Now()))
+	reset, _ = repo.GetByHash(ctx, "hash-reset2")
+	assert.NotNil(t, reset.UsedAt)
+}
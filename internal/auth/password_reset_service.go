@@ -0,0 +1,181 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/garaekz/priv8/internal/entity"
+	"github.com/garaekz/priv8/internal/errors"
+	"github.com/garaekz/priv8/pkg/mail"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	netmail "net/mail"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// passwordResetLifetime is how long a password reset token can be used.
+const passwordResetLifetime = time.Hour
+
+// ForgotPasswordRequest represents a request to send a password reset email.
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+// Validate validates the ForgotPasswordRequest fields.
+func (m ForgotPasswordRequest) Validate() error {
+	return validation.ValidateStruct(&m,
+		validation.Field(&m.Email, validation.Required, validation.By(checkEmail)),
+	)
+}
+
+// ResetPasswordRequest represents a request to set a new password with a password reset token.
+type ResetPasswordRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+// Validate validates the ResetPasswordRequest fields.
+func (m ResetPasswordRequest) Validate() error {
+	return validation.ValidateStruct(&m,
+		validation.Field(&m.Token, validation.Required),
+		validation.Field(&m.NewPassword, passwordRules...),
+	)
+}
+
+// ForgotPassword sends a password reset email to the user with the given email address.
+// Nothing happens if no user has the address, and failures to send the email are only logged,
+// so that the caller cannot tell which addresses are registered.
+func (s service) ForgotPassword(ctx context.Context, req ForgotPasswordRequest) error {
+	if err := req.Validate(); err != nil {
+		return err
+	}
+	user, err := s.repo.GetByEmail(ctx, strings.ToLower(req.Email))
+	if err == sql.ErrNoRows {
+		s.logger.With(ctx).Infof("password reset requested for an unknown email address")
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	token, err := GenerateToken()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	err = s.resetRepo.Create(ctx, entity.PasswordReset{
+		ID:        entity.GenerateID(),
+		UserID:    user.ID,
+		TokenHash: HashToken(token),
+		ExpiresAt: now.Add(passwordResetLifetime),
+		CreatedAt: now,
+	})
+	if err != nil {
+		return err
+	}
+	if err := s.mailer.Send(ctx, s.passwordResetMessage(user, token)); err != nil {
+		s.logger.With(ctx, "user", user.Name).Errorf("failed to send the password reset email: %v", err)
+		return nil
+	}
+	s.logger.With(ctx, "user", user.Name).Infof("password reset email sent")
+	return nil
+}
+
+// ResetPassword sets a new password for the user that the password reset token was sent to.
+// The token can be used only once. Other password reset tokens and all refresh tokens of the user are revoked,
+// and the failed logins of the user are forgotten.
+func (s service) ResetPassword(ctx context.Context, req ResetPasswordRequest) error {
+	if err := req.Validate(); err != nil {
+		return err
+	}
+	invalid := errors.BadRequest("The password reset token is invalid or has expired.")
+	reset, err := s.resetRepo.GetByHash(ctx, HashToken(req.Token))
+	if err == sql.ErrNoRows {
+		return invalid
+	} else if err != nil {
+		return err
+	}
+	now := time.Now()
+	if reset.UsedAt != nil || !now.Before(reset.ExpiresAt) {
+		return invalid
+	}
+	hash, err := hashPassword(req.NewPassword)
+	if err != nil {
+		return err
+	}
+
+	var user entity.User
+	err = s.transactional(ctx, func(ctx context.Context) error {
+		if ok, err := s.resetRepo.MarkUsed(ctx, reset.ID, now); err != nil {
+			return err
+		} else if !ok {
+			return invalid
+		}
+		var err error
+		user, err = s.repo.Get(ctx, reset.UserID)
+		if err == sql.ErrNoRows {
+			return invalid
+		} else if err != nil {
+			return err
+		}
+		before := user
+		user.PasswordHash = hash
+		user.UpdatedAt = now
+		if err := s.repo.Update(ctx, user); err != nil {
+			return err
+		}
+		if err := s.resetRepo.MarkUserUsed(ctx, user.ID, now); err != nil {
+			return err
+		}
+		if err := s.tokenRepo.RevokeUser(ctx, user.ID, "", now); err != nil {
+			return err
+		}
+		if err := s.sessionRepo.RevokeUser(ctx, user.ID, "", now); err != nil {
+			return err
+		}
+		// the reset is recorded as a change of the account by its owner, who proved to have access to the email
+		actx := WithUser(ctx, user.ID, user.Name, user.Roles...)
+		return s.auditor.Record(actx, entity.AuditUpdate, auditUserResource, user.ID, before, user)
+	})
+	if err != nil {
+		return err
+	}
+	if err := s.throttler.Succeed(ctx, user.Name); err != nil {
+		return err
+	}
+	s.logger.With(ctx, "user", user.Name).Infof("password reset")
+	return nil
+}
+
+// passwordResetMessage returns the email that sends a password reset token to a user.
+// The token is appended to the password reset URL if there is one, and sent as is otherwise.
+func (s service) passwordResetMessage(user entity.User, token string) mail.Message {
+	link := token
+	if u, err := url.Parse(s.passwordResetURL); err == nil && s.passwordResetURL != "" {
+		query := u.Query()
+		query.Set("token", token)
+		u.RawQuery = query.Encode()
+		link = u.String()
+	}
+	return mail.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hello %s,\n\n"+
+			"Someone asked to reset the password of your account. If it was you, use the following to choose\n"+
+			"a new password within %v:\n\n%s\n\n"+
+			"If it was not you, you can ignore this email and your password stays the same.\n",
+			user.Name, passwordResetLifetime, link),
+	}
+}
+
+// checkEmail checks that a value is a bare email address, without a display name.
+func checkEmail(value interface{}) error {
+	email, _ := value.(string)
+	if email == "" {
+		return nil
+	}
+	if addr, err := netmail.ParseAddress(email); err != nil || addr.Address != email {
+		return validation.NewError("validation_is_email", "must be a valid email address")
+	}
+	return nil
+}
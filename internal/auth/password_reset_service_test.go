@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garaekz/priv8/internal/entity"
+	"github.com/garaekz/priv8/internal/errors"
+	"github.com/garaekz/priv8/pkg/log"
+	"github.com/garaekz/priv8/pkg/mail"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForgotPasswordRequest_Validate(t *testing.T) {
+	assert.Nil(t, ForgotPasswordRequest{Email: "demo@example.com"}.Validate())
+	assert.NotNil(t, ForgotPasswordRequest{}.Validate())
+	assert.NotNil(t, ForgotPasswordRequest{Email: "demo"}.Validate())
+}
+
+func TestResetPasswordRequest_Validate(t *testing.T) {
+	assert.Nil(t, ResetPasswordRequest{Token: "abc", NewPassword: "n3w-pass-word"}.Validate())
+	assert.NotNil(t, ResetPasswordRequest{NewPassword: "n3w-pass-word"}.Validate())
+	assert.NotNil(t, ResetPasswordRequest{Token: "abc", NewPassword: "short"}.Validate())
+}
+
+func Test_service_PasswordReset(t *testing.T) {
+	logger, _ := log.NewForTest()
+	repo := newMockRepository()
+	tokenRepo := &mockTokenRepository{}
+	resetRepo := &mockPasswordResetRepository{}
+	mailer := &mockMailer{}
+	auditor := &mockAuditor{}
+	s := NewService(repo, tokenRepo, &mockSessionRepository{}, &mockAPIKeyRepository{}, resetRepo, NewMemoryDenylist(),
+		NewKeyRing(NewHMACKey("test")), NewThrottler(NewMemoryAttemptStore(), logger), mailer, &mockAlbumDeleter{}, auditor, withoutTransaction,
+		"https://example.com/reset?lang=en", 15*time.Minute, time.Hour, logger)
+	ctx := context.Background()
+	tokens, _ := s.Login(ctx, "demo", "pass")
+
+	// unknown email addresses are ignored
+	assert.Nil(t, s.ForgotPassword(ctx, ForgotPasswordRequest{Email: "unknown@example.com"}))
+	assert.Empty(t, mailer.messages)
+	assert.NotNil(t, s.ForgotPassword(ctx, ForgotPasswordRequest{Email: "demo"}))
+
+	// forgot
+	assert.Nil(t, s.ForgotPassword(ctx, ForgotPasswordRequest{Email: "DEMO@example.com"}))
+	assert.Nil(t, s.ForgotPassword(ctx, ForgotPasswordRequest{Email: "demo@example.com"}))
+	if !assert.Len(t, mailer.messages, 2) {
+		return
+	}
+	assert.Equal(t, "demo@example.com", mailer.messages[0].To)
+	token := resetToken(mailer.messages[0])
+	assert.NotEmpty(t, token)
+	assert.Contains(t, mailer.messages[0].Body, "https://example.com/reset?lang=en&token="+token)
+	assert.Equal(t, HashToken(token), resetRepo.items[0].TokenHash)
+
+	// invalid tokens
+	invalid := errors.BadRequest("The password reset token is invalid or has expired.")
+	assert.Equal(t, invalid, s.ResetPassword(ctx, ResetPasswordRequest{Token: "xyz", NewPassword: "n3w-pass-word"}))
+	resetRepo.items[1].ExpiresAt = time.Now().Add(-time.Minute)
+	assert.Equal(t, invalid, s.ResetPassword(ctx, ResetPasswordRequest{Token: resetToken(mailer.messages[1]), NewPassword: "n3w-pass-word"}))
+	assert.NotNil(t, s.ResetPassword(ctx, ResetPasswordRequest{Token: token, NewPassword: "short"}))
+
+	// reset
+	assert.Nil(t, s.ResetPassword(ctx, ResetPasswordRequest{Token: token, NewPassword: "n3w-pass-word"}))
+	assert.Equal(t, entity.AuditRecord{ActorID: "100", Action: entity.AuditUpdate, ResourceType: "user", ResourceID: "100"},
+		auditor.records[len(auditor.records)-1])
+	_, err := s.Login(ctx, "demo", "pass")
+	assert.Equal(t, errors.Unauthorized(""), err)
+	_, err = s.Login(ctx, "demo", "n3w-pass-word")
+	assert.Nil(t, err)
+	_, err = s.Refresh(ctx, tokens.RefreshToken)
+	assert.Equal(t, errors.Unauthorized(""), err)
+
+	// the token can be used only once
+	assert.Equal(t, invalid, s.ResetPassword(ctx, ResetPasswordRequest{Token: token, NewPassword: "0ther-pass-word"}))
+
+	// a failure to send the email is not reported, as it would tell that the address is registered
+	mailer.err = sql.ErrConnDone
+	assert.Nil(t, s.ForgotPassword(ctx, ForgotPasswordRequest{Email: "demo@example.com"}))
+	assert.Len(t, mailer.messages, 2)
+}
+
+func Test_service_passwordResetMessage(t *testing.T) {
+	logger, _ := log.NewForTest()
+	s := newTestService(newMockRepository(), logger).(service)
+	msg := s.passwordResetMessage(entity.User{Name: "demo", Email: "demo@example.com"}, "abc")
+	assert.Equal(t, "demo@example.com", msg.To)
+	assert.Contains(t, msg.Body, "\n\nabc\n\n")
+}
+
+// resetToken extracts the password reset token from a password reset email.
+func resetToken(msg mail.Message) string {
+	for _, line := range strings.Split(msg.Body, "\n") {
+		if i := strings.Index(line, "token="); i >= 0 {
+			return line[i+len("token="):]
+		}
+	}
+	return ""
+}
+
+type mockMailer struct {
+	messages []mail.Message
+	// err, if set, is returned by Send instead of sending the message.
+	err error
+}
+
+func (m *mockMailer) Send(_ context.Context, msg mail.Message) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+type mockPasswordResetRepository struct {
+	items []entity.PasswordReset
+}
+
+func (m mockPasswordResetRepository) GetByHash(_ context.Context, hash string) (entity.PasswordReset, error) {
+	for _, item := range m.items {
+		if item.TokenHash == hash {
+			return item, nil
+		}
+	}
+	return entity.PasswordReset{}, sql.ErrNoRows
+}
+
+func (m *mockPasswordResetRepository) Create(_ context.Context, reset entity.PasswordReset) error {
+	m.items = append(m.items, reset)
+	return nil
+}
+
+func (m *mockPasswordResetRepository) MarkUsed(_ context.Context, id string, at time.Time) (bool, error) {
+	for i, item := range m.items {
+		if item.ID == id && item.UsedAt == nil {
+			m.items[i].UsedAt = &at
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *mockPasswordResetRepository) MarkUserUsed(_ context.Context, userID string, at time.Time) error {
+	for i, item := range m.items {
+		if item.UserID == userID && item.UsedAt == nil {
+			m.items[i].UsedAt = &at
+		}
+	}
+	return nil
+}
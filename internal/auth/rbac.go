@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"context"
+	"github.com/garaekz/priv8/internal/errors"
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"sort"
+)
+
+// Roles that can be assigned to users.
+const (
+	// RoleUser is the role of every registered user.
+	RoleUser = "user"
+	// RoleAdmin is the role of the users who administer the service. It grants every permission.
+	RoleAdmin = "admin"
+)
+
+// Permissions that can be required by the API endpoints.
+const (
+	PermissionAlbumCreate = "album:create"
+	PermissionAlbumUpdate = "album:update"
+	PermissionAlbumDelete = "album:delete"
+	// PermissionAlbumShare allows sharing albums with other users and via share links.
+	PermissionAlbumShare = "album:share"
+	// PermissionAlbumManage allows viewing and modifying the albums of other users.
+	PermissionAlbumManage = "album:manage"
+	// PermissionTokenIntrospect allows OAuth clients to introspect the access tokens of any user.
+	PermissionTokenIntrospect = "token:introspect"
+	// PermissionUserImpersonate allows acting as other users with a short-lived impersonation token.
+	PermissionUserImpersonate = "user:impersonate"
+	// PermissionAuditRead allows reading the audit log.
+	PermissionAuditRead = "audit:read"
+)
+
+// rolePermissions lists the permissions granted by each role.
+var rolePermissions = map[string][]string{
+	RoleUser: {PermissionAlbumCreate, PermissionAlbumUpdate, PermissionAlbumDelete, PermissionAlbumShare},
+	RoleAdmin: {PermissionAlbumCreate, PermissionAlbumUpdate, PermissionAlbumDelete, PermissionAlbumShare,
+		PermissionAlbumManage, PermissionTokenIntrospect, PermissionUserImpersonate, PermissionAuditRead},
+}
+
+// Permissions returns the sorted list of the permissions granted by the given roles.
+// Unknown roles grant no permissions.
+func Permissions(roles ...string) []string {
+	set := map[string]bool{}
+	for _, role := range roles {
+		for _, permission := range rolePermissions[role] {
+			set[permission] = true
+		}
+	}
+	permissions := []string{}
+	for permission := range set {
+		permissions = append(permissions, permission)
+	}
+	sort.Strings(permissions)
+	return permissions
+}
+
+// Require returns a middleware that allows a request only if the current user has all the given permissions.
+// It must be used after the authentication middleware.
+func Require(permissions ...string) routing.Handler {
+	return func(c *routing.Context) error {
+		ctx := c.Request.Context()
+		if CurrentUser(ctx) == nil {
+			return errors.Unauthorized("")
+		}
+		for _, permission := range permissions {
+			if !HasPermission(ctx, permission) {
+				return errors.Forbidden("")
+			}
+		}
+		return nil
+	}
+}
+
+// WithPermissions returns a context that contains the permissions of the current user.
+func WithPermissions(ctx context.Context, permissions ...string) context.Context {
+	return context.WithValue(ctx, permissionsKey, permissions)
+}
+
+// CurrentPermissions returns the permissions of the current user in the given context.
+func CurrentPermissions(ctx context.Context) []string {
+	permissions, _ := ctx.Value(permissionsKey).([]string)
+	return permissions
+}
+
+// HasPermission reports whether the current user in the given context has the specified permission.
+func HasPermission(ctx context.Context, permission string) bool {
+	for _, p := range CurrentPermissions(ctx) {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"context"
+	"github.com/garaekz/priv8/internal/errors"
+	"github.com/garaekz/priv8/internal/test"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestPermissions(t *testing.T) {
+	assert.Equal(t, []string{}, Permissions())
+	assert.Equal(t, []string{}, Permissions("unknown"))
+	assert.Equal(t, []string{PermissionAlbumCreate, PermissionAlbumDelete, PermissionAlbumShare, PermissionAlbumUpdate},
+		Permissions(RoleUser))
+	assert.Equal(t, Permissions(RoleUser), Permissions(RoleUser, RoleUser))
+	for _, permissions := range rolePermissions {
+		for _, permission := range permissions {
+			assert.Contains(t, Permissions(RoleAdmin), permission)
+		}
+	}
+	assert.NotContains(t, Permissions(RoleUser), PermissionAlbumManage)
+	assert.NotContains(t, Permissions(RoleUser), PermissionTokenIntrospect)
+}
+
+func TestHasPermission(t *testing.T) {
+	ctx := context.Background()
+	assert.False(t, HasPermission(ctx, PermissionAlbumCreate))
+	assert.Nil(t, CurrentPermissions(ctx))
+	ctx = WithPermissions(ctx, PermissionAlbumCreate)
+	assert.Equal(t, []string{PermissionAlbumCreate}, CurrentPermissions(ctx))
+	assert.True(t, HasPermission(ctx, PermissionAlbumCreate))
+	assert.False(t, HasPermission(ctx, PermissionAlbumDelete))
+}
+
+func TestRequire(t *testing.T) {
+	handler := Require(PermissionAlbumCreate, PermissionAlbumUpdate)
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+
+	// not authenticated
+	ctx, _ := test.MockRoutingContext(req)
+	assert.Equal(t, errors.Unauthorized(""), handler(ctx))
+
+	// missing a permission
+	ctx, _ = test.MockRoutingContext(req.WithContext(WithPermissions(WithUser(req.Context(), "100", "test"), PermissionAlbumCreate)))
+	assert.Equal(t, errors.Forbidden(""), handler(ctx))
+
+	// all permissions
+	ctx, _ = test.MockRoutingContext(req.WithContext(WithPermissions(WithUser(req.Context(), "100", "test"), Permissions(RoleUser)...)))
+	assert.Nil(t, handler(ctx))
+
+	// no permissions required
+	ctx, _ = test.MockRoutingContext(req.WithContext(WithUser(req.Context(), "100", "test")))
+	assert.Nil(t, Require()(ctx))
+}
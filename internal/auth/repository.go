@@ -0,0 +1,192 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"github.com/garaekz/priv8/internal/entity"
+	"github.com/garaekz/priv8/pkg/dbcontext"
+	"github.com/garaekz/priv8/pkg/log"
+	dbx "github.com/go-ozzo/ozzo-dbx"
+	"github.com/lib/pq"
+	"time"
+)
+
+var (
+	// ErrDuplicateName is returned by Repository.Create if another user has the same username.
+	ErrDuplicateName = errors.New("username already exists")
+	// ErrDuplicateEmail is returned by Repository.Create if another user has the same email address.
+	ErrDuplicateEmail = errors.New("email address already exists")
+)
+
+// uniqueViolation is the PostgreSQL error code of unique constraint violations.
+const uniqueViolation = "23505"
+
+// Repository encapsulates the logic to access users from the data source.
+// The users returned by the repository include their roles.
+type Repository interface {
+	// Get returns the user with the specified user ID.
+	Get(ctx context.Context, id string) (entity.User, error)
+	// GetByName returns the user with the specified username.
+	GetByName(ctx context.Context, name string) (entity.User, error)
+	// GetByEmail returns the user with the specified email address.
+	GetByEmail(ctx context.Context, email string) (entity.User, error)
+	// Create saves a new user and its roles in the storage.
+	// It returns ErrDuplicateName or ErrDuplicateEmail if the username or the email address is taken.
+	Create(ctx context.Context, user entity.User) error
+	// Update updates the user with given ID in the storage. The roles of the user are not changed.
+	Update(ctx context.Context, user entity.User) error
+	// Delete removes the user with given ID from the storage.
+	Delete(ctx context.Context, id string) error
+	// ReplaceRecoveryCodes replaces the recovery codes of the specified user with the given code hashes.
+	ReplaceRecoveryCodes(ctx context.Context, userID string, hashes []string) error
+	// UseRecoveryCode marks the recovery code with the given hash as used.
+	// It returns false if the user has no such code or the code was used already.
+	UseRecoveryCode(ctx context.Context, userID, hash string) (bool, error)
+	// UseTOTPStep records the time step of a TOTP code used by the specified user.
+	// It returns false if a code of the same or a later time step was used already.
+	UseTOTPStep(ctx context.Context, userID string, step int64) (bool, error)
+}
+
+// repository persists users in database
+type repository struct {
+	db     *dbcontext.DB
+	logger log.Logger
+}
+
+// NewRepository creates a new user repository
+func NewRepository(db *dbcontext.DB, logger log.Logger) Repository {
+	return repository{db, logger}
+}
+
+// Get reads the user with the specified ID from the database.
+func (r repository) Get(ctx context.Context, id string) (entity.User, error) {
+	var user entity.User
+	if err := r.db.With(ctx).Select().Model(id, &user); err != nil {
+		return user, err
+	}
+	return r.withRoles(ctx, user)
+}
+
+// GetByName reads the user with the specified username from the database.
+func (r repository) GetByName(ctx context.Context, name string) (entity.User, error) {
+	var user entity.User
+	if err := r.db.With(ctx).Select().Where(dbx.HashExp{"name": name}).One(&user); err != nil {
+		return user, err
+	}
+	return r.withRoles(ctx, user)
+}
+
+// GetByEmail reads the user with the specified email address from the database.
+func (r repository) GetByEmail(ctx context.Context, email string) (entity.User, error) {
+	var user entity.User
+	if err := r.db.With(ctx).Select().Where(dbx.HashExp{"email": email}).One(&user); err != nil {
+		return user, err
+	}
+	return r.withRoles(ctx, user)
+}
+
+// Create saves a new user record and its roles in the database in one transaction,
+// so that no user is left without its roles.
+func (r repository) Create(ctx context.Context, user entity.User) error {
+	return r.db.Transactional(ctx, func(ctx context.Context) error {
+		if err := r.db.With(ctx).Model(&user).Insert(); err != nil {
+			return duplicateError(err)
+		}
+		for _, role := range user.Roles {
+			_, err := r.db.With(ctx).Insert("user_role", dbx.Params{"user_id": user.ID, "role": role}).Execute()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Update saves the changes to a user in the database.
+func (r repository) Update(ctx context.Context, user entity.User) error {
+	return r.db.With(ctx).Model(&user).Update()
+}
+
+// Delete deletes a user with the specified ID from the database.
+func (r repository) Delete(ctx context.Context, id string) error {
+	user, err := r.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	return r.db.With(ctx).Model(&user).Delete()
+}
+
+// ReplaceRecoveryCodes deletes the recovery codes of the specified user and inserts the given ones in the database.
+func (r repository) ReplaceRecoveryCodes(ctx context.Context, userID string, hashes []string) error {
+	_, err := r.db.With(ctx).Delete("recovery_code", dbx.HashExp{"user_id": userID}).Execute()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, hash := range hashes {
+		_, err := r.db.With(ctx).Insert("recovery_code", dbx.Params{
+			"user_id":    userID,
+			"code_hash":  hash,
+			"created_at": now,
+		}).Execute()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UseRecoveryCode sets the used time of an unused recovery code in the database.
+// The check and the update happen in one statement so that a code cannot be used twice concurrently.
+func (r repository) UseRecoveryCode(ctx context.Context, userID, hash string) (bool, error) {
+	result, err := r.db.With(ctx).Update("recovery_code",
+		dbx.Params{"used_at": time.Now()},
+		dbx.HashExp{"user_id": userID, "code_hash": hash, "used_at": nil},
+	).Execute()
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// duplicateError returns ErrDuplicateName or ErrDuplicateEmail if the given error is caused by the
+// unique constraint on the username or the email address respectively. Other errors are returned unchanged.
+func duplicateError(err error) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || pqErr.Code != uniqueViolation {
+		return err
+	}
+	switch pqErr.Constraint {
+	case "user_name_key":
+		return ErrDuplicateName
+	case "user_email_idx":
+		return ErrDuplicateEmail
+	}
+	return err
+}
+
+// UseTOTPStep sets the last used TOTP time step of a user in the database if the given step is later.
+// The check and the update happen in one statement so that a code cannot be used twice concurrently.
+func (r repository) UseTOTPStep(ctx context.Context, userID string, step int64) (bool, error) {
+	result, err := r.db.With(ctx).Update("user",
+		dbx.Params{"totp_last_step": step},
+		dbx.And(dbx.HashExp{"id": userID}, dbx.NewExp("totp_last_step < {:step}", dbx.Params{"step": step})),
+	).Execute()
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// withRoles reads the roles of the given user from the database.
+func (r repository) withRoles(ctx context.Context, user entity.User) (entity.User, error) {
+	err := r.db.With(ctx).
+		Select("role").
+		From("user_role").
+		Where(dbx.HashExp{"user_id": user.ID}).
+		OrderBy("role").
+		Column(&user.Roles)
+	return user, err
+}
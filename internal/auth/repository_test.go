@@ -0,0 +1,125 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"github.com/garaekz/priv8/internal/entity"
+	"github.com/garaekz/priv8/internal/test"
+	"github.com/garaekz/priv8/pkg/log"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRepository(t *testing.T) {
+	logger, _ := log.NewForTest()
+	db := test.DB(t)
+	test.ResetTables(t, db, "user")
+	repo := NewRepository(db, logger)
+
+	ctx := context.Background()
+
+	// create
+	err := repo.Create(ctx, entity.User{
+		ID:           "test1",
+		Name:         "user1",
+		PasswordHash: demoPasswordHash,
+		Roles:        []string{RoleUser, RoleAdmin},
+		CreatedAt:    time.Now(),
+		UpdatedAt:    time.Now(),
+	})
+	assert.Nil(t, err)
+
+	// duplicate username
+	err = repo.Create(ctx, entity.User{
+		ID:           "test2",
+		Name:         "user1",
+		PasswordHash: demoPasswordHash,
+		CreatedAt:    time.Now(),
+		UpdatedAt:    time.Now(),
+	})
+	assert.Equal(t, ErrDuplicateName, err)
+
+	// get
+	user, err := repo.Get(ctx, "test1")
+	assert.Nil(t, err)
+	assert.Equal(t, "user1", user.Name)
+	assert.Equal(t, demoPasswordHash, user.PasswordHash)
+	assert.Equal(t, []string{RoleAdmin, RoleUser}, user.Roles)
+	_, err = repo.Get(ctx, "test0")
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	// get by name
+	user, err = repo.GetByName(ctx, "user1")
+	assert.Nil(t, err)
+	assert.Equal(t, "test1", user.ID)
+	assert.Equal(t, []string{RoleAdmin, RoleUser}, user.Roles)
+	_, err = repo.GetByName(ctx, "user0")
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	// update
+	user.Name = "user1 updated"
+	err = repo.Update(ctx, user)
+	assert.Nil(t, err)
+	user, _ = repo.Get(ctx, "test1")
+	assert.Equal(t, "user1 updated", user.Name)
+	assert.Len(t, user.Roles, 2)
+
+	// totp
+	user.TOTPSecret = "JBSWY3DPEHPK3PXP"
+	user.TOTPEnabled = true
+	user.TOTPLastStep = 42
+	assert.Nil(t, repo.Update(ctx, user))
+	user, _ = repo.Get(ctx, "test1")
+	assert.Equal(t, "JBSWY3DPEHPK3PXP", user.TOTPSecret)
+	assert.True(t, user.TOTPEnabled)
+	assert.Equal(t, int64(42), user.TOTPLastStep)
+	ok, err := repo.UseTOTPStep(ctx, "test1", 43)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, _ = repo.UseTOTPStep(ctx, "test1", 43)
+	assert.False(t, ok)
+	ok, _ = repo.UseTOTPStep(ctx, "test1", 42)
+	assert.False(t, ok)
+	user, _ = repo.Get(ctx, "test1")
+	assert.Equal(t, int64(43), user.TOTPLastStep)
+
+	// recovery codes
+	assert.Nil(t, repo.ReplaceRecoveryCodes(ctx, "test1", []string{"hash1", "hash2"}))
+	ok, err = repo.UseRecoveryCode(ctx, "test1", "hash1")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, _ = repo.UseRecoveryCode(ctx, "test1", "hash1")
+	assert.False(t, ok)
+	assert.Nil(t, repo.ReplaceRecoveryCodes(ctx, "test1", []string{"hash3"}))
+	ok, _ = repo.UseRecoveryCode(ctx, "test1", "hash2")
+	assert.False(t, ok)
+	ok, _ = repo.UseRecoveryCode(ctx, "test1", "hash3")
+	assert.True(t, ok)
+
+	// get by email
+	_, err = repo.GetByEmail(ctx, "user1@example.com")
+	assert.Equal(t, sql.ErrNoRows, err)
+	user.Email = "user1@example.com"
+	assert.Nil(t, repo.Update(ctx, user))
+	user, err = repo.GetByEmail(ctx, "user1@example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, "test1", user.ID)
+	err = repo.Create(ctx, entity.User{
+		ID:           "test2",
+		Name:         "user2",
+		Email:        "user1@example.com",
+		PasswordHash: demoPasswordHash,
+		CreatedAt:    time.Now(),
+		UpdatedAt:    time.Now(),
+	})
+	assert.Equal(t, ErrDuplicateEmail, err)
+
+	// delete
+	err = repo.Delete(ctx, "test1")
+	assert.Nil(t, err)
+	_, err = repo.Get(ctx, "test1")
+	assert.Equal(t, sql.ErrNoRows, err)
+	err = repo.Delete(ctx, "test1")
+	assert.Equal(t, sql.ErrNoRows, err)
+}
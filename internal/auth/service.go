@@ -2,18 +2,99 @@ package auth
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/garaekz/priv8/internal/entity"
 	"github.com/garaekz/priv8/internal/errors"
+	"github.com/garaekz/priv8/pkg/dbcontext"
 	"github.com/garaekz/priv8/pkg/log"
+	"github.com/garaekz/priv8/pkg/mail"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"golang.org/x/crypto/bcrypt"
+	"regexp"
+	"strings"
 	"time"
+	"unicode"
 )
 
+// dummyPasswordHash is compared against when the requested user does not exist so that
+// the response time does not reveal whether a username is registered.
+const dummyPasswordHash = "$2a$10$ipRKid86I5bAy09kUzbiQewflBP.Wd2VlopDxFLDiOrQ2anOJKFOO"
+
 // Service encapsulates the authentication logic.
 type Service interface {
-	// authenticate authenticates a user using username and password.
-	// It returns a JWT token if authentication succeeds. Otherwise, an error is returned.
-	Login(ctx context.Context, username, password string) (string, error)
+	// Login authenticates a user using username and password.
+	// It returns an access token and a refresh token if authentication succeeds. Otherwise, an error is returned.
+	// If the user has two-factor authentication enabled, only a challenge token is returned, to be passed to LoginMFA.
+	Login(ctx context.Context, username, password string) (Tokens, error)
+	// LoginMFA completes a login with the challenge token returned by Login and a TOTP code or a recovery code.
+	LoginMFA(ctx context.Context, mfaToken, code string) (Tokens, error)
+	// Refresh exchanges a refresh token for a new pair of tokens. The given refresh token becomes invalid.
+	Refresh(ctx context.Context, refreshToken string) (Tokens, error)
+	// Logout revokes the access token with the specified ID, its session and, if given, the refresh token of the user.
+	Logout(ctx context.Context, userID, sessionID, tokenID string, expiresAt time.Time, refreshToken string) error
+	// Register creates a new user account.
+	Register(ctx context.Context, input RegisterRequest) (entity.User, error)
+	// ChangePassword changes the password of the user with the specified ID.
+	ChangePassword(ctx context.Context, id string, input ChangePasswordRequest) error
+	// DeleteAccount deletes the user account with the specified ID.
+	DeleteAccount(ctx context.Context, id string) (entity.User, error)
+	// ForgotPassword sends a password reset email to the user with the given email address.
+	ForgotPassword(ctx context.Context, input ForgotPasswordRequest) error
+	// ResetPassword sets a new password with a password reset token.
+	ResetPassword(ctx context.Context, input ResetPasswordRequest) error
+	// QueryAPIKeys returns the API keys of the user with the specified ID.
+	QueryAPIKeys(ctx context.Context, userID string) ([]entity.APIKey, error)
+	// CreateAPIKey creates a new API key for the user with the specified ID.
+	CreateAPIKey(ctx context.Context, userID string, input CreateAPIKeyRequest) (NewAPIKey, error)
+	// DeleteAPIKey revokes an API key of the user with the specified ID.
+	DeleteAPIKey(ctx context.Context, userID, id string) error
+	// EnrollTOTP generates a new TOTP secret for the user with the specified ID.
+	EnrollTOTP(ctx context.Context, userID string) (TOTPEnrollment, error)
+	// ConfirmTOTP enables two-factor authentication with the enrolled TOTP secret and returns recovery codes.
+	ConfirmTOTP(ctx context.Context, userID, code string) (RecoveryCodes, error)
+	// DisableTOTP disables two-factor authentication for the user with the specified ID.
+	DisableTOTP(ctx context.Context, userID, code string) error
+	// RegenerateRecoveryCodes replaces the recovery codes of the user with the specified ID.
+	RegenerateRecoveryCodes(ctx context.Context, userID, code string) (RecoveryCodes, error)
+	// QuerySessions returns the active sessions of the user with the specified ID.
+	QuerySessions(ctx context.Context, userID string) ([]entity.Session, error)
+	// RevokeSession revokes a session of the user with the specified ID.
+	RevokeSession(ctx context.Context, userID, id string) error
+	// Impersonate issues an access token with which the given administrator acts as the user with the specified ID.
+	Impersonate(ctx context.Context, actor Identity, userID string) (Tokens, error)
+	APIKeyAuthenticator
+	SessionValidator
+}
+
+// Types of the resources whose changes are recorded in the audit log.
+const (
+	auditUserResource          = "user"
+	auditSessionResource       = "session"
+	auditAPIKeyResource        = "api_key"
+	auditRecoveryCodesResource = "recovery_codes"
+)
+
+// Auditor records actions in the audit log. It is implemented by audit.Service.
+type Auditor interface {
+	// Record records an action of the current user on a resource with the resource before and after the action.
+	Record(ctx context.Context, action, resourceType, resourceID string, before, after interface{}) error
+}
+
+// AlbumDeleter moves the albums of a user to the trash. It is implemented by album.Service.
+type AlbumDeleter interface {
+	// DeleteOwnedBy moves the albums owned by the user with the specified ID to the trash.
+	DeleteOwnedBy(ctx context.Context, ownerID string) error
+}
+
+// APIKeyAuthenticator authenticates requests that carry an API key.
+type APIKeyAuthenticator interface {
+	// AuthenticateAPIKey returns the identity of the owner of the given API key and the permissions of the key.
+	AuthenticateAPIKey(ctx context.Context, key string) (Identity, []string, error)
 }
 
 // Identity represents an authenticated user identity.
@@ -22,48 +103,468 @@ type Identity interface {
 	GetID() string
 	// GetName returns the user name.
 	GetName() string
+	// GetRoles returns the roles of the user.
+	GetRoles() []string
+}
+
+// Tokens represents the tokens issued to an authenticated user.
+type Tokens struct {
+	// AccessToken is the short-lived JWT used to access protected resources.
+	AccessToken string `json:"token,omitempty"`
+	// RefreshToken is the opaque token used to obtain new tokens once the access token expires.
+	RefreshToken string `json:"refresh_token,omitempty"`
+	// MFAToken is the challenge token issued instead of the other tokens when a second factor is required.
+	MFAToken string `json:"mfa_token,omitempty"`
+	// ExpiresIn is the lifetime of the access token, or of the challenge token, in seconds.
+	ExpiresIn int `json:"expires_in"`
+}
+
+var usernameRegexp = regexp.MustCompile("^[a-zA-Z0-9_.-]+$")
+
+// normalizeUsername returns the form in which a username is stored and looked up.
+// Usernames are case-insensitive, so they are kept in lower case.
+func normalizeUsername(username string) string {
+	return strings.ToLower(username)
+}
+
+// errUsernameTaken returns the validation error for a username that belongs to another user.
+func errUsernameTaken() error {
+	return validation.Errors{"username": validation.NewError("validation_username_taken", "is already taken")}
+}
+
+// errEmailTaken returns the validation error for an email address that belongs to another user.
+func errEmailTaken() error {
+	return validation.Errors{"email": validation.NewError("validation_email_taken", "is already registered")}
+}
+
+// passwordRules are the validation rules that every new password must satisfy.
+var passwordRules = []validation.Rule{
+	validation.Required,
+	validation.Length(8, 72),
+	validation.By(checkPasswordStrength),
+}
+
+// RegisterRequest represents a user registration request.
+type RegisterRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Email is optional, but the password cannot be reset without it.
+	Email string `json:"email"`
+}
+
+// Validate validates the RegisterRequest fields.
+func (m RegisterRequest) Validate() error {
+	return validation.ValidateStruct(&m,
+		validation.Field(&m.Username, validation.Required, validation.Length(3, 32), validation.Match(usernameRegexp)),
+		validation.Field(&m.Password, passwordRules...),
+		validation.Field(&m.Email, validation.Length(0, 254), validation.By(checkEmail)),
+	)
+}
+
+// ChangePasswordRequest represents a password change request.
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// Validate validates the ChangePasswordRequest fields.
+func (m ChangePasswordRequest) Validate() error {
+	return validation.ValidateStruct(&m,
+		validation.Field(&m.CurrentPassword, validation.Required),
+		validation.Field(&m.NewPassword, passwordRules...),
+	)
 }
 
 type service struct {
-	signingKey      string
-	tokenExpiration int
-	logger          log.Logger
+	repo                   Repository
+	tokenRepo              TokenRepository
+	sessionRepo            SessionRepository
+	apiKeyRepo             APIKeyRepository
+	resetRepo              PasswordResetRepository
+	denylist               Denylist
+	keys                   *KeyRing
+	throttler              *Throttler
+	mailer                 mail.Mailer
+	albums                 AlbumDeleter
+	auditor                Auditor
+	transactional          dbcontext.TransactionFunc
+	passwordResetURL       string
+	accessTokenExpiration  time.Duration
+	refreshTokenExpiration time.Duration
+	logger                 log.Logger
 }
 
 // NewService creates a new authentication service.
-func NewService(signingKey string, tokenExpiration int, logger log.Logger) Service {
-	return service{signingKey, tokenExpiration, logger}
+// The throttler limits the failed logins per username and per client IP.
+// Password reset emails are sent with the mailer and link to the given URL, if it is not empty.
+// The albums of deleted accounts are moved to the trash with the album deleter.
+// Logins and the changes to accounts, sessions and API keys are recorded with the auditor in the transactions
+// that make them.
+func NewService(repo Repository, tokenRepo TokenRepository, sessionRepo SessionRepository,
+	apiKeyRepo APIKeyRepository, resetRepo PasswordResetRepository, denylist Denylist, keys *KeyRing,
+	throttler *Throttler, mailer mail.Mailer, albums AlbumDeleter, auditor Auditor,
+	transactional dbcontext.TransactionFunc, passwordResetURL string,
+	accessTokenExpiration, refreshTokenExpiration time.Duration, logger log.Logger) Service {
+	return service{repo, tokenRepo, sessionRepo, apiKeyRepo, resetRepo, denylist, keys, throttler, mailer, albums,
+		auditor, transactional, passwordResetURL, accessTokenExpiration, refreshTokenExpiration, logger}
 }
 
-// Login authenticates a user and generates a JWT token if authentication succeeds.
-// Otherwise, an error is returned.
-func (s service) Login(ctx context.Context, username, password string) (string, error) {
-	if identity := s.authenticate(ctx, username, password); identity != nil {
-		return s.generateJWT(identity)
+// Login authenticates a user and generates an access token and a refresh token if authentication succeeds.
+// Otherwise, an error is returned. Usernames and client IPs with too many failed logins are locked out.
+func (s service) Login(ctx context.Context, username, password string) (Tokens, error) {
+	username = normalizeUsername(username)
+	ip := clientIP(ctx)
+	if err := s.throttler.Check(ctx, username, ip); err != nil {
+		return Tokens{}, err
+	}
+	user, err := s.authenticate(ctx, username, password)
+	if err != nil {
+		return Tokens{}, err
 	}
-	return "", errors.Unauthorized("")
+	if user == nil {
+		if err := s.throttler.Fail(ctx, username, ip); err != nil {
+			return Tokens{}, err
+		}
+		return Tokens{}, errors.Unauthorized("")
+	}
+	// the failed attempts are only forgotten once the second factor is verified as well
+	if user.TOTPEnabled {
+		return s.issueMFAChallenge(*user)
+	}
+	if err := s.throttler.Succeed(ctx, user.Name); err != nil {
+		return Tokens{}, err
+	}
+	return s.issueTokens(ctx, user, "")
+}
+
+// Refresh rotates the given refresh token and issues a new pair of tokens.
+// If a refresh token that was already rotated is presented again, the token is considered stolen
+// and every refresh token in the same family is revoked.
+func (s service) Refresh(ctx context.Context, refreshToken string) (Tokens, error) {
+	token, err := s.tokenRepo.GetByHash(ctx, HashToken(refreshToken))
+	if err == sql.ErrNoRows {
+		return Tokens{}, errors.Unauthorized("")
+	} else if err != nil {
+		return Tokens{}, err
+	}
+
+	logger := s.logger.With(ctx, "user", token.UserID)
+	now := time.Now()
+	if token.RevokedAt != nil || now.After(token.ExpiresAt) {
+		logger.Infof("refresh token rejected")
+		return Tokens{}, errors.Unauthorized("")
+	}
+
+	rotated := false
+	if token.UsedAt == nil {
+		if rotated, err = s.tokenRepo.MarkUsed(ctx, token.ID, now); err != nil {
+			return Tokens{}, err
+		}
+	}
+	if !rotated {
+		logger.Errorf("refresh token reuse detected, revoking token family %v", token.FamilyID)
+		if err := s.tokenRepo.RevokeFamily(ctx, token.FamilyID, now); err != nil {
+			return Tokens{}, err
+		}
+		return Tokens{}, errors.Unauthorized("")
+	}
+
+	user, err := s.repo.Get(ctx, token.UserID)
+	if err == sql.ErrNoRows {
+		return Tokens{}, errors.Unauthorized("")
+	} else if err != nil {
+		return Tokens{}, err
+	}
+	return s.issueTokens(ctx, user, token.FamilyID)
+}
+
+// Logout revokes the access token with the specified ID until it expires, together with its session, if any.
+// If a refresh token of the same user is given, its token family is revoked as well.
+func (s service) Logout(ctx context.Context, userID, sessionID, tokenID string, expiresAt time.Time,
+	refreshToken string) error {
+	if err := s.denylist.Revoke(ctx, tokenID, expiresAt); err != nil {
+		return err
+	}
+	if sessionID != "" {
+		if err := s.RevokeSession(ctx, userID, sessionID); err != nil && err != sql.ErrNoRows {
+			return err
+		}
+	}
+	if refreshToken != "" {
+		token, err := s.tokenRepo.GetByHash(ctx, HashToken(refreshToken))
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if err == nil && token.UserID == userID {
+			if err := s.tokenRepo.RevokeFamily(ctx, token.FamilyID, time.Now()); err != nil {
+				return err
+			}
+		}
+	}
+	s.logger.With(ctx, "user", userID).Infof("logout successful")
+	return nil
+}
+
+// Register creates a new user account with the given username and password.
+func (s service) Register(ctx context.Context, req RegisterRequest) (entity.User, error) {
+	if err := req.Validate(); err != nil {
+		return entity.User{}, err
+	}
+	username := normalizeUsername(req.Username)
+	if _, err := s.repo.GetByName(ctx, username); err == nil {
+		return entity.User{}, errUsernameTaken()
+	} else if err != sql.ErrNoRows {
+		return entity.User{}, err
+	}
+	email := strings.ToLower(req.Email)
+	if email != "" {
+		if _, err := s.repo.GetByEmail(ctx, email); err == nil {
+			return entity.User{}, errEmailTaken()
+		} else if err != sql.ErrNoRows {
+			return entity.User{}, err
+		}
+	}
+
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		return entity.User{}, err
+	}
+	now := time.Now()
+	user := entity.User{
+		ID:           entity.GenerateID(),
+		Name:         username,
+		Email:        email,
+		PasswordHash: hash,
+		Roles:        []string{RoleUser},
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	err = s.transactional(ctx, func(ctx context.Context) error {
+		// the checks above cannot rule out that a concurrent registration takes the username or email first
+		switch err := s.repo.Create(ctx, user); err {
+		case nil:
+		case ErrDuplicateName:
+			return errUsernameTaken()
+		case ErrDuplicateEmail:
+			return errEmailTaken()
+		default:
+			return err
+		}
+		// the registration is recorded as the creation of the account by the new user
+		actx := WithUser(ctx, user.ID, user.Name, user.Roles...)
+		return s.auditor.Record(actx, entity.AuditCreate, auditUserResource, user.ID, nil, user)
+	})
+	if err != nil {
+		return entity.User{}, err
+	}
+	s.logger.With(ctx, "user", user.Name).Infof("user registered")
+	return user, nil
+}
+
+// ChangePassword replaces the password of the user with the specified ID after verifying the current one.
+// Every other session of the user is revoked together with its refresh tokens, so that whoever may have
+// obtained the old password is logged out. The session of the current request is kept.
+func (s service) ChangePassword(ctx context.Context, id string, req ChangePasswordRequest) error {
+	if err := req.Validate(); err != nil {
+		return err
+	}
+	user, err := s.repo.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !checkPassword(user.PasswordHash, req.CurrentPassword) {
+		return validation.Errors{
+			"current_password": validation.NewError("validation_password_incorrect", "is incorrect"),
+		}
+	}
+
+	before := user
+	if user.PasswordHash, err = hashPassword(req.NewPassword); err != nil {
+		return err
+	}
+	user.UpdatedAt = time.Now()
+	var keep string
+	if token, ok := currentToken(ctx); ok {
+		keep = token.SessionID
+	}
+	err = s.transactional(ctx, func(ctx context.Context) error {
+		if err := s.repo.Update(ctx, user); err != nil {
+			return err
+		}
+		if err := s.tokenRepo.RevokeUser(ctx, user.ID, keep, user.UpdatedAt); err != nil {
+			return err
+		}
+		if err := s.sessionRepo.RevokeUser(ctx, user.ID, keep, user.UpdatedAt); err != nil {
+			return err
+		}
+		return s.auditor.Record(ctx, entity.AuditUpdate, auditUserResource, user.ID, before, user)
+	})
+	if err != nil {
+		return err
+	}
+	s.logger.With(ctx, "user", user.Name).Infof("password changed")
+	return nil
+}
+
+// DeleteAccount deletes the user account with the specified ID. The albums of the user are moved to the trash
+// in the same transaction, where they are kept without an owner until they are purged.
+func (s service) DeleteAccount(ctx context.Context, id string) (entity.User, error) {
+	user, err := s.repo.Get(ctx, id)
+	if err != nil {
+		return entity.User{}, err
+	}
+	err = s.transactional(ctx, func(ctx context.Context) error {
+		if err := s.albums.DeleteOwnedBy(ctx, id); err != nil {
+			return err
+		}
+		if err := s.repo.Delete(ctx, id); err != nil {
+			return err
+		}
+		return s.auditor.Record(ctx, entity.AuditDelete, auditUserResource, id, user, nil)
+	})
+	if err != nil {
+		return entity.User{}, err
+	}
+	s.logger.With(ctx, "user", user.Name).Infof("account deleted")
+	return user, nil
 }
 
 // authenticate authenticates a user using username and password.
-// If username and password are correct, an identity is returned. Otherwise, nil is returned.
-func (s service) authenticate(ctx context.Context, username, password string) Identity {
+// If username and password are correct, the user is returned. Otherwise, nil is returned.
+// An error is returned only if the user storage cannot be accessed.
+func (s service) authenticate(ctx context.Context, username, password string) (*entity.User, error) {
 	logger := s.logger.With(ctx, "user", username)
 
-	// TODO: the following authentication logic is only for demo purpose
-	if username == "demo" && password == "pass" {
+	user, err := s.repo.GetByName(ctx, username)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			return nil, err
+		}
+		_ = checkPassword(dummyPasswordHash, password)
+		logger.Infof("authentication failed")
+		return nil, nil
+	}
+
+	if checkPassword(user.PasswordHash, password) {
 		logger.Infof("authentication successful")
-		return entity.User{ID: "100", Name: "demo"}
+		return &user, nil
 	}
 
 	logger.Infof("authentication failed")
+	return nil, nil
+}
+
+// issueTokens generates an access token and a refresh token for an identity.
+// The refresh token joins the given token family, or starts a new one if familyID is empty.
+// Every token family is a session, which is recorded when the family starts.
+func (s service) issueTokens(ctx context.Context, identity Identity, familyID string) (Tokens, error) {
+	var tokens Tokens
+	err := s.transactional(ctx, func(ctx context.Context) error {
+		if familyID == "" {
+			familyID = entity.GenerateID()
+			session, err := s.startSession(ctx, identity.GetID(), familyID)
+			if err != nil {
+				return err
+			}
+			// the login is recorded as the creation of its session by the user who logs in
+			actx := WithUser(ctx, identity.GetID(), identity.GetName(), identity.GetRoles()...)
+			if err := s.auditor.Record(actx, entity.AuditLogin, auditSessionResource, session.ID, nil, session); err != nil {
+				return err
+			}
+		} else if err := s.extendSession(ctx, identity.GetID(), familyID); err != nil {
+			return err
+		}
+		accessToken, err := s.generateJWT(identity, familyID)
+		if err != nil {
+			return err
+		}
+		refreshToken, err := s.generateRefreshToken(ctx, identity, familyID)
+		if err != nil {
+			return err
+		}
+		tokens = Tokens{
+			AccessToken:  accessToken,
+			RefreshToken: refreshToken,
+			ExpiresIn:    int(s.accessTokenExpiration.Seconds()),
+		}
+		return nil
+	})
+	return tokens, err
+}
+
+// generateJWT generates a JWT that encodes an identity together with its roles and permissions.
+// The token is bound to the session with the specified ID.
+func (s service) generateJWT(identity Identity, sessionID string) (string, error) {
+	return s.keys.Sign(jwt.MapClaims{
+		"jti":         entity.GenerateID(),
+		"sid":         sessionID,
+		"id":          identity.GetID(),
+		"name":        identity.GetName(),
+		"roles":       identity.GetRoles(),
+		"permissions": Permissions(identity.GetRoles()...),
+		"exp":         time.Now().Add(s.accessTokenExpiration).Unix(),
+	})
+}
+
+// generateRefreshToken generates an opaque refresh token in the given token family for an identity
+// and stores its hash.
+func (s service) generateRefreshToken(ctx context.Context, identity Identity, familyID string) (string, error) {
+	token, err := GenerateToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	err = s.tokenRepo.Create(ctx, entity.RefreshToken{
+		ID:        entity.GenerateID(),
+		FamilyID:  familyID,
+		UserID:    identity.GetID(),
+		TokenHash: HashToken(token),
+		ExpiresAt: now.Add(s.refreshTokenExpiration),
+		CreatedAt: now,
+	})
+	return token, err
+}
+
+// GenerateToken returns a random URL-safe token with 256 bits of entropy.
+func GenerateToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashToken returns the hex-encoded SHA-256 hash of a token, in which form tokens are stored and looked up.
+// Tokens are random and long, so a fast hash is sufficient to protect them at rest.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// hashPassword returns the bcrypt hash of the given password.
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// checkPasswordStrength checks that a password mixes letters with digits or symbols.
+func checkPasswordStrength(value interface{}) error {
+	password, _ := value.(string)
+	var letters, others bool
+	for _, r := range password {
+		if unicode.IsLetter(r) {
+			letters = true
+		} else {
+			others = true
+		}
+	}
+	if password != "" && (!letters || !others) {
+		return validation.NewError("validation_password_weak", "must contain letters and at least one digit or symbol")
+	}
 	return nil
 }
 
-// generateJWT generates a JWT that encodes an identity.
-func (s service) generateJWT(identity Identity) (string, error) {
-	return jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"id":   identity.GetID(),
-		"name": identity.GetName(),
-		"exp":  time.Now().Add(time.Duration(s.tokenExpiration) * time.Hour).Unix(),
-	}).SignedString([]byte(s.signingKey))
+// checkPassword reports whether the given password matches the bcrypt hash.
+func checkPassword(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
 }
@@ -2,39 +2,540 @@ package auth
 
 import (
 	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
 	"testing"
+	"time"
 
+	"github.com/dgrijalva/jwt-go"
 	"github.com/garaekz/priv8/internal/entity"
 	"github.com/garaekz/priv8/internal/errors"
 	"github.com/garaekz/priv8/pkg/log"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
 	"github.com/stretchr/testify/assert"
 )
 
+var errCRUD = fmt.Errorf("error crud")
+
 func Test_service_Login(t *testing.T) {
 	logger, _ := log.NewForTest()
-	s := NewService("test", 100, logger)
+	s := newTestService(newMockRepository(), logger)
 	_, err := s.Login(context.Background(), "unknown", "bad")
 	assert.Equal(t, errors.Unauthorized(""), err)
-	token, err := s.Login(context.Background(), "demo", "pass")
+	_, err = s.Login(context.Background(), "demo", "bad")
+	assert.Equal(t, errors.Unauthorized(""), err)
+	_, err = s.Login(context.Background(), "error", "pass")
+	assert.Equal(t, errCRUD, err)
+	tokens, err := s.Login(context.Background(), "demo", "pass")
+	assert.Nil(t, err)
+	assert.NotEmpty(t, tokens.AccessToken)
+	assert.NotEmpty(t, tokens.RefreshToken)
+	assert.Equal(t, 900, tokens.ExpiresIn)
+
+	// the access token carries the roles and permissions of the user
+	token, err := jwt.Parse(tokens.AccessToken, NewKeyRing(NewHMACKey("test")).keyFunc)
+	if assert.Nil(t, err) {
+		claims := token.Claims.(jwt.MapClaims)
+		assert.Equal(t, []string{RoleUser}, stringsClaim(claims, "roles"))
+		assert.Equal(t, Permissions(RoleUser), stringsClaim(claims, "permissions"))
+	}
+}
+
+func Test_service_Login_lockout(t *testing.T) {
+	logger, _ := log.NewForTest()
+	s := newTestService(newMockRepository(), logger)
+	ctx := withClient(context.Background(), &http.Request{RemoteAddr: "127.0.0.1:1234"})
+	for i := 0; i < usernameFailureLimit; i++ {
+		_, err := s.Login(ctx, "demo", "bad")
+		assert.Equal(t, errors.Unauthorized(""), err)
+	}
+	_, err := s.Login(ctx, "demo", "pass")
+	if assert.IsType(t, errors.ErrorResponse{}, err) {
+		assert.Equal(t, http.StatusTooManyRequests, err.(errors.ErrorResponse).Status)
+	}
+}
+
+func Test_service_Refresh(t *testing.T) {
+	logger, _ := log.NewForTest()
+	tokenRepo := &mockTokenRepository{}
+	s := NewService(newMockRepository(), tokenRepo, &mockSessionRepository{}, &mockAPIKeyRepository{}, &mockPasswordResetRepository{}, NewMemoryDenylist(), NewKeyRing(NewHMACKey("test")), NewThrottler(NewMemoryAttemptStore(), logger), &mockMailer{}, &mockAlbumDeleter{}, &mockAuditor{}, withoutTransaction, "", 15*time.Minute, time.Hour, logger)
+	ctx := context.Background()
+
+	// unknown token
+	_, err := s.Refresh(ctx, "unknown")
+	assert.Equal(t, errors.Unauthorized(""), err)
+
+	// rotation
+	tokens, err := s.Login(ctx, "demo", "pass")
+	assert.Nil(t, err)
+	tokens2, err := s.Refresh(ctx, tokens.RefreshToken)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, tokens2.AccessToken)
+	assert.NotEqual(t, tokens.RefreshToken, tokens2.RefreshToken)
+	tokens3, err := s.Refresh(ctx, tokens2.RefreshToken)
+	assert.Nil(t, err)
+	assert.Equal(t, tokenRepo.items[0].FamilyID, tokenRepo.items[2].FamilyID)
+
+	// reuse of a rotated token revokes the whole family
+	_, err = s.Refresh(ctx, tokens.RefreshToken)
+	assert.Equal(t, errors.Unauthorized(""), err)
+	_, err = s.Refresh(ctx, tokens3.RefreshToken)
+	assert.Equal(t, errors.Unauthorized(""), err)
+
+	// other families are not affected
+	tokens, _ = s.Login(ctx, "demo", "pass")
+	_, err = s.Refresh(ctx, tokens.RefreshToken)
+	assert.Nil(t, err)
+
+	// expired token
+	tokenRepo.items = append(tokenRepo.items, entity.RefreshToken{
+		ID:        "expired",
+		FamilyID:  "expired",
+		UserID:    "100",
+		TokenHash: HashToken("expired"),
+		ExpiresAt: time.Now().Add(-time.Minute),
+	})
+	_, err = s.Refresh(ctx, "expired")
+	assert.Equal(t, errors.Unauthorized(""), err)
+
+	// deleted user
+	tokenRepo.items = append(tokenRepo.items, entity.RefreshToken{
+		ID:        "deleted",
+		FamilyID:  "deleted",
+		UserID:    "none",
+		TokenHash: HashToken("deleted"),
+		ExpiresAt: time.Now().Add(time.Minute),
+	})
+	_, err = s.Refresh(ctx, "deleted")
+	assert.Equal(t, errors.Unauthorized(""), err)
+}
+
+func TestRegisterRequest_Validate(t *testing.T) {
+	tests := []struct {
+		name      string
+		model     RegisterRequest
+		wantError bool
+	}{
+		{"success", RegisterRequest{Username: "test", Password: "s3cret-pass"}, false},
+		{"username required", RegisterRequest{Username: "", Password: "s3cret-pass"}, true},
+		{"username too short", RegisterRequest{Username: "ab", Password: "s3cret-pass"}, true},
+		{"username invalid", RegisterRequest{Username: "a b c", Password: "s3cret-pass"}, true},
+		{"password required", RegisterRequest{Username: "test", Password: ""}, true},
+		{"password too short", RegisterRequest{Username: "test", Password: "s3cret"}, true},
+		{"password letters only", RegisterRequest{Username: "test", Password: "secretpass"}, true},
+		{"password digits only", RegisterRequest{Username: "test", Password: "1234567890"}, true},
+		{"email", RegisterRequest{Username: "test", Password: "s3cret-pass", Email: "test@example.com"}, false},
+		{"email invalid", RegisterRequest{Username: "test", Password: "s3cret-pass", Email: "test"}, true},
+		{"email with name", RegisterRequest{Username: "test", Password: "s3cret-pass", Email: "Test <test@example.com>"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.model.Validate()
+			assert.Equal(t, tt.wantError, err != nil)
+		})
+	}
+}
+
+func TestChangePasswordRequest_Validate(t *testing.T) {
+	tests := []struct {
+		name      string
+		model     ChangePasswordRequest
+		wantError bool
+	}{
+		{"success", ChangePasswordRequest{CurrentPassword: "pass", NewPassword: "s3cret-pass"}, false},
+		{"current required", ChangePasswordRequest{CurrentPassword: "", NewPassword: "s3cret-pass"}, true},
+		{"new required", ChangePasswordRequest{CurrentPassword: "pass", NewPassword: ""}, true},
+		{"new weak", ChangePasswordRequest{CurrentPassword: "pass", NewPassword: "secretpass"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.model.Validate()
+			assert.Equal(t, tt.wantError, err != nil)
+		})
+	}
+}
+
+func Test_service_Logout(t *testing.T) {
+	logger, _ := log.NewForTest()
+	tokenRepo := &mockTokenRepository{}
+	denylist := NewMemoryDenylist()
+	s := NewService(newMockRepository(), tokenRepo, &mockSessionRepository{}, &mockAPIKeyRepository{}, &mockPasswordResetRepository{}, denylist, NewKeyRing(NewHMACKey("test")), NewThrottler(NewMemoryAttemptStore(), logger), &mockMailer{}, &mockAlbumDeleter{}, &mockAuditor{}, withoutTransaction, "", 15*time.Minute, time.Hour, logger)
+	ctx := context.Background()
+
+	tokens, _ := s.Login(ctx, "demo", "pass")
+
+	// access token only
+	err := s.Logout(ctx, "100", "", "token1", time.Now().Add(time.Minute), "")
+	assert.Nil(t, err)
+	revoked, _ := denylist.IsRevoked(ctx, "token1")
+	assert.True(t, revoked)
+
+	// refresh token of another user is left alone
+	err = s.Logout(ctx, "101", "", "token2", time.Now().Add(time.Minute), tokens.RefreshToken)
+	assert.Nil(t, err)
+	assert.Nil(t, tokenRepo.items[0].RevokedAt)
+
+	// unknown refresh token
+	err = s.Logout(ctx, "100", "", "token3", time.Now().Add(time.Minute), "unknown")
+	assert.Nil(t, err)
+
+	// refresh token of the user is revoked
+	err = s.Logout(ctx, "100", "", "token4", time.Now().Add(time.Minute), tokens.RefreshToken)
+	assert.Nil(t, err)
+	assert.NotNil(t, tokenRepo.items[0].RevokedAt)
+	_, err = s.Refresh(ctx, tokens.RefreshToken)
+	assert.Equal(t, errors.Unauthorized(""), err)
+
+	// the session of the access token is revoked
+	tokens, _ = s.Login(ctx, "demo", "pass")
+	sessionID := tokenRepo.items[1].FamilyID
+	err = s.Logout(ctx, "100", sessionID, "token5", time.Now().Add(time.Minute), "")
+	assert.Nil(t, err)
+	active, _ := s.ValidateSession(ctx, sessionID)
+	assert.False(t, active)
+	_, err = s.Refresh(ctx, tokens.RefreshToken)
+	assert.Equal(t, errors.Unauthorized(""), err)
+}
+
+func Test_service_Register(t *testing.T) {
+	logger, _ := log.NewForTest()
+	repo := newMockRepository()
+	s := newTestService(repo, logger)
+	ctx := context.Background()
+
+	// validation error
+	_, err := s.Register(ctx, RegisterRequest{Username: "newbie", Password: "weak"})
+	assert.NotNil(t, err)
+
+	// duplicate username
+	_, err = s.Register(ctx, RegisterRequest{Username: "demo", Password: "s3cret-pass"})
+	if assert.IsType(t, validation.Errors{}, err) {
+		assert.Contains(t, err.(validation.Errors), "username")
+	}
+	_, err = s.Register(ctx, RegisterRequest{Username: "DeMo", Password: "s3cret-pass"})
+	assert.Equal(t, errUsernameTaken(), err)
+
+	// username or email taken by a concurrent registration
+	_, err = s.Register(ctx, RegisterRequest{Username: "racer", Password: "s3cret-pass"})
+	assert.Equal(t, errUsernameTaken(), err)
+	_, err = s.Register(ctx, RegisterRequest{Username: "newbie", Password: "s3cret-pass", Email: "racer@example.com"})
+	assert.Equal(t, errEmailTaken(), err)
+
+	// duplicate email
+	_, err = s.Register(ctx, RegisterRequest{Username: "newbie", Password: "s3cret-pass", Email: "Demo@Example.com"})
+	if assert.IsType(t, validation.Errors{}, err) {
+		assert.Contains(t, err.(validation.Errors), "email")
+	}
+
+	// unexpected error
+	_, err = s.Register(ctx, RegisterRequest{Username: "error", Password: "s3cret-pass"})
+	assert.Equal(t, errCRUD, err)
+
+	// success
+	user, err := s.Register(ctx, RegisterRequest{Username: "NewBie", Password: "s3cret-pass", Email: "Newbie@Example.com"})
+	assert.Nil(t, err)
+	assert.NotEmpty(t, user.ID)
+	assert.Equal(t, "newbie", user.Name)
+	assert.Equal(t, "newbie@example.com", user.Email)
+	assert.Equal(t, []string{RoleUser}, user.Roles)
+	assert.NotEqual(t, "s3cret-pass", user.PasswordHash)
+	assert.Equal(t, 2, len(repo.items))
+	assert.Equal(t, []entity.AuditRecord{{ActorID: user.ID, Action: entity.AuditCreate, ResourceType: "user", ResourceID: user.ID}},
+		s.(service).auditor.(*mockAuditor).records)
+
+	// the new user can log in, with the username in any case
+	_, err = s.Login(ctx, "newbie", "s3cret-pass")
+	assert.Nil(t, err)
+	_, err = s.Login(ctx, "NEWBIE", "s3cret-pass")
+	assert.Nil(t, err)
+}
+
+func Test_service_ChangePassword(t *testing.T) {
+	logger, _ := log.NewForTest()
+	s := newTestService(newMockRepository(), logger)
+	ctx := WithUser(context.Background(), "100", "demo", RoleUser)
+
+	// validation error
+	err := s.ChangePassword(ctx, "100", ChangePasswordRequest{CurrentPassword: "pass", NewPassword: "weak"})
+	assert.NotNil(t, err)
+
+	// unknown user
+	err = s.ChangePassword(ctx, "none", ChangePasswordRequest{CurrentPassword: "pass", NewPassword: "n3w-pass-word"})
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	// wrong current password
+	err = s.ChangePassword(ctx, "100", ChangePasswordRequest{CurrentPassword: "bad", NewPassword: "n3w-pass-word"})
+	if assert.IsType(t, validation.Errors{}, err) {
+		assert.Contains(t, err.(validation.Errors), "current_password")
+	}
+
+	// success
+	err = s.ChangePassword(ctx, "100", ChangePasswordRequest{CurrentPassword: "pass", NewPassword: "n3w-pass-word"})
+	assert.Nil(t, err)
+	assert.Equal(t, []entity.AuditRecord{{ActorID: "100", Action: entity.AuditUpdate, ResourceType: "user", ResourceID: "100"}},
+		s.(service).auditor.(*mockAuditor).records)
+	_, err = s.Login(ctx, "demo", "pass")
+	assert.Equal(t, errors.Unauthorized(""), err)
+	_, err = s.Login(ctx, "demo", "n3w-pass-word")
+	assert.Nil(t, err)
+}
+
+func Test_service_DeleteAccount(t *testing.T) {
+	logger, _ := log.NewForTest()
+	repo := newMockRepository()
+	s := newTestService(repo, logger)
+	ctx := WithUser(context.Background(), "100", "demo", RoleUser)
+
+	_, err := s.DeleteAccount(ctx, "none")
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	user, err := s.DeleteAccount(ctx, "100")
 	assert.Nil(t, err)
-	assert.NotEmpty(t, token)
+	assert.Equal(t, "demo", user.Name)
+	assert.Empty(t, repo.items)
+	assert.Equal(t, []string{"100"}, s.(service).albums.(*mockAlbumDeleter).owners)
+	assert.Equal(t, []entity.AuditRecord{{ActorID: "100", Action: entity.AuditDelete, ResourceType: "user", ResourceID: "100"}},
+		s.(service).auditor.(*mockAuditor).records)
+	_, err = s.Login(ctx, "demo", "pass")
+	assert.Equal(t, errors.Unauthorized(""), err)
 }
 
 func Test_service_authenticate(t *testing.T) {
 	logger, _ := log.NewForTest()
-	s := service{"test", 100, logger}
-	assert.Nil(t, s.authenticate(context.Background(), "unknown", "bad"))
-	assert.NotNil(t, s.authenticate(context.Background(), "demo", "pass"))
+	s := newTestService(newMockRepository(), logger).(service)
+	identity, err := s.authenticate(context.Background(), "unknown", "bad")
+	assert.Nil(t, err)
+	assert.Nil(t, identity)
+	identity, err = s.authenticate(context.Background(), "demo", "bad")
+	assert.Nil(t, err)
+	assert.Nil(t, identity)
+	identity, err = s.authenticate(context.Background(), "demo", "pass")
+	assert.Nil(t, err)
+	if assert.NotNil(t, identity) {
+		assert.Equal(t, "100", identity.GetID())
+	}
 }
 
 func Test_service_GenerateJWT(t *testing.T) {
 	logger, _ := log.NewForTest()
-	s := service{"test", 100, logger}
+	s := newTestService(newMockRepository(), logger).(service)
 	token, err := s.generateJWT(entity.User{
 		ID:   "100",
 		Name: "demo",
-	})
+	}, "session")
 	if assert.Nil(t, err) {
-		assert.NotEmpty(t, token)
+		claims, _ := s.keys.Parse(token)
+		assert.Equal(t, "session", claims["sid"])
+	}
+}
+
+func Test_generateToken(t *testing.T) {
+	token, err := GenerateToken()
+	assert.Nil(t, err)
+	assert.Len(t, token, 43)
+	token2, _ := GenerateToken()
+	assert.NotEqual(t, token, token2)
+	assert.Equal(t, HashToken(token), HashToken(token))
+	assert.NotEqual(t, HashToken(token), HashToken(token2))
+}
+
+func Test_hashPassword(t *testing.T) {
+	hash, err := hashPassword("pass")
+	assert.Nil(t, err)
+	assert.NotEqual(t, "pass", hash)
+	assert.True(t, checkPassword(hash, "pass"))
+	assert.False(t, checkPassword(hash, "bad"))
+	assert.False(t, checkPassword("", "pass"))
+}
+
+// demoPasswordHash is the bcrypt hash of "pass".
+const demoPasswordHash = "$2a$10$E8iO8Baplgb7izmPuqwYnOW0hIajAmfpqKt0jmLZpaKhW6pZJDmiu"
+
+func newTestService(repo Repository, logger log.Logger) Service {
+	return NewService(repo, &mockTokenRepository{}, &mockSessionRepository{}, &mockAPIKeyRepository{}, &mockPasswordResetRepository{}, NewMemoryDenylist(), NewKeyRing(NewHMACKey("test")), NewThrottler(NewMemoryAttemptStore(), logger), &mockMailer{}, &mockAlbumDeleter{}, &mockAuditor{}, withoutTransaction, "", 15*time.Minute, time.Hour, logger)
+}
+
+type mockRepository struct {
+	items []entity.User
+	// recoveryCodes maps the recovery code hashes of each user to whether they were used
+	recoveryCodes map[string]map[string]bool
+}
+
+func newMockRepository() *mockRepository {
+	return &mockRepository{items: []entity.User{
+		{ID: "100", Name: "demo", Email: "demo@example.com", PasswordHash: demoPasswordHash, Roles: []string{RoleUser}},
+	}}
+}
+
+func (m mockRepository) Get(_ context.Context, id string) (entity.User, error) {
+	for _, item := range m.items {
+		if item.ID == id {
+			return item, nil
+		}
+	}
+	return entity.User{}, sql.ErrNoRows
+}
+
+func (m mockRepository) GetByName(_ context.Context, name string) (entity.User, error) {
+	if name == "error" {
+		return entity.User{}, errCRUD
+	}
+	for _, item := range m.items {
+		if item.Name == name {
+			return item, nil
+		}
+	}
+	return entity.User{}, sql.ErrNoRows
+}
+
+func (m mockRepository) GetByEmail(_ context.Context, email string) (entity.User, error) {
+	for _, item := range m.items {
+		if item.Email != "" && item.Email == email {
+			return item, nil
+		}
+	}
+	return entity.User{}, sql.ErrNoRows
+}
+
+func (m *mockRepository) Create(_ context.Context, user entity.User) error {
+	switch {
+	case user.Name == "error":
+		return errCRUD
+	// "racer" is taken by a concurrent registration between the checks of the service and the insert
+	case user.Name == "racer":
+		return ErrDuplicateName
+	case user.Email == "racer@example.com":
+		return ErrDuplicateEmail
+	}
+	m.items = append(m.items, user)
+	return nil
+}
+
+func (m *mockRepository) Update(_ context.Context, user entity.User) error {
+	for i, item := range m.items {
+		if item.ID == user.ID {
+			m.items[i] = user
+			break
+		}
+	}
+	return nil
+}
+
+func (m *mockRepository) Delete(_ context.Context, id string) error {
+	for i, item := range m.items {
+		if item.ID == id {
+			m.items[i] = m.items[len(m.items)-1]
+			m.items = m.items[:len(m.items)-1]
+			break
+		}
+	}
+	return nil
+}
+
+func (m *mockRepository) ReplaceRecoveryCodes(_ context.Context, userID string, hashes []string) error {
+	if m.recoveryCodes == nil {
+		m.recoveryCodes = map[string]map[string]bool{}
+	}
+	m.recoveryCodes[userID] = map[string]bool{}
+	for _, hash := range hashes {
+		m.recoveryCodes[userID][hash] = false
+	}
+	return nil
+}
+
+func (m *mockRepository) UseRecoveryCode(_ context.Context, userID, hash string) (bool, error) {
+	used, ok := m.recoveryCodes[userID][hash]
+	if !ok || used {
+		return false, nil
+	}
+	m.recoveryCodes[userID][hash] = true
+	return true, nil
+}
+
+func (m *mockRepository) UseTOTPStep(_ context.Context, userID string, step int64) (bool, error) {
+	for i, item := range m.items {
+		if item.ID == userID && item.TOTPLastStep < step {
+			m.items[i].TOTPLastStep = step
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// withoutTransaction runs f as if it was in a transaction.
+func withoutTransaction(ctx context.Context, f func(ctx context.Context) error) error {
+	return f(ctx)
+}
+
+type mockAlbumDeleter struct {
+	owners []string
+}
+
+func (m *mockAlbumDeleter) DeleteOwnedBy(_ context.Context, ownerID string) error {
+	m.owners = append(m.owners, ownerID)
+	return nil
+}
+
+type mockAuditor struct {
+	records []entity.AuditRecord
+}
+
+func (m *mockAuditor) Record(ctx context.Context, action, resourceType, resourceID string, _, _ interface{}) error {
+	record := entity.AuditRecord{
+		Action:       action,
+		ResourceType: resourceType,
+		ResourceID:   resourceID,
+	}
+	if user := CurrentUser(ctx); user != nil {
+		record.ActorID = user.GetID()
+	}
+	m.records = append(m.records, record)
+	return nil
+}
+
+type mockTokenRepository struct {
+	items []entity.RefreshToken
+}
+
+func (m mockTokenRepository) GetByHash(_ context.Context, hash string) (entity.RefreshToken, error) {
+	for _, item := range m.items {
+		if item.TokenHash == hash {
+			return item, nil
+		}
+	}
+	return entity.RefreshToken{}, sql.ErrNoRows
+}
+
+func (m *mockTokenRepository) Create(_ context.Context, token entity.RefreshToken) error {
+	m.items = append(m.items, token)
+	return nil
+}
+
+func (m *mockTokenRepository) MarkUsed(_ context.Context, id string, at time.Time) (bool, error) {
+	for i, item := range m.items {
+		if item.ID == id && item.UsedAt == nil {
+			m.items[i].UsedAt = &at
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *mockTokenRepository) RevokeFamily(_ context.Context, familyID string, at time.Time) error {
+	for i, item := range m.items {
+		if item.FamilyID == familyID && item.RevokedAt == nil {
+			m.items[i].RevokedAt = &at
+		}
+	}
+	return nil
+}
+
+func (m *mockTokenRepository) RevokeUser(_ context.Context, userID, keepFamilyID string, at time.Time) error {
+	for i, item := range m.items {
+		if item.UserID == userID && item.FamilyID != keepFamilyID && item.RevokedAt == nil {
+			m.items[i].RevokedAt = &at
+		}
 	}
+	return nil
 }
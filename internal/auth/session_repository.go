@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"context"
+	"github.com/garaekz/priv8/internal/entity"
+	"github.com/garaekz/priv8/pkg/dbcontext"
+	"github.com/garaekz/priv8/pkg/log"
+	dbx "github.com/go-ozzo/ozzo-dbx"
+	"time"
+)
+
+// SessionRepository encapsulates the logic to access login sessions from the data source.
+type SessionRepository interface {
+	// Get returns the session with the specified ID.
+	Get(ctx context.Context, id string) (entity.Session, error)
+	// Query returns the sessions of the user with the specified ID that are neither revoked nor expired.
+	Query(ctx context.Context, userID string) ([]entity.Session, error)
+	// Create saves a new session in the storage.
+	Create(ctx context.Context, session entity.Session) error
+	// Touch sets the last seen time and the expiration time of the session with the specified ID unless the session
+	// is revoked. It reports whether the session was updated.
+	Touch(ctx context.Context, id string, lastSeenAt, expiresAt time.Time) (bool, error)
+	// Revoke revokes the session with the specified ID of the user with the specified ID.
+	Revoke(ctx context.Context, userID, id string, at time.Time) error
+	// RevokeUser revokes every session of the user with the specified ID except the session keepID,
+	// which may be empty.
+	RevokeUser(ctx context.Context, userID, keepID string, at time.Time) error
+}
+
+// sessionRepository persists sessions in database
+type sessionRepository struct {
+	db     *dbcontext.DB
+	logger log.Logger
+}
+
+// NewSessionRepository creates a new session repository
+func NewSessionRepository(db *dbcontext.DB, logger log.Logger) SessionRepository {
+	return sessionRepository{db, logger}
+}
+
+// Get reads the session with the specified ID from the database.
+func (r sessionRepository) Get(ctx context.Context, id string) (entity.Session, error) {
+	var session entity.Session
+	err := r.db.With(ctx).Select().Model(id, &session)
+	return session, err
+}
+
+// Query reads the active sessions of the specified user from the database, most recently seen first.
+func (r sessionRepository) Query(ctx context.Context, userID string) ([]entity.Session, error) {
+	var sessions []entity.Session
+	err := r.db.With(ctx).Select().
+		Where(dbx.HashExp{"user_id": userID, "revoked_at": nil}).
+		AndWhere(dbx.NewExp("expires_at > {:now}", dbx.Params{"now": time.Now()})).
+		OrderBy("last_seen_at DESC").
+		All(&sessions)
+	return sessions, err
+}
+
+// Create saves a new session record in the database.
+func (r sessionRepository) Create(ctx context.Context, session entity.Session) error {
+	return r.db.With(ctx).Model(&session).Insert()
+}
+
+// Touch updates the last seen time and the expiration time of a session in the database.
+// Only these columns are written, and only if the session is not revoked, so that a concurrent revocation
+// is never undone.
+func (r sessionRepository) Touch(ctx context.Context, id string, lastSeenAt, expiresAt time.Time) (bool, error) {
+	result, err := r.db.With(ctx).Update("session",
+		dbx.Params{"last_seen_at": lastSeenAt, "expires_at": expiresAt},
+		dbx.HashExp{"id": id, "revoked_at": nil},
+	).Execute()
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// Revoke sets the revocation time of the session with the specified ID and user ID in the database.
+func (r sessionRepository) Revoke(ctx context.Context, userID, id string, at time.Time) error {
+	var session entity.Session
+	if err := r.db.With(ctx).Select().Where(dbx.HashExp{"id": id, "user_id": userID}).One(&session); err != nil {
+		return err
+	}
+	if session.RevokedAt != nil {
+		return nil
+	}
+	session.RevokedAt = &at
+	return r.db.With(ctx).Model(&session).Update("RevokedAt")
+}
+
+// RevokeUser sets the revocation time of every active session of a user but the given one in the database.
+func (r sessionRepository) RevokeUser(ctx context.Context, userID, keepID string, at time.Time) error {
+	_, err := r.db.With(ctx).Update("session",
+		dbx.Params{"revoked_at": at},
+		dbx.And(dbx.HashExp{"user_id": userID, "revoked_at": nil}, dbx.Not(dbx.HashExp{"id": keepID})),
+	).Execute()
+	return err
+}
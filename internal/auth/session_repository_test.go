@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"github.com/garaekz/priv8/internal/entity"
+	"github.com/garaekz/priv8/internal/test"
+	"github.com/garaekz/priv8/pkg/log"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestSessionRepository(t *testing.T) {
+	logger, _ := log.NewForTest()
+	db := test.DB(t)
+	test.ResetTables(t, db, "session", "user")
+	test.CreateUser(t, db, "100", "demo")
+	test.CreateUser(t, db, "101", "other")
+	repo := NewSessionRepository(db, logger)
+	ctx := context.Background()
+	now := time.Now()
+
+	// create
+	for _, id := range []string{"session1", "session2"} {
+		err := repo.Create(ctx, entity.Session{
+			ID:         id,
+			UserID:     "100",
+			UserAgent:  "test/1.0",
+			IP:         "192.168.0.1",
+			CreatedAt:  now,
+			LastSeenAt: now,
+			ExpiresAt:  now.Add(time.Hour),
+		})
+		assert.Nil(t, err)
+	}
+
+	// get
+	session, err := repo.Get(ctx, "session1")
+	assert.Nil(t, err)
+	assert.Equal(t, "100", session.UserID)
+	assert.Equal(t, "192.168.0.1", session.IP)
+	assert.Nil(t, session.RevokedAt)
+	_, err = repo.Get(ctx, "session0")
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	// touch
+	updated, err := repo.Touch(ctx, "session1", now.Add(time.Minute), now.Add(2*time.Hour))
+	assert.Nil(t, err)
+	assert.True(t, updated)
+
+	// query
+	sessions, err := repo.Query(ctx, "100")
+	assert.Nil(t, err)
+	if assert.Equal(t, 2, len(sessions)) {
+		assert.Equal(t, "session1", sessions[0].ID)
+	}
+	sessions, _ = repo.Query(ctx, "101")
+	assert.Equal(t, 0, len(sessions))
+
+	// revoke
+	assert.Equal(t, sql.ErrNoRows, repo.Revoke(ctx, "101", "session1", now))
+	assert.Nil(t, repo.Revoke(ctx, "100", "session1", now))
+	session, _ = repo.Get(ctx, "session1")
+	assert.NotNil(t, session.RevokedAt)
+	updated, err = repo.Touch(ctx, "session1", now.Add(time.Minute), now.Add(2*time.Hour))
+	assert.Nil(t, err)
+	assert.False(t, updated)
+	session, _ = repo.Get(ctx, "session1")
+	assert.NotNil(t, session.RevokedAt)
+	sessions, _ = repo.Query(ctx, "100")
+	assert.Equal(t, 1, len(sessions))
+
+	// revoke user
+	assert.Nil(t, repo.RevokeUser(ctx, "100", "session2", now))
+	sessions, _ = repo.Query(ctx, "100")
+	assert.Equal(t, 1, len(sessions))
+	assert.Nil(t, repo.RevokeUser(ctx, "100", "", now))
+	sessions, _ = repo.Query(ctx, "100")
+	assert.Equal(t, 0, len(sessions))
+}
@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"github.com/garaekz/priv8/internal/entity"
+	"github.com/garaekz/priv8/internal/errors"
+	"time"
+)
+
+// sessionUsageInterval is how often the last seen time of a session is updated at most.
+const sessionUsageInterval = time.Minute
+
+// maxUserAgentLength is the length at which the user agent of a session is truncated.
+const maxUserAgentLength = 512
+
+// SessionValidator checks the sessions that access tokens are bound to.
+type SessionValidator interface {
+	// ValidateSession reports whether the session with the specified ID is still active.
+	ValidateSession(ctx context.Context, id string) (bool, error)
+}
+
+// QuerySessions returns the active sessions of the user with the specified ID.
+func (s service) QuerySessions(ctx context.Context, userID string) ([]entity.Session, error) {
+	sessions, err := s.sessionRepo.Query(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if sessions == nil {
+		sessions = []entity.Session{}
+	}
+	return sessions, nil
+}
+
+// RevokeSession revokes the session with the specified ID of the user with the specified ID.
+// The refresh tokens of the session are revoked, and its access tokens are rejected from now on.
+// sql.ErrNoRows is returned if the user has no such session.
+func (s service) RevokeSession(ctx context.Context, userID, id string) error {
+	session, err := s.sessionRepo.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if session.UserID != userID {
+		return sql.ErrNoRows
+	}
+	now := time.Now()
+	err = s.transactional(ctx, func(ctx context.Context) error {
+		if err := s.sessionRepo.Revoke(ctx, userID, id, now); err != nil {
+			return err
+		}
+		if err := s.tokenRepo.RevokeFamily(ctx, id, now); err != nil {
+			return err
+		}
+		if session.RevokedAt != nil {
+			return nil
+		}
+		return s.auditor.Record(ctx, entity.AuditDelete, auditSessionResource, id, session, nil)
+	})
+	if err != nil {
+		return err
+	}
+	s.logger.With(ctx, "user", userID).Infof("session %v revoked", id)
+	return nil
+}
+
+// ValidateSession reports whether the session with the specified ID is neither revoked nor expired.
+// The last seen time of an active session is updated at most once per sessionUsageInterval.
+func (s service) ValidateSession(ctx context.Context, id string) (bool, error) {
+	session, err := s.sessionRepo.Get(ctx, id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	if session.RevokedAt != nil || !now.Before(session.ExpiresAt) {
+		return false, nil
+	}
+	if now.Sub(session.LastSeenAt) >= sessionUsageInterval {
+		// the session may have been revoked since it was read
+		return s.sessionRepo.Touch(ctx, id, now, session.ExpiresAt)
+	}
+	return true, nil
+}
+
+// startSession records a new session with the specified ID for the user with the client IP and the user agent
+// in the context.
+func (s service) startSession(ctx context.Context, userID, id string) (entity.Session, error) {
+	now := time.Now()
+	agent := userAgent(ctx)
+	if len(agent) > maxUserAgentLength {
+		agent = agent[:maxUserAgentLength]
+	}
+	session := entity.Session{
+		ID:         id,
+		UserID:     userID,
+		UserAgent:  agent,
+		IP:         clientIP(ctx),
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(s.refreshTokenExpiration),
+	}
+	return session, s.sessionRepo.Create(ctx, session)
+}
+
+// extendSession marks the session with the specified ID as seen and extends it for the lifetime of
+// a new refresh token. Token families issued before sessions were recorded get a session of their own.
+// errors.Unauthorized is returned if the session has been revoked.
+func (s service) extendSession(ctx context.Context, userID, id string) error {
+	_, err := s.sessionRepo.Get(ctx, id)
+	if err == sql.ErrNoRows {
+		_, err := s.startSession(ctx, userID, id)
+		return err
+	} else if err != nil {
+		return err
+	}
+	now := time.Now()
+	active, err := s.sessionRepo.Touch(ctx, id, now, now.Add(s.refreshTokenExpiration))
+	if err != nil {
+		return err
+	}
+	if !active {
+		return errors.Unauthorized("")
+	}
+	return nil
+}
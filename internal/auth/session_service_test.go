@@ -0,0 +1,196 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garaekz/priv8/internal/entity"
+	"github.com/garaekz/priv8/internal/errors"
+	"github.com/garaekz/priv8/pkg/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_service_ChangePasswordRevokesSessions(t *testing.T) {
+	logger, _ := log.NewForTest()
+	tokenRepo := &mockTokenRepository{}
+	sessionRepo := &mockSessionRepository{}
+	s := NewService(newMockRepository(), tokenRepo, sessionRepo, &mockAPIKeyRepository{}, &mockPasswordResetRepository{}, NewMemoryDenylist(), NewKeyRing(NewHMACKey("test")), NewThrottler(NewMemoryAttemptStore(), logger), &mockMailer{}, &mockAlbumDeleter{}, &mockAuditor{}, withoutTransaction, "", 15*time.Minute, time.Hour, logger)
+	ctx := context.Background()
+
+	// a stolen session and the session that changes the password
+	stolen, err := s.Login(ctx, "demo", "pass")
+	assert.Nil(t, err)
+	current, err := s.Login(ctx, "demo", "pass")
+	assert.Nil(t, err)
+	stolenID, currentID := sessionRepo.items[0].ID, sessionRepo.items[1].ID
+
+	ctx = withToken(WithUser(ctx, "100", "demo", RoleUser), tokenInfo{ID: "token", SessionID: currentID, ExpiresAt: time.Now().Add(time.Hour)})
+	assert.Nil(t, s.ChangePassword(ctx, "100", ChangePasswordRequest{CurrentPassword: "pass", NewPassword: "n3w-pass-word"}))
+
+	_, err = s.Refresh(ctx, stolen.RefreshToken)
+	assert.Equal(t, errors.Unauthorized(""), err)
+	active, _ := s.ValidateSession(ctx, stolenID)
+	assert.False(t, active)
+	_, err = s.Refresh(ctx, current.RefreshToken)
+	assert.Nil(t, err)
+	active, _ = s.ValidateSession(ctx, currentID)
+	assert.True(t, active)
+}
+
+func Test_service_Sessions(t *testing.T) {
+	logger, _ := log.NewForTest()
+	tokenRepo := &mockTokenRepository{}
+	sessionRepo := &mockSessionRepository{}
+	auditor := &mockAuditor{}
+	keys := NewKeyRing(NewHMACKey("test"))
+	s := NewService(newMockRepository(), tokenRepo, sessionRepo, &mockAPIKeyRepository{}, &mockPasswordResetRepository{}, NewMemoryDenylist(), keys, NewThrottler(NewMemoryAttemptStore(), logger), &mockMailer{}, &mockAlbumDeleter{}, auditor, withoutTransaction, "", 15*time.Minute, time.Hour, logger)
+	ctx := withClient(context.Background(), &http.Request{RemoteAddr: "192.168.0.1:4321",
+		Header: http.Header{"User-Agent": {strings.Repeat("x", maxUserAgentLength+1)}}})
+
+	// login starts a session that the tokens are bound to
+	tokens, err := s.Login(ctx, "demo", "pass")
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(sessionRepo.items)) {
+		session := sessionRepo.items[0]
+		assert.Equal(t, "100", session.UserID)
+		assert.Equal(t, "192.168.0.1", session.IP)
+		assert.Equal(t, maxUserAgentLength, len(session.UserAgent))
+		assert.Equal(t, session.ID, tokenRepo.items[0].FamilyID)
+	}
+	sessionID := sessionRepo.items[0].ID
+	claims, _ := keys.Parse(tokens.AccessToken)
+	assert.Equal(t, sessionID, claims["sid"])
+	assert.Equal(t, []entity.AuditRecord{{ActorID: "100", Action: entity.AuditLogin, ResourceType: "session", ResourceID: sessionID}},
+		auditor.records)
+
+	// refresh keeps the session
+	sessionRepo.items[0].LastSeenAt = time.Now().Add(-time.Hour)
+	tokens, err = s.Refresh(ctx, tokens.RefreshToken)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(auditor.records))
+	assert.Equal(t, 1, len(sessionRepo.items))
+	assert.WithinDuration(t, time.Now(), sessionRepo.items[0].LastSeenAt, time.Minute)
+	claims, _ = keys.Parse(tokens.AccessToken)
+	assert.Equal(t, sessionID, claims["sid"])
+
+	// query
+	_, _ = s.Login(ctx, "demo", "pass")
+	sessions, err := s.QuerySessions(ctx, "100")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(sessions))
+	sessions, _ = s.QuerySessions(ctx, "101")
+	assert.Equal(t, []entity.Session{}, sessions)
+
+	// validate
+	active, err := s.ValidateSession(ctx, sessionID)
+	assert.Nil(t, err)
+	assert.True(t, active)
+	active, _ = s.ValidateSession(ctx, "unknown")
+	assert.False(t, active)
+
+	// revoke
+	assert.Equal(t, sql.ErrNoRows, s.RevokeSession(ctx, "101", sessionID))
+	assert.Nil(t, s.RevokeSession(WithUser(ctx, "100", "demo", RoleUser), "100", sessionID))
+	active, _ = s.ValidateSession(ctx, sessionID)
+	assert.False(t, active)
+	assert.Equal(t, entity.AuditRecord{ActorID: "100", Action: entity.AuditDelete, ResourceType: "session", ResourceID: sessionID},
+		auditor.records[len(auditor.records)-1])
+	// revoking a revoked session is not audited again
+	count := len(auditor.records)
+	assert.Nil(t, s.RevokeSession(ctx, "100", sessionID))
+	assert.Equal(t, count, len(auditor.records))
+	_, err = s.Refresh(ctx, tokens.RefreshToken)
+	assert.Equal(t, errors.Unauthorized(""), err)
+	sessions, _ = s.QuerySessions(ctx, "100")
+	assert.Equal(t, 1, len(sessions))
+
+	// expired sessions are inactive
+	sessionRepo.items[1].ExpiresAt = time.Now().Add(-time.Second)
+	active, _ = s.ValidateSession(ctx, sessionRepo.items[1].ID)
+	assert.False(t, active)
+
+	// a session revoked after it was read stays revoked
+	s = NewService(newMockRepository(), tokenRepo, staleSessionRepository{sessionRepo}, &mockAPIKeyRepository{}, &mockPasswordResetRepository{}, NewMemoryDenylist(), keys, NewThrottler(NewMemoryAttemptStore(), logger), &mockMailer{}, &mockAlbumDeleter{}, auditor, withoutTransaction, "", 15*time.Minute, time.Hour, logger)
+	sessionRepo.items[0].LastSeenAt = time.Now().Add(-time.Hour)
+	active, err = s.ValidateSession(ctx, sessionID)
+	assert.Nil(t, err)
+	assert.False(t, active)
+	assert.Equal(t, errors.Unauthorized(""), s.(service).extendSession(ctx, "100", sessionID))
+	assert.NotNil(t, sessionRepo.items[0].RevokedAt)
+}
+
+type mockSessionRepository struct {
+	items []entity.Session
+}
+
+func (m mockSessionRepository) Get(_ context.Context, id string) (entity.Session, error) {
+	for _, item := range m.items {
+		if item.ID == id {
+			return item, nil
+		}
+	}
+	return entity.Session{}, sql.ErrNoRows
+}
+
+func (m mockSessionRepository) Query(_ context.Context, userID string) ([]entity.Session, error) {
+	var sessions []entity.Session
+	for _, item := range m.items {
+		if item.UserID == userID && item.RevokedAt == nil && time.Now().Before(item.ExpiresAt) {
+			sessions = append(sessions, item)
+		}
+	}
+	return sessions, nil
+}
+
+func (m *mockSessionRepository) Create(_ context.Context, session entity.Session) error {
+	m.items = append(m.items, session)
+	return nil
+}
+
+func (m *mockSessionRepository) Touch(_ context.Context, id string, lastSeenAt, expiresAt time.Time) (bool, error) {
+	for i, item := range m.items {
+		if item.ID == id && item.RevokedAt == nil {
+			m.items[i].LastSeenAt = lastSeenAt
+			m.items[i].ExpiresAt = expiresAt
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// staleSessionRepository returns the sessions as they were before they were revoked, as if they were read
+// right before a concurrent revocation.
+type staleSessionRepository struct {
+	*mockSessionRepository
+}
+
+func (m staleSessionRepository) Get(ctx context.Context, id string) (entity.Session, error) {
+	session, err := m.mockSessionRepository.Get(ctx, id)
+	session.RevokedAt = nil
+	return session, err
+}
+
+func (m *mockSessionRepository) Revoke(_ context.Context, userID, id string, at time.Time) error {
+	for i, item := range m.items {
+		if item.ID == id && item.UserID == userID {
+			if item.RevokedAt == nil {
+				m.items[i].RevokedAt = &at
+			}
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (m *mockSessionRepository) RevokeUser(_ context.Context, userID, keepID string, at time.Time) error {
+	for i, item := range m.items {
+		if item.UserID == userID && item.ID != keepID && item.RevokedAt == nil {
+			m.items[i].RevokedAt = &at
+		}
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"github.com/garaekz/priv8/internal/errors"
+	"github.com/garaekz/priv8/pkg/dbcontext"
+	"github.com/garaekz/priv8/pkg/log"
+	dbx "github.com/go-ozzo/ozzo-dbx"
+	"sync"
+	"time"
+)
+
+const (
+	// usernameFailureLimit is the number of failed logins of a username after which the username is locked out.
+	usernameFailureLimit = 5
+	// ipFailureLimit is the number of failed logins from a client IP after which the IP is locked out.
+	// It is higher than the username limit because several users may share an IP.
+	ipFailureLimit = 20
+	// minLockout is the lockout after the failure limit is reached. It doubles with every further failure.
+	minLockout = 30 * time.Second
+	// maxLockout is the longest lockout.
+	maxLockout = 15 * time.Minute
+	// failureWindow is how long failed logins are remembered after the last one.
+	failureWindow = time.Hour
+)
+
+// LoginAttempts represents the failed login attempts recorded for a key, such as a username or a client IP.
+type LoginAttempts struct {
+	Failures      int
+	LastFailureAt time.Time
+	// LockedUntil is the time until which logins are rejected. It is zero if the key is not locked out.
+	LockedUntil time.Time
+}
+
+// AttemptStore keeps track of failed login attempts.
+type AttemptStore interface {
+	// Get returns the failed attempts recorded for the key. A zero value is returned if there are none.
+	Get(ctx context.Context, key string) (LoginAttempts, error)
+	// AddFailure records a failed attempt for the key and returns the number of failures.
+	// If the previous failure happened before the given time, the count starts over.
+	AddFailure(ctx context.Context, key string, at, since time.Time) (int, error)
+	// Lock rejects the logins of the key until the given time.
+	Lock(ctx context.Context, key string, until time.Time) error
+	// Reset removes the failed attempts of the key.
+	Reset(ctx context.Context, key string) error
+	// Prune removes the records of the keys that are not locked out and have not failed since the given time.
+	Prune(ctx context.Context, before time.Time) error
+}
+
+// Throttler protects the login against brute-force attacks.
+// It counts failed logins per username and per client IP and locks them out with an exponential backoff
+// once they exceed their limits.
+type Throttler struct {
+	store  AttemptStore
+	logger log.Logger
+}
+
+// NewThrottler creates a new login throttler that keeps the failed attempts in the given store.
+func NewThrottler(store AttemptStore, logger log.Logger) *Throttler {
+	return &Throttler{store, logger}
+}
+
+// Check returns a TooManyRequests error if the username or the client IP is locked out.
+func (t *Throttler) Check(ctx context.Context, username, ip string) error {
+	var retryAfter time.Duration
+	now := time.Now()
+	for _, key := range t.keys(username, ip) {
+		attempts, err := t.store.Get(ctx, key.name)
+		if err != nil {
+			return err
+		}
+		if wait := attempts.LockedUntil.Sub(now); wait > retryAfter {
+			retryAfter = wait
+		}
+	}
+	if retryAfter > 0 {
+		t.logger.With(ctx, "user", username, "ip", ip).Infof("login rejected during lockout")
+		return errors.TooManyRequests("Too many failed login attempts. Please try again later.", retryAfter)
+	}
+	return nil
+}
+
+// Fail records a failed login of the username from the client IP and locks out the ones that reached their limit.
+func (t *Throttler) Fail(ctx context.Context, username, ip string) error {
+	now := time.Now()
+	for _, key := range t.keys(username, ip) {
+		failures, err := t.store.AddFailure(ctx, key.name, now, now.Add(-failureWindow))
+		if err != nil {
+			return err
+		}
+		if failures < key.limit {
+			continue
+		}
+		lockout := maxLockout
+		if n := failures - key.limit; n < 16 {
+			if d := minLockout << n; d < maxLockout {
+				lockout = d
+			}
+		}
+		if err := t.store.Lock(ctx, key.name, now.Add(lockout)); err != nil {
+			return err
+		}
+		t.logger.With(ctx, "user", username, "ip", ip).
+			Infof("%v locked out for %v after %d failed login attempts", key.name, lockout, failures)
+	}
+	return nil
+}
+
+// Succeed forgets the failed logins of the username. Failures from the client IP are kept
+// so that a valid account cannot be used to reset the IP limit.
+func (t *Throttler) Succeed(ctx context.Context, username string) error {
+	return t.store.Reset(ctx, usernameKey(username))
+}
+
+// Prune removes the failed attempts that are no longer relevant.
+func (t *Throttler) Prune(ctx context.Context) error {
+	return t.store.Prune(ctx, time.Now().Add(-failureWindow))
+}
+
+type throttleKey struct {
+	name  string
+	limit int
+}
+
+// keys returns the keys that the attempts of the username from the client IP are counted for.
+func (t *Throttler) keys(username, ip string) []throttleKey {
+	keys := []throttleKey{{usernameKey(username), usernameFailureLimit}}
+	if ip != "" {
+		keys = append(keys, throttleKey{"ip:" + ip, ipFailureLimit})
+	}
+	return keys
+}
+
+// usernameKey returns the key that the attempts of a username are counted for. The username is normalized
+// so that the limit cannot be bypassed by changing the case.
+func usernameKey(username string) string {
+	return "user:" + normalizeUsername(username)
+}
+
+// memoryAttemptStore keeps failed login attempts in memory. It is only suitable for a single server instance.
+type memoryAttemptStore struct {
+	mu    sync.Mutex
+	items map[string]LoginAttempts
+}
+
+// NewMemoryAttemptStore creates a new attempt store that keeps failed login attempts in memory.
+func NewMemoryAttemptStore() AttemptStore {
+	return &memoryAttemptStore{items: map[string]LoginAttempts{}}
+}
+
+// Get returns the failed attempts of the key.
+func (m *memoryAttemptStore) Get(_ context.Context, key string) (LoginAttempts, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.items[key], nil
+}
+
+// AddFailure increments the failure count of the key.
+func (m *memoryAttemptStore) AddFailure(_ context.Context, key string, at, since time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	attempts := m.items[key]
+	if attempts.LastFailureAt.Before(since) {
+		attempts.Failures = 0
+	}
+	attempts.Failures++
+	attempts.LastFailureAt = at
+	m.items[key] = attempts
+	return attempts.Failures, nil
+}
+
+// Lock sets the lockout time of the key.
+func (m *memoryAttemptStore) Lock(_ context.Context, key string, until time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	attempts := m.items[key]
+	attempts.LockedUntil = until
+	m.items[key] = attempts
+	return nil
+}
+
+// Reset removes the key.
+func (m *memoryAttemptStore) Reset(_ context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.items, key)
+	return nil
+}
+
+// Prune removes the keys that are not locked out and have not failed since the given time.
+func (m *memoryAttemptStore) Prune(_ context.Context, before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for key, attempts := range m.items {
+		if attempts.LastFailureAt.Before(before) && !now.Before(attempts.LockedUntil) {
+			delete(m.items, key)
+		}
+	}
+	return nil
+}
+
+// dbAttemptStore keeps failed login attempts in the database so that they are shared by all server instances.
+type dbAttemptStore struct {
+	db     *dbcontext.DB
+	logger log.Logger
+}
+
+// NewDBAttemptStore creates a new attempt store that keeps failed login attempts in the database.
+func NewDBAttemptStore(db *dbcontext.DB, logger log.Logger) AttemptStore {
+	return dbAttemptStore{db, logger}
+}
+
+// Get reads the failed attempts of the key from the database.
+func (r dbAttemptStore) Get(ctx context.Context, key string) (LoginAttempts, error) {
+	var row struct {
+		Failures      int
+		LastFailureAt time.Time
+		LockedUntil   *time.Time
+	}
+	err := r.db.With(ctx).Select("failures", "last_failure_at", "locked_until").From("login_attempt").
+		Where(dbx.HashExp{"key": key}).One(&row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return LoginAttempts{}, nil
+		}
+		return LoginAttempts{}, err
+	}
+	attempts := LoginAttempts{Failures: row.Failures, LastFailureAt: row.LastFailureAt}
+	if row.LockedUntil != nil {
+		attempts.LockedUntil = *row.LockedUntil
+	}
+	return attempts, nil
+}
+
+// AddFailure increments the failure count of the key in the database.
+// The check and the update happen in one statement so that concurrent failures are all counted.
+func (r dbAttemptStore) AddFailure(ctx context.Context, key string, at, since time.Time) (int, error) {
+	var failures int
+	err := r.db.With(ctx).NewQuery(`
+		INSERT INTO login_attempt (key, failures, last_failure_at) VALUES ({:key}, 1, {:at})
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE WHEN login_attempt.last_failure_at < {:since} THEN 1 ELSE login_attempt.failures + 1 END,
+			last_failure_at = {:at}
+		RETURNING failures`,
+	).Bind(dbx.Params{"key": key, "at": at, "since": since}).Row(&failures)
+	return failures, err
+}
+
+// Lock sets the lockout time of the key in the database.
+func (r dbAttemptStore) Lock(ctx context.Context, key string, until time.Time) error {
+	_, err := r.db.With(ctx).Update("login_attempt", dbx.Params{"locked_until": until}, dbx.HashExp{"key": key}).Execute()
+	return err
+}
+
+// Reset deletes the record of the key from the database.
+func (r dbAttemptStore) Reset(ctx context.Context, key string) error {
+	_, err := r.db.With(ctx).Delete("login_attempt", dbx.HashExp{"key": key}).Execute()
+	return err
+}
+
+// Prune deletes the records of the keys that are not locked out and have not failed since the given time.
+func (r dbAttemptStore) Prune(ctx context.Context, before time.Time) error {
+	result, err := r.db.With(ctx).Delete("login_attempt", dbx.And(
+		dbx.NewExp("last_failure_at < {:before}", dbx.Params{"before": before}),
+		dbx.Or(dbx.HashExp{"locked_until": nil}, dbx.NewExp("locked_until <= {:now}", dbx.Params{"now": time.Now()})),
+	)).Execute()
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n > 0 {
+		r.logger.With(ctx).Infof("pruned %d expired login attempt records", n)
+	}
+	return nil
+}
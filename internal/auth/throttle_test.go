@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"context"
+	"github.com/garaekz/priv8/internal/errors"
+	"github.com/garaekz/priv8/internal/test"
+	"github.com/garaekz/priv8/pkg/log"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestMemoryAttemptStore(t *testing.T) {
+	testAttemptStore(t, NewMemoryAttemptStore())
+}
+
+func TestDBAttemptStore(t *testing.T) {
+	logger, _ := log.NewForTest()
+	db := test.DB(t)
+	test.ResetTables(t, db, "login_attempt")
+	testAttemptStore(t, NewDBAttemptStore(db, logger))
+}
+
+func testAttemptStore(t *testing.T, store AttemptStore) {
+	ctx := context.Background()
+	now := time.Now()
+
+	attempts, err := store.Get(ctx, "user:demo")
+	assert.Nil(t, err)
+	assert.Zero(t, attempts.Failures)
+	assert.True(t, attempts.LockedUntil.IsZero())
+
+	// failures
+	for i := 1; i <= 3; i++ {
+		failures, err := store.AddFailure(ctx, "user:demo", now, now.Add(-time.Hour))
+		assert.Nil(t, err)
+		assert.Equal(t, i, failures)
+	}
+	// the count starts over after the previous failure is too old
+	failures, err := store.AddFailure(ctx, "user:demo", now.Add(time.Minute), now.Add(time.Second))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, failures)
+
+	// lock
+	assert.Nil(t, store.Lock(ctx, "user:demo", now.Add(time.Hour)))
+	attempts, err = store.Get(ctx, "user:demo")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, attempts.Failures)
+	assert.WithinDuration(t, now.Add(time.Hour), attempts.LockedUntil, time.Second)
+
+	// prune keeps the keys that are locked out or failed recently
+	_, _ = store.AddFailure(ctx, "ip:127.0.0.1", now.Add(-2*time.Hour), now.Add(-3*time.Hour))
+	_, _ = store.AddFailure(ctx, "ip:127.0.0.2", now, now.Add(-time.Hour))
+	assert.Nil(t, store.Prune(ctx, now.Add(-time.Hour)))
+	attempts, _ = store.Get(ctx, "ip:127.0.0.1")
+	assert.Zero(t, attempts.Failures)
+	attempts, _ = store.Get(ctx, "ip:127.0.0.2")
+	assert.Equal(t, 1, attempts.Failures)
+	attempts, _ = store.Get(ctx, "user:demo")
+	assert.Equal(t, 1, attempts.Failures)
+
+	// reset
+	assert.Nil(t, store.Reset(ctx, "user:demo"))
+	attempts, _ = store.Get(ctx, "user:demo")
+	assert.Zero(t, attempts.Failures)
+}
+
+func TestThrottler(t *testing.T) {
+	logger, entries := log.NewForTest()
+	store := NewMemoryAttemptStore()
+	throttler := NewThrottler(store, logger)
+	ctx := context.Background()
+
+	// the username is locked out after reaching its limit
+	for i := 0; i < usernameFailureLimit; i++ {
+		assert.Nil(t, throttler.Check(ctx, "Demo", "127.0.0.1"))
+		assert.Nil(t, throttler.Fail(ctx, "Demo", "127.0.0.1"))
+	}
+	err := throttler.Check(ctx, "demo", "127.0.0.2")
+	if assert.IsType(t, errors.ErrorResponse{}, err) {
+		assert.Equal(t, 429, err.(errors.ErrorResponse).Status)
+		assert.Equal(t, 30, err.(errors.ErrorResponse).RetryAfter)
+	}
+	assert.Equal(t, 1, entries.FilterMessageSnippet("locked out").Len())
+	assert.Nil(t, throttler.Check(ctx, "other", "127.0.0.1"))
+
+	// the lockout doubles with every further failure
+	assert.Nil(t, throttler.Fail(ctx, "demo", "127.0.0.1"))
+	attempts, _ := store.Get(ctx, usernameKey("demo"))
+	assert.WithinDuration(t, time.Now().Add(2*minLockout), attempts.LockedUntil, time.Second)
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, throttler.Fail(ctx, "demo", "127.0.0.1"))
+	}
+	attempts, _ = store.Get(ctx, usernameKey("demo"))
+	assert.WithinDuration(t, time.Now().Add(maxLockout), attempts.LockedUntil, time.Second)
+
+	// the client IP is locked out after reaching its limit, regardless of the username
+	for i := 0; i < ipFailureLimit; i++ {
+		assert.Nil(t, throttler.Fail(ctx, "user", "10.0.0.1"))
+		assert.Nil(t, throttler.Succeed(ctx, "user"))
+	}
+	assert.NotNil(t, throttler.Check(ctx, "another", "10.0.0.1"))
+
+	// success forgets the failures of the username
+	assert.Nil(t, throttler.Fail(ctx, "newbie", ""))
+	assert.Nil(t, throttler.Succeed(ctx, "newbie"))
+	attempts, _ = store.Get(ctx, usernameKey("newbie"))
+	assert.Zero(t, attempts.Failures)
+
+	assert.Nil(t, throttler.Prune(ctx))
+}
@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"context"
+	"github.com/garaekz/priv8/internal/entity"
+	"github.com/garaekz/priv8/pkg/dbcontext"
+	"github.com/garaekz/priv8/pkg/log"
+	dbx "github.com/go-ozzo/ozzo-dbx"
+	"time"
+)
+
+// TokenRepository encapsulates the logic to access refresh tokens from the data source.
+type TokenRepository interface {
+	// GetByHash returns the refresh token with the specified token hash.
+	GetByHash(ctx context.Context, hash string) (entity.RefreshToken, error)
+	// Create saves a new refresh token in the storage.
+	Create(ctx context.Context, token entity.RefreshToken) error
+	// MarkUsed marks the refresh token with the specified ID as used.
+	// It returns false if the token has already been used.
+	MarkUsed(ctx context.Context, id string, at time.Time) (bool, error)
+	// RevokeFamily revokes all refresh tokens in the specified token family.
+	RevokeFamily(ctx context.Context, familyID string, at time.Time) error
+	// RevokeUser revokes all refresh tokens of the specified user except those in the token family keepFamilyID,
+	// which may be empty.
+	RevokeUser(ctx context.Context, userID, keepFamilyID string, at time.Time) error
+}
+
+// tokenRepository persists refresh tokens in database
+type tokenRepository struct {
+	db     *dbcontext.DB
+	logger log.Logger
+}
+
+// NewTokenRepository creates a new refresh token repository
+func NewTokenRepository(db *dbcontext.DB, logger log.Logger) TokenRepository {
+	return tokenRepository{db, logger}
+}
+
+// GetByHash reads the refresh token with the specified hash from the database.
+func (r tokenRepository) GetByHash(ctx context.Context, hash string) (entity.RefreshToken, error) {
+	var token entity.RefreshToken
+	err := r.db.With(ctx).Select().Where(dbx.HashExp{"token_hash": hash}).One(&token)
+	return token, err
+}
+
+// Create saves a new refresh token record in the database.
+func (r tokenRepository) Create(ctx context.Context, token entity.RefreshToken) error {
+	return r.db.With(ctx).Model(&token).Insert()
+}
+
+// MarkUsed sets the used time of an unused refresh token.
+// The check and the update happen in one statement so that concurrent refreshes cannot both succeed.
+func (r tokenRepository) MarkUsed(ctx context.Context, id string, at time.Time) (bool, error) {
+	result, err := r.db.With(ctx).Update("refresh_token",
+		dbx.Params{"used_at": at},
+		dbx.HashExp{"id": id, "used_at": nil},
+	).Execute()
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// RevokeFamily sets the revocation time of every unrevoked refresh token in a token family.
+func (r tokenRepository) RevokeFamily(ctx context.Context, familyID string, at time.Time) error {
+	_, err := r.db.With(ctx).Update("refresh_token",
+		dbx.Params{"revoked_at": at},
+		dbx.HashExp{"family_id": familyID, "revoked_at": nil},
+	).Execute()
+	return err
+}
+
+// RevokeUser sets the revocation time of every unrevoked refresh token of a user outside the given token family.
+func (r tokenRepository) RevokeUser(ctx context.Context, userID, keepFamilyID string, at time.Time) error {
+	_, err := r.db.With(ctx).Update("refresh_token",
+		dbx.Params{"revoked_at": at},
+		dbx.And(dbx.HashExp{"user_id": userID, "revoked_at": nil}, dbx.Not(dbx.HashExp{"family_id": keepFamilyID})),
+	).Execute()
+	return err
+}
@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"github.com/garaekz/priv8/internal/entity"
+	"github.com/garaekz/priv8/internal/test"
+	"github.com/garaekz/priv8/pkg/log"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestTokenRepository(t *testing.T) {
+	logger, _ := log.NewForTest()
+	db := test.DB(t)
+	test.ResetTables(t, db, "refresh_token", "user")
+	ctx := context.Background()
+	err := NewRepository(db, logger).Create(ctx, entity.User{
+		ID:           "100",
+		Name:         "demo",
+		PasswordHash: demoPasswordHash,
+		CreatedAt:    time.Now(),
+		UpdatedAt:    time.Now(),
+	})
+	assert.Nil(t, err)
+	repo := NewTokenRepository(db, logger)
+
+	// create
+	for _, id := range []string{"token1", "token2"} {
+		err = repo.Create(ctx, entity.RefreshToken{
+			ID:        id,
+			FamilyID:  "family1",
+			UserID:    "100",
+			TokenHash: "hash-" + id,
+			ExpiresAt: time.Now().Add(time.Hour),
+			CreatedAt: time.Now(),
+		})
+		assert.Nil(t, err)
+	}
+
+	// get by hash
+	token, err := repo.GetByHash(ctx, "hash-token1")
+	assert.Nil(t, err)
+	assert.Equal(t, "token1", token.ID)
+	assert.Nil(t, token.UsedAt)
+	assert.Nil(t, token.RevokedAt)
+	_, err = repo.GetByHash(ctx, "hash-token0")
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	// mark used
+	ok, err := repo.MarkUsed(ctx, "token1", time.Now())
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = repo.MarkUsed(ctx, "token1", time.Now())
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	token, _ = repo.GetByHash(ctx, "hash-token1")
+	assert.NotNil(t, token.UsedAt)
+
+	// revoke family
+	err = repo.RevokeFamily(ctx, "family1", time.Now())
+	assert.Nil(t, err)
+	token, _ = repo.GetByHash(ctx, "hash-token2")
+	assert.NotNil(t, token.RevokedAt)
+
+	// revoke user
+	err = repo.Create(ctx, entity.RefreshToken{
+		ID:        "token3",
+		FamilyID:  "family2",
+		UserID:    "100",
+		TokenHash: "hash-token3",
+		ExpiresAt: time.Now().Add(time.Hour),
+		CreatedAt: time.Now(),
+	})
+	assert.Nil(t, err)
+	err = repo.Create(ctx, entity.RefreshToken{
+		ID:        "token4",
+		FamilyID:  "family3",
+		UserID:    "100",
+		TokenHash: "hash-token4",
+		ExpiresAt: time.Now().Add(time.Hour),
+		CreatedAt: time.Now(),
+	})
+	assert.Nil(t, err)
+	err = repo.RevokeUser(ctx, "100", "family3", time.Now())
+	assert.Nil(t, err)
+	token, _ = repo.GetByHash(ctx, "hash-token3")
+	assert.NotNil(t, token.RevokedAt)
+	token, _ = repo.GetByHash(ctx, "hash-token4")
+	assert.Nil(t, token.RevokedAt)
+}
@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_totpCode(t *testing.T) {
+	// test vectors of RFC 6238 for SHA1, truncated to 6 digits
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		time int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.code, totpCode(secret, tt.time/totpPeriod))
+	}
+}
+
+func Test_validateTOTP(t *testing.T) {
+	secret, err := generateTOTPSecret()
+	assert.Nil(t, err)
+	key, _ := totpEncoding.DecodeString(secret)
+	now := time.Now()
+	step := now.Unix() / totpPeriod
+
+	matched, ok := validateTOTP(secret, totpCode(key, step), now, 0)
+	assert.True(t, ok)
+	assert.Equal(t, step, matched)
+
+	// clock drift
+	_, ok = validateTOTP(secret, totpCode(key, step-1), now, 0)
+	assert.True(t, ok)
+	_, ok = validateTOTP(secret, totpCode(key, step+1), now, 0)
+	assert.True(t, ok)
+	_, ok = validateTOTP(secret, totpCode(key, step-2), now, 0)
+	assert.False(t, ok)
+
+	// replay
+	_, ok = validateTOTP(secret, totpCode(key, step), now, step)
+	assert.False(t, ok)
+
+	// malformed
+	_, ok = validateTOTP(secret, "12345", now, 0)
+	assert.False(t, ok)
+	_, ok = validateTOTP("not base32!", "123456", now, 0)
+	assert.False(t, ok)
+}
+
+func Test_totpURI(t *testing.T) {
+	uri := totpURI("JBSWY3DPEHPK3PXP", "demo")
+	assert.True(t, strings.HasPrefix(uri, "otpauth://totp/priv8:demo?"))
+	assert.Contains(t, uri, "secret=JBSWY3DPEHPK3PXP")
+	assert.Contains(t, uri, "issuer=priv8")
+}
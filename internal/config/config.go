@@ -1,16 +1,25 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"github.com/garaekz/priv8/pkg/log"
 	"github.com/go-ozzo/ozzo-validation/v4"
 	"github.com/qiangxue/go-env"
+	"golang.org/x/crypto/hkdf"
 	"gopkg.in/yaml.v2"
+	"io"
 	"io/ioutil"
 )
 
 const (
-	defaultServerPort         = 8080
-	defaultJWTExpirationHours = 72
+	defaultServerPort                   = 8080
+	defaultAccessTokenExpirationMinutes = 15
+	defaultRefreshTokenExpirationHours  = 720
+	defaultLoginAttemptStore            = "db"
+	defaultMailFrom                     = "priv8 <no-reply@localhost>"
+	defaultMailDir                      = "./mail"
+	defaultTrashRetentionDays           = 30
 )
 
 // Config represents an application configuration.
@@ -19,17 +28,54 @@ type Config struct {
 	ServerPort int `yaml:"server_port" env:"SERVER_PORT"`
 	// the data source name (DSN) for connecting to the database. required.
 	DSN string `yaml:"dsn" env:"DSN,secret"`
-	// JWT signing key. required.
+	// JWT signing key used with HS256. required unless JWTPrivateKeyFile or JWTKeyDir is set.
 	JWTSigningKey string `yaml:"jwt_signing_key" env:"JWT_SIGNING_KEY,secret"`
-	// JWT expiration in hours. Defaults to 72 hours (3 days)
-	JWTExpiration int `yaml:"jwt_expiration" env:"JWT_EXPIRATION"`
+	// path to a PEM-encoded RSA, ECDSA or Ed25519 private key used to sign JWTs.
+	// When set, it takes precedence over JWTSigningKey and its public key is published at /.well-known/jwks.json.
+	JWTPrivateKeyFile string `yaml:"jwt_private_key_file" env:"JWT_PRIVATE_KEY_FILE"`
+	// path to a key ring directory managed by the rotate-keys command.
+	// When set, it takes precedence over JWTPrivateKeyFile and JWTSigningKey.
+	JWTKeyDir string `yaml:"jwt_key_dir" env:"JWT_KEY_DIR"`
+	// the key that the cursors of paginated lists are signed with. Defaults to a key derived from JWTSigningKey,
+	// and is required if JWTSigningKey is not set.
+	CursorSigningKey string `yaml:"cursor_signing_key" env:"CURSOR_SIGNING_KEY,secret"`
+	// the key that share link tokens are signed with. Unlike the JWT keys it is never rotated, as share links
+	// may be valid for a year. Defaults to a key derived from JWTSigningKey, and is required if JWTSigningKey
+	// is not set.
+	ShareLinkSigningKey string `yaml:"share_link_signing_key" env:"SHARE_LINK_SIGNING_KEY,secret"`
+	// access token (JWT) expiration in minutes. Defaults to 15 minutes
+	AccessTokenExpiration int `yaml:"access_token_expiration" env:"ACCESS_TOKEN_EXPIRATION"`
+	// refresh token expiration in hours. Defaults to 720 hours (30 days)
+	RefreshTokenExpiration int `yaml:"refresh_token_expiration" env:"REFRESH_TOKEN_EXPIRATION"`
+	// where failed logins are counted: "memory" for a single server instance or "db" to share them
+	// between server instances. Defaults to "db"
+	LoginAttemptStore string `yaml:"login_attempt_store" env:"LOGIN_ATTEMPT_STORE"`
+	// the address (host:port) of the SMTP server that sends emails. When empty, emails are written to MailDir instead.
+	SMTPAddr string `yaml:"smtp_addr" env:"SMTP_ADDR"`
+	// the user name for authenticating with the SMTP server. Authentication is skipped when empty.
+	SMTPUsername string `yaml:"smtp_username" env:"SMTP_USERNAME"`
+	// the password for authenticating with the SMTP server.
+	SMTPPassword string `yaml:"smtp_password" env:"SMTP_PASSWORD,secret"`
+	// the sender of emails. Defaults to "priv8 <no-reply@localhost>"
+	MailFrom string `yaml:"mail_from" env:"MAIL_FROM"`
+	// the directory that emails are written to when no SMTP server is configured. Defaults to "./mail"
+	MailDir string `yaml:"mail_dir" env:"MAIL_DIR"`
+	// the URL of the page where users choose a new password. The reset token is appended as the "token" query
+	// parameter. When empty, password reset emails contain only the token.
+	PasswordResetURL string `yaml:"password_reset_url" env:"PASSWORD_RESET_URL"`
+	// the number of days that deleted albums are kept in the trash before they are purged. Defaults to 30 days
+	TrashRetention int `yaml:"trash_retention" env:"TRASH_RETENTION"`
 }
 
 // Validate validates the application configuration.
 func (c Config) Validate() error {
 	return validation.ValidateStruct(&c,
 		validation.Field(&c.DSN, validation.Required),
-		validation.Field(&c.JWTSigningKey, validation.Required),
+		validation.Field(&c.JWTSigningKey, validation.When(c.JWTPrivateKeyFile == "" && c.JWTKeyDir == "", validation.Required)),
+		validation.Field(&c.CursorSigningKey, validation.Required),
+		validation.Field(&c.ShareLinkSigningKey, validation.Required),
+		validation.Field(&c.LoginAttemptStore, validation.In("memory", "db")),
+		validation.Field(&c.TrashRetention, validation.Min(1)),
 	)
 }
 
@@ -37,8 +83,13 @@ func (c Config) Validate() error {
 func Load(file string, logger log.Logger) (*Config, error) {
 	// default config
 	c := Config{
-		ServerPort:    defaultServerPort,
-		JWTExpiration: defaultJWTExpirationHours,
+		ServerPort:             defaultServerPort,
+		AccessTokenExpiration:  defaultAccessTokenExpirationMinutes,
+		RefreshTokenExpiration: defaultRefreshTokenExpirationHours,
+		LoginAttemptStore:      defaultLoginAttemptStore,
+		MailFrom:               defaultMailFrom,
+		MailDir:                defaultMailDir,
+		TrashRetention:         defaultTrashRetentionDays,
 	}
 
 	// load from YAML config file
@@ -55,6 +106,13 @@ func Load(file string, logger log.Logger) (*Config, error) {
 		return nil, err
 	}
 
+	if c.CursorSigningKey == "" && c.JWTSigningKey != "" {
+		c.CursorSigningKey = deriveKey(c.JWTSigningKey, "cursor")
+	}
+	if c.ShareLinkSigningKey == "" && c.JWTSigningKey != "" {
+		c.ShareLinkSigningKey = deriveKey(c.JWTSigningKey, "share-link")
+	}
+
 	// validation
 	if err = c.Validate(); err != nil {
 		return nil, err
@@ -62,3 +120,11 @@ func Load(file string, logger log.Logger) (*Config, error) {
 
 	return &c, err
 }
+
+// deriveKey derives a key for the given purpose from a secret with HKDF-SHA256 (RFC 5869),
+// so that the secret can serve several purposes without the keys being interchangeable.
+func deriveKey(secret, purpose string) string {
+	key := make([]byte, 32)
+	_, _ = io.ReadFull(hkdf.New(sha256.New, []byte(secret), nil, []byte(purpose)), key)
+	return hex.EncodeToString(key)
+}
@@ -4,10 +4,31 @@ import (
 	"time"
 )
 
+// Visibilities of an album.
+const (
+	// AlbumPrivate albums can only be seen by their owners.
+	AlbumPrivate = "private"
+	// AlbumUnlisted albums can be seen by anyone who knows their IDs, but they are not listed.
+	AlbumUnlisted = "unlisted"
+	// AlbumPublic albums can be seen and listed by anyone.
+	AlbumPublic = "public"
+)
+
 // Album represents an album record.
 type Album struct {
-	ID        string    `json:"id"`
-	Name      string    `json:"name"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	OwnerID    *string   `json:"owner_id"`
+	Visibility string    `json:"visibility"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+	// Version is incremented by every update of the album. It is sent to clients as the ETag of the album.
+	Version int `json:"version"`
+	// DeletedAt is the time when the album was moved to the trash. It is nil unless the album is in the trash.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// IsOwnedBy reports whether the album is owned by the user with the specified ID.
+func (a Album) IsOwnedBy(userID string) bool {
+	return a.OwnerID != nil && *a.OwnerID == userID
 }
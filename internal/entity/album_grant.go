@@ -0,0 +1,19 @@
+package entity
+
+import "time"
+
+// Access levels of an album grant.
+const (
+	// AlbumViewer grants can view an album.
+	AlbumViewer = "viewer"
+	// AlbumEditor grants can view and update an album.
+	AlbumEditor = "editor"
+)
+
+// AlbumGrant represents the access to an album that its owner granted to another user.
+type AlbumGrant struct {
+	AlbumID   string    `json:"album_id" db:"pk"`
+	UserID    string    `json:"user_id" db:"pk"`
+	Level     string    `json:"level"`
+	CreatedAt time.Time `json:"created_at"`
+}
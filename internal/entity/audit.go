@@ -0,0 +1,88 @@
+package entity
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"time"
+)
+
+// Actions recorded in the audit log.
+const (
+	AuditCreate  = "create"
+	AuditUpdate  = "update"
+	AuditDelete  = "delete"
+	AuditRestore = "restore"
+	AuditLogin   = "login"
+	// AuditImpersonate is recorded when an administrator starts to impersonate a user.
+	AuditImpersonate = "impersonate"
+)
+
+// AuditRecord represents an action that changed the data of the service, such as creating an album or logging in.
+// Records are never changed or deleted, and they keep the IDs and names of the users even after the users are deleted.
+type AuditRecord struct {
+	ID string `json:"id"`
+	// ActorID and ActorName identify the user who performed the action.
+	ActorID   string `json:"actor_id"`
+	ActorName string `json:"actor_name"`
+	// ImpersonatorID and ImpersonatorName identify the administrator who impersonated the actor, if any.
+	ImpersonatorID   string `json:"impersonator_id,omitempty"`
+	ImpersonatorName string `json:"impersonator_name,omitempty"`
+	Action           string `json:"action"`
+	ResourceType     string `json:"resource_type"`
+	ResourceID       string `json:"resource_id"`
+	// Before and After are the resource before and after the action. Before is null for created resources,
+	// and After is null for deleted ones.
+	Before    Snapshot  `json:"before"`
+	After     Snapshot  `json:"after"`
+	RequestID string    `json:"request_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TableName returns the name of the database table that stores audit records.
+func (AuditRecord) TableName() string {
+	return "audit_record"
+}
+
+// Snapshot is the JSON representation of a resource. It is stored in the database as JSONB.
+type Snapshot []byte
+
+// MarshalJSON implements json.Marshaler. An empty snapshot is encoded as null.
+func (s Snapshot) MarshalJSON() ([]byte, error) {
+	if len(s) == 0 {
+		return []byte("null"), nil
+	}
+	return s, nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (s *Snapshot) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*s = nil
+		return nil
+	}
+	*s = append((*s)[0:0], data...)
+	return nil
+}
+
+// Value implements driver.Valuer.
+func (s Snapshot) Value() (driver.Value, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+	return string(s), nil
+}
+
+// Scan implements sql.Scanner.
+func (s *Snapshot) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case string:
+		*s = Snapshot(v)
+	case []byte:
+		*s = append(Snapshot(nil), v...)
+	case nil:
+		*s = nil
+	default:
+		return fmt.Errorf("cannot scan %T into Snapshot", value)
+	}
+	return nil
+}
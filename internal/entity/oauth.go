@@ -0,0 +1,46 @@
+package entity
+
+import "time"
+
+// OAuthClient represents an application registered to obtain access tokens through OAuth 2.0.
+// Confidential clients authenticate with a secret, of which only the hash is stored. Public clients,
+// such as browser and mobile apps, cannot keep a secret and may only use the authorization code grant with PKCE.
+type OAuthClient struct {
+	ID     string `json:"id"`
+	UserID string `json:"user_id"`
+	Name   string `json:"name"`
+	// RedirectURIs are the only URIs that authorization codes may be sent to.
+	RedirectURIs Scopes    `json:"redirect_uris" db:"redirect_uris"`
+	Scopes       Scopes    `json:"scopes"`
+	Confidential bool      `json:"confidential"`
+	SecretHash   string    `json:"-"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// TableName returns the name of the database table that stores OAuth clients.
+func (OAuthClient) TableName() string {
+	return "oauth_client"
+}
+
+// OAuthCode represents an authorization code that a user granted to an OAuth client.
+// Only the hash of the code is stored. The code can be exchanged for an access token once.
+type OAuthCode struct {
+	ID          string
+	ClientID    string
+	UserID      string
+	CodeHash    string
+	RedirectURI string
+	Scopes      Scopes
+	// CodeChallenge is the PKCE code challenge (RFC 7636) that the code verifier must match.
+	CodeChallenge string
+	// TokenID is the ID of the access token issued for the code. It is empty until the code is used.
+	TokenID   string
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// TableName returns the name of the database table that stores authorization codes.
+func (OAuthCode) TableName() string {
+	return "oauth_code"
+}
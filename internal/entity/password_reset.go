@@ -0,0 +1,14 @@
+package entity
+
+import "time"
+
+// PasswordReset represents a password reset token sent to a user.
+// Only the hash of the token is stored, and the token can be used only once.
+type PasswordReset struct {
+	ID        string
+	UserID    string
+	TokenHash string
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
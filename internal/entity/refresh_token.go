@@ -0,0 +1,16 @@
+package entity
+
+import "time"
+
+// RefreshToken represents a refresh token issued to a user.
+// Only the hash of the token is stored. Tokens rotated from the same login share a family ID.
+type RefreshToken struct {
+	ID        string
+	FamilyID  string
+	UserID    string
+	TokenHash string
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	RevokedAt *time.Time
+	CreatedAt time.Time
+}
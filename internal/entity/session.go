@@ -0,0 +1,18 @@
+package entity
+
+import "time"
+
+// Session represents a login of a user on a device. The refresh tokens and access tokens issued
+// for the login are bound to the session and stop working once it is revoked.
+type Session struct {
+	ID         string     `json:"id"`
+	UserID     string     `json:"-"`
+	UserAgent  string     `json:"user_agent"`
+	IP         string     `json:"ip" db:"ip"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastSeenAt time.Time  `json:"last_seen_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RevokedAt  *time.Time `json:"-"`
+	// Current indicates that the session authenticated the request that lists it.
+	Current bool `json:"current" db:"-"`
+}
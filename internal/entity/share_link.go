@@ -0,0 +1,14 @@
+package entity
+
+import "time"
+
+// ShareLink represents a link that gives read access to an album without an account.
+// The link itself is a signed token that is not stored. PasswordHash is empty if the link has no password.
+type ShareLink struct {
+	ID           string    `json:"id"`
+	AlbumID      string    `json:"album_id"`
+	CreatedBy    string    `json:"created_by"`
+	PasswordHash string    `json:"-"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	CreatedAt    time.Time `json:"created_at"`
+}
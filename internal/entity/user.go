@@ -1,9 +1,23 @@
 package entity
 
+import "time"
+
 // User represents a user.
 type User struct {
-	ID   string
-	Name string
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Email is the address that password reset links are sent to. It is stored in lower case and may be empty.
+	Email        string   `json:"email"`
+	PasswordHash string   `json:"-"`
+	Roles        []string `json:"roles" db:"-"`
+	// TOTPSecret is the secret of the TOTP authenticator of the user. It is set while enrolling as well.
+	TOTPSecret string `json:"-" db:"totp_secret"`
+	// TOTPEnabled indicates whether the user has confirmed the TOTP enrolment and must use two-factor authentication.
+	TOTPEnabled bool `json:"totp_enabled" db:"totp_enabled"`
+	// TOTPLastStep is the time step of the last TOTP code used, so that codes cannot be replayed.
+	TOTPLastStep int64     `json:"-" db:"totp_last_step"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
 }
 
 // GetID returns the user ID.
@@ -15,3 +29,8 @@ func (u User) GetID() string {
 func (u User) GetName() string {
 	return u.Name
 }
+
+// GetRoles returns the roles assigned to the user.
+func (u User) GetRoles() []string {
+	return u.Roles
+}
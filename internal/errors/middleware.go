@@ -9,6 +9,7 @@ import (
 	validation "github.com/go-ozzo/ozzo-validation/v4"
 	"net/http"
 	"runtime/debug"
+	"strconv"
 )
 
 // Handler creates a middleware that handles panics and errors encountered during HTTP request processing.
@@ -30,6 +31,9 @@ func Handler(logger log.Logger) routing.Handler {
 				if res.StatusCode() == http.StatusInternalServerError {
 					l.Errorf("encountered internal server error: %v", err)
 				}
+				if res.RetryAfter > 0 {
+					c.Response.Header().Set("Retry-After", strconv.Itoa(res.RetryAfter))
+				}
 				c.Response.WriteHeader(res.StatusCode())
 				if err = c.Write(res); err != nil {
 					l.Errorf("failed writing error response: %v", err)
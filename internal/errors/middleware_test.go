@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/garaekz/priv8/pkg/log"
 	routing "github.com/go-ozzo/ozzo-routing/v2"
@@ -41,6 +42,15 @@ func TestHandler(t *testing.T) {
 		assert.Equal(t, http.StatusNotFound, res.Code)
 	})
 
+	t.Run("rate limit processing", func(t *testing.T) {
+		logger, _ := log.NewForTest()
+		handler := Handler(logger)
+		ctx, res := buildContext(handler, handlerRateLimited)
+		assert.Nil(t, ctx.Next())
+		assert.Equal(t, http.StatusTooManyRequests, res.Code)
+		assert.Equal(t, "30", res.Header().Get("Retry-After"))
+	})
+
 	t.Run("panic processing", func(t *testing.T) {
 		logger, entries := log.NewForTest()
 		handler := Handler(logger)
@@ -89,6 +99,10 @@ func handlerHTTPError(_ *routing.Context) error {
 	return NotFound("")
 }
 
+func handlerRateLimited(_ *routing.Context) error {
+	return TooManyRequests("", 30*time.Second)
+}
+
 func handlerPanic(_ *routing.Context) error {
 	panic("xyz")
 }
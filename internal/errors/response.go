@@ -4,6 +4,7 @@ import (
 	validation "github.com/go-ozzo/ozzo-validation/v4"
 	"net/http"
 	"sort"
+	"time"
 )
 
 // ErrorResponse is the response that represents an error.
@@ -11,6 +12,8 @@ type ErrorResponse struct {
 	Status  int         `json:"status"`
 	Message string      `json:"message"`
 	Details interface{} `json:"details,omitempty"`
+	// RetryAfter is the number of seconds after which the request may be retried. It is sent in the Retry-After header.
+	RetryAfter int `json:"-"`
 }
 
 // Error is required by the error interface.
@@ -78,6 +81,53 @@ func BadRequest(msg string) ErrorResponse {
 	}
 }
 
+// PreconditionFailed creates a new error response representing a failed precondition (HTTP 412),
+// such as an If-Match header that does not match the current version of a resource.
+func PreconditionFailed(msg string) ErrorResponse {
+	if msg == "" {
+		msg = "The resource has been changed since you retrieved it."
+	}
+	return ErrorResponse{
+		Status:  http.StatusPreconditionFailed,
+		Message: msg,
+	}
+}
+
+// PreconditionRequired creates a new error response representing a request that must be conditional (HTTP 428)
+func PreconditionRequired(msg string) ErrorResponse {
+	if msg == "" {
+		msg = "Your request must be conditional."
+	}
+	return ErrorResponse{
+		Status:  http.StatusPreconditionRequired,
+		Message: msg,
+	}
+}
+
+// UnsupportedMediaType creates a new error response representing a request body of an unsupported type (HTTP 415)
+func UnsupportedMediaType(msg string) ErrorResponse {
+	if msg == "" {
+		msg = "The format of your request body is not supported."
+	}
+	return ErrorResponse{
+		Status:  http.StatusUnsupportedMediaType,
+		Message: msg,
+	}
+}
+
+// TooManyRequests creates a new error response representing a rate limit error (HTTP 429).
+// The retry delay is rounded up to whole seconds.
+func TooManyRequests(msg string, retryAfter time.Duration) ErrorResponse {
+	if msg == "" {
+		msg = "You have made too many requests. Please try again later."
+	}
+	return ErrorResponse{
+		Status:     http.StatusTooManyRequests,
+		Message:    msg,
+		RetryAfter: int((retryAfter + time.Second - 1) / time.Second),
+	}
+}
+
 type invalidField struct {
 	Field string `json:"field"`
 	Error string `json:"error"`
@@ -6,6 +6,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"net/http"
 	"testing"
+	"time"
 )
 
 func TestErrorResponse_Error(t *testing.T) {
@@ -62,6 +63,40 @@ func TestBadRequest(t *testing.T) {
 	assert.NotEmpty(t, res.Error())
 }
 
+func TestPreconditionFailed(t *testing.T) {
+	res := PreconditionFailed("test")
+	assert.Equal(t, http.StatusPreconditionFailed, res.StatusCode())
+	assert.Equal(t, "test", res.Error())
+	res = PreconditionFailed("")
+	assert.NotEmpty(t, res.Error())
+}
+
+func TestPreconditionRequired(t *testing.T) {
+	res := PreconditionRequired("test")
+	assert.Equal(t, http.StatusPreconditionRequired, res.StatusCode())
+	assert.Equal(t, "test", res.Error())
+	res = PreconditionRequired("")
+	assert.NotEmpty(t, res.Error())
+}
+
+func TestUnsupportedMediaType(t *testing.T) {
+	res := UnsupportedMediaType("test")
+	assert.Equal(t, http.StatusUnsupportedMediaType, res.StatusCode())
+	assert.Equal(t, "test", res.Error())
+	res = UnsupportedMediaType("")
+	assert.NotEmpty(t, res.Error())
+}
+
+func TestTooManyRequests(t *testing.T) {
+	res := TooManyRequests("test", 1500*time.Millisecond)
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode())
+	assert.Equal(t, "test", res.Error())
+	assert.Equal(t, 2, res.RetryAfter)
+	res = TooManyRequests("", time.Minute)
+	assert.NotEmpty(t, res.Error())
+	assert.Equal(t, 60, res.RetryAfter)
+}
+
 func TestInvalidInput(t *testing.T) {
 	err := InvalidInput(validation.Errors{
 		"xyz": fmt.Errorf("2"),
@@ -0,0 +1,159 @@
+package oauth
+
+import (
+	"github.com/garaekz/priv8/internal/auth"
+	"github.com/garaekz/priv8/internal/errors"
+	"github.com/garaekz/priv8/pkg/log"
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"net/http"
+	"net/url"
+)
+
+// RegisterHandlers registers the handlers that manage clients and authorize them on behalf of the current user.
+func RegisterHandlers(rg *routing.RouteGroup, service Service, authHandler routing.Handler, logger log.Logger) {
+	rg.Use(authHandler)
+
+	// the following endpoints require an access token issued at login; API keys and OAuth clients cannot
+	// register or authorize clients
+	rg.Get("/oauth/clients", auth.RequireToken, queryClients(service))
+	rg.Post("/oauth/clients", auth.RequireToken, createClient(service, logger))
+	rg.Delete("/oauth/clients/<id>", auth.RequireToken, deleteClient(service))
+	rg.Post("/oauth/authorize", auth.RequireToken, authorize(service, logger))
+}
+
+// RegisterServerHandlers registers the OAuth 2.0 endpoints that clients authenticate to with their credentials.
+func RegisterServerHandlers(r *routing.Router, service Service) {
+	r.Post("/oauth/token", token(service))
+	r.Post("/oauth/introspect", introspect(service))
+}
+
+// queryClients returns a handler that lists the clients registered by the current user.
+func queryClients(service Service) routing.Handler {
+	return func(c *routing.Context) error {
+		ctx := c.Request.Context()
+		clients, err := service.QueryClients(ctx, auth.CurrentUser(ctx).GetID())
+		if err != nil {
+			return err
+		}
+		return c.Write(clients)
+	}
+}
+
+// createClient returns a handler that registers a client for the current user.
+func createClient(service Service, logger log.Logger) routing.Handler {
+	return func(c *routing.Context) error {
+		var input CreateClientRequest
+		if err := c.Read(&input); err != nil {
+			logger.With(c.Request.Context()).Errorf("invalid request: %v", err)
+			return errors.BadRequest("")
+		}
+
+		ctx := c.Request.Context()
+		client, err := service.CreateClient(ctx, auth.CurrentUser(ctx).GetID(), input)
+		if err != nil {
+			return err
+		}
+		return c.WriteWithStatus(client, http.StatusCreated)
+	}
+}
+
+// deleteClient returns a handler that deletes a client registered by the current user.
+func deleteClient(service Service) routing.Handler {
+	return func(c *routing.Context) error {
+		ctx := c.Request.Context()
+		if err := service.DeleteClient(ctx, auth.CurrentUser(ctx).GetID(), c.Param("id")); err != nil {
+			return err
+		}
+		c.Response.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+}
+
+// authorize returns a handler that issues an authorization code to a client on behalf of the current user.
+// It is meant to be called by the consent page of the front end once the user approves the client.
+func authorize(service Service, logger log.Logger) routing.Handler {
+	return func(c *routing.Context) error {
+		var input AuthorizeRequest
+		if err := c.Read(&input); err != nil {
+			logger.With(c.Request.Context()).Errorf("invalid request: %v", err)
+			return errors.BadRequest("")
+		}
+
+		ctx := c.Request.Context()
+		authorization, err := service.Authorize(ctx, auth.CurrentUser(ctx).GetID(), input)
+		if err != nil {
+			return err
+		}
+		return c.Write(authorization)
+	}
+}
+
+// token returns a handler that implements the OAuth 2.0 token endpoint (RFC 6749, section 3.2).
+// The request parameters are form-encoded, and errors are reported in the format defined by OAuth 2.0.
+func token(service Service) routing.Handler {
+	return func(c *routing.Context) error {
+		var input TokenRequest
+		if err := readForm(c, &input, &input.ClientID, &input.ClientSecret); err != nil {
+			return writeError(c, err.(Error))
+		}
+
+		c.Response.Header().Set("Cache-Control", "no-store")
+		c.Response.Header().Set("Pragma", "no-cache")
+		result, err := service.Token(c.Request.Context(), input)
+		if err != nil {
+			if e, ok := err.(Error); ok {
+				return writeError(c, e)
+			}
+			return err
+		}
+		return c.Write(result)
+	}
+}
+
+// introspect returns a handler that implements the token introspection endpoint (RFC 7662).
+func introspect(service Service) routing.Handler {
+	return func(c *routing.Context) error {
+		var input IntrospectRequest
+		if err := readForm(c, &input, &input.ClientID, &input.ClientSecret); err != nil {
+			return writeError(c, err.(Error))
+		}
+
+		c.Response.Header().Set("Cache-Control", "no-store")
+		result, err := service.Introspect(c.Request.Context(), input)
+		if err != nil {
+			if e, ok := err.(Error); ok {
+				return writeError(c, e)
+			}
+			return err
+		}
+		return c.Write(result)
+	}
+}
+
+// readForm reads the form-encoded parameters of a request into data. The client credentials are taken from
+// the HTTP Basic authentication header, if given, and stored in clientID and clientSecret.
+func readForm(c *routing.Context, data interface{}, clientID, clientSecret *string) error {
+	if err := c.Request.ParseForm(); err != nil {
+		return invalidRequest("the request body is malformed")
+	}
+	if err := c.Read(data); err != nil {
+		return invalidRequest("the request body is malformed")
+	}
+	if id, secret, ok := c.Request.BasicAuth(); ok {
+		if *clientID != "" || *clientSecret != "" {
+			return invalidRequest("the client must use only one authentication method")
+		}
+		// the credentials are form-encoded before they are put in the header (RFC 6749, section 2.3.1)
+		*clientID, _ = url.QueryUnescape(id)
+		*clientSecret, _ = url.QueryUnescape(secret)
+	}
+	return nil
+}
+
+// writeError responds with an OAuth 2.0 error.
+func writeError(c *routing.Context, err Error) error {
+	if err.Status == http.StatusUnauthorized {
+		c.Response.Header().Set("WWW-Authenticate", `Basic realm="OAuth"`)
+	}
+	return c.WriteWithStatus(err, err.Status)
+}
@@ -0,0 +1,92 @@
+package oauth
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/garaekz/priv8/internal/auth"
+	"github.com/garaekz/priv8/internal/entity"
+	"github.com/garaekz/priv8/internal/test"
+	"github.com/garaekz/priv8/pkg/log"
+)
+
+func TestAPI(t *testing.T) {
+	logger, _ := log.NewForTest()
+	router := test.MockRouter(logger)
+	repo := &mockRepository{clients: []entity.OAuthClient{
+		{ID: "backend", UserID: "102", Name: "backend", Scopes: entity.Scopes{auth.PermissionTokenIntrospect},
+			Confidential: true, SecretHash: auth.HashToken("s3cret"), CreatedAt: time.Now()},
+		{ID: "app", UserID: "100", Name: "app", Scopes: entity.Scopes{auth.PermissionAlbumCreate},
+			Confidential: true, SecretHash: auth.HashToken("s3cret"), CreatedAt: time.Now()},
+		{ID: "spa", UserID: "100", Name: "spa", RedirectURIs: entity.Scopes{"https://example.com/cb"},
+			Scopes: entity.Scopes{auth.PermissionAlbumCreate}, CreatedAt: time.Now()},
+	}}
+	service := NewService(repo, newMockUserRepository(), testKeys, auth.NewMemoryDenylist(), mockSessionValidator{}, &mockAuditor{}, withoutTransaction, time.Minute, logger)
+	RegisterServerHandlers(router, service)
+	RegisterHandlers(router.Group("/v1"), service, auth.MockAuthHandler, logger)
+	header := auth.MockAuthHeader()
+
+	form := http.Header{"Content-Type": []string{"application/x-www-form-urlencoded"}}
+	basic := func(id, secret string) http.Header {
+		req, _ := http.NewRequest("POST", "/", nil)
+		req.SetBasicAuth(url.QueryEscape(id), url.QueryEscape(secret))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req.Header
+	}
+	authorize := `{"response_type":"code","client_id":"spa","redirect_uri":"https://example.com/cb","state":"xyz",` +
+		`"code_challenge":"` + challenge(testVerifier) + `","code_challenge_method":"S256"}`
+
+	tests := []test.APITestCase{
+		{"clients", "GET", "/v1/oauth/clients", "", header, http.StatusOK, `*"id":"app"*`},
+		{"clients auth error", "GET", "/v1/oauth/clients", "", nil, http.StatusUnauthorized, ""},
+		{"create client", "POST", "/v1/oauth/clients", `{"name":"new","scopes":["album:create"],"confidential":true}`, header, http.StatusCreated, `*"client_secret":*`},
+		{"create client input error", "POST", "/v1/oauth/clients", `{"name":"new","scopes":["album:create"]}`, header, http.StatusBadRequest, `*"field":"redirect_uris"*`},
+		{"create client bad json", "POST", "/v1/oauth/clients", `"name"}`, header, http.StatusBadRequest, ""},
+		{"delete client unknown", "DELETE", "/v1/oauth/clients/unknown", "", header, http.StatusNotFound, ""},
+		{"authorize", "POST", "/v1/oauth/authorize", authorize, header, http.StatusOK, `*"state":"xyz"*`},
+		{"authorize input error", "POST", "/v1/oauth/authorize", `{"response_type":"code"}`, header, http.StatusBadRequest, ""},
+		{"authorize auth error", "POST", "/v1/oauth/authorize", authorize, nil, http.StatusUnauthorized, ""},
+		{"token basic auth", "POST", "/oauth/token", "grant_type=client_credentials", basic("app", "s3cret"), http.StatusOK, `*"token_type":"Bearer"*`},
+		{"token form auth", "POST", "/oauth/token", "grant_type=client_credentials&client_id=app&client_secret=s3cret", form, http.StatusOK, `*"scope":"album:create"*`},
+		{"token both auth methods", "POST", "/oauth/token", "grant_type=client_credentials&client_id=app", basic("app", "s3cret"), http.StatusBadRequest, `*"error":"invalid_request"*`},
+		{"token invalid client", "POST", "/oauth/token", "grant_type=client_credentials", basic("app", "wrong"), http.StatusUnauthorized, `*"error":"invalid_client"*`},
+		{"token unsupported grant", "POST", "/oauth/token", "grant_type=password", basic("app", "s3cret"), http.StatusBadRequest, `{"error":"unsupported_grant_type"}`},
+		{"token invalid grant", "POST", "/oauth/token", "grant_type=authorization_code&client_id=spa&code=xyz&redirect_uri=https://example.com/cb&code_verifier=" + testVerifier, form, http.StatusBadRequest, `*"error":"invalid_grant"*`},
+		{"introspect", "POST", "/oauth/introspect", "token=xyz", basic("backend", "s3cret"), http.StatusOK, `{"active":false}`},
+		{"introspect invalid client", "POST", "/oauth/introspect", "token=xyz", basic("backend", "wrong"), http.StatusUnauthorized, `*"error":"invalid_client"*`},
+		{"introspect insufficient scope", "POST", "/oauth/introspect", "token=xyz", basic("app", "s3cret"), http.StatusForbidden, `*"error":"insufficient_scope"*`},
+		{"token delete client", "DELETE", "/v1/oauth/clients/app", "", header, http.StatusNoContent, ""},
+		{"token deleted client", "POST", "/oauth/token", "grant_type=client_credentials", basic("app", "s3cret"), http.StatusUnauthorized, `*"error":"invalid_client"*`},
+	}
+	for _, tc := range tests {
+		test.Endpoint(t, router, tc)
+	}
+}
+
+func TestAPI_clientToken(t *testing.T) {
+	logger, _ := log.NewForTest()
+	router := test.MockRouter(logger)
+	repo := &mockRepository{clients: []entity.OAuthClient{
+		{ID: "spa", UserID: "100", Name: "spa", RedirectURIs: entity.Scopes{"https://example.com/cb"},
+			Scopes: entity.Scopes{auth.PermissionAlbumCreate, auth.PermissionAlbumDelete}, CreatedAt: time.Now()},
+	}}
+	service := NewService(repo, newMockUserRepository(), testKeys, auth.NewMemoryDenylist(), mockSessionValidator{}, &mockAuditor{}, withoutTransaction, time.Minute, logger)
+	RegisterHandlers(router.Group("/v1"), service, auth.MockAuthHandler, logger)
+	header := auth.MockClientAuthHeader()
+	authorize := `{"response_type":"code","client_id":"spa","redirect_uri":"https://example.com/cb","scope":"album:delete",` +
+		`"code_challenge":"` + challenge(testVerifier) + `","code_challenge_method":"S256"}`
+
+	tests := []test.APITestCase{
+		{Name: "clients cannot list clients", Method: "GET", URL: "/v1/oauth/clients", Header: header, WantStatus: http.StatusForbidden},
+		{Name: "clients cannot create clients", Method: "POST", URL: "/v1/oauth/clients", Header: header,
+			Body: `{"name":"new","scopes":["album:delete"],"confidential":true}`, WantStatus: http.StatusForbidden},
+		{Name: "clients cannot delete clients", Method: "DELETE", URL: "/v1/oauth/clients/spa", Header: header, WantStatus: http.StatusForbidden},
+		{Name: "clients cannot authorize clients", Method: "POST", URL: "/v1/oauth/authorize", Header: header,
+			Body: authorize, WantStatus: http.StatusForbidden},
+	}
+	for _, tc := range tests {
+		test.Endpoint(t, router, tc)
+	}
+}
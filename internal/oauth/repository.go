@@ -0,0 +1,111 @@
+package oauth
+
+import (
+	"context"
+	"github.com/garaekz/priv8/internal/entity"
+	"github.com/garaekz/priv8/pkg/dbcontext"
+	"github.com/garaekz/priv8/pkg/log"
+	dbx "github.com/go-ozzo/ozzo-dbx"
+	"time"
+)
+
+// Repository encapsulates the logic to access OAuth clients and authorization codes from the data source.
+type Repository interface {
+	// GetClient returns the client with the specified ID.
+	GetClient(ctx context.Context, id string) (entity.OAuthClient, error)
+	// QueryClients returns the clients registered by the user with the specified ID.
+	QueryClients(ctx context.Context, userID string) ([]entity.OAuthClient, error)
+	// CreateClient saves a new client in the storage.
+	CreateClient(ctx context.Context, client entity.OAuthClient) error
+	// DeleteClient removes the client with the specified ID registered by the user with the specified ID.
+	DeleteClient(ctx context.Context, userID, id string) error
+	// GetCode returns the authorization code with the specified code hash.
+	GetCode(ctx context.Context, hash string) (entity.OAuthCode, error)
+	// CreateCode saves a new authorization code in the storage.
+	CreateCode(ctx context.Context, code entity.OAuthCode) error
+	// MarkCodeUsed marks the authorization code with the specified ID as used by the access token with the given ID.
+	// It returns false if the code has already been used.
+	MarkCodeUsed(ctx context.Context, id, tokenID string, at time.Time) (bool, error)
+	// Prune removes the authorization codes that have expired.
+	Prune(ctx context.Context) error
+}
+
+// repository persists OAuth clients and authorization codes in database
+type repository struct {
+	db     *dbcontext.DB
+	logger log.Logger
+}
+
+// NewRepository creates a new OAuth repository
+func NewRepository(db *dbcontext.DB, logger log.Logger) Repository {
+	return repository{db, logger}
+}
+
+// GetClient reads the client with the specified ID from the database.
+func (r repository) GetClient(ctx context.Context, id string) (entity.OAuthClient, error) {
+	var client entity.OAuthClient
+	err := r.db.With(ctx).Select().Model(id, &client)
+	return client, err
+}
+
+// QueryClients reads the clients of the specified user from the database.
+func (r repository) QueryClients(ctx context.Context, userID string) ([]entity.OAuthClient, error) {
+	var clients []entity.OAuthClient
+	err := r.db.With(ctx).Select().Where(dbx.HashExp{"user_id": userID}).OrderBy("created_at").All(&clients)
+	return clients, err
+}
+
+// CreateClient saves a new client record in the database.
+func (r repository) CreateClient(ctx context.Context, client entity.OAuthClient) error {
+	return r.db.With(ctx).Model(&client).Insert()
+}
+
+// DeleteClient deletes the client with the specified ID and user ID from the database.
+// The authorization codes of the client are deleted with it.
+func (r repository) DeleteClient(ctx context.Context, userID, id string) error {
+	var client entity.OAuthClient
+	if err := r.db.With(ctx).Select().Where(dbx.HashExp{"id": id, "user_id": userID}).One(&client); err != nil {
+		return err
+	}
+	return r.db.With(ctx).Model(&client).Delete()
+}
+
+// GetCode reads the authorization code with the specified hash from the database.
+func (r repository) GetCode(ctx context.Context, hash string) (entity.OAuthCode, error) {
+	var code entity.OAuthCode
+	err := r.db.With(ctx).Select().Where(dbx.HashExp{"code_hash": hash}).One(&code)
+	return code, err
+}
+
+// CreateCode saves a new authorization code record in the database.
+func (r repository) CreateCode(ctx context.Context, code entity.OAuthCode) error {
+	return r.db.With(ctx).Model(&code).Insert()
+}
+
+// MarkCodeUsed sets the used time and the token ID of an unused authorization code.
+// The check and the update happen in one statement so that a code cannot be exchanged twice concurrently.
+func (r repository) MarkCodeUsed(ctx context.Context, id, tokenID string, at time.Time) (bool, error) {
+	result, err := r.db.With(ctx).Update("oauth_code",
+		dbx.Params{"used_at": at, "token_id": tokenID},
+		dbx.HashExp{"id": id, "used_at": nil},
+	).Execute()
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// Prune deletes the expired authorization codes from the database.
+func (r repository) Prune(ctx context.Context) error {
+	result, err := r.db.With(ctx).Delete("oauth_code",
+		dbx.NewExp("expires_at < {:now}", dbx.Params{"now": time.Now()}),
+	).Execute()
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n > 0 {
+		r.logger.With(ctx).Infof("pruned %d expired authorization codes", n)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package oauth
+
+import (
+	"context"
+	"database/sql"
+	"github.com/garaekz/priv8/internal/auth"
+	"github.com/garaekz/priv8/internal/entity"
+	"github.com/garaekz/priv8/internal/test"
+	"github.com/garaekz/priv8/pkg/log"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRepository(t *testing.T) {
+	logger, _ := log.NewForTest()
+	db := test.DB(t)
+	test.ResetTables(t, db, "oauth_code", "oauth_client", "user")
+	test.CreateUser(t, db, "100", "demo")
+	test.CreateUser(t, db, "101", "other")
+	repo := NewRepository(db, logger)
+	ctx := context.Background()
+
+	// create client
+	for _, id := range []string{"client1", "client2"} {
+		err := repo.CreateClient(ctx, entity.OAuthClient{
+			ID:           id,
+			UserID:       "100",
+			Name:         id,
+			RedirectURIs: entity.Scopes{"https://example.com/cb", "https://example.com/cb2"},
+			Scopes:       entity.Scopes{auth.PermissionAlbumCreate},
+			CreatedAt:    time.Now(),
+		})
+		assert.Nil(t, err)
+	}
+
+	// get client
+	client, err := repo.GetClient(ctx, "client1")
+	assert.Nil(t, err)
+	assert.Equal(t, entity.Scopes{"https://example.com/cb", "https://example.com/cb2"}, client.RedirectURIs)
+	_, err = repo.GetClient(ctx, "client0")
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	// query clients
+	clients, err := repo.QueryClients(ctx, "100")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(clients))
+
+	// create code
+	err = repo.CreateCode(ctx, entity.OAuthCode{
+		ID:            "code1",
+		ClientID:      "client1",
+		UserID:        "101",
+		CodeHash:      "hash-code1",
+		RedirectURI:   "https://example.com/cb",
+		Scopes:        entity.Scopes{auth.PermissionAlbumCreate},
+		CodeChallenge: "challenge",
+		ExpiresAt:     time.Now().Add(time.Minute),
+		CreatedAt:     time.Now(),
+	})
+	assert.Nil(t, err)
+
+	// get code
+	code, err := repo.GetCode(ctx, "hash-code1")
+	assert.Nil(t, err)
+	assert.Equal(t, "code1", code.ID)
+	assert.Nil(t, code.UsedAt)
+
+	// mark code used
+	ok, err := repo.MarkCodeUsed(ctx, "code1", "token1", time.Now())
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = repo.MarkCodeUsed(ctx, "code1", "token2", time.Now())
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	code, _ = repo.GetCode(ctx, "hash-code1")
+	assert.Equal(t, "token1", code.TokenID)
+
+	// prune
+	assert.Nil(t, repo.Prune(ctx))
+	_, err = repo.GetCode(ctx, "hash-code1")
+	assert.Nil(t, err)
+
+	// delete client
+	err = repo.DeleteClient(ctx, "101", "client1")
+	assert.Equal(t, sql.ErrNoRows, err)
+	err = repo.DeleteClient(ctx, "100", "client1")
+	assert.Nil(t, err)
+	_, err = repo.GetCode(ctx, "hash-code1")
+	assert.Equal(t, sql.ErrNoRows, err)
+}
@@ -0,0 +1,631 @@
+package oauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/garaekz/priv8/internal/auth"
+	"github.com/garaekz/priv8/internal/entity"
+	"github.com/garaekz/priv8/pkg/dbcontext"
+	"github.com/garaekz/priv8/pkg/log"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Grant types supported by the token endpoint.
+const (
+	GrantClientCredentials = "client_credentials"
+	GrantAuthorizationCode = "authorization_code"
+)
+
+const (
+	// codeLifetime is how long an authorization code can be exchanged for an access token.
+	codeLifetime = 5 * time.Minute
+	// challengeMethodS256 is the only supported PKCE code challenge method.
+	challengeMethodS256 = "S256"
+)
+
+// pkceRegexp matches PKCE code verifiers and code challenges (RFC 7636, section 4.1).
+var pkceRegexp = regexp.MustCompile("^[A-Za-z0-9._~-]{43,128}$")
+
+// Service encapsulates the OAuth 2.0 authorization server logic.
+type Service interface {
+	// QueryClients returns the clients registered by the user with the specified ID.
+	QueryClients(ctx context.Context, userID string) ([]entity.OAuthClient, error)
+	// CreateClient registers a new client for the user with the specified ID.
+	CreateClient(ctx context.Context, userID string, input CreateClientRequest) (NewClient, error)
+	// DeleteClient removes a client registered by the user with the specified ID.
+	DeleteClient(ctx context.Context, userID, id string) error
+	// Authorize issues an authorization code with which a client can obtain an access token
+	// on behalf of the user with the specified ID.
+	Authorize(ctx context.Context, userID string, input AuthorizeRequest) (Authorization, error)
+	// Token authenticates a client and issues an access token for the requested grant.
+	// The errors that the client can act on are of type Error.
+	Token(ctx context.Context, input TokenRequest) (Token, error)
+	// Introspect authenticates a client and describes the given access token to it.
+	// The errors that the client can act on are of type Error.
+	Introspect(ctx context.Context, input IntrospectRequest) (Introspection, error)
+}
+
+// NewClient represents a newly registered client. The secret is only returned once, on registration.
+type NewClient struct {
+	entity.OAuthClient
+	Secret string `json:"client_secret,omitempty"`
+}
+
+// CreateClientRequest represents a client registration request.
+type CreateClientRequest struct {
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirect_uris"`
+	// Scopes are the permissions that the client may request. They must be granted to the user as well.
+	Scopes []string `json:"scopes"`
+	// Confidential indicates that the client can keep a secret, such as a server-side application.
+	Confidential bool `json:"confidential"`
+}
+
+// Validate validates the CreateClientRequest fields.
+func (m CreateClientRequest) Validate() error {
+	return validation.ValidateStruct(&m,
+		validation.Field(&m.Name, validation.Required, validation.Length(0, 64)),
+		validation.Field(&m.RedirectURIs, validation.When(!m.Confidential, validation.Required),
+			validation.Each(validation.Required, validation.Length(0, 2048), validation.By(checkRedirectURI))),
+		validation.Field(&m.Scopes, validation.Required),
+	)
+}
+
+// AuthorizeRequest represents the request of a client for an authorization code (RFC 6749, section 4.1.1).
+type AuthorizeRequest struct {
+	ResponseType string `json:"response_type"`
+	ClientID     string `json:"client_id"`
+	RedirectURI  string `json:"redirect_uri"`
+	// Scope is a space-separated list of permissions. It defaults to the scopes of the client.
+	Scope string `json:"scope"`
+	// State is returned to the client unchanged.
+	State               string `json:"state"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+}
+
+// Validate validates the AuthorizeRequest fields.
+func (m AuthorizeRequest) Validate() error {
+	return validation.ValidateStruct(&m,
+		validation.Field(&m.ResponseType, validation.Required, validation.In("code")),
+		validation.Field(&m.ClientID, validation.Required),
+		validation.Field(&m.RedirectURI, validation.Required),
+		validation.Field(&m.CodeChallenge, validation.Required, validation.Match(pkceRegexp)),
+		validation.Field(&m.CodeChallengeMethod, validation.Required, validation.In(challengeMethodS256)),
+	)
+}
+
+// Authorization represents an issued authorization code.
+type Authorization struct {
+	Code  string `json:"code"`
+	State string `json:"state,omitempty"`
+	// RedirectURI is the redirect URI of the client with the code and the state added to its query.
+	RedirectURI string `json:"redirect_uri"`
+}
+
+// TokenRequest represents an access token request (RFC 6749, sections 4.1.3 and 4.4.2).
+// The client credentials may be given in the request body or with HTTP Basic authentication.
+type TokenRequest struct {
+	GrantType    string `form:"grant_type"`
+	ClientID     string `form:"client_id"`
+	ClientSecret string `form:"client_secret"`
+	Scope        string `form:"scope"`
+	Code         string `form:"code"`
+	RedirectURI  string `form:"redirect_uri"`
+	CodeVerifier string `form:"code_verifier"`
+}
+
+// Token represents a successful access token response (RFC 6749, section 5.1).
+type Token struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	Scope       string `json:"scope"`
+}
+
+// IntrospectRequest represents a token introspection request (RFC 7662, section 2.1).
+// The client credentials may be given in the request body or with HTTP Basic authentication.
+type IntrospectRequest struct {
+	Token         string `form:"token"`
+	TokenTypeHint string `form:"token_type_hint"`
+	ClientID      string `form:"client_id"`
+	ClientSecret  string `form:"client_secret"`
+}
+
+// Introspection represents a token introspection response (RFC 7662, section 2.2).
+// Only Active is set if the token is not an active access token.
+type Introspection struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	ID        string `json:"jti,omitempty"`
+}
+
+// Error represents an OAuth 2.0 error response (RFC 6749, section 5.2).
+type Error struct {
+	Status      int    `json:"-"`
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+// Error returns the error description.
+func (e Error) Error() string {
+	if e.Description == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Description
+}
+
+func invalidRequest(description string) Error {
+	return Error{http.StatusBadRequest, "invalid_request", description}
+}
+
+func invalidClient() Error {
+	return Error{http.StatusUnauthorized, "invalid_client", "client authentication failed"}
+}
+
+func invalidGrant(description string) Error {
+	return Error{http.StatusBadRequest, "invalid_grant", description}
+}
+
+func unauthorizedClient(description string) Error {
+	return Error{http.StatusBadRequest, "unauthorized_client", description}
+}
+
+func unsupportedGrantType() Error {
+	return Error{http.StatusBadRequest, "unsupported_grant_type", ""}
+}
+
+func invalidScope(description string) Error {
+	return Error{http.StatusBadRequest, "invalid_scope", description}
+}
+
+func insufficientScope(description string) Error {
+	return Error{http.StatusForbidden, "insufficient_scope", description}
+}
+
+// auditResource is the type of the resources whose changes are recorded in the audit log.
+const auditResource = "oauth_client"
+
+type service struct {
+	repo                  Repository
+	userRepo              auth.Repository
+	keys                  *auth.KeyRing
+	denylist              auth.Denylist
+	sessions              auth.SessionValidator
+	auditor               auth.Auditor
+	transactional         dbcontext.TransactionFunc
+	accessTokenExpiration time.Duration
+	logger                log.Logger
+}
+
+// NewService creates a new OAuth service. The access tokens are signed with the given key ring
+// and are accepted by the authentication middleware of the auth package, like the tokens issued at login.
+// The sessions that introspected tokens are bound to are checked with the given validator, as that middleware does.
+// The registration and deletion of clients are recorded with the auditor in the transactions that make them.
+func NewService(repo Repository, userRepo auth.Repository, keys *auth.KeyRing, denylist auth.Denylist,
+	sessions auth.SessionValidator, auditor auth.Auditor, transactional dbcontext.TransactionFunc,
+	accessTokenExpiration time.Duration, logger log.Logger) Service {
+	return service{repo, userRepo, keys, denylist, sessions, auditor, transactional, accessTokenExpiration, logger}
+}
+
+// QueryClients returns the clients registered by the user with the specified ID.
+func (s service) QueryClients(ctx context.Context, userID string) ([]entity.OAuthClient, error) {
+	clients, err := s.repo.QueryClients(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if clients == nil {
+		clients = []entity.OAuthClient{}
+	}
+	return clients, nil
+}
+
+// CreateClient registers a new client for the user with the specified ID.
+// A secret is generated for confidential clients.
+func (s service) CreateClient(ctx context.Context, userID string, req CreateClientRequest) (NewClient, error) {
+	if err := req.Validate(); err != nil {
+		return NewClient{}, err
+	}
+	user, err := s.userRepo.Get(ctx, userID)
+	if err != nil {
+		return NewClient{}, err
+	}
+	var allowed []interface{}
+	for _, permission := range auth.Permissions(user.Roles...) {
+		allowed = append(allowed, permission)
+	}
+	if err := validation.Validate(req.Scopes, validation.Each(validation.In(allowed...))); err != nil {
+		return NewClient{}, validation.Errors{"scopes": err}
+	}
+
+	client := entity.OAuthClient{
+		ID:           entity.GenerateID(),
+		UserID:       userID,
+		Name:         req.Name,
+		RedirectURIs: req.RedirectURIs,
+		Scopes:       req.Scopes,
+		Confidential: req.Confidential,
+		CreatedAt:    time.Now(),
+	}
+	var secret string
+	if req.Confidential {
+		if secret, err = auth.GenerateToken(); err != nil {
+			return NewClient{}, err
+		}
+		client.SecretHash = auth.HashToken(secret)
+	}
+	err = s.transactional(ctx, func(ctx context.Context) error {
+		if err := s.repo.CreateClient(ctx, client); err != nil {
+			return err
+		}
+		return s.auditor.Record(ctx, entity.AuditCreate, auditResource, client.ID, nil, client)
+	})
+	if err != nil {
+		return NewClient{}, err
+	}
+	s.logger.With(ctx, "user", user.Name).Infof("OAuth client %v registered", client.ID)
+	return NewClient{OAuthClient: client, Secret: secret}, nil
+}
+
+// DeleteClient removes the client with the specified ID registered by the user with the specified ID.
+// The access tokens already issued to the client stay valid until they expire.
+// sql.ErrNoRows is returned if the user has registered no such client.
+func (s service) DeleteClient(ctx context.Context, userID, id string) error {
+	client, err := s.repo.GetClient(ctx, id)
+	if err != nil {
+		return err
+	}
+	if client.UserID != userID {
+		return sql.ErrNoRows
+	}
+	err = s.transactional(ctx, func(ctx context.Context) error {
+		if err := s.repo.DeleteClient(ctx, userID, id); err != nil {
+			return err
+		}
+		return s.auditor.Record(ctx, entity.AuditDelete, auditResource, id, client, nil)
+	})
+	if err != nil {
+		return err
+	}
+	s.logger.With(ctx, "user", userID).Infof("OAuth client %v deleted", id)
+	return nil
+}
+
+// Authorize issues an authorization code for the client on behalf of the user with the specified ID.
+// The requested scopes must be registered for the client. Scopes that are not granted to the user are dropped.
+func (s service) Authorize(ctx context.Context, userID string, req AuthorizeRequest) (Authorization, error) {
+	if err := req.Validate(); err != nil {
+		return Authorization{}, err
+	}
+	client, err := s.repo.GetClient(ctx, req.ClientID)
+	if err == sql.ErrNoRows {
+		return Authorization{}, validation.Errors{
+			"client_id": validation.NewError("validation_client_unknown", "is not a registered client"),
+		}
+	} else if err != nil {
+		return Authorization{}, err
+	}
+	if !contains(client.RedirectURIs, req.RedirectURI) {
+		return Authorization{}, validation.Errors{
+			"redirect_uri": validation.NewError("validation_redirect_uri_unknown", "is not registered for the client"),
+		}
+	}
+	scopes, ok := requestedScopes(req.Scope, client.Scopes)
+	if !ok {
+		return Authorization{}, validation.Errors{
+			"scope": validation.NewError("validation_scope_invalid", "contains scopes not registered for the client"),
+		}
+	}
+	user, err := s.userRepo.Get(ctx, userID)
+	if err != nil {
+		return Authorization{}, err
+	}
+
+	code, err := auth.GenerateToken()
+	if err != nil {
+		return Authorization{}, err
+	}
+	now := time.Now()
+	err = s.repo.CreateCode(ctx, entity.OAuthCode{
+		ID:            entity.GenerateID(),
+		ClientID:      client.ID,
+		UserID:        user.ID,
+		CodeHash:      auth.HashToken(code),
+		RedirectURI:   req.RedirectURI,
+		Scopes:        grantedScopes(scopes, user.Roles),
+		CodeChallenge: req.CodeChallenge,
+		ExpiresAt:     now.Add(codeLifetime),
+		CreatedAt:     now,
+	})
+	if err != nil {
+		return Authorization{}, err
+	}
+	s.logger.With(ctx, "user", user.Name, "client", client.ID).Infof("authorization code issued")
+
+	redirect, err := url.Parse(req.RedirectURI)
+	if err != nil {
+		return Authorization{}, err
+	}
+	query := redirect.Query()
+	query.Set("code", code)
+	if req.State != "" {
+		query.Set("state", req.State)
+	}
+	redirect.RawQuery = query.Encode()
+	return Authorization{Code: code, State: req.State, RedirectURI: redirect.String()}, nil
+}
+
+// Token authenticates the client and issues an access token for the requested grant.
+func (s service) Token(ctx context.Context, req TokenRequest) (Token, error) {
+	if req.GrantType == "" {
+		return Token{}, invalidRequest("grant_type is required")
+	}
+	if req.GrantType != GrantClientCredentials && req.GrantType != GrantAuthorizationCode {
+		return Token{}, unsupportedGrantType()
+	}
+	client, err := s.authenticateClient(ctx, req.ClientID, req.ClientSecret)
+	if err != nil {
+		return Token{}, err
+	}
+	if req.GrantType == GrantClientCredentials {
+		return s.clientCredentials(ctx, client, req)
+	}
+	return s.authorizationCode(ctx, client, req)
+}
+
+// Introspect describes the given access token to a confidential client that has the token:introspect scope.
+// Tokens that are invalid, expired or revoked, tokens whose sessions are revoked or expired, and tokens that are
+// not access tokens, are reported as inactive.
+func (s service) Introspect(ctx context.Context, req IntrospectRequest) (Introspection, error) {
+	client, err := s.authenticateClient(ctx, req.ClientID, req.ClientSecret)
+	if err != nil {
+		return Introspection{}, err
+	}
+	owner, err := s.userRepo.Get(ctx, client.UserID)
+	if err != nil {
+		return Introspection{}, err
+	}
+	if !client.Confidential ||
+		!contains(grantedScopes(client.Scopes, owner.Roles), auth.PermissionTokenIntrospect) {
+		return Introspection{}, insufficientScope("the client is not allowed to introspect tokens")
+	}
+	if req.Token == "" {
+		return Introspection{}, invalidRequest("token is required")
+	}
+
+	inactive := Introspection{Active: false}
+	jwtClaims, err := s.keys.Parse(req.Token)
+	if err != nil {
+		return inactive, nil
+	}
+	claims, err := auth.ParseAccessClaims(jwtClaims)
+	if err != nil {
+		return inactive, nil
+	}
+	revoked, err := s.denylist.IsRevoked(ctx, claims.ID)
+	if err != nil {
+		return Introspection{}, err
+	}
+	if revoked {
+		return inactive, nil
+	}
+	if claims.SessionID != "" {
+		active, err := s.sessions.ValidateSession(ctx, claims.SessionID)
+		if err != nil {
+			return Introspection{}, err
+		}
+		if !active {
+			return inactive, nil
+		}
+	}
+	return Introspection{
+		Active:    true,
+		Scope:     strings.Join(claims.Permissions, " "),
+		ClientID:  claims.ClientID,
+		Username:  claims.UserName,
+		TokenType: "Bearer",
+		ExpiresAt: claims.ExpiresAt.Unix(),
+		Subject:   claims.UserID,
+		ID:        claims.ID,
+	}, nil
+}
+
+// authenticateClient returns the client with the given ID if the secret matches the client.
+// Public clients have no secret and are identified by their ID alone.
+func (s service) authenticateClient(ctx context.Context, id, secret string) (entity.OAuthClient, error) {
+	if id == "" {
+		return entity.OAuthClient{}, invalidClient()
+	}
+	client, err := s.repo.GetClient(ctx, id)
+	if err == sql.ErrNoRows {
+		return entity.OAuthClient{}, invalidClient()
+	} else if err != nil {
+		return entity.OAuthClient{}, err
+	}
+	if client.Confidential {
+		if subtle.ConstantTimeCompare([]byte(auth.HashToken(secret)), []byte(client.SecretHash)) != 1 {
+			s.logger.With(ctx, "client", client.ID).Infof("OAuth client authentication failed")
+			return entity.OAuthClient{}, invalidClient()
+		}
+	} else if secret != "" {
+		return entity.OAuthClient{}, invalidClient()
+	}
+	return client, nil
+}
+
+// clientCredentials issues an access token that acts on behalf of the user who registered the client.
+func (s service) clientCredentials(ctx context.Context, client entity.OAuthClient, req TokenRequest) (Token, error) {
+	if !client.Confidential {
+		return Token{}, unauthorizedClient("public clients cannot use the client_credentials grant")
+	}
+	scopes, ok := requestedScopes(req.Scope, client.Scopes)
+	if !ok {
+		return Token{}, invalidScope("the requested scope is not registered for the client")
+	}
+	user, err := s.userRepo.Get(ctx, client.UserID)
+	if err != nil {
+		return Token{}, err
+	}
+	return s.issueToken(ctx, client, user, scopes, entity.GenerateID(), req.GrantType)
+}
+
+// authorizationCode exchanges an authorization code for an access token that acts on behalf of the user
+// who granted the code. If a used code is presented again, the token issued for it is revoked.
+func (s service) authorizationCode(ctx context.Context, client entity.OAuthClient, req TokenRequest) (Token, error) {
+	if req.Code == "" || req.RedirectURI == "" || req.CodeVerifier == "" {
+		return Token{}, invalidRequest("code, redirect_uri and code_verifier are required")
+	}
+	code, err := s.repo.GetCode(ctx, auth.HashToken(req.Code))
+	if err == sql.ErrNoRows {
+		return Token{}, invalidGrant("the authorization code is invalid")
+	} else if err != nil {
+		return Token{}, err
+	}
+	now := time.Now()
+	if code.ClientID != client.ID || !now.Before(code.ExpiresAt) {
+		return Token{}, invalidGrant("the authorization code is invalid")
+	}
+	if code.RedirectURI != req.RedirectURI {
+		return Token{}, invalidGrant("the redirect URI does not match the authorization request")
+	}
+	if !verifyCodeChallenge(code.CodeChallenge, req.CodeVerifier) {
+		return Token{}, invalidGrant("the code verifier does not match the code challenge")
+	}
+
+	tokenID := entity.GenerateID()
+	used := true
+	if code.UsedAt == nil {
+		ok, err := s.repo.MarkCodeUsed(ctx, code.ID, tokenID, now)
+		if err != nil {
+			return Token{}, err
+		}
+		used = !ok
+	}
+	if used {
+		s.logger.With(ctx, "user", code.UserID, "client", client.ID).Errorf("authorization code reuse detected")
+		if code.TokenID != "" {
+			if err := s.denylist.Revoke(ctx, code.TokenID, now.Add(s.accessTokenExpiration)); err != nil {
+				return Token{}, err
+			}
+		}
+		return Token{}, invalidGrant("the authorization code is invalid")
+	}
+
+	user, err := s.userRepo.Get(ctx, code.UserID)
+	if err == sql.ErrNoRows {
+		return Token{}, invalidGrant("the authorization code is invalid")
+	} else if err != nil {
+		return Token{}, err
+	}
+	return s.issueToken(ctx, client, user, code.Scopes, tokenID, req.GrantType)
+}
+
+// issueToken generates an access token for the user that carries the given scopes as its permissions.
+// Scopes that are no longer granted to the user or registered for the client are dropped.
+func (s service) issueToken(ctx context.Context, client entity.OAuthClient, user entity.User, scopes []string,
+	tokenID, grantType string) (Token, error) {
+	permissions := grantedScopes(scopes, user.Roles)
+	var registered []string
+	for _, permission := range permissions {
+		if contains(client.Scopes, permission) {
+			registered = append(registered, permission)
+		}
+	}
+	if registered == nil {
+		registered = []string{}
+	}
+	token, err := s.keys.Sign(jwt.MapClaims{
+		"jti":         tokenID,
+		"id":          user.ID,
+		"name":        user.Name,
+		"roles":       user.Roles,
+		"permissions": registered,
+		"client_id":   client.ID,
+		"exp":         time.Now().Add(s.accessTokenExpiration).Unix(),
+	})
+	if err != nil {
+		return Token{}, err
+	}
+	s.logger.With(ctx, "user", user.Name, "client", client.ID).Infof("access token issued via %v", grantType)
+	return Token{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(s.accessTokenExpiration.Seconds()),
+		Scope:       strings.Join(registered, " "),
+	}, nil
+}
+
+// requestedScopes parses a space-separated scope parameter. An empty parameter requests every registered scope.
+// False is returned if a scope is not registered.
+func requestedScopes(scope string, registered []string) ([]string, bool) {
+	scopes := strings.Fields(scope)
+	if len(scopes) == 0 {
+		return registered, true
+	}
+	for _, s := range scopes {
+		if !contains(registered, s) {
+			return nil, false
+		}
+	}
+	return scopes, true
+}
+
+// grantedScopes returns the scopes that are permissions granted by the given roles.
+func grantedScopes(scopes []string, roles []string) []string {
+	permissions := auth.Permissions(roles...)
+	granted := []string{}
+	for _, scope := range scopes {
+		if contains(permissions, scope) && !contains(granted, scope) {
+			granted = append(granted, scope)
+		}
+	}
+	return granted
+}
+
+// verifyCodeChallenge reports whether the code verifier matches the S256 code challenge (RFC 7636, section 4.6).
+func verifyCodeChallenge(challenge, verifier string) bool {
+	if !pkceRegexp.MatchString(verifier) {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+// checkRedirectURI checks that a redirect URI is an absolute URI without a fragment (RFC 6749, section 3.1.2).
+func checkRedirectURI(value interface{}) error {
+	s, _ := value.(string)
+	if s == "" {
+		return nil
+	}
+	u, err := url.Parse(s)
+	// native apps may use private-use URI schemes, which have no host (RFC 8252, section 7.1)
+	web := u != nil && (u.Scheme == "http" || u.Scheme == "https")
+	if err != nil || u.Scheme == "" || web && u.Host == "" || strings.ContainsAny(s, " #") {
+		return validation.NewError("validation_redirect_uri_invalid", "must be an absolute URI without a fragment")
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
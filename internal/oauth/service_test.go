@@ -0,0 +1,442 @@
+package oauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/garaekz/priv8/internal/auth"
+	"github.com/garaekz/priv8/internal/entity"
+	"github.com/garaekz/priv8/pkg/log"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+const testVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+
+var testKeys = auth.NewKeyRing(auth.NewHMACKey("test"))
+
+func TestCreateClientRequest_Validate(t *testing.T) {
+	tests := []struct {
+		name      string
+		model     CreateClientRequest
+		wantError bool
+	}{
+		{"public", CreateClientRequest{Name: "app", RedirectURIs: []string{"https://example.com/cb"}, Scopes: []string{"album:create"}}, false},
+		{"native", CreateClientRequest{Name: "app", RedirectURIs: []string{"com.example.app:/cb"}, Scopes: []string{"album:create"}}, false},
+		{"confidential", CreateClientRequest{Name: "app", Scopes: []string{"album:create"}, Confidential: true}, false},
+		{"public without redirect URI", CreateClientRequest{Name: "app", Scopes: []string{"album:create"}}, true},
+		{"relative redirect URI", CreateClientRequest{Name: "app", RedirectURIs: []string{"/cb"}, Scopes: []string{"album:create"}}, true},
+		{"redirect URI without host", CreateClientRequest{Name: "app", RedirectURIs: []string{"https:/cb"}, Scopes: []string{"album:create"}}, true},
+		{"redirect URI with fragment", CreateClientRequest{Name: "app", RedirectURIs: []string{"https://example.com/cb#x"}, Scopes: []string{"album:create"}}, true},
+		{"name required", CreateClientRequest{RedirectURIs: []string{"https://example.com/cb"}, Scopes: []string{"album:create"}}, true},
+		{"scopes required", CreateClientRequest{Name: "app", RedirectURIs: []string{"https://example.com/cb"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.model.Validate()
+			assert.Equal(t, tt.wantError, err != nil)
+		})
+	}
+}
+
+func TestAuthorizeRequest_Validate(t *testing.T) {
+	valid := AuthorizeRequest{ResponseType: "code", ClientID: "app", RedirectURI: "https://example.com/cb",
+		CodeChallenge: challenge(testVerifier), CodeChallengeMethod: "S256"}
+	assert.Nil(t, valid.Validate())
+	req := valid
+	req.ResponseType = "token"
+	assert.NotNil(t, req.Validate())
+	req = valid
+	req.CodeChallengeMethod = "plain"
+	assert.NotNil(t, req.Validate())
+	req = valid
+	req.CodeChallenge = "short"
+	assert.NotNil(t, req.Validate())
+}
+
+func Test_service_Clients(t *testing.T) {
+	logger, _ := log.NewForTest()
+	auditor := &mockAuditor{}
+	s := NewService(&mockRepository{}, newMockUserRepository(), testKeys, auth.NewMemoryDenylist(), mockSessionValidator{}, auditor, withoutTransaction, time.Minute, logger)
+	ctx := auth.WithUser(context.Background(), "100", "demo", auth.RoleUser)
+
+	// scopes must be granted to the user
+	_, err := s.CreateClient(ctx, "100", CreateClientRequest{Name: "app", Scopes: []string{auth.PermissionAlbumManage}, Confidential: true})
+	if assert.IsType(t, validation.Errors{}, err) {
+		assert.Contains(t, err.(validation.Errors), "scopes")
+	}
+
+	// confidential
+	client, err := s.CreateClient(ctx, "100", CreateClientRequest{Name: "app", Scopes: []string{auth.PermissionAlbumCreate}, Confidential: true})
+	assert.Nil(t, err)
+	assert.NotEmpty(t, client.Secret)
+	assert.Equal(t, auth.HashToken(client.Secret), client.SecretHash)
+
+	// public
+	client, err = s.CreateClient(ctx, "100", CreateClientRequest{Name: "spa", RedirectURIs: []string{"https://example.com/cb"},
+		Scopes: []string{auth.PermissionAlbumCreate}})
+	assert.Nil(t, err)
+	assert.Empty(t, client.Secret)
+	assert.Empty(t, client.SecretHash)
+
+	clients, _ := s.QueryClients(ctx, "100")
+	assert.Equal(t, 2, len(clients))
+	clients, _ = s.QueryClients(ctx, "101")
+	assert.Equal(t, 0, len(clients))
+
+	assert.Equal(t, sql.ErrNoRows, s.DeleteClient(ctx, "101", client.ID))
+	assert.Nil(t, s.DeleteClient(ctx, "100", client.ID))
+	clients, _ = s.QueryClients(ctx, "100")
+	assert.Equal(t, 1, len(clients))
+
+	// registrations and deletions are audited
+	assert.Equal(t, []entity.AuditRecord{
+		{ActorID: "100", Action: entity.AuditCreate, ResourceType: auditResource, ResourceID: clients[0].ID},
+		{ActorID: "100", Action: entity.AuditCreate, ResourceType: auditResource, ResourceID: client.ID},
+		{ActorID: "100", Action: entity.AuditDelete, ResourceType: auditResource, ResourceID: client.ID},
+	}, auditor.records)
+}
+
+func Test_service_ClientCredentials(t *testing.T) {
+	logger, _ := log.NewForTest()
+	s := NewService(&mockRepository{}, newMockUserRepository(), testKeys, auth.NewMemoryDenylist(), mockSessionValidator{}, &mockAuditor{}, withoutTransaction, time.Minute, logger)
+	ctx := context.Background()
+	client, _ := s.CreateClient(ctx, "100", CreateClientRequest{Name: "app", Confidential: true,
+		Scopes: []string{auth.PermissionAlbumCreate, auth.PermissionAlbumUpdate}})
+	public, _ := s.CreateClient(ctx, "100", CreateClientRequest{Name: "spa", RedirectURIs: []string{"https://example.com/cb"},
+		Scopes: []string{auth.PermissionAlbumCreate}})
+
+	// client authentication
+	_, err := s.Token(ctx, TokenRequest{GrantType: GrantClientCredentials, ClientID: client.ID, ClientSecret: "wrong"})
+	assert.Equal(t, invalidClient(), err)
+	_, err = s.Token(ctx, TokenRequest{GrantType: GrantClientCredentials, ClientID: "unknown", ClientSecret: client.Secret})
+	assert.Equal(t, invalidClient(), err)
+	_, err = s.Token(ctx, TokenRequest{GrantType: GrantClientCredentials})
+	assert.Equal(t, invalidClient(), err)
+	_, err = s.Token(ctx, TokenRequest{GrantType: GrantClientCredentials, ClientID: public.ID})
+	assert.Equal(t, "unauthorized_client", err.(Error).Code)
+
+	// grant types
+	_, err = s.Token(ctx, TokenRequest{ClientID: client.ID, ClientSecret: client.Secret})
+	assert.Equal(t, "invalid_request", err.(Error).Code)
+	_, err = s.Token(ctx, TokenRequest{GrantType: "password", ClientID: client.ID, ClientSecret: client.Secret})
+	assert.Equal(t, unsupportedGrantType(), err)
+
+	// scopes
+	_, err = s.Token(ctx, TokenRequest{GrantType: GrantClientCredentials, ClientID: client.ID, ClientSecret: client.Secret,
+		Scope: auth.PermissionAlbumDelete})
+	assert.Equal(t, "invalid_scope", err.(Error).Code)
+	token, err := s.Token(ctx, TokenRequest{GrantType: GrantClientCredentials, ClientID: client.ID, ClientSecret: client.Secret,
+		Scope: auth.PermissionAlbumUpdate})
+	assert.Nil(t, err)
+	assert.Equal(t, "Bearer", token.TokenType)
+	assert.Equal(t, 60, token.ExpiresIn)
+	assert.Equal(t, auth.PermissionAlbumUpdate, token.Scope)
+
+	claims, err := testKeys.Parse(token.AccessToken)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, claims["jti"])
+	assert.Equal(t, "100", claims["id"])
+	assert.Equal(t, "demo", claims["name"])
+	assert.Equal(t, client.ID, claims["client_id"])
+	assert.Equal(t, []interface{}{auth.PermissionAlbumUpdate}, claims["permissions"])
+
+	// all registered scopes by default
+	token, err = s.Token(ctx, TokenRequest{GrantType: GrantClientCredentials, ClientID: client.ID, ClientSecret: client.Secret})
+	assert.Nil(t, err)
+	assert.Equal(t, auth.PermissionAlbumCreate+" "+auth.PermissionAlbumUpdate, token.Scope)
+}
+
+func Test_service_AuthorizationCode(t *testing.T) {
+	logger, _ := log.NewForTest()
+	repo := &mockRepository{}
+	denylist := auth.NewMemoryDenylist()
+	s := NewService(repo, newMockUserRepository(), testKeys, denylist, mockSessionValidator{}, &mockAuditor{}, withoutTransaction, time.Minute, logger)
+	ctx := context.Background()
+	client, _ := s.CreateClient(ctx, "100", CreateClientRequest{Name: "spa", RedirectURIs: []string{"https://example.com/cb?x=1"},
+		Scopes: []string{auth.PermissionAlbumCreate, auth.PermissionAlbumUpdate}})
+	other, _ := s.CreateClient(ctx, "100", CreateClientRequest{Name: "app", Confidential: true, RedirectURIs: []string{"https://example.com/cb?x=1"},
+		Scopes: []string{auth.PermissionAlbumCreate}})
+	req := AuthorizeRequest{ResponseType: "code", ClientID: client.ID, RedirectURI: "https://example.com/cb?x=1",
+		Scope: auth.PermissionAlbumCreate, State: "xyz", CodeChallenge: challenge(testVerifier), CodeChallengeMethod: "S256"}
+
+	// authorization errors
+	invalid := req
+	invalid.ClientID = "unknown"
+	_, err := s.Authorize(ctx, "101", invalid)
+	assert.Contains(t, err.(validation.Errors), "client_id")
+	invalid = req
+	invalid.RedirectURI = "https://attacker.com/cb"
+	_, err = s.Authorize(ctx, "101", invalid)
+	assert.Contains(t, err.(validation.Errors), "redirect_uri")
+	invalid = req
+	invalid.Scope = auth.PermissionAlbumDelete
+	_, err = s.Authorize(ctx, "101", invalid)
+	assert.Contains(t, err.(validation.Errors), "scope")
+
+	// authorize
+	authorization, err := s.Authorize(ctx, "101", req)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, authorization.Code)
+	assert.Equal(t, "xyz", authorization.State)
+	redirect, _ := url.Parse(authorization.RedirectURI)
+	assert.Equal(t, "1", redirect.Query().Get("x"))
+	assert.Equal(t, authorization.Code, redirect.Query().Get("code"))
+	assert.Equal(t, "xyz", redirect.Query().Get("state"))
+
+	exchange := TokenRequest{GrantType: GrantAuthorizationCode, ClientID: client.ID, Code: authorization.Code,
+		RedirectURI: req.RedirectURI, CodeVerifier: testVerifier}
+
+	// exchange errors
+	invalidExchange := exchange
+	invalidExchange.CodeVerifier = ""
+	_, err = s.Token(ctx, invalidExchange)
+	assert.Equal(t, "invalid_request", err.(Error).Code)
+	invalidExchange = exchange
+	invalidExchange.CodeVerifier = strings.Repeat("a", 43)
+	_, err = s.Token(ctx, invalidExchange)
+	assert.Equal(t, "invalid_grant", err.(Error).Code)
+	invalidExchange = exchange
+	invalidExchange.RedirectURI = "https://example.com/cb"
+	_, err = s.Token(ctx, invalidExchange)
+	assert.Equal(t, "invalid_grant", err.(Error).Code)
+	invalidExchange = exchange
+	invalidExchange.Code = "unknown"
+	_, err = s.Token(ctx, invalidExchange)
+	assert.Equal(t, "invalid_grant", err.(Error).Code)
+	invalidExchange = exchange
+	invalidExchange.ClientID, invalidExchange.ClientSecret = other.ID, other.Secret
+	_, err = s.Token(ctx, invalidExchange)
+	assert.Equal(t, "invalid_grant", err.(Error).Code)
+
+	// exchange
+	token, err := s.Token(ctx, exchange)
+	assert.Nil(t, err)
+	assert.Equal(t, auth.PermissionAlbumCreate, token.Scope)
+	claims, _ := testKeys.Parse(token.AccessToken)
+	assert.Equal(t, "101", claims["id"])
+	assert.Equal(t, client.ID, claims["client_id"])
+
+	// a reused code revokes the token issued for it
+	_, err = s.Token(ctx, exchange)
+	assert.Equal(t, "invalid_grant", err.(Error).Code)
+	revoked, _ := denylist.IsRevoked(ctx, claims["jti"].(string))
+	assert.True(t, revoked)
+
+	// expired code
+	authorization, _ = s.Authorize(ctx, "101", req)
+	repo.codes[len(repo.codes)-1].ExpiresAt = time.Now().Add(-time.Second)
+	exchange.Code = authorization.Code
+	_, err = s.Token(ctx, exchange)
+	assert.Equal(t, "invalid_grant", err.(Error).Code)
+}
+
+func Test_service_Introspect(t *testing.T) {
+	logger, _ := log.NewForTest()
+	users := newMockUserRepository()
+	denylist := auth.NewMemoryDenylist()
+	s := NewService(&mockRepository{}, users, testKeys, denylist, mockSessionValidator{}, &mockAuditor{}, withoutTransaction, time.Minute, logger)
+	ctx := context.Background()
+	backend, _ := s.CreateClient(ctx, "102", CreateClientRequest{Name: "backend", Confidential: true,
+		Scopes: []string{auth.PermissionTokenIntrospect, auth.PermissionAlbumCreate}})
+	app, _ := s.CreateClient(ctx, "100", CreateClientRequest{Name: "app", Confidential: true,
+		Scopes: []string{auth.PermissionAlbumCreate}})
+	token, _ := s.Token(ctx, TokenRequest{GrantType: GrantClientCredentials, ClientID: app.ID, ClientSecret: app.Secret})
+	introspect := func(token string) (Introspection, error) {
+		return s.Introspect(ctx, IntrospectRequest{Token: token, ClientID: backend.ID, ClientSecret: backend.Secret})
+	}
+
+	// client authentication
+	_, err := s.Introspect(ctx, IntrospectRequest{Token: token.AccessToken, ClientID: backend.ID, ClientSecret: "wrong"})
+	assert.Equal(t, invalidClient(), err)
+	_, err = s.Introspect(ctx, IntrospectRequest{Token: token.AccessToken, ClientID: app.ID, ClientSecret: app.Secret})
+	assert.Equal(t, "insufficient_scope", err.(Error).Code)
+	_, err = introspect("")
+	assert.Equal(t, "invalid_request", err.(Error).Code)
+
+	// active token
+	result, err := introspect(token.AccessToken)
+	assert.Nil(t, err)
+	assert.True(t, result.Active)
+	assert.Equal(t, auth.PermissionAlbumCreate, result.Scope)
+	assert.Equal(t, app.ID, result.ClientID)
+	assert.Equal(t, "demo", result.Username)
+	assert.Equal(t, "100", result.Subject)
+	assert.Equal(t, "Bearer", result.TokenType)
+	assert.NotZero(t, result.ExpiresAt)
+
+	// inactive tokens
+	result, _ = introspect("xyz")
+	assert.Equal(t, Introspection{}, result)
+	share, _ := testKeys.Sign(jwt.MapClaims{"share": "123", "exp": time.Now().Add(time.Hour).Unix()})
+	result, _ = introspect(share)
+	assert.False(t, result.Active)
+	expired, _ := testKeys.Sign(jwt.MapClaims{"jti": "abc", "id": "100", "name": "demo", "exp": time.Now().Add(-time.Hour).Unix()})
+	result, _ = introspect(expired)
+	assert.False(t, result.Active)
+	result, _ = introspect(token.AccessToken)
+	_ = denylist.Revoke(ctx, result.ID, time.Now().Add(time.Hour))
+	result, _ = introspect(token.AccessToken)
+	assert.False(t, result.Active)
+	session := func(sid string) string {
+		token, _ := testKeys.Sign(jwt.MapClaims{"jti": entity.GenerateID(), "id": "100", "name": "demo", "sid": sid,
+			"exp": time.Now().Add(time.Hour).Unix()})
+		return token
+	}
+	result, _ = introspect(session("active"))
+	assert.True(t, result.Active)
+	result, _ = introspect(session("revoked"))
+	assert.False(t, result.Active)
+
+	// the scope is only effective while the owner of the client has the permission
+	users.items[2].Roles = []string{auth.RoleUser}
+	_, err = introspect(token.AccessToken)
+	assert.Equal(t, "insufficient_scope", err.(Error).Code)
+}
+
+func Test_verifyCodeChallenge(t *testing.T) {
+	// the example of RFC 7636, appendix B
+	assert.True(t, verifyCodeChallenge("E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM", testVerifier))
+	assert.False(t, verifyCodeChallenge("E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM", testVerifier+"x"))
+	assert.False(t, verifyCodeChallenge(testVerifier, testVerifier))
+	assert.False(t, verifyCodeChallenge(challenge("short"), "short"))
+}
+
+func Test_grantedScopes(t *testing.T) {
+	assert.Equal(t, []string{auth.PermissionAlbumCreate},
+		grantedScopes([]string{auth.PermissionAlbumCreate, auth.PermissionAlbumManage, auth.PermissionAlbumCreate}, []string{auth.RoleUser}))
+	assert.Equal(t, []string{}, grantedScopes([]string{auth.PermissionAlbumCreate}, nil))
+}
+
+// challenge returns the S256 code challenge of a code verifier.
+func challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// mockSessionValidator reports the session with the ID "active" as the only active one.
+type mockSessionValidator struct{}
+
+func (mockSessionValidator) ValidateSession(_ context.Context, id string) (bool, error) {
+	return id == "active", nil
+}
+
+// withoutTransaction runs f as if it was in a transaction.
+func withoutTransaction(ctx context.Context, f func(ctx context.Context) error) error {
+	return f(ctx)
+}
+
+type mockAuditor struct {
+	records []entity.AuditRecord
+}
+
+func (m *mockAuditor) Record(ctx context.Context, action, resourceType, resourceID string, _, _ interface{}) error {
+	record := entity.AuditRecord{
+		Action:       action,
+		ResourceType: resourceType,
+		ResourceID:   resourceID,
+	}
+	if user := auth.CurrentUser(ctx); user != nil {
+		record.ActorID = user.GetID()
+	}
+	m.records = append(m.records, record)
+	return nil
+}
+
+type mockRepository struct {
+	clients []entity.OAuthClient
+	codes   []entity.OAuthCode
+}
+
+func (m mockRepository) GetClient(_ context.Context, id string) (entity.OAuthClient, error) {
+	for _, client := range m.clients {
+		if client.ID == id {
+			return client, nil
+		}
+	}
+	return entity.OAuthClient{}, sql.ErrNoRows
+}
+
+func (m mockRepository) QueryClients(_ context.Context, userID string) ([]entity.OAuthClient, error) {
+	var clients []entity.OAuthClient
+	for _, client := range m.clients {
+		if client.UserID == userID {
+			clients = append(clients, client)
+		}
+	}
+	return clients, nil
+}
+
+func (m *mockRepository) CreateClient(_ context.Context, client entity.OAuthClient) error {
+	m.clients = append(m.clients, client)
+	return nil
+}
+
+func (m *mockRepository) DeleteClient(_ context.Context, userID, id string) error {
+	for i, client := range m.clients {
+		if client.ID == id && client.UserID == userID {
+			m.clients = append(m.clients[:i], m.clients[i+1:]...)
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (m mockRepository) GetCode(_ context.Context, hash string) (entity.OAuthCode, error) {
+	for _, code := range m.codes {
+		if code.CodeHash == hash {
+			return code, nil
+		}
+	}
+	return entity.OAuthCode{}, sql.ErrNoRows
+}
+
+func (m *mockRepository) CreateCode(_ context.Context, code entity.OAuthCode) error {
+	m.codes = append(m.codes, code)
+	return nil
+}
+
+func (m *mockRepository) MarkCodeUsed(_ context.Context, id, tokenID string, at time.Time) (bool, error) {
+	for i, code := range m.codes {
+		if code.ID == id && code.UsedAt == nil {
+			m.codes[i].UsedAt = &at
+			m.codes[i].TokenID = tokenID
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *mockRepository) Prune(context.Context) error {
+	return nil
+}
+
+// mockUserRepository implements the part of auth.Repository that the OAuth service uses.
+type mockUserRepository struct {
+	auth.Repository
+	items []entity.User
+}
+
+func newMockUserRepository() *mockUserRepository {
+	return &mockUserRepository{items: []entity.User{
+		{ID: "100", Name: "demo", Roles: []string{auth.RoleUser}},
+		{ID: "101", Name: "other", Roles: []string{auth.RoleUser}},
+		{ID: "102", Name: "admin", Roles: []string{auth.RoleUser, auth.RoleAdmin}},
+	}}
+}
+
+func (m mockUserRepository) Get(_ context.Context, id string) (entity.User, error) {
+	for _, user := range m.items {
+		if user.ID == id {
+			return user, nil
+		}
+	}
+	return entity.User{}, sql.ErrNoRows
+}
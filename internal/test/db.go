@@ -9,6 +9,7 @@ import (
 	"path"
 	"runtime"
 	"testing"
+	"time"
 )
 
 var db *dbcontext.DB
@@ -36,9 +37,10 @@ func DB(t *testing.T) *dbcontext.DB {
 }
 
 // ResetTables truncates all data in the specified tables.
+// Rows in other tables that reference the truncated rows via foreign keys are removed as well.
 func ResetTables(t *testing.T, db *dbcontext.DB, tables ...string) {
 	for _, table := range tables {
-		_, err := db.DB().TruncateTable(table).Execute()
+		_, err := db.DB().NewQuery("TRUNCATE TABLE " + db.DB().QuoteTableName(table) + " CASCADE").Execute()
 		if err != nil {
 			t.Error(err)
 			t.FailNow()
@@ -46,6 +48,21 @@ func ResetTables(t *testing.T, db *dbcontext.DB, tables ...string) {
 	}
 }
 
+// CreateUser inserts a user with the specified ID and name so that rows referencing the user can be created.
+func CreateUser(t *testing.T, db *dbcontext.DB, id, name string) {
+	_, err := db.DB().Insert("user", dbx.Params{
+		"id":            id,
+		"name":          name,
+		"password_hash": "",
+		"created_at":    time.Now(),
+		"updated_at":    time.Now(),
+	}).Execute()
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+}
+
 // getSourcePath returns the directory containing the source code that is calling this function.
 func getSourcePath() string {
 	_, filename, _, _ := runtime.Caller(1)
@@ -0,0 +1,8 @@
+CREATE TABLE "user"
+(
+    id            VARCHAR PRIMARY KEY,
+    name          VARCHAR NOT NULL UNIQUE,
+    password_hash VARCHAR NOT NULL,
+    created_at    TIMESTAMP NOT NULL,
+    updated_at    TIMESTAMP NOT NULL
+);
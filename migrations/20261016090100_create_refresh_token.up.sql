@@ -0,0 +1,12 @@
+CREATE TABLE refresh_token
+(
+    id         VARCHAR PRIMARY KEY,
+    family_id  VARCHAR NOT NULL,
+    user_id    VARCHAR NOT NULL REFERENCES "user" (id) ON DELETE CASCADE,
+    token_hash VARCHAR NOT NULL UNIQUE,
+    expires_at TIMESTAMP NOT NULL,
+    used_at    TIMESTAMP,
+    revoked_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL
+);
+CREATE INDEX refresh_token_family_id_idx ON refresh_token (family_id);
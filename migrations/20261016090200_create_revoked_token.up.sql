@@ -0,0 +1,6 @@
+CREATE TABLE revoked_token
+(
+    id         VARCHAR PRIMARY KEY,
+    expires_at TIMESTAMP NOT NULL
+);
+CREATE INDEX revoked_token_expires_at_idx ON revoked_token (expires_at);
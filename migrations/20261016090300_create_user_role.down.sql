@@ -0,0 +1 @@
+DROP TABLE user_role;
\ No newline at end of file
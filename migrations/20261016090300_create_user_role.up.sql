@@ -0,0 +1,10 @@
+CREATE TABLE user_role
+(
+    user_id VARCHAR NOT NULL REFERENCES "user" (id) ON DELETE CASCADE,
+    role    VARCHAR NOT NULL,
+    PRIMARY KEY (user_id, role)
+);
+-- existing users get the default role
+INSERT INTO user_role (user_id, role)
+SELECT id, 'user'
+FROM "user";
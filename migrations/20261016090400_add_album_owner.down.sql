@@ -0,0 +1,3 @@
+ALTER TABLE album
+    DROP COLUMN visibility,
+    DROP COLUMN owner_id;
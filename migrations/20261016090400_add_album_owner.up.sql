@@ -0,0 +1,5 @@
+-- albums created before ownership was introduced have no owner and can only be managed by administrators
+ALTER TABLE album
+    ADD COLUMN owner_id   VARCHAR REFERENCES "user" (id) ON DELETE CASCADE,
+    ADD COLUMN visibility VARCHAR NOT NULL DEFAULT 'private';
+CREATE INDEX album_owner_id_idx ON album (owner_id);
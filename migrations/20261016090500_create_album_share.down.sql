@@ -0,0 +1,2 @@
+DROP TABLE share_link;
+DROP TABLE album_grant;
@@ -0,0 +1,20 @@
+CREATE TABLE album_grant
+(
+    album_id   VARCHAR NOT NULL REFERENCES album (id) ON DELETE CASCADE,
+    user_id    VARCHAR NOT NULL REFERENCES "user" (id) ON DELETE CASCADE,
+    level      VARCHAR NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (album_id, user_id)
+);
+CREATE INDEX album_grant_user_id_idx ON album_grant (user_id);
+
+CREATE TABLE share_link
+(
+    id            VARCHAR PRIMARY KEY,
+    album_id      VARCHAR NOT NULL REFERENCES album (id) ON DELETE CASCADE,
+    created_by    VARCHAR NOT NULL,
+    password_hash VARCHAR NOT NULL,
+    expires_at    TIMESTAMP NOT NULL,
+    created_at    TIMESTAMP NOT NULL
+);
+CREATE INDEX share_link_album_id_idx ON share_link (album_id);
@@ -0,0 +1,13 @@
+CREATE TABLE api_key
+(
+    id           VARCHAR PRIMARY KEY,
+    user_id      VARCHAR NOT NULL REFERENCES "user" (id) ON DELETE CASCADE,
+    name         VARCHAR NOT NULL,
+    prefix       VARCHAR NOT NULL,
+    key_hash     VARCHAR NOT NULL UNIQUE,
+    scopes       VARCHAR NOT NULL,
+    expires_at   TIMESTAMP,
+    last_used_at TIMESTAMP,
+    created_at   TIMESTAMP NOT NULL
+);
+CREATE INDEX api_key_user_id_idx ON api_key (user_id);
@@ -0,0 +1,6 @@
+DROP TABLE recovery_code;
+
+ALTER TABLE "user"
+    DROP COLUMN totp_secret,
+    DROP COLUMN totp_enabled,
+    DROP COLUMN totp_last_step;
@@ -0,0 +1,13 @@
+ALTER TABLE "user"
+    ADD COLUMN totp_secret    VARCHAR NOT NULL DEFAULT '',
+    ADD COLUMN totp_enabled   BOOLEAN NOT NULL DEFAULT FALSE,
+    ADD COLUMN totp_last_step BIGINT  NOT NULL DEFAULT 0;
+
+CREATE TABLE recovery_code
+(
+    user_id    VARCHAR   NOT NULL REFERENCES "user" (id) ON DELETE CASCADE,
+    code_hash  VARCHAR   NOT NULL,
+    used_at    TIMESTAMP NULL,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (user_id, code_hash)
+);
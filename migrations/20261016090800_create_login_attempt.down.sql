@@ -0,0 +1 @@
+DROP TABLE login_attempt;
\ No newline at end of file
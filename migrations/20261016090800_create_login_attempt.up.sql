@@ -0,0 +1,8 @@
+CREATE TABLE login_attempt
+(
+    key             VARCHAR PRIMARY KEY,
+    failures        INT       NOT NULL,
+    last_failure_at TIMESTAMP NOT NULL,
+    locked_until    TIMESTAMP NULL
+);
+CREATE INDEX login_attempt_last_failure_at_idx ON login_attempt (last_failure_at);
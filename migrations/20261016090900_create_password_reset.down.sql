@@ -0,0 +1,5 @@
+DROP TABLE password_reset;
+
+DROP INDEX user_email_idx;
+ALTER TABLE "user"
+    DROP COLUMN email;
@@ -0,0 +1,14 @@
+ALTER TABLE "user"
+    ADD COLUMN email VARCHAR NOT NULL DEFAULT '';
+CREATE UNIQUE INDEX user_email_idx ON "user" (email) WHERE email <> '';
+
+CREATE TABLE password_reset
+(
+    id         VARCHAR PRIMARY KEY,
+    user_id    VARCHAR NOT NULL REFERENCES "user" (id) ON DELETE CASCADE,
+    token_hash VARCHAR NOT NULL UNIQUE,
+    expires_at TIMESTAMP NOT NULL,
+    used_at    TIMESTAMP,
+    created_at TIMESTAMP NOT NULL
+);
+CREATE INDEX password_reset_user_id_idx ON password_reset (user_id);
@@ -0,0 +1,2 @@
+DROP TABLE oauth_code;
+DROP TABLE oauth_client;
@@ -0,0 +1,27 @@
+CREATE TABLE oauth_client
+(
+    id            VARCHAR PRIMARY KEY,
+    user_id       VARCHAR NOT NULL REFERENCES "user" (id) ON DELETE CASCADE,
+    name          VARCHAR NOT NULL,
+    redirect_uris VARCHAR NOT NULL,
+    scopes        VARCHAR NOT NULL,
+    confidential  BOOLEAN NOT NULL,
+    secret_hash   VARCHAR NOT NULL,
+    created_at    TIMESTAMP NOT NULL
+);
+CREATE INDEX oauth_client_user_id_idx ON oauth_client (user_id);
+
+CREATE TABLE oauth_code
+(
+    id             VARCHAR PRIMARY KEY,
+    client_id      VARCHAR NOT NULL REFERENCES oauth_client (id) ON DELETE CASCADE,
+    user_id        VARCHAR NOT NULL REFERENCES "user" (id) ON DELETE CASCADE,
+    code_hash      VARCHAR NOT NULL UNIQUE,
+    redirect_uri   VARCHAR NOT NULL,
+    scopes         VARCHAR NOT NULL,
+    code_challenge VARCHAR NOT NULL,
+    token_id       VARCHAR NOT NULL,
+    expires_at     TIMESTAMP NOT NULL,
+    used_at        TIMESTAMP,
+    created_at     TIMESTAMP NOT NULL
+);
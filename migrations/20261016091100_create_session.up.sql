@@ -0,0 +1,12 @@
+CREATE TABLE session
+(
+    id           VARCHAR PRIMARY KEY,
+    user_id      VARCHAR NOT NULL REFERENCES "user" (id) ON DELETE CASCADE,
+    user_agent   VARCHAR NOT NULL,
+    ip           VARCHAR NOT NULL,
+    created_at   TIMESTAMP NOT NULL,
+    last_seen_at TIMESTAMP NOT NULL,
+    expires_at   TIMESTAMP NOT NULL,
+    revoked_at   TIMESTAMP
+);
+CREATE INDEX session_user_id_idx ON session (user_id);
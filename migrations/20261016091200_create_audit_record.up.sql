@@ -0,0 +1,18 @@
+CREATE TABLE audit_record
+(
+    id                VARCHAR PRIMARY KEY,
+    actor_id          VARCHAR NOT NULL,
+    actor_name        VARCHAR NOT NULL,
+    impersonator_id   VARCHAR NOT NULL,
+    impersonator_name VARCHAR NOT NULL,
+    action            VARCHAR NOT NULL,
+    resource_type     VARCHAR NOT NULL,
+    resource_id       VARCHAR NOT NULL,
+    before            JSONB,
+    after             JSONB,
+    request_id        VARCHAR NOT NULL,
+    created_at        TIMESTAMP NOT NULL
+);
+CREATE INDEX audit_record_created_at_idx ON audit_record (created_at);
+CREATE INDEX audit_record_actor_id_idx ON audit_record (actor_id);
+CREATE INDEX audit_record_resource_idx ON audit_record (resource_type, resource_id);
@@ -0,0 +1,3 @@
+-- the version is incremented by every update so that concurrent updates can be detected
+ALTER TABLE album
+    ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
@@ -0,0 +1,2 @@
+ALTER TABLE album
+    DROP COLUMN deleted_at;
@@ -0,0 +1,4 @@
+-- deleted albums are kept in the trash, where they can be restored, until they are purged
+ALTER TABLE album
+    ADD COLUMN deleted_at TIMESTAMP;
+CREATE INDEX album_deleted_at_idx ON album (deleted_at);
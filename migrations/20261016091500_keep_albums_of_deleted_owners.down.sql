@@ -0,0 +1,3 @@
+ALTER TABLE album
+    DROP CONSTRAINT album_owner_id_fkey,
+    ADD CONSTRAINT album_owner_id_fkey FOREIGN KEY (owner_id) REFERENCES "user" (id) ON DELETE CASCADE;
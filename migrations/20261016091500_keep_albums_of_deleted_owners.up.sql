@@ -0,0 +1,4 @@
+-- the albums of deleted users are moved to the trash without an owner instead of being deleted with them
+ALTER TABLE album
+    DROP CONSTRAINT album_owner_id_fkey,
+    ADD CONSTRAINT album_owner_id_fkey FOREIGN KEY (owner_id) REFERENCES "user" (id) ON DELETE SET NULL;
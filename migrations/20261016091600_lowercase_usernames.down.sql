@@ -0,0 +1 @@
+ALTER TABLE "user" DROP CONSTRAINT user_name_lower_check;
@@ -0,0 +1,3 @@
+-- usernames are case-insensitive and stored in lower case; this fails if two usernames differ only in case
+UPDATE "user" SET name = LOWER(name) WHERE name <> LOWER(name);
+ALTER TABLE "user" ADD CONSTRAINT user_name_lower_check CHECK (name = LOWER(name));
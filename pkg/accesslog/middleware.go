@@ -25,8 +25,8 @@ func Handler(logger log.Logger) routing.Handler {
 
 		err := c.Next()
 
-		// generate an access log message
-		logger.With(ctx, "duration", time.Now().Sub(start).Milliseconds(), "status", rw.Status).
+		// generate an access log message, including the fields that the handlers recorded in the context
+		logger.With(c.Request.Context(), "duration", time.Now().Sub(start).Milliseconds(), "status", rw.Status).
 			Infof("%s %s %s %d %d", c.Request.Method, c.Request.URL.Path, c.Request.Proto, rw.Status, rw.BytesWritten)
 
 		return err
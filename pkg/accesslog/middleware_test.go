@@ -22,3 +22,17 @@ func TestHandler(t *testing.T) {
 	assert.Equal(t, 1, entries.Len())
 	assert.Equal(t, "GET /users HTTP/1.1 200 0", entries.All()[0].Message)
 }
+
+func TestHandler_fields(t *testing.T) {
+	res := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "http://127.0.0.1/users", nil)
+	logger, entries := log.NewForTest()
+	ctx := routing.NewContext(res, req, Handler(logger), func(c *routing.Context) error {
+		c.Request = c.Request.WithContext(log.WithFields(c.Request.Context(), "user", "demo"))
+		return nil
+	})
+	assert.Nil(t, ctx.Next())
+	if assert.Equal(t, 1, entries.Len()) {
+		assert.Equal(t, "demo", entries.All()[0].ContextMap()["user"])
+	}
+}
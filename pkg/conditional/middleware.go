@@ -0,0 +1,111 @@
+// Package conditional provides a middleware that answers conditional GET requests with 304 Not Modified.
+package conditional
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Handler is a middleware that supports conditional GET requests (RFC 7232).
+//
+// The response of the handlers that follow it is buffered. If it is successful, it is given an ETag computed from
+// its body unless the handlers set one, and the If-None-Match and If-Modified-Since headers of the request are
+// evaluated against its ETag and Last-Modified headers. The body is omitted with 304 Not Modified if they match.
+// The handlers may set the Last-Modified header with SetLastModified.
+func Handler(c *routing.Context) error {
+	if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+		return c.Next()
+	}
+
+	w := c.Response
+	bw := &bufferedWriter{ResponseWriter: w}
+	c.Response = bw
+	err := c.Next()
+	c.Response = w
+
+	if err != nil || bw.status != http.StatusOK {
+		bw.flush()
+		return err
+	}
+
+	header := w.Header()
+	if header.Get("ETag") == "" {
+		header.Set("ETag", fmt.Sprintf(`"%x"`, sha1.Sum(bw.body.Bytes())))
+	}
+	if notModified(c.Request, header) {
+		header.Del("Content-Type")
+		header.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	bw.flush()
+	return nil
+}
+
+// SetLastModified sets the Last-Modified header of a response to the given time, unless it is zero.
+func SetLastModified(w http.ResponseWriter, t time.Time) {
+	if !t.IsZero() {
+		w.Header().Set("Last-Modified", t.UTC().Format(http.TimeFormat))
+	}
+}
+
+// notModified reports whether the conditional headers of the request match the given response headers.
+// If-Modified-Since is ignored if the request has If-None-Match, as required by RFC 7232.
+func notModified(req *http.Request, header http.Header) bool {
+	if value := req.Header.Get("If-None-Match"); value != "" {
+		etag := strings.TrimPrefix(header.Get("ETag"), "W/")
+		for _, tag := range strings.Split(value, ",") {
+			tag = strings.TrimSpace(tag)
+			// If-None-Match uses the weak comparison of entity tags
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	return !modified.After(since)
+}
+
+// bufferedWriter holds back the status and the body of a response until they are flushed.
+type bufferedWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+// WriteHeader records the status of the response.
+func (w *bufferedWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+// Write appends data to the body of the response.
+func (w *bufferedWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(data)
+}
+
+// flush writes the buffered response to the underlying writer.
+func (w *bufferedWriter) flush() {
+	if w.status == 0 {
+		return
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	_, _ = w.ResponseWriter.Write(w.body.Bytes())
+}
@@ -0,0 +1,99 @@
+package conditional
+
+import (
+	"errors"
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHandler(t *testing.T) {
+	modified := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	withETag := func(c *routing.Context) error {
+		c.Response.Header().Set("ETag", `"3"`)
+		SetLastModified(c.Response, modified)
+		c.Response.Header().Set("Content-Type", "application/json")
+		_, err := c.Response.Write([]byte(`{"id":"123"}`))
+		return err
+	}
+	withoutETag := func(c *routing.Context) error {
+		_, err := c.Response.Write([]byte(`{"id":"123"}`))
+		return err
+	}
+	generated := `"bb381f78de4ade97241559a0e796cb8aee670d49"`
+
+	tests := []struct {
+		name       string
+		method     string
+		header     http.Header
+		handler    routing.Handler
+		wantStatus int
+		wantETag   string
+		wantBody   string
+	}{
+		{"unconditional", "GET", nil, withETag, http.StatusOK, `"3"`, `{"id":"123"}`},
+		{"matching etag", "GET", http.Header{"If-None-Match": {`"3"`}}, withETag, http.StatusNotModified, `"3"`, ""},
+		{"matching weak etag", "GET", http.Header{"If-None-Match": {`"1", W/"3"`}}, withETag, http.StatusNotModified, `"3"`, ""},
+		{"matching any etag", "GET", http.Header{"If-None-Match": {"*"}}, withETag, http.StatusNotModified, `"3"`, ""},
+		{"changed etag", "GET", http.Header{"If-None-Match": {`"2"`}}, withETag, http.StatusOK, `"3"`, `{"id":"123"}`},
+		{"etag has precedence", "GET", http.Header{"If-None-Match": {`"2"`}, "If-Modified-Since": {modified.Format(http.TimeFormat)}}, withETag, http.StatusOK, `"3"`, `{"id":"123"}`},
+		{"not modified since", "GET", http.Header{"If-Modified-Since": {modified.Format(http.TimeFormat)}}, withETag, http.StatusNotModified, `"3"`, ""},
+		{"modified since", "GET", http.Header{"If-Modified-Since": {modified.Add(-time.Second).Format(http.TimeFormat)}}, withETag, http.StatusOK, `"3"`, `{"id":"123"}`},
+		{"invalid date", "GET", http.Header{"If-Modified-Since": {"yesterday"}}, withETag, http.StatusOK, `"3"`, `{"id":"123"}`},
+		{"generated etag", "GET", nil, withoutETag, http.StatusOK, generated, `{"id":"123"}`},
+		{"matching generated etag", "GET", http.Header{"If-None-Match": {generated}}, withoutETag, http.StatusNotModified, generated, ""},
+		{"no last modified", "GET", http.Header{"If-Modified-Since": {modified.Format(http.TimeFormat)}}, withoutETag, http.StatusOK, generated, `{"id":"123"}`},
+		{"not a read", "PUT", http.Header{"If-None-Match": {"*"}}, withoutETag, http.StatusOK, "", `{"id":"123"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := httptest.NewRecorder()
+			req, _ := http.NewRequest(tt.method, "http://127.0.0.1/albums/123", nil)
+			if tt.header != nil {
+				req.Header = tt.header
+			}
+			c := routing.NewContext(res, req, Handler, tt.handler)
+			assert.Nil(t, c.Next())
+			assert.Equal(t, tt.wantStatus, res.Code)
+			assert.Equal(t, tt.wantETag, res.Header().Get("ETag"))
+			assert.Equal(t, tt.wantBody, res.Body.String())
+			if tt.wantStatus == http.StatusNotModified {
+				assert.Empty(t, res.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestHandler_error(t *testing.T) {
+	res := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://127.0.0.1/albums/123", http.NoBody)
+	req.Header.Set("If-None-Match", "*")
+	failure := errors.New("failure")
+	c := routing.NewContext(res, req, Handler, func(c *routing.Context) error {
+		return failure
+	})
+	assert.Equal(t, failure, c.Next())
+	// the error is written by the error handler to the original response
+	assert.Equal(t, res, c.Response)
+	assert.Empty(t, res.Header().Get("ETag"))
+
+	// unsuccessful responses are not conditional
+	res = httptest.NewRecorder()
+	c = routing.NewContext(res, req, Handler, func(c *routing.Context) error {
+		c.Response.WriteHeader(http.StatusAccepted)
+		return nil
+	})
+	assert.Nil(t, c.Next())
+	assert.Equal(t, http.StatusAccepted, res.Code)
+}
+
+func TestSetLastModified(t *testing.T) {
+	res := httptest.NewRecorder()
+	SetLastModified(res, time.Time{})
+	assert.Empty(t, res.Header().Get("Last-Modified"))
+	SetLastModified(res, time.Date(2026, 10, 16, 14, 0, 0, 0, time.FixedZone("CEST", 2*3600)))
+	assert.Equal(t, "Fri, 16 Oct 2026 12:00:00 GMT", res.Header().Get("Last-Modified"))
+}
@@ -45,7 +45,11 @@ func (db *DB) With(ctx context.Context) dbx.Builder {
 
 // Transactional starts a transaction and calls the given function with a context storing the transaction.
 // The transaction associated with the context can be accesse via With().
+// If the context already stores a transaction, the function is called in that transaction instead.
 func (db *DB) Transactional(ctx context.Context, f func(ctx context.Context) error) error {
+	if _, ok := ctx.Value(txKey).(*dbx.Tx); ok {
+		return f(ctx)
+	}
 	return db.db.TransactionalContext(ctx, nil, func(tx *dbx.Tx) error {
 		return f(context.WithValue(ctx, txKey, tx))
 	})
@@ -61,6 +61,18 @@ func TestDB_Transactional(t *testing.T) {
 		})
 		assert.Equal(t, sql.ErrNoRows, err)
 		assert.Equal(t, 4, runCountQuery(t, db))
+
+		// a nested transaction is part of the outer one
+		err = dbc.Transactional(context.Background(), func(ctx context.Context) error {
+			err := dbc.Transactional(ctx, func(ctx context.Context) error {
+				_, err := dbc.With(ctx).Insert("dbcontexttest", dbx.Params{"id": "5", "name": "name1"}).Execute()
+				return err
+			})
+			assert.Nil(t, err)
+			return sql.ErrNoRows
+		})
+		assert.Equal(t, sql.ErrNoRows, err)
+		assert.Equal(t, 4, runCountQuery(t, db))
 	})
 }
 
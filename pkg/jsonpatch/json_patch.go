@@ -0,0 +1,310 @@
+package jsonpatch
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Operation is an operation of a JSON Patch document.
+type Operation struct {
+	// Op is one of "add", "remove", "replace", "move", "copy" and "test".
+	Op string `json:"op"`
+	// Path is the JSON Pointer (RFC 6901) to the location that the operation is performed on.
+	Path string `json:"path"`
+	// From is the JSON Pointer to the source location of the "move" and "copy" operations.
+	From string `json:"from,omitempty"`
+	// Value is the value of the "add", "replace" and "test" operations.
+	Value json.RawMessage `json:"value,omitempty"`
+
+	path, from []string
+	value      interface{}
+}
+
+// JSONPatch is a JSON Patch document (RFC 6902). Its operations are applied in order, and the patch fails
+// as a whole if one of them fails.
+type JSONPatch []Operation
+
+// NewJSONPatch parses a JSON Patch document and checks that its operations are well-formed.
+func NewJSONPatch(data []byte) (JSONPatch, error) {
+	var patch JSONPatch
+	if err := json.Unmarshal(data, &patch); err != nil {
+		return nil, fmt.Errorf("the JSON patch is not an array of operations: %v", err)
+	}
+	for i := range patch {
+		if err := patch[i].parse(); err != nil {
+			return nil, fmt.Errorf("operation %d: %v", i, err)
+		}
+	}
+	return patch, nil
+}
+
+// parse parses the pointers and the value of the operation.
+func (o *Operation) parse() (err error) {
+	if o.path, err = parsePointer(o.Path); err != nil {
+		return err
+	}
+	switch o.Op {
+	case "add", "replace", "test":
+		if o.Value == nil {
+			return fmt.Errorf("the %q operation requires a value", o.Op)
+		}
+		if o.value, err = decode(o.Value); err != nil {
+			return err
+		}
+	case "move", "copy":
+		if o.from, err = parsePointer(o.From); err != nil {
+			return err
+		}
+		if o.Op == "move" && strings.HasPrefix(o.Path, o.From+"/") {
+			return fmt.Errorf("cannot move %q into one of its children", o.From)
+		}
+	case "remove":
+	default:
+		return fmt.Errorf("unknown operation %q", o.Op)
+	}
+	return nil
+}
+
+// Apply applies the operations of the patch to the given JSON document.
+func (p JSONPatch) Apply(doc []byte) ([]byte, error) {
+	target, err := decode(doc)
+	if err != nil {
+		return nil, err
+	}
+	for i, o := range p {
+		if target, err = o.apply(target); err != nil {
+			return nil, fmt.Errorf("operation %d: %v", i, err)
+		}
+	}
+	return json.Marshal(target)
+}
+
+// apply performs the operation on the given document and returns the resulting document.
+func (o Operation) apply(doc interface{}) (interface{}, error) {
+	switch o.Op {
+	case "add":
+		return add(doc, o.path, clone(o.value))
+	case "remove":
+		return remove(doc, o.path)
+	case "replace":
+		if _, err := get(doc, o.path); err != nil {
+			return nil, err
+		}
+		if len(o.path) == 0 {
+			return clone(o.value), nil
+		}
+		doc, _ = remove(doc, o.path)
+		return add(doc, o.path, clone(o.value))
+	case "move":
+		value, err := get(doc, o.from)
+		if err != nil {
+			return nil, err
+		}
+		if doc, err = remove(doc, o.from); err != nil {
+			return nil, err
+		}
+		return add(doc, o.path, value)
+	case "copy":
+		value, err := get(doc, o.from)
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, o.path, clone(value))
+	default: // test
+		value, err := get(doc, o.path)
+		if err != nil {
+			return nil, err
+		}
+		if !equal(value, o.value) {
+			return nil, fmt.Errorf("the value at %q is not the expected value", o.Path)
+		}
+		return doc, nil
+	}
+}
+
+// parsePointer splits a JSON Pointer (RFC 6901) into its unescaped reference tokens.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if pointer[0] != '/' {
+		return nil, fmt.Errorf("%q is not a valid JSON pointer", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+	}
+	return tokens, nil
+}
+
+// get returns the value at the given path of the document.
+func get(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("the member %q does not exist", token)
+			}
+			doc = value
+		case []interface{}:
+			i, err := index(token, len(node)-1)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[i]
+		default:
+			return nil, fmt.Errorf("cannot find %q in a value that is neither an object nor an array", token)
+		}
+	}
+	return doc, nil
+}
+
+// add returns the document with the value added at the given path. An existing object member is replaced,
+// and the value is inserted into an array before the element at the index, or appended if the index is "-".
+func add(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return modify(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			node[token] = value
+			return node, nil
+		case []interface{}:
+			i := len(node)
+			if token != "-" {
+				var err error
+				if i, err = index(token, len(node)); err != nil {
+					return nil, err
+				}
+			}
+			node = append(node, nil)
+			copy(node[i+1:], node[i:])
+			node[i] = value
+			return node, nil
+		}
+		return nil, fmt.Errorf("cannot add %q to a value that is neither an object nor an array", token)
+	})
+}
+
+// remove returns the document with the value at the given path removed.
+func remove(doc interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("cannot remove the whole document")
+	}
+	return modify(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := node[token]; !ok {
+				return nil, fmt.Errorf("the member %q does not exist", token)
+			}
+			delete(node, token)
+			return node, nil
+		case []interface{}:
+			i, err := index(token, len(node)-1)
+			if err != nil {
+				return nil, err
+			}
+			return append(node[:i], node[i+1:]...), nil
+		}
+		return nil, fmt.Errorf("cannot remove %q from a value that is neither an object nor an array", token)
+	})
+}
+
+// modify replaces the parent of the location at the given non-empty path with the result of f, which is called
+// with the parent and the last token of the path. It returns the modified document.
+func modify(doc interface{}, path []string, f func(parent interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return f(doc, path[0])
+	}
+	child, err := get(doc, path[:1])
+	if err != nil {
+		return nil, err
+	}
+	if child, err = modify(child, path[1:], f); err != nil {
+		return nil, err
+	}
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		node[path[0]] = child
+	case []interface{}:
+		i, _ := index(path[0], len(node)-1)
+		node[i] = child
+	}
+	return doc, nil
+}
+
+// index parses an array index that must not be greater than max.
+func index(token string, max int) (int, error) {
+	// leading zeros are not allowed by RFC 6901
+	if token == "" || len(token) > 1 && token[0] == '0' {
+		return 0, fmt.Errorf("%q is not a valid array index", token)
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("%q is not a valid array index", token)
+	}
+	if i > max {
+		return 0, fmt.Errorf("the array index %d is out of bounds", i)
+	}
+	return i, nil
+}
+
+// clone returns a deep copy of a decoded JSON value.
+func clone(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for name, member := range v {
+			result[name] = clone(member)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, element := range v {
+			result[i] = clone(element)
+		}
+		return result
+	}
+	return value
+}
+
+// equal reports whether two decoded JSON values are equal. Numbers are compared by their values.
+func equal(a, b interface{}) bool {
+	switch x := a.(type) {
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for name, value := range x {
+			if other, ok := y[name]; !ok || !equal(value, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !equal(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		y, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		fx, errx := x.Float64()
+		fy, erry := y.Float64()
+		return errx == nil && erry == nil && fx == fy
+	}
+	return a == b
+}
@@ -0,0 +1,91 @@
+package jsonpatch
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNewJSONPatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		patch string
+		valid bool
+	}{
+		{"valid", `[{"op":"add","path":"/a","value":1},{"op":"remove","path":"/a"},{"op":"move","from":"/b","path":"/c"}]`, true},
+		{"null value", `[{"op":"replace","path":"/a","value":null}]`, true},
+		{"empty", `[]`, true},
+		{"not an array", `{"op":"remove","path":"/a"}`, false},
+		{"unknown operation", `[{"op":"delete","path":"/a"}]`, false},
+		{"missing value", `[{"op":"add","path":"/a"}]`, false},
+		{"invalid path", `[{"op":"remove","path":"a"}]`, false},
+		{"invalid from", `[{"op":"copy","from":"b","path":"/a"}]`, false},
+		{"move into child", `[{"op":"move","from":"/a","path":"/a/b"}]`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewJSONPatch([]byte(tt.patch))
+			assert.Equal(t, tt.valid, err == nil, err)
+		})
+	}
+}
+
+func TestJSONPatch_Apply(t *testing.T) {
+	// mostly the examples of RFC 6902, appendix A
+	tests := []struct {
+		name, doc, patch, want string
+	}{
+		{"add member", `{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`},
+		{"add element", `{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`},
+		{"remove member", `{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`},
+		{"remove element", `{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`},
+		{"replace", `{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`},
+		{"move member", `{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`, `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`,
+			`{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{"move element", `{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`},
+		{"test", `{"baz":"qux","foo":["a",2,"c"]}`, `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2}]`,
+			`{"baz":"qux","foo":["a",2,"c"]}`},
+		{"add nested member", `{"foo":"bar"}`, `[{"op":"add","path":"/child","value":{"grandchild":{}}}]`, `{"foo":"bar","child":{"grandchild":{}}}`},
+		{"escaped path", `{"/":9,"~1":10}`, `[{"op":"test","path":"/~01","value":10},{"op":"remove","path":"/~1"}]`, `{"~1":10}`},
+		{"append", `{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":["abc","def"]}]`, `{"foo":["bar",["abc","def"]]}`},
+		{"copy", `{"foo":{"a":1}}`, `[{"op":"copy","from":"/foo","path":"/bar"},{"op":"replace","path":"/bar/a","value":2}]`,
+			`{"foo":{"a":1},"bar":{"a":2}}`},
+		{"replace root", `{"foo":1}`, `[{"op":"replace","path":"","value":[1]}]`, `[1]`},
+		{"equal numbers", `{"foo":1}`, `[{"op":"test","path":"/foo","value":1.0}]`, `{"foo":1}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewJSONPatch([]byte(tt.patch))
+			if assert.Nil(t, err) {
+				doc, err := p.Apply([]byte(tt.doc))
+				assert.Nil(t, err)
+				assert.JSONEq(t, tt.want, string(doc))
+			}
+		})
+	}
+}
+
+func TestJSONPatch_Apply_error(t *testing.T) {
+	tests := []struct {
+		name, doc, patch string
+	}{
+		{"missing member", `{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":"qux"}]`},
+		{"remove missing member", `{"foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`},
+		{"replace missing member", `{"foo":"bar"}`, `[{"op":"replace","path":"/baz","value":1}]`},
+		{"index out of bounds", `{"foo":["bar"]}`, `[{"op":"add","path":"/foo/2","value":"qux"}]`},
+		{"invalid index", `{"foo":["bar"]}`, `[{"op":"remove","path":"/foo/01"}]`},
+		{"failed test", `{"baz":"qux"}`, `[{"op":"test","path":"/baz","value":"bar"}]`},
+		{"type mismatch", `{"baz":"1"}`, `[{"op":"test","path":"/baz","value":1}]`},
+		{"scalar parent", `{"baz":"qux"}`, `[{"op":"add","path":"/baz/a","value":1}]`},
+		{"remove root", `{"baz":"qux"}`, `[{"op":"remove","path":""}]`},
+		{"failure after success", `{"baz":"qux"}`, `[{"op":"remove","path":"/baz"},{"op":"test","path":"/baz","value":"qux"}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewJSONPatch([]byte(tt.patch))
+			if assert.Nil(t, err) {
+				_, err = p.Apply([]byte(tt.doc))
+				assert.NotNil(t, err)
+			}
+		})
+	}
+}
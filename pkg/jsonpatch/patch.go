@@ -0,0 +1,101 @@
+// Package jsonpatch applies JSON Merge Patch (RFC 7396) and JSON Patch (RFC 6902) documents to JSON documents.
+package jsonpatch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+)
+
+// Media types of the supported patch documents.
+const (
+	// MergePatchType is the media type of JSON Merge Patch documents.
+	MergePatchType = "application/merge-patch+json"
+	// JSONPatchType is the media type of JSON Patch documents.
+	JSONPatchType = "application/json-patch+json"
+)
+
+// ErrUnsupportedType is returned by New if the media type is not one of the supported patch types.
+var ErrUnsupportedType = errors.New("unsupported patch media type")
+
+// Patch is a patch document that can be applied to JSON documents.
+type Patch interface {
+	// Apply applies the patch to the given JSON document and returns the patched document.
+	// The given document is not modified.
+	Apply(doc []byte) ([]byte, error)
+}
+
+// New parses a patch document of the given media type, which is typically the Content-Type of a PATCH request.
+func New(mediaType string, data []byte) (Patch, error) {
+	mediaType, _, err := mime.ParseMediaType(mediaType)
+	if err != nil {
+		return nil, ErrUnsupportedType
+	}
+	switch mediaType {
+	case MergePatchType:
+		return NewMergePatch(data)
+	case JSONPatchType:
+		return NewJSONPatch(data)
+	}
+	return nil, ErrUnsupportedType
+}
+
+// MergePatch is a JSON Merge Patch document (RFC 7396). The members of the patch replace those of the target
+// document, recursively for objects, and the members whose value is null are removed.
+type MergePatch struct {
+	patch interface{}
+}
+
+// NewMergePatch parses a JSON Merge Patch document.
+func NewMergePatch(data []byte) (MergePatch, error) {
+	patch, err := decode(data)
+	if err != nil {
+		return MergePatch{}, fmt.Errorf("the merge patch is not valid JSON: %v", err)
+	}
+	return MergePatch{patch}, nil
+}
+
+// Apply applies the merge patch to the given JSON document.
+func (p MergePatch) Apply(doc []byte) ([]byte, error) {
+	target, err := decode(doc)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(merge(target, p.patch))
+}
+
+// merge returns the target merged with the patch as described in RFC 7396.
+func merge(target, patch interface{}) interface{} {
+	members, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	result, ok := target.(map[string]interface{})
+	if !ok {
+		result = map[string]interface{}{}
+	}
+	for name, value := range members {
+		if value == nil {
+			delete(result, name)
+		} else {
+			result[name] = merge(result[name], value)
+		}
+	}
+	return result
+}
+
+// decode decodes a JSON document. Numbers are kept as json.Number so that they are encoded again unchanged.
+func decode(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, errors.New("unexpected data after the JSON value")
+	}
+	return value, nil
+}
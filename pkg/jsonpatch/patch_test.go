@@ -0,0 +1,60 @@
+package jsonpatch
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	p, err := New("application/merge-patch+json; charset=utf-8", []byte(`{"a":1}`))
+	assert.Nil(t, err)
+	assert.IsType(t, MergePatch{}, p)
+	p, err = New(JSONPatchType, []byte(`[{"op":"remove","path":"/a"}]`))
+	assert.Nil(t, err)
+	assert.IsType(t, JSONPatch{}, p)
+	_, err = New("application/json", []byte(`{"a":1}`))
+	assert.Equal(t, ErrUnsupportedType, err)
+	_, err = New("", []byte(`{"a":1}`))
+	assert.Equal(t, ErrUnsupportedType, err)
+	_, err = New(MergePatchType, []byte(`{"a":`))
+	assert.NotNil(t, err)
+}
+
+func TestMergePatch_Apply(t *testing.T) {
+	// the examples of RFC 7396, appendix A
+	tests := []struct {
+		target, patch, want string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+		// large numbers are kept unchanged
+		{`{"a":12345678901234567890}`, `{"b":1.50}`, `{"a":12345678901234567890,"b":1.50}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.patch, func(t *testing.T) {
+			p, err := NewMergePatch([]byte(tt.patch))
+			if assert.Nil(t, err) {
+				doc, err := p.Apply([]byte(tt.target))
+				assert.Nil(t, err)
+				assert.JSONEq(t, tt.want, string(doc))
+			}
+		})
+	}
+
+	p, _ := NewMergePatch([]byte(`{"a":1}`))
+	_, err := p.Apply([]byte(`{"a":`))
+	assert.NotNil(t, err)
+}
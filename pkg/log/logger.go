@@ -39,6 +39,7 @@ type contextKey int
 const (
 	requestIDKey contextKey = iota
 	correlationIDKey
+	fieldsKey
 )
 
 // New creates a new logger using the default configuration.
@@ -62,6 +63,7 @@ func NewForTest() (Logger, *observer.ObservedLogs) {
 //
 // If the context contains request ID and/or correlation ID information (recorded via WithRequestID()
 // and WithCorrelationID()), they will be added to every log message generated by the new logger.
+// So will the fields recorded in the context via WithFields().
 //
 // The arguments should be specified as a sequence of name, value pairs with names being strings.
 // The arguments will also be added to every log message generated by the logger.
@@ -73,6 +75,9 @@ func (l *logger) With(ctx context.Context, args ...interface{}) Logger {
 		if id, ok := ctx.Value(correlationIDKey).(string); ok {
 			args = append(args, zap.String("correlation_id", id))
 		}
+		if fields, ok := ctx.Value(fieldsKey).([]interface{}); ok {
+			args = append(args, fields...)
+		}
 	}
 	if len(args) > 0 {
 		return &logger{l.SugaredLogger.With(args...)}
@@ -93,6 +98,21 @@ func WithRequest(ctx context.Context, req *http.Request) context.Context {
 	return ctx
 }
 
+// RequestID returns the request ID recorded in the given context via WithRequest().
+// An empty string is returned if the context contains no request ID.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// WithFields returns a context which carries the given name-value pairs, in addition to those it already carries,
+// so that they are added to every log message generated by a logger decorated with the context.
+func WithFields(ctx context.Context, args ...interface{}) context.Context {
+	fields, _ := ctx.Value(fieldsKey).([]interface{})
+	fields = append(fields[:len(fields):len(fields)], args...)
+	return context.WithValue(ctx, fieldsKey, fields)
+}
+
 // getCorrelationID extracts the correlation ID from the HTTP request
 func getCorrelationID(req *http.Request) string {
 	return req.Header.Get("X-Correlation-ID")
@@ -57,6 +57,24 @@ func Test_logger_With(t *testing.T) {
 	assert.False(t, reflect.DeepEqual(l3, l2))
 }
 
+func TestRequestID(t *testing.T) {
+	assert.Empty(t, RequestID(context.Background()))
+	ctx := WithRequest(context.Background(), buildRequest("abc", ""))
+	assert.Equal(t, "abc", RequestID(ctx))
+}
+
+func TestWithFields(t *testing.T) {
+	logger, entries := NewForTest()
+	ctx := WithFields(context.Background(), "a", 1)
+	ctx2 := WithFields(ctx, "b", 2)
+	logger.With(ctx).Info("msg 1")
+	logger.With(ctx2, "c", 3).Info("msg 2")
+	if assert.Equal(t, 2, entries.Len()) {
+		assert.Equal(t, map[string]interface{}{"a": int64(1)}, entries.All()[0].ContextMap())
+		assert.Equal(t, map[string]interface{}{"a": int64(1), "b": int64(2), "c": int64(3)}, entries.All()[1].ContextMap())
+	}
+}
+
 func buildRequest(requestID, correlationID string) *http.Request {
 	req, _ := http.NewRequest("GET", "http://example.com", bytes.NewBufferString(""))
 	if requestID != "" {
@@ -0,0 +1,115 @@
+// Package mail provides the means of sending plain text emails.
+package mail
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Message represents a plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends emails.
+type Mailer interface {
+	// Send sends the given message.
+	Send(ctx context.Context, msg Message) error
+}
+
+// smtpMailer sends emails through an SMTP server.
+type smtpMailer struct {
+	addr string
+	// from is the From header, which may include a display name, and sender is its bare address,
+	// which is the envelope sender given to the SMTP server.
+	from   string
+	sender string
+	auth   smtp.Auth
+}
+
+// NewSMTPMailer creates a new mailer that sends emails from the given address through the SMTP server at addr
+// (host:port). The address may include a display name, as in "priv8 <no-reply@example.com>".
+// The connection is upgraded with STARTTLS if the server supports it. The credentials are only used
+// if username is not empty. An error is returned if the address cannot be parsed.
+func NewSMTPMailer(addr, username, password, from string) (Mailer, error) {
+	sender, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender address %q: %v", from, err)
+	}
+	var auth smtp.Auth
+	if username != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+	return smtpMailer{addr, from, sender.Address, auth}, nil
+}
+
+// Send sends the message through the SMTP server.
+func (m smtpMailer) Send(_ context.Context, msg Message) error {
+	data, err := format(m.from, msg)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(m.addr, m.auth, m.sender, []string{msg.To}, data)
+}
+
+// dirMailer writes emails as files to a directory instead of sending them.
+type dirMailer struct {
+	dir  string
+	from string
+}
+
+// NewDirMailer creates a new mailer that writes every email to a new .eml file in the given directory.
+// It is meant for development and tests, where no SMTP server is available.
+func NewDirMailer(dir, from string) Mailer {
+	return dirMailer{dir, from}
+}
+
+// Send writes the message to a new file in the directory.
+func (m dirMailer) Send(_ context.Context, msg Message) error {
+	data, err := format(m.from, msg)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.dir, 0700); err != nil {
+		return err
+	}
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	name := time.Now().UTC().Format("20060102T150405.000000000") + "-" + hex.EncodeToString(b) + ".eml"
+	return os.WriteFile(filepath.Join(m.dir, name), data, 0600)
+}
+
+// format returns the message in the Internet Message Format (RFC 5322).
+func format(from string, msg Message) ([]byte, error) {
+	for _, value := range []string{from, msg.To, msg.Subject} {
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("mail header contains a line break: %q", value)
+		}
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(strings.ReplaceAll(strings.ReplaceAll(msg.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,108 @@
+package mail
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDirMailer(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mail")
+	mailer := NewDirMailer(dir, "priv8 <no-reply@example.com>")
+	ctx := context.Background()
+
+	assert.Nil(t, mailer.Send(ctx, Message{To: "demo@example.com", Subject: "Hello", Body: "line 1\nline 2"}))
+	assert.Nil(t, mailer.Send(ctx, Message{To: "demo@example.com", Subject: "Hello again", Body: "..."}))
+	files, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	if assert.Len(t, files, 2) {
+		data, _ := os.ReadFile(filepath.Join(dir, files[0].Name()))
+		assert.Contains(t, string(data), "To: demo@example.com\r\n")
+		assert.Contains(t, string(data), "\r\n\r\nline 1\r\nline 2")
+	}
+
+	assert.NotNil(t, mailer.Send(ctx, Message{To: "demo@example.com\r\nBcc: evil@example.com", Subject: "Hello"}))
+}
+
+func TestSMTPMailer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	commands := make(chan []string, 1)
+	go serveSMTP(listener, commands)
+
+	mailer, err := NewSMTPMailer(listener.Addr().String(), "", "", "priv8 <no-reply@example.com>")
+	assert.Nil(t, err)
+	assert.Nil(t, mailer.Send(context.Background(), Message{To: "demo@example.com", Subject: "Hello", Body: "body"}))
+	received := <-commands
+	// the envelope has the bare addresses, while the header keeps the display name
+	assert.Contains(t, received, "MAIL FROM:<no-reply@example.com> BODY=8BITMIME")
+	assert.Contains(t, received, "RCPT TO:<demo@example.com>")
+	assert.Contains(t, received, "From: priv8 <no-reply@example.com>")
+
+	_, err = NewSMTPMailer(listener.Addr().String(), "", "", "priv8 no-reply")
+	assert.NotNil(t, err)
+}
+
+// serveSMTP accepts one connection on the listener, plays the part of an SMTP server
+// and sends the lines received from the client to the channel.
+func serveSMTP(listener net.Listener, commands chan<- []string) {
+	conn, err := listener.Accept()
+	if err != nil {
+		close(commands)
+		return
+	}
+	defer conn.Close()
+	var lines []string
+	r := bufio.NewReader(conn)
+	reply := func(s string) { _, _ = conn.Write([]byte(s + "\r\n")) }
+	reply("220 localhost ESMTP")
+	data := false
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			break
+		}
+		line = strings.TrimRight(line, "\r\n")
+		lines = append(lines, line)
+		switch {
+		case data:
+			if line == "." {
+				data = false
+				reply("250 OK")
+			}
+		case strings.HasPrefix(line, "EHLO"):
+			reply("250-localhost")
+			reply("250 8BITMIME")
+		case line == "DATA":
+			data = true
+			reply("354 go ahead")
+		case line == "QUIT":
+			reply("221 bye")
+			commands <- lines
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+	commands <- lines
+}
+
+func Test_format(t *testing.T) {
+	data, err := format("priv8 <no-reply@example.com>", Message{To: "demo@example.com", Subject: "Grüße", Body: "body"})
+	assert.Nil(t, err)
+	assert.Contains(t, string(data), "From: priv8 <no-reply@example.com>\r\n")
+	assert.Contains(t, string(data), "Subject: =?utf-8?q?Gr=C3=BC=C3=9Fe?=\r\n")
+	assert.Contains(t, string(data), "Content-Type: text/plain; charset=utf-8\r\n")
+
+	_, err = format("priv8 <no-reply@example.com>", Message{To: "demo@example.com", Subject: "a\nb"})
+	assert.NotNil(t, err)
+}
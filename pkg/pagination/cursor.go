@@ -0,0 +1,187 @@
+package pagination
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var (
+	// CursorVar specifies the query parameter name for the cursor. An empty cursor requests the first page.
+	CursorVar = "cursor"
+	// LimitVar specifies the query parameter name for the page size when paginating with cursors
+	LimitVar = "limit"
+	// CountVar specifies the query parameter name that requests the total number of items with cursors
+	CountVar = "count"
+)
+
+// ErrInvalidCursor is returned if a cursor is malformed, was not signed with the key of the codec,
+// or was created for another sort order.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Cursor is a position in a list of items sorted by a key, such as the creation time and the ID of the items.
+// Unlike an offset, a cursor keeps its position when items are added or removed before it.
+type Cursor struct {
+	// Key is the sort key of the item that the page starts after, or ends before if Backward is true.
+	Key []string `json:"k"`
+	// Backward is true if the page holds the items before Key.
+	Backward bool `json:"b,omitempty"`
+	// Order identifies the sort order that the key belongs to.
+	Order string `json:"o"`
+}
+
+// CursorCodec encodes cursors into opaque strings signed with HMAC-SHA256, so that clients cannot forge them.
+type CursorCodec struct {
+	key []byte
+}
+
+// NewCursorCodec creates a codec that signs cursors with the given key.
+func NewCursorCodec(key []byte) CursorCodec {
+	return CursorCodec{key}
+}
+
+// Encode returns the opaque string for the given cursor.
+func (c CursorCodec) Encode(cursor Cursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data) + "." + base64.RawURLEncoding.EncodeToString(c.sign(data))
+}
+
+// Decode returns the cursor of an opaque string returned by Encode.
+func (c CursorCodec) Decode(value string) (Cursor, error) {
+	var cursor Cursor
+	parts := strings.Split(value, ".")
+	if len(parts) != 2 {
+		return cursor, ErrInvalidCursor
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return cursor, ErrInvalidCursor
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(signature, c.sign(data)) {
+		return cursor, ErrInvalidCursor
+	}
+	if err := json.Unmarshal(data, &cursor); err != nil || len(cursor.Key) == 0 {
+		return Cursor{}, ErrInvalidCursor
+	}
+	return cursor, nil
+}
+
+// sign returns the HMAC-SHA256 signature of the given data.
+func (c CursorCodec) sign(data []byte) []byte {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// CursorPages represents a page of a list of data items paginated with cursors.
+// Unlike Pages, it does not require the total number of items.
+type CursorPages struct {
+	Limit int `json:"limit"`
+	// TotalCount is only set if it was requested.
+	TotalCount *int `json:"total_count,omitempty"`
+	// NextCursor and PrevCursor are the cursors of the next and the previous pages, if there are such pages.
+	NextCursor string      `json:"next_cursor,omitempty"`
+	PrevCursor string      `json:"prev_cursor,omitempty"`
+	Links      *Links      `json:"links,omitempty"`
+	Items      interface{} `json:"items"`
+
+	// Cursor is the cursor of the page. It is nil for the first page.
+	Cursor *Cursor `json:"-"`
+	// WithCount reports whether the client requested the total number of items.
+	WithCount bool `json:"-"`
+
+	codec CursorCodec
+	order string
+}
+
+// IsCursorRequest reports whether the given HTTP request asks for pagination with cursors.
+func IsCursorRequest(req *http.Request) bool {
+	_, ok := req.URL.Query()[CursorVar]
+	return ok
+}
+
+// NewCursorPagesFromRequest creates a CursorPages object using the query parameters found in the given HTTP request.
+// order identifies the sort order of the list, such as the ORDER BY clause. ErrInvalidCursor is returned
+// if the cursor of the request cannot be decoded with the codec or was created for another order.
+func NewCursorPagesFromRequest(req *http.Request, codec CursorCodec, order string) (*CursorPages, error) {
+	query := req.URL.Query()
+	limit := parseInt(query.Get(LimitVar), DefaultPageSize)
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+	if limit > MaxPageSize {
+		limit = MaxPageSize
+	}
+	p := &CursorPages{Limit: limit, WithCount: query.Get(CountVar) == "true", codec: codec, order: order}
+	if value := query.Get(CursorVar); value != "" {
+		cursor, err := codec.Decode(value)
+		if err != nil || cursor.Order != order {
+			return nil, ErrInvalidCursor
+		}
+		p.Cursor = &cursor
+	}
+	return p, nil
+}
+
+// FetchLimit returns the number of items that should be fetched after or before the cursor:
+// one more than the limit, so that it can be told whether there are more items.
+func (p *CursorPages) FetchLimit() int {
+	return p.Limit + 1
+}
+
+// SetCursors sets NextCursor and PrevCursor for the n items fetched with FetchLimit, which are in list order
+// also when they were fetched backward. key returns the sort key of the fetched item at the given index.
+// It returns the range [start, end) of the fetched items that belong to the page. An empty page has no cursors.
+func (p *CursorPages) SetCursors(n int, key func(i int) []string) (start, end int) {
+	backward := p.Cursor != nil && p.Cursor.Backward
+	more := n > p.Limit
+	start, end = 0, n
+	if more {
+		if backward {
+			start = n - p.Limit
+		} else {
+			end = p.Limit
+		}
+	}
+	if start == end {
+		return start, end
+	}
+	// a page fetched forward after a cursor always has a previous page, and one fetched backward a next page
+	if more || backward {
+		p.NextCursor = p.codec.Encode(Cursor{Key: key(end - 1), Order: p.order})
+	}
+	if backward && more || !backward && p.Cursor != nil {
+		p.PrevCursor = p.codec.Encode(Cursor{Key: key(start), Backward: true, Order: p.order})
+	}
+	return start, end
+}
+
+// SetLinks sets the Link header (RFC 8288) of the response with the links to the first, the previous and
+// the next pages, which keep the query parameters of the request other than the cursor. The links are also
+// included in the response body if the request asks for them with LinksVar. It must be called after SetCursors.
+func (p *CursorPages) SetLinks(w http.ResponseWriter, req *http.Request) {
+	base := requestURL(req, CursorVar)
+	if strings.Contains(base, "?") {
+		base += "&"
+	} else {
+		base += "?"
+	}
+	base += CursorVar + "="
+	var links Links
+	if p.Cursor != nil {
+		links.First = base
+	}
+	if p.PrevCursor != "" {
+		links.Prev = base + url.QueryEscape(p.PrevCursor)
+	}
+	if p.NextCursor != "" {
+		links.Next = base + url.QueryEscape(p.NextCursor)
+	}
+	p.Links = links.set(w, req)
+}
@@ -0,0 +1,135 @@
+package pagination
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCursorCodec(t *testing.T) {
+	codec := NewCursorCodec([]byte("secret"))
+	cursor := Cursor{Key: []string{"2026-10-16T12:00:00Z", "abc"}, Backward: true, Order: "created_at DESC,id"}
+	value := codec.Encode(cursor)
+	decoded, err := codec.Decode(value)
+	assert.Nil(t, err)
+	assert.Equal(t, cursor, decoded)
+
+	// the cursor is signed with the key
+	_, err = NewCursorCodec([]byte("other")).Decode(value)
+	assert.Equal(t, ErrInvalidCursor, err)
+	forged := codec.Encode(Cursor{Key: []string{"xyz"}, Order: "id"})
+	_, err = codec.Decode(strings.Split(forged, ".")[0] + "." + strings.Split(value, ".")[1])
+	assert.Equal(t, ErrInvalidCursor, err)
+
+	for _, value := range []string{"", "abc", "abc.def", "a.b.c", codec.Encode(Cursor{Order: "id"})} {
+		_, err = codec.Decode(value)
+		assert.Equal(t, ErrInvalidCursor, err, value)
+	}
+}
+
+func TestIsCursorRequest(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://example.com?cursor=&limit=20", nil)
+	assert.True(t, IsCursorRequest(req))
+	req, _ = http.NewRequest("GET", "http://example.com?page=2", nil)
+	assert.False(t, IsCursorRequest(req))
+}
+
+func TestNewCursorPagesFromRequest(t *testing.T) {
+	codec := NewCursorCodec([]byte("secret"))
+	cursor := codec.Encode(Cursor{Key: []string{"abc"}, Order: "id"})
+
+	req, _ := http.NewRequest("GET", "http://example.com?cursor=&limit=20&count=true", nil)
+	p, err := NewCursorPagesFromRequest(req, codec, "id")
+	assert.Nil(t, err)
+	assert.Equal(t, 20, p.Limit)
+	assert.Equal(t, 21, p.FetchLimit())
+	assert.True(t, p.WithCount)
+	assert.Nil(t, p.Cursor)
+
+	req, _ = http.NewRequest("GET", "http://example.com?cursor="+cursor+"&limit=5000", nil)
+	p, err = NewCursorPagesFromRequest(req, codec, "id")
+	assert.Nil(t, err)
+	assert.Equal(t, MaxPageSize, p.Limit)
+	assert.False(t, p.WithCount)
+	assert.Equal(t, []string{"abc"}, p.Cursor.Key)
+
+	// the cursor must belong to the sort order
+	_, err = NewCursorPagesFromRequest(req, codec, "name ASC,id")
+	assert.Equal(t, ErrInvalidCursor, err)
+	req, _ = http.NewRequest("GET", "http://example.com?cursor=xyz", nil)
+	_, err = NewCursorPagesFromRequest(req, codec, "id")
+	assert.Equal(t, ErrInvalidCursor, err)
+}
+
+func TestCursorPages_SetCursors(t *testing.T) {
+	codec := NewCursorCodec([]byte("secret"))
+	keys := []string{"a", "b", "c", "d"}
+	key := func(i int) []string { return []string{keys[i]} }
+	cursor := func(value string) *Cursor {
+		if value == "" {
+			return nil
+		}
+		c, err := codec.Decode(value)
+		assert.Nil(t, err)
+		return &c
+	}
+
+	tests := []struct {
+		name       string
+		cursor     *Cursor
+		n          int
+		start, end int
+		next, prev *Cursor
+	}{
+		{"first page", nil, 4, 0, 3, &Cursor{Key: []string{"c"}, Order: "id"}, nil},
+		{"only page", nil, 3, 0, 3, nil, nil},
+		{"middle page", &Cursor{Key: []string{"x"}, Order: "id"}, 4, 0, 3,
+			&Cursor{Key: []string{"c"}, Order: "id"}, &Cursor{Key: []string{"a"}, Backward: true, Order: "id"}},
+		{"last page", &Cursor{Key: []string{"x"}, Order: "id"}, 2, 0, 2,
+			nil, &Cursor{Key: []string{"a"}, Backward: true, Order: "id"}},
+		{"backward page", &Cursor{Key: []string{"x"}, Backward: true, Order: "id"}, 4, 1, 4,
+			&Cursor{Key: []string{"d"}, Order: "id"}, &Cursor{Key: []string{"b"}, Backward: true, Order: "id"}},
+		{"backward first page", &Cursor{Key: []string{"x"}, Backward: true, Order: "id"}, 3, 0, 3,
+			&Cursor{Key: []string{"c"}, Order: "id"}, nil},
+		{"empty page", &Cursor{Key: []string{"x"}, Order: "id"}, 0, 0, 0, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &CursorPages{Limit: 3, Cursor: tt.cursor, codec: codec, order: "id"}
+			start, end := p.SetCursors(tt.n, key)
+			assert.Equal(t, tt.start, start)
+			assert.Equal(t, tt.end, end)
+			assert.Equal(t, tt.next, cursor(p.NextCursor))
+			assert.Equal(t, tt.prev, cursor(p.PrevCursor))
+		})
+	}
+}
+
+func TestCursorPages_SetLinks(t *testing.T) {
+	codec := NewCursorCodec([]byte("secret"))
+	cursor := codec.Encode(Cursor{Key: []string{"x"}, Order: "id"})
+	req, _ := http.NewRequest("GET", "http://example.com/v1/albums?sort=name&cursor="+cursor+"&limit=2&links=true", nil)
+	p, _ := NewCursorPagesFromRequest(req, codec, "id")
+	p.SetCursors(3, func(i int) []string { return []string{string(rune('a' + i))} })
+	res := httptest.NewRecorder()
+	p.SetLinks(res, req)
+
+	base := "/v1/albums?limit=2&links=true&sort=name&cursor="
+	want := &Links{First: base, Prev: base + p.PrevCursor, Next: base + p.NextCursor}
+	assert.Equal(t, want, p.Links)
+	assert.Equal(t, "<"+want.First+">; rel=\"first\", <"+want.Prev+">; rel=\"prev\", <"+want.Next+">; rel=\"next\"",
+		res.Header().Get("Link"))
+
+	// the first page has no first and previous links
+	req, _ = http.NewRequest("GET", "http://example.com/v1/albums?cursor=", nil)
+	p, _ = NewCursorPagesFromRequest(req, codec, "id")
+	p.SetCursors(1, func(i int) []string { return []string{"a"} })
+	res = httptest.NewRecorder()
+	p.SetLinks(res, req)
+	assert.Nil(t, p.Links)
+	_, ok := res.Header()["Link"]
+	assert.False(t, ok)
+}
@@ -4,6 +4,7 @@ package pagination
 import (
 	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 )
@@ -17,6 +18,8 @@ var (
 	PageVar = "page"
 	// PageSizeVar specifies the query parameter name for page size
 	PageSizeVar = "per_page"
+	// LinksVar specifies the query parameter name that requests the navigation links in the response body
+	LinksVar = "links"
 )
 
 // Pages represents a paginated list of data items.
@@ -25,9 +28,18 @@ type Pages struct {
 	PerPage    int         `json:"per_page"`
 	PageCount  int         `json:"page_count"`
 	TotalCount int         `json:"total_count"`
+	Links      *Links      `json:"links,omitempty"`
 	Items      interface{} `json:"items"`
 }
 
+// Links holds the navigation links of a paginated list. A link is empty if there is no such page.
+type Links struct {
+	First string `json:"first,omitempty"`
+	Prev  string `json:"prev,omitempty"`
+	Next  string `json:"next,omitempty"`
+	Last  string `json:"last,omitempty"`
+}
+
 // New creates a new Pages instance.
 // The page parameter is 1-based and refers to the current page index/number.
 // The perPage parameter refers to the number of items on each page.
@@ -91,21 +103,48 @@ func (p *Pages) Limit() int {
 // BuildLinkHeader returns an HTTP header containing the links about the pagination.
 func (p *Pages) BuildLinkHeader(baseURL string, defaultPerPage int) string {
 	links := p.BuildLinks(baseURL, defaultPerPage)
-	header := ""
-	if links[0] != "" {
-		header += fmt.Sprintf("<%v>; rel=\"first\", ", links[0])
-		header += fmt.Sprintf("<%v>; rel=\"prev\"", links[1])
-	}
-	if links[2] != "" {
-		if header != "" {
-			header += ", "
-		}
-		header += fmt.Sprintf("<%v>; rel=\"next\"", links[2])
-		if links[3] != "" {
-			header += fmt.Sprintf(", <%v>; rel=\"last\"", links[3])
+	return Links{links[0], links[1], links[2], links[3]}.header()
+}
+
+// SetLinks sets the Link header (RFC 8288) of the response with the links built by BuildLinks for the given request.
+// The links keep the query parameters of the request other than the page number and size. They are also included
+// in the response body if the request asks for them with LinksVar.
+func (p *Pages) SetLinks(w http.ResponseWriter, req *http.Request) {
+	links := p.BuildLinks(requestURL(req, PageVar, PageSizeVar), DefaultPageSize)
+	p.Links = Links{links[0], links[1], links[2], links[3]}.set(w, req)
+}
+
+// header returns the value of the Link header (RFC 8288) that contains the non-empty links.
+func (l Links) header() string {
+	var values []string
+	for _, link := range []struct{ url, rel string }{{l.First, "first"}, {l.Prev, "prev"}, {l.Next, "next"}, {l.Last, "last"}} {
+		if link.url != "" {
+			values = append(values, fmt.Sprintf("<%v>; rel=\"%v\"", link.url, link.rel))
 		}
 	}
-	return header
+	return strings.Join(values, ", ")
+}
+
+// set sets the Link header of the response to the links. It returns the links if the request asks for them
+// in the response body, and nil otherwise.
+func (l Links) set(w http.ResponseWriter, req *http.Request) *Links {
+	if header := l.header(); header != "" {
+		w.Header().Set("Link", header)
+	}
+	if req.URL.Query().Get(LinksVar) != "true" {
+		return nil
+	}
+	return &l
+}
+
+// requestURL returns the path and the query of the request URL without the given query parameters.
+func requestURL(req *http.Request, exclude ...string) string {
+	query := req.URL.Query()
+	for _, name := range exclude {
+		query.Del(name)
+	}
+	u := url.URL{Path: req.URL.Path, RawQuery: query.Encode()}
+	return u.String()
 }
 
 // BuildLinks returns the first, prev, next, and last links corresponding to the pagination.
@@ -3,6 +3,7 @@ package pagination
 import (
 	"bytes"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -100,3 +101,30 @@ func TestNewFromRequest(t *testing.T) {
 	assert.Equal(t, 100, p.TotalCount)
 	assert.Equal(t, 5, p.PageCount)
 }
+
+func TestPages_SetLinks(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://example.com/v1/albums?sort=-name&page=2&per_page=20", nil)
+	p := NewFromRequest(req, 100)
+	res := httptest.NewRecorder()
+	p.SetLinks(res, req)
+	assert.Equal(t, "</v1/albums?sort=-name&page=1&per_page=20>; rel=\"first\", </v1/albums?sort=-name&page=1&per_page=20>; rel=\"prev\", "+
+		"</v1/albums?sort=-name&page=3&per_page=20>; rel=\"next\", </v1/albums?sort=-name&page=5&per_page=20>; rel=\"last\"",
+		res.Header().Get("Link"))
+	assert.Nil(t, p.Links)
+
+	// the links are included in the body on request
+	req, _ = http.NewRequest("GET", "http://example.com/v1/albums?links=true", nil)
+	p = NewFromRequest(req, 250)
+	res = httptest.NewRecorder()
+	p.SetLinks(res, req)
+	assert.Equal(t, "</v1/albums?links=true&page=2>; rel=\"next\", </v1/albums?links=true&page=3>; rel=\"last\"", res.Header().Get("Link"))
+	assert.Equal(t, &Links{Next: "/v1/albums?links=true&page=2", Last: "/v1/albums?links=true&page=3"}, p.Links)
+
+	// a single page has no links
+	req, _ = http.NewRequest("GET", "http://example.com/v1/albums", nil)
+	p = NewFromRequest(req, 10)
+	res = httptest.NewRecorder()
+	p.SetLinks(res, req)
+	_, ok := res.Header()["Link"]
+	assert.False(t, ok)
+}
@@ -1,6 +1,17 @@
-INSERT INTO album (id, name, created_at, updated_at)
-VALUES ('967d5bb5-3a7a-4d5e-8a6c-febc8c5b3f13', 'Hollywood''s Bleeding', '2019-10-01 15:36:38'::timestamp, '2019-10-01 15:36:38'::timestamp),
-       ('c809bf15-bc2c-4621-bb96-70af96fd5d67', 'AI YoungBoy 2', '2019-10-02 11:16:12'::timestamp, '2019-10-02 11:16:12'::timestamp),
-       ('2367710a-d4fb-49f5-8860-557b337386dd', 'KIRK', '2019-10-05 05:21:11'::timestamp, '2019-10-05 05:21:11'::timestamp),
-       ('b0a24f12-428f-4ff5-84d5-bc1fdcff6f03', 'Lover', '2019-10-11 19:43:18'::timestamp, '2019-10-11 19:43:18'::timestamp),
-       ('e0bb80ec-75a6-4348-bfc3-6ac1e89b195e', 'So Much Fun', '2019-10-12 12:16:02'::timestamp, '2019-10-12 12:16:02'::timestamp);
+-- the password of both users is "pass"
+INSERT INTO "user" (id, name, email, password_hash, created_at, updated_at)
+VALUES ('100', 'demo', 'demo@example.com', '$2a$10$E8iO8Baplgb7izmPuqwYnOW0hIajAmfpqKt0jmLZpaKhW6pZJDmiu', '2019-10-01 15:36:38'::timestamp, '2019-10-01 15:36:38'::timestamp),
+       ('101', 'admin', 'admin@example.com', '$2a$10$E8iO8Baplgb7izmPuqwYnOW0hIajAmfpqKt0jmLZpaKhW6pZJDmiu', '2019-10-01 15:36:38'::timestamp, '2019-10-01 15:36:38'::timestamp);
+
+-- the admin user can manage everything
+INSERT INTO user_role (user_id, role)
+VALUES ('100', 'user'),
+       ('101', 'user'),
+       ('101', 'admin');
+
+INSERT INTO album (id, name, owner_id, visibility, created_at, updated_at)
+VALUES ('967d5bb5-3a7a-4d5e-8a6c-febc8c5b3f13', 'Hollywood''s Bleeding', '100', 'public', '2019-10-01 15:36:38'::timestamp, '2019-10-01 15:36:38'::timestamp),
+       ('c809bf15-bc2c-4621-bb96-70af96fd5d67', 'AI YoungBoy 2', '100', 'public', '2019-10-02 11:16:12'::timestamp, '2019-10-02 11:16:12'::timestamp),
+       ('2367710a-d4fb-49f5-8860-557b337386dd', 'KIRK', '100', 'unlisted', '2019-10-05 05:21:11'::timestamp, '2019-10-05 05:21:11'::timestamp),
+       ('b0a24f12-428f-4ff5-84d5-bc1fdcff6f03', 'Lover', '100', 'private', '2019-10-11 19:43:18'::timestamp, '2019-10-11 19:43:18'::timestamp),
+       ('e0bb80ec-75a6-4348-bfc3-6ac1e89b195e', 'So Much Fun', '101', 'private', '2019-10-12 12:16:02'::timestamp, '2019-10-12 12:16:02'::timestamp);